@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/catroll/smtpd/access"
+)
+
+const (
+	// rejectWriteTimeout 在 Accept 中直接向被拒绝的明文连接写入回复的时限，
+	// 新连接的发送缓冲区是空的，写入通常立即完成
+	rejectWriteTimeout = time.Second
+	// rejectTLSTimeout 隐式 TLS 下为发送拒绝回复进行握手和写入的最长时间
+	rejectTLSTimeout = 10 * time.Second
+	// maxRejectTLS 同时为发送拒绝回复进行 TLS 握手的连接数上限，超出时直接关闭连接
+	maxRejectTLS = 64
+)
+
+// accessListener 在连接建立时按访问控制规则和连接数限制过滤客户端：go-smtp 直到 HELO
+// 才调用 NewSession，因此在 Accept 中检查，被拒绝的连接在问候之前收到 554 或 421
+// 回复并被关闭。包装的是 TLS 之下的原始连接，以便统计连接的关闭和命令速率
+type accessListener struct {
+	net.Listener
+	// lists 依次检查的规则，监听器自己的规则在前
+	lists   []*access.List
+	limiter *connLimiter
+	// tlsConfig 隐式 TLS 监听器的配置，接受的连接在此包装为 TLS 连接
+	tlsConfig *tls.Config
+	// rejecting 限制同时进行的拒绝握手，只在隐式 TLS 时使用
+	rejecting chan struct{}
+	message   string
+	hostname  string
+	listener  string
+}
+
+// listen 为监听器配置了访问控制规则或连接限制时包装 l；tlsConfig 不为空时
+// 接受的连接使用隐式 TLS
+func (b *Backend) listen(l net.Listener, tlsConfig *tls.Config) net.Listener {
+	var lists []*access.List
+	if access := b.listenerAccess[b.listener.Name]; access != nil {
+		lists = append(lists, access)
+	}
+	if b.access != nil {
+		lists = append(lists, b.access)
+	}
+	if len(lists) == 0 && b.limiter == nil {
+		if tlsConfig != nil {
+			return tls.NewListener(l, tlsConfig)
+		}
+		return l
+	}
+	return &accessListener{
+		Listener:  l,
+		lists:     lists,
+		limiter:   b.limiter,
+		tlsConfig: tlsConfig,
+		rejecting: make(chan struct{}, maxRejectTLS),
+		message:   b.cfg.Server.RejectMessage,
+		hostname:  b.cfg.SMTP.Hostname,
+		listener:  b.listener.Name,
+	}
+}
+
+func (l *accessListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		addrPort, _ := netip.ParseAddrPort(conn.RemoteAddr().String())
+		ip := addrPort.Addr().Unmap()
+
+		if rule, ok := l.allowed(ip); !ok {
+			slog.Warn("访问控制拒绝连接",
+				"listener", l.listener,
+				"remote_addr", conn.RemoteAddr().String(),
+				"rule", rule,
+				"timestamp", time.Now().Format(time.RFC3339Nano),
+			)
+			l.reject(conn, fmt.Sprintf("554 5.7.1 %s", l.message))
+			continue
+		}
+
+		if l.limiter != nil {
+			limited, reason := l.limiter.acquire(conn, ip)
+			if limited == nil {
+				slog.Warn("连接超出速率或数量限制",
+					"listener", l.listener,
+					"remote_addr", conn.RemoteAddr().String(),
+					"limit", reason,
+					"timestamp", time.Now().Format(time.RFC3339Nano),
+				)
+				l.reject(conn, fmt.Sprintf("421 4.7.0 %s Too many connections, try again later", l.hostname))
+				continue
+			}
+			conn = limited
+		}
+
+		if l.tlsConfig != nil {
+			conn = tls.Server(conn, l.tlsConfig)
+		}
+		return conn, nil
+	}
+}
+
+// allowed 依次检查各规则列表，返回是否允许连接及匹配的规则；都不匹配时允许
+func (l *accessListener) allowed(ip netip.Addr) (string, bool) {
+	if !ip.IsValid() {
+		// 非 TCP 连接没有客户端 IP，不做限制
+		return "", true
+	}
+	for _, list := range l.lists {
+		if allowed, matched, rule := list.Check(ip); matched {
+			return rule, allowed
+		}
+	}
+	return "", true
+}
+
+// reject 发送 reply 后关闭连接。明文连接直接在 Accept 中写入；隐式 TLS 下写入前需要完成握手，
+// 在单独的协程中进行，同时进行的握手达到上限时不再回复，直接关闭连接
+func (l *accessListener) reject(conn net.Conn, reply string) {
+	if l.tlsConfig == nil {
+		conn.SetWriteDeadline(time.Now().Add(rejectWriteTimeout))
+		fmt.Fprintf(conn, "%s\r\n", reply)
+		conn.Close()
+		return
+	}
+
+	select {
+	case l.rejecting <- struct{}{}:
+	default:
+		conn.Close()
+		return
+	}
+	go func() {
+		defer func() { <-l.rejecting }()
+		tlsConn := tls.Server(conn, l.tlsConfig)
+		defer tlsConn.Close()
+		tlsConn.SetDeadline(time.Now().Add(rejectTLSTimeout))
+		fmt.Fprintf(tlsConn, "%s\r\n", reply)
+	}()
+}
@@ -0,0 +1,136 @@
+package access
+
+import (
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/catroll/smtpd/internal/netaddr"
+	"github.com/catroll/smtpd/internal/textfile"
+)
+
+// rule 访问控制规则
+type rule struct {
+	allow  bool
+	prefix netip.Prefix
+	// all 匹配所有地址
+	all bool
+}
+
+func (r rule) matches(addr netip.Addr) bool {
+	return r.all || r.prefix.Contains(addr)
+}
+
+func (r rule) String() string {
+	action := "deny"
+	if r.allow {
+		action = "allow"
+	}
+	if r.all {
+		return action + " all"
+	}
+	return action + " " + r.prefix.String()
+}
+
+// List 按客户端 IP 允许或拒绝连接的规则列表
+//
+// 规则文件每行一条规则，动作后跟 CIDR 网段、单个 IP 或 all，# 开头的行为注释：
+//
+//	deny  192.0.2.0/24
+//	allow 10.0.0.0/8
+//	allow 2001:db8::/32
+//	deny  all
+//
+// 按顺序匹配，第一条匹配的规则生效。
+type List struct {
+	mu       sync.RWMutex
+	rules    []rule
+	filename string
+}
+
+// New 加载访问控制规则文件
+func New(filename string) (*List, error) {
+	l := &List{filename: filename}
+	if err := l.Reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Reload 重新加载规则文件，失败时保留原有规则
+func (l *List) Reload() error {
+	data, err := os.ReadFile(l.filename)
+	if err != nil {
+		slog.Error("读取访问控制文件失败",
+			"file", l.filename,
+			"error", err,
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+		return err
+	}
+
+	var rules []rule
+	err = textfile.ScanLines(data, func(lineno int, line string) error {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("line %d: expected action followed by network", lineno)
+		}
+		var r rule
+		switch strings.ToLower(fields[0]) {
+		case "allow":
+			r.allow = true
+		case "deny":
+		default:
+			return fmt.Errorf("line %d: unknown action %q", lineno, fields[0])
+		}
+		if strings.EqualFold(fields[1], "all") {
+			r.all = true
+		} else {
+			prefix, err := netaddr.ParsePrefix(fields[1])
+			if err != nil {
+				return fmt.Errorf("line %d: %w", lineno, err)
+			}
+			r.prefix = prefix
+		}
+		rules = append(rules, r)
+		return nil
+	})
+	if err != nil {
+		slog.Error("解析访问控制文件失败",
+			"file", l.filename,
+			"error", err,
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+		return err
+	}
+
+	l.mu.Lock()
+	l.rules = rules
+	l.mu.Unlock()
+
+	slog.Info("加载访问控制规则成功",
+		"file", l.filename,
+		"rules", len(rules),
+		"timestamp", time.Now().Format(time.RFC3339Nano),
+	)
+	return nil
+}
+
+// Check 返回第一条匹配 addr 的规则是否允许连接；matched 为 false 表示没有规则匹配，
+// rule 为匹配的规则，用于日志
+func (l *List) Check(addr netip.Addr) (allowed, matched bool, rule string) {
+	addr = addr.Unmap()
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, r := range l.rules {
+		if r.matches(addr) {
+			return r.allow, true, r.String()
+		}
+	}
+	return false, false, ""
+}
@@ -0,0 +1,70 @@
+package access
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAccessList(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "access.txt")
+	content := `# 先匹配的规则生效
+deny  10.1.0.0/16
+allow 10.0.0.0/8
+allow 2001:db8::/32
+allow 192.0.2.1
+DENY  all
+`
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write access list: %v", err)
+	}
+	l, err := New(filename)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	tests := []struct {
+		addr        string
+		wantAllowed bool
+		wantRule    string
+	}{
+		{"10.1.2.3", false, "deny 10.1.0.0/16"},
+		{"10.2.3.4", true, "allow 10.0.0.0/8"},
+		{"::ffff:10.2.3.4", true, "allow 10.0.0.0/8"},
+		{"2001:db8::25", true, "allow 2001:db8::/32"},
+		{"192.0.2.1", true, "allow 192.0.2.1/32"},
+		{"192.0.2.2", false, "deny all"},
+		{"2001:db9::1", false, "deny all"},
+	}
+	for _, tt := range tests {
+		allowed, matched, rule := l.Check(netip.MustParseAddr(tt.addr))
+		if allowed != tt.wantAllowed || !matched || rule != tt.wantRule {
+			t.Errorf("Check(%s) = %v, %v, %q; want %v, true, %q", tt.addr, allowed, matched, rule, tt.wantAllowed, tt.wantRule)
+		}
+	}
+
+	// 重新加载失败时保留原有规则
+	if err := os.WriteFile(filename, []byte("block 10.0.0.0/8\n"), 0600); err != nil {
+		t.Fatalf("Failed to write access list: %v", err)
+	}
+	if err := l.Reload(); err == nil {
+		t.Errorf("Reload() with unknown action succeeded")
+	}
+	if allowed, _, _ := l.Check(netip.MustParseAddr("10.2.3.4")); !allowed {
+		t.Errorf("Rules lost after failed reload")
+	}
+
+	if err := os.WriteFile(filename, []byte("deny 10.0.0.0/8\n"), 0600); err != nil {
+		t.Fatalf("Failed to write access list: %v", err)
+	}
+	if err := l.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if allowed, matched, _ := l.Check(netip.MustParseAddr("10.2.3.4")); allowed || !matched {
+		t.Errorf("Check() after reload = %v, %v; want denied", allowed, matched)
+	}
+	if _, matched, _ := l.Check(netip.MustParseAddr("192.0.2.2")); matched {
+		t.Errorf("Check() matched an address without a rule")
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/catroll/smtpd/config"
+	gosmtp "github.com/emersion/go-smtp"
+)
+
+func TestAccessList(t *testing.T) {
+	dir := t.TempDir()
+	writeList := func(name, content string) string {
+		t.Helper()
+		filename := filepath.Join(dir, name)
+		if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatalf("Failed to write access list: %v", err)
+		}
+		return filename
+	}
+	deny := writeList("deny.txt", "allow 10.0.0.0/8\ndeny 127.0.0.0/8\n")
+	allow := writeList("allow.txt", "allow 127.0.0.1\n")
+
+	tests := []struct {
+		name     string
+		listener *config.Listener
+		wantCode int
+	}{
+		{name: "global deny", wantCode: 554},
+		{name: "listener allow overrides global", listener: &config.Listener{Port: 2526, AccessList: allow}},
+		{name: "listener without own rules", listener: &config.Listener{Port: 2526}, wantCode: 554},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.New()
+			cfg.Server.AccessList = deny
+			cfg.Server.RejectMessage = "Go away"
+			if tt.listener != nil {
+				cfg.Server.Listeners = []config.Listener{*tt.listener}
+			}
+			addr, _ := startTestServer(t, cfg, "")
+
+			c, err := gosmtp.Dial(addr)
+			if err != nil {
+				t.Fatalf("Failed to dial: %v", err)
+			}
+			defer c.Close()
+			// 客户端在第一条命令前读取问候
+			err = c.Hello("localhost")
+			if tt.wantCode == 0 {
+				if err != nil {
+					t.Errorf("Hello() error = %v", err)
+				}
+				return
+			}
+			var smtpErr *gosmtp.SMTPError
+			if !errors.As(err, &smtpErr) || smtpErr.Code != tt.wantCode || smtpErr.Message != "Go away" {
+				t.Errorf("Expected %d Go away, got %v", tt.wantCode, err)
+			}
+		})
+	}
+}
+
+func TestRejectTLSBounded(t *testing.T) {
+	l := &accessListener{tlsConfig: &tls.Config{}, rejecting: make(chan struct{}, 1)}
+	l.rejecting <- struct{}{}
+
+	// 同时进行的拒绝握手已达上限，连接直接关闭而不进行握手
+	server, client := net.Pipe()
+	defer client.Close()
+	l.reject(server, "554 5.7.1 rejected")
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read() error = %v, want EOF", err)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// RFC 5321 4.5.3.1 的长度限制
+const (
+	maxLocalPartLength = 64
+	maxDomainLength    = 255
+	maxPathLength      = 256
+)
+
+// idnaProfile 转换和校验域名：映射为小写、检查 LDH 规则和标签长度
+var idnaProfile = idna.New(
+	idna.MapForLookup(),
+	idna.Transitional(false),
+	idna.StrictDomainName(true),
+	idna.VerifyDNSLength(true),
+	idna.BidiRule(),
+)
+
+// errAddressUTF8 地址含有非 ASCII 字符，但 MAIL 命令没有声明 SMTPUTF8
+var errAddressUTF8 = errors.New("non-ascii address without SMTPUTF8")
+
+// Address 解析后的信封地址，会话中的策略检查都使用这一表示
+type Address struct {
+	// Local 本地部分，引号字符串已去掉引号和转义；区分大小写，原样保留
+	Local string
+	// Domain 小写的 ASCII 域名，国际化域名已转换为 punycode（A-label），
+	// 地址字面量保留方括号，如 [192.0.2.1]、[IPv6:2001:db8::1]
+	Domain string
+	// UTF8 地址含有非 ASCII 字符，传输时需要 SMTPUTF8
+	UTF8 bool
+}
+
+// IsNull 判断是否为空的反向路径 <>
+func (a Address) IsNull() bool {
+	return a.Local == "" && a.Domain == ""
+}
+
+// String 返回 local@domain 形式的地址，本地部分不是合法的点分原子时加引号
+func (a Address) String() string {
+	if a.IsNull() {
+		return ""
+	}
+	return quoteLocalPart(a.Local) + "@" + a.Domain
+}
+
+// UnicodeDomain 返回 U-label 形式的域名，用于显示；无法转换时返回 ASCII 形式
+func (a Address) UnicodeDomain() string {
+	if strings.HasPrefix(a.Domain, "[") {
+		return a.Domain
+	}
+	domain, err := idnaProfile.ToUnicode(a.Domain)
+	if err != nil {
+		return a.Domain
+	}
+	return domain
+}
+
+// ParseAddress 按 RFC 5321 / RFC 6531 解析 go-smtp 传入的信封地址（已去掉尖括号、
+// 源路由和本地部分的引号），空字符串表示空的反向路径
+func ParseAddress(s string) (Address, error) {
+	if s == "" {
+		return Address{}, nil
+	}
+	if len(s) > maxPathLength-2 {
+		return Address{}, fmt.Errorf("address longer than %d octets", maxPathLength-2)
+	}
+	if !utf8.ValidString(s) {
+		return Address{}, fmt.Errorf("address is not valid UTF-8")
+	}
+
+	i := strings.LastIndexByte(s, '@')
+	if i < 0 {
+		return Address{}, fmt.Errorf("missing domain")
+	}
+	local, domain := s[:i], s[i+1:]
+	if err := checkLocalPart(local); err != nil {
+		return Address{}, err
+	}
+
+	addr := Address{Local: local, UTF8: !isASCII(local)}
+	if strings.HasPrefix(domain, "[") {
+		literal, err := parseAddressLiteral(domain)
+		if err != nil {
+			return Address{}, err
+		}
+		addr.Domain = literal
+		return addr, nil
+	}
+
+	if domain == "" || len(domain) > maxDomainLength {
+		return Address{}, fmt.Errorf("invalid domain length")
+	}
+	if !isASCII(domain) {
+		addr.UTF8 = true
+	}
+	ascii, err := idnaProfile.ToASCII(domain)
+	if err != nil {
+		return Address{}, fmt.Errorf("invalid domain %q: %w", domain, err)
+	}
+	if strings.HasSuffix(ascii, ".") {
+		return Address{}, fmt.Errorf("invalid domain %q", domain)
+	}
+	addr.Domain = ascii
+	return addr, nil
+}
+
+// checkLocalPart 检查本地部分：可以是点分原子（Dot-string），也可以是去掉引号的
+// 引号字符串内容；RFC 6531 允许 UTF-8 字符
+func checkLocalPart(local string) error {
+	if local == "" {
+		return fmt.Errorf("empty local part")
+	}
+	if len(local) > maxLocalPartLength {
+		return fmt.Errorf("local part longer than %d octets", maxLocalPartLength)
+	}
+	for _, r := range local {
+		// 引号字符串内可以是除控制字符外的任意字符（qtextSMTP 和 quoted-pairSMTP）
+		if r < 0x20 || r == 0x7f {
+			return fmt.Errorf("invalid character %q in local part", r)
+		}
+	}
+	return nil
+}
+
+// isDotString 判断本地部分是否为合法的点分原子，不需要加引号
+func isDotString(local string) bool {
+	if local == "" || local[0] == '.' || local[len(local)-1] == '.' || strings.Contains(local, "..") {
+		return false
+	}
+	for _, r := range local {
+		if r >= utf8.RuneSelf {
+			continue
+		}
+		if !isAtext(byte(r)) && r != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// isAtext 判断 ASCII 字符是否为 RFC 5322 的 atext
+func isAtext(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-/=?^_`{|}~", c) >= 0
+}
+
+// quoteLocalPart 本地部分不是点分原子时加引号，并转义引号和反斜杠
+func quoteLocalPart(local string) string {
+	if isDotString(local) {
+		return local
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(local); i++ {
+		if local[i] == '"' || local[i] == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(local[i])
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// parseAddressLiteral 解析 [IPv4] 或 [IPv6:地址] 形式的地址字面量，返回规范形式
+func parseAddressLiteral(literal string) (string, error) {
+	if !strings.HasSuffix(literal, "]") {
+		return "", fmt.Errorf("malformed address literal %q", literal)
+	}
+	inner := literal[1 : len(literal)-1]
+	if v6, ok := cutPrefixFold(inner, "IPv6:"); ok {
+		ip, err := netip.ParseAddr(v6)
+		if err != nil || !ip.Is6() || ip.Zone() != "" {
+			return "", fmt.Errorf("malformed address literal %q", literal)
+		}
+		return "[IPv6:" + ip.String() + "]", nil
+	}
+	ip, err := netip.ParseAddr(inner)
+	if err != nil || !ip.Is4() {
+		return "", fmt.Errorf("malformed address literal %q", literal)
+	}
+	return "[" + ip.String() + "]", nil
+}
+
+// cutPrefixFold 不区分大小写地去掉前缀
+func cutPrefixFold(s, prefix string) (string, bool) {
+	if len(s) < len(prefix) || !strings.EqualFold(s[:len(prefix)], prefix) {
+		return s, false
+	}
+	return s[len(prefix):], true
+}
+
+// isASCII 判断字符串是否只含 ASCII 字符
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		input      string
+		want       Address
+		wantString string
+		wantErr    bool
+	}{
+		{input: "", want: Address{}, wantString: ""},
+		{input: "User.Name+tag@Example.COM", want: Address{Local: "User.Name+tag", Domain: "example.com"}, wantString: "User.Name+tag@example.com"},
+		{input: "user@localhost", want: Address{Local: "user", Domain: "localhost"}, wantString: "user@localhost"},
+		{input: "user@Bücher.Example", want: Address{Local: "user", Domain: "xn--bcher-kva.example", UTF8: true}, wantString: "user@xn--bcher-kva.example"},
+		{input: "user@xn--bcher-kva.example", want: Address{Local: "user", Domain: "xn--bcher-kva.example"}, wantString: "user@xn--bcher-kva.example"},
+		{input: "用户@例子.测试", want: Address{Local: "用户", Domain: "xn--fsqu00a.xn--0zwm56d", UTF8: true}, wantString: "用户@xn--fsqu00a.xn--0zwm56d"},
+		{input: "john doe@example.com", want: Address{Local: "john doe", Domain: "example.com"}, wantString: `"john doe"@example.com`},
+		{input: `a"b@example.com`, want: Address{Local: `a"b`, Domain: "example.com"}, wantString: `"a\"b"@example.com`},
+		{input: "user@[192.0.2.1]", want: Address{Local: "user", Domain: "[192.0.2.1]"}, wantString: "user@[192.0.2.1]"},
+		{input: "user@[ipv6:2001:DB8::1]", want: Address{Local: "user", Domain: "[IPv6:2001:db8::1]"}, wantString: "user@[IPv6:2001:db8::1]"},
+		{input: "user", wantErr: true},
+		{input: "@example.com", wantErr: true},
+		{input: "user@", wantErr: true},
+		{input: "user@exa_mple.com", wantErr: true},
+		{input: "user@-example.com", wantErr: true},
+		{input: "user@example..com", wantErr: true},
+		{input: "user@example.com.", wantErr: true},
+		{input: "user@[192.0.2.300]", wantErr: true},
+		{input: "user@[2001:db8::1]", wantErr: true},
+		{input: "us\ter@example.com", wantErr: true},
+		{input: "user@example.com\xff", wantErr: true},
+		{input: "a123456789012345678901234567890123456789012345678901234567890123456789@example.com", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseAddress(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseAddress(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseAddress(%q) = %+v, want %+v", tt.input, got, tt.want)
+		}
+		if s := got.String(); s != tt.wantString {
+			t.Errorf("ParseAddress(%q).String() = %q, want %q", tt.input, s, tt.wantString)
+		}
+	}
+
+	addr, _ := ParseAddress("user@Bücher.Example")
+	if got := addr.UnicodeDomain(); got != "bücher.example" {
+		t.Errorf("UnicodeDomain() = %q, want %q", got, "bücher.example")
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/catroll/smtpd/recipient"
+)
+
+// maxAliasDepth 别名递归展开的最大层数，超过时视为循环
+const maxAliasDepth = 20
+
+// errAliasLoop 别名展开出现循环或层数过多
+var errAliasLoop = errors.New("alias expansion loop")
+
+// splitSubaddress 按分隔符拆分本地部分，返回去掉标签的地址和标签，如 user+tag@example.com
+// 拆分为 user@example.com 和 tag；分隔符为空、未出现或在本地部分开头时不拆分
+func splitSubaddress(addr Address, delimiter string) (Address, string) {
+	if delimiter == "" {
+		return addr, ""
+	}
+	i := strings.Index(addr.Local, delimiter)
+	if i <= 0 {
+		return addr, ""
+	}
+	tag := addr.Local[i+len(delimiter):]
+	addr.Local = addr.Local[:i]
+	return addr, tag
+}
+
+// expandAlias 递归展开地址的虚拟别名，返回去重后的最终收件人；没有别名的地址原样返回。
+// 完整地址的别名优先于域名的 catch-all，目标指向自身时不再展开，出现循环时返回 errAliasLoop
+func expandAlias(aliases *recipient.AliasMap, addr Address) ([]Address, error) {
+	var expanded []Address
+	if err := expandAliasPath(aliases, addr, nil, &expanded); err != nil {
+		return nil, err
+	}
+	return expanded, nil
+}
+
+// expandAliasPath 展开 addr 并把最终收件人追加到 out，path 为从原始收件人到 addr 的展开路径
+func expandAliasPath(aliases *recipient.AliasMap, addr Address, path []string, out *[]Address) error {
+	targets, ok := aliases.Lookup(addr.String())
+	if !ok {
+		targets, ok = aliases.LookupDomain(addr.Domain)
+	}
+	if !ok {
+		if !slices.Contains(*out, addr) {
+			*out = append(*out, addr)
+		}
+		return nil
+	}
+	if len(path) >= maxAliasDepth {
+		return errAliasLoop
+	}
+
+	key := strings.ToLower(addr.String())
+	path = append(path, key)
+	for _, target := range targets {
+		// @域名 的目标保留本地部分
+		if strings.HasPrefix(target, "@") {
+			target = addr.Local + target
+		}
+		next, err := ParseAddress(target)
+		if err != nil {
+			return fmt.Errorf("invalid alias target %q: %w", target, err)
+		}
+
+		nextKey := strings.ToLower(next.String())
+		switch {
+		case nextKey == key:
+			// 指向自身，如 user@example.com 同时投递给自己和其他地址
+			if !slices.Contains(*out, next) {
+				*out = append(*out, next)
+			}
+		case slices.Contains(path, nextKey):
+			return errAliasLoop
+		default:
+			if err := expandAliasPath(aliases, next, path, out); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/catroll/smtpd/recipient"
+)
+
+// writeAliasMap 把别名写入临时文件并加载
+func writeAliasMap(t *testing.T, content string) *recipient.AliasMap {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "virtual")
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	aliases, err := recipient.NewAliasMap(filename)
+	if err != nil {
+		t.Fatalf("NewAliasMap() error = %v", err)
+	}
+	return aliases
+}
+
+func TestExpandAlias(t *testing.T) {
+	aliases := writeAliasMap(t, ""+
+		"team@example.com      alice@example.com, sales@example.com\n"+
+		"sales@example.com     bob@example.com, alice@example.com\n"+
+		"bob@example.com       bob@example.com, archive@example.net\n"+
+		"@example.org          catchall@example.org\n"+
+		"postmaster@example.org admin@example.com\n"+
+		"@old.example          @example.com\n"+
+		"loop1@example.com     loop2@example.com\n"+
+		"loop2@example.com     loop1@example.com\n")
+
+	tests := []struct {
+		input   string
+		want    []string
+		wantErr error
+	}{
+		{input: "nobody@example.com", want: []string{"nobody@example.com"}},
+		{input: "team@example.com", want: []string{"alice@example.com", "bob@example.com", "archive@example.net"}},
+		{input: "Sales@Example.COM", want: []string{"bob@example.com", "archive@example.net", "alice@example.com"}},
+		{input: "anyone@example.org", want: []string{"catchall@example.org"}},
+		{input: "postmaster@example.org", want: []string{"admin@example.com"}},
+		{input: "team@old.example", want: []string{"alice@example.com", "bob@example.com", "archive@example.net"}},
+		{input: "loop1@example.com", wantErr: errAliasLoop},
+	}
+	for _, tt := range tests {
+		addr, err := ParseAddress(tt.input)
+		if err != nil {
+			t.Fatalf("ParseAddress(%q) error = %v", tt.input, err)
+		}
+		got, err := expandAlias(aliases, addr)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("expandAlias(%q) error = %v, want %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		var to []string
+		for _, a := range got {
+			to = append(to, a.String())
+		}
+		if !slices.Equal(to, tt.want) {
+			t.Errorf("expandAlias(%q) = %v, want %v", tt.input, to, tt.want)
+		}
+	}
+}
+
+func TestSplitSubaddress(t *testing.T) {
+	tests := []struct {
+		input     string
+		delimiter string
+		want      string
+		wantTag   string
+	}{
+		{input: "user+news@example.com", delimiter: "+", want: "user@example.com", wantTag: "news"},
+		{input: "user+a+b@example.com", delimiter: "+", want: "user@example.com", wantTag: "a+b"},
+		{input: "user+@example.com", delimiter: "+", want: "user@example.com"},
+		{input: "+user@example.com", delimiter: "+", want: "+user@example.com"},
+		{input: "user-news@example.com", delimiter: "+", want: "user-news@example.com"},
+		{input: "user-news@example.com", delimiter: "-", want: "user@example.com", wantTag: "news"},
+		{input: "user+news@example.com", delimiter: "", want: "user+news@example.com"},
+	}
+	for _, tt := range tests {
+		addr, err := ParseAddress(tt.input)
+		if err != nil {
+			t.Fatalf("ParseAddress(%q) error = %v", tt.input, err)
+		}
+		got, tag := splitSubaddress(addr, tt.delimiter)
+		if got.String() != tt.want || tag != tt.wantTag {
+			t.Errorf("splitSubaddress(%q, %q) = %q, %q, want %q, %q", tt.input, tt.delimiter, got.String(), tag, tt.want, tt.wantTag)
+		}
+	}
+}
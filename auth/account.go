@@ -0,0 +1,198 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/catroll/smtpd/internal/netaddr"
+)
+
+// Account 账户记录及其属性
+type Account struct {
+	Username string
+	// Password 已存储的密码哈希或密钥
+	Password string
+	// Disabled 账户是否已停用
+	Disabled bool
+	// ExpiresAt 过期时间，零值表示永不过期
+	ExpiresAt time.Time
+	// Networks 允许登录的来源网段，为空时不限制
+	Networks []netip.Prefix
+	// MaxMessageSize 单封邮件的最大字节数，0 表示只受全局限制
+	MaxMessageSize int64
+	// MaxRecipients 单封邮件的最大收件人数量，0 表示只受全局限制
+	MaxRecipients int
+	// Tags 自由格式的标签，记录在日志和邮件元数据中
+	Tags []string
+	// AppPasswords 应用专用密码，可以与账户密码同时使用
+	AppPasswords []AppPassword
+
+	// expires 文件中原始的过期时间，写回时保持原样
+	expires string
+}
+
+// 账户不可用的原因
+var (
+	ErrAccountDisabled = errors.New("account is disabled")
+	ErrAccountExpired  = errors.New("account has expired")
+)
+
+// Usable 检查账户在 now 时是否可以登录
+func (a *Account) Usable(now time.Time) error {
+	if a.Disabled {
+		return ErrAccountDisabled
+	}
+	if !a.ExpiresAt.IsZero() && !now.Before(a.ExpiresAt) {
+		return ErrAccountExpired
+	}
+	return nil
+}
+
+// AllowsAddr 判断是否允许从该地址登录
+func (a *Account) AllowsAddr(addr netip.Addr) bool {
+	if len(a.Networks) == 0 {
+		return true
+	}
+	addr = addr.Unmap()
+	for _, prefix := range a.Networks {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasAttributes 账户是否设置了密码以外的属性，没有时按旧格式写回
+func (a *Account) hasAttributes() bool {
+	return a.Disabled || !a.ExpiresAt.IsZero() || len(a.Networks) > 0 ||
+		a.MaxMessageSize > 0 || a.MaxRecipients > 0 || len(a.Tags) > 0 ||
+		len(a.AppPasswords) > 0
+}
+
+// equal 比较两个账户记录是否相同
+func (a *Account) equal(b *Account) bool {
+	return a.Password == b.Password && a.Disabled == b.Disabled &&
+		a.ExpiresAt.Equal(b.ExpiresAt) && slices.Equal(a.Networks, b.Networks) &&
+		a.MaxMessageSize == b.MaxMessageSize && a.MaxRecipients == b.MaxRecipients &&
+		slices.Equal(a.Tags, b.Tags) &&
+		slices.EqualFunc(a.AppPasswords, b.AppPasswords, func(x, y AppPassword) bool {
+			// 最近使用时间的变化不算作修改
+			return x.Label == y.Label && x.Password == y.Password && x.ExpiresAt.Equal(y.ExpiresAt)
+		})
+}
+
+// accountJSON JSON 认证文件中的账户对象
+type accountJSON struct {
+	Password       string   `json:"password,omitempty"`
+	Enabled        *bool    `json:"enabled,omitempty"`
+	Expires        string   `json:"expires,omitempty"`
+	Networks       []string `json:"networks,omitempty"`
+	MaxMessageSize int64    `json:"max_message_size,omitempty"`
+	MaxRecipients  int      `json:"max_recipients,omitempty"`
+	Tags           []string `json:"tags,omitempty"`
+
+	AppPasswords []AppPassword `json:"app_passwords,omitempty"`
+}
+
+// UnmarshalJSON 解析账户，值可以是密码哈希字符串（旧格式）或账户对象
+func (a *Account) UnmarshalJSON(data []byte) error {
+	var password string
+	if err := json.Unmarshal(data, &password); err == nil {
+		*a = Account{Password: password}
+		return nil
+	}
+
+	// 拼错的字段名（如 "enabeld"）会让限制静默失效，因此拒绝未知字段
+	var v accountJSON
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&v); err != nil {
+		return err
+	}
+	// 只有应用专用密码的账户不能用账户密码登录
+	if v.Password == "" && len(v.AppPasswords) == 0 {
+		return fmt.Errorf("missing password")
+	}
+	for i, p := range v.AppPasswords {
+		if p.Label == "" || p.Password == "" {
+			return fmt.Errorf("app password %d: label and password are required", i)
+		}
+		if slices.ContainsFunc(v.AppPasswords[:i], func(q AppPassword) bool { return q.Label == p.Label }) {
+			return fmt.Errorf("duplicate app password label %q", p.Label)
+		}
+	}
+	account := Account{
+		Password:       v.Password,
+		Disabled:       v.Enabled != nil && !*v.Enabled,
+		MaxMessageSize: v.MaxMessageSize,
+		MaxRecipients:  v.MaxRecipients,
+		Tags:           v.Tags,
+		AppPasswords:   v.AppPasswords,
+		expires:        v.Expires,
+	}
+	if account.MaxMessageSize < 0 || account.MaxRecipients < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	if v.Expires != "" {
+		t, err := ParseExpiry(v.Expires)
+		if err != nil {
+			return err
+		}
+		account.ExpiresAt = t
+	}
+	for _, network := range v.Networks {
+		prefix, err := netaddr.ParsePrefix(network)
+		if err != nil {
+			return err
+		}
+		account.Networks = append(account.Networks, prefix)
+	}
+	*a = account
+	return nil
+}
+
+// MarshalJSON 没有其他属性的账户写为密码哈希字符串，与旧格式保持一致
+func (a *Account) MarshalJSON() ([]byte, error) {
+	if !a.hasAttributes() {
+		return json.Marshal(a.Password)
+	}
+
+	v := accountJSON{
+		Password:       a.Password,
+		MaxMessageSize: a.MaxMessageSize,
+		MaxRecipients:  a.MaxRecipients,
+		Tags:           a.Tags,
+		AppPasswords:   a.AppPasswords,
+	}
+	if a.Disabled {
+		enabled := false
+		v.Enabled = &enabled
+	}
+	if !a.ExpiresAt.IsZero() {
+		v.Expires = a.ExpiresAt.Format(time.RFC3339)
+		if t, err := ParseExpiry(a.expires); err == nil && t.Equal(a.ExpiresAt) {
+			v.Expires = a.expires
+		}
+	}
+	for _, prefix := range a.Networks {
+		v.Networks = append(v.Networks, prefix.String())
+	}
+	return json.Marshal(v)
+}
+
+// ParseExpiry 解析过期时间：RFC 3339 时间，或 2006-01-02 格式的日期（当天结束时过期，本地时区）
+func ParseExpiry(s string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t.AddDate(0, 0, 1), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid expiry %q: want YYYY-MM-DD or RFC 3339", s)
+	}
+	return t, nil
+}
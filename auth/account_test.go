@@ -0,0 +1,113 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONStoreAccounts(t *testing.T) {
+	authFile := filepath.Join(t.TempDir(), "auth.txt")
+	content := `{
+    "user1": "{PLAIN}password123",
+    "user2": {
+        "password": "{PLAIN}password456",
+        "expires": "2030-06-30",
+        "networks": ["10.0.0.0/8", "2001:db8::/32", "192.0.2.7"],
+        "max_message_size": 1048576,
+        "max_recipients": 5,
+        "tags": ["billing", "internal"]
+    },
+    "user3": {"password": "{PLAIN}password789", "enabled": false}
+}`
+	if err := os.WriteFile(authFile, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write auth file: %v", err)
+	}
+
+	store, err := NewJSONStore(authFile, Options{AllowPlaintext: true})
+	if err != nil {
+		t.Fatalf("NewJSONStore() error = %v", err)
+	}
+	a := New(store)
+
+	// 旧格式的账户没有任何限制
+	user1, _, _ := a.Authenticate("user1", "password123")
+	if user1 == nil || user1.Username != "user1" || user1.hasAttributes() {
+		t.Fatalf("Authenticate(user1) = %+v, want account without attributes", user1)
+	}
+
+	user2, _, _ := a.Authenticate("user2", "password456")
+	if user2 == nil {
+		t.Fatalf("Authenticate(user2) = nil, want account")
+	}
+	if user2.MaxMessageSize != 1<<20 || user2.MaxRecipients != 5 || strings.Join(user2.Tags, ",") != "billing,internal" {
+		t.Errorf("Account attributes = %+v", user2)
+	}
+	wantExpiry := time.Date(2030, 7, 1, 0, 0, 0, 0, time.Local)
+	if !user2.ExpiresAt.Equal(wantExpiry) {
+		t.Errorf("ExpiresAt = %v, want %v", user2.ExpiresAt, wantExpiry)
+	}
+	for addr, want := range map[string]bool{
+		"10.1.2.3":        true,
+		"::ffff:10.1.2.3": true,
+		"2001:db8::1":     true,
+		"192.0.2.7":       true,
+		"192.0.2.8":       false,
+		"2001:db9::1":     false,
+	} {
+		if got := user2.AllowsAddr(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("AllowsAddr(%s) = %v, want %v", addr, got, want)
+		}
+	}
+	if err := user2.Usable(wantExpiry); err != ErrAccountExpired {
+		t.Errorf("Usable() at expiry = %v, want %v", err, ErrAccountExpired)
+	}
+
+	if account, _, _ := a.Authenticate("user3", "password789"); account != nil {
+		t.Errorf("Authenticate() returned an account for a disabled user")
+	}
+}
+
+func TestAccountJSONRoundTrip(t *testing.T) {
+	in := `{"flat":"{PLAIN}a","rich":{"password":"{PLAIN}b","enabled":false,"expires":"2030-06-30","networks":["10.0.0.0/8"],"max_recipients":3,"tags":["x"]}}`
+	accounts, err := jsonFormat.parse([]byte(in))
+	if err != nil {
+		t.Fatalf("parse() error = %v", err)
+	}
+	data, err := jsonFormat.encode(accounts)
+	if err != nil {
+		t.Fatalf("encode() error = %v", err)
+	}
+
+	var got map[string]any
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Failed to parse encoded file: %v", err)
+	}
+	if got["flat"] != "{PLAIN}a" {
+		t.Errorf("flat account encoded as %v, want a plain string", got["flat"])
+	}
+	rich, _ := got["rich"].(map[string]any)
+	if rich["expires"] != "2030-06-30" || rich["enabled"] != false || rich["max_recipients"] != float64(3) {
+		t.Errorf("rich account encoded as %v", got["rich"])
+	}
+}
+
+func TestAccountJSONInvalid(t *testing.T) {
+	for _, in := range []string{
+		`{"u": {"enabled": true}}`,
+		`{"u": {"password": "x", "networks": ["10.0.0.0/33"]}}`,
+		`{"u": {"password": "x", "expires": "next week"}}`,
+		`{"u": {"password": "x", "max_recipients": -1}}`,
+		`{"u": null}`,
+		`{"u": {"password": "x", "enabeld": false}}`,
+		`{"u": {"app_passwords": [{"label": "phone", "password": "x", "expire": "2030-01-01"}]}}`,
+	} {
+		if _, err := jsonFormat.parse([]byte(in)); err == nil {
+			t.Errorf("parse(%s) error = nil, want error", in)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// lastUsedInterval 应用专用密码最近使用时间的记录精度，
+// 距上次记录超过该时间才写回文件，避免每次登录都写文件
+const lastUsedInterval = time.Hour
+
+// AppPassword 应用专用密码，供 CI、打印机、脚本等单独使用，可以单独吊销
+type AppPassword struct {
+	// Label 标签，在同一账户内唯一
+	Label string `json:"label"`
+	// Password 密码哈希
+	Password string `json:"password"`
+	// CreatedAt 创建时间
+	CreatedAt time.Time `json:"created,omitzero"`
+	// LastUsed 最近一次成功登录的时间，精度为 lastUsedInterval
+	LastUsed time.Time `json:"last_used,omitzero"`
+	// ExpiresAt 过期时间，零值表示永不过期
+	ExpiresAt time.Time `json:"expires,omitzero"`
+}
+
+// Active 判断应用专用密码在 now 时是否有效
+func (p *AppPassword) Active(now time.Time) bool {
+	return p.ExpiresAt.IsZero() || now.Before(p.ExpiresAt)
+}
+
+// ErrAppPasswordNotFound 账户中没有该标签的应用专用密码
+var ErrAppPasswordNotFound = errors.New("app password not found")
+
+// AppPasswordStore 支持应用专用密码的存储
+type AppPasswordStore interface {
+	Store
+	// VerifyAppPassword 依次校验用户的有效应用专用密码，返回匹配的标签
+	VerifyAppPassword(username, password string) (label string, ok bool, err error)
+}
+
+// VerifyAppPassword 依次校验用户的有效应用专用密码，返回匹配的标签，并更新其最近使用时间
+func (s *FileStore) VerifyAppPassword(username, password string) (string, bool, error) {
+	s.mu.RLock()
+	account, exists := s.accounts[username]
+	s.mu.RUnlock()
+	if !exists {
+		return "", false, nil
+	}
+
+	now := time.Now()
+	for _, p := range account.AppPasswords {
+		if !p.Active(now) {
+			continue
+		}
+		if Identify(p.Password) == SchemePlain && !s.opts.AllowPlaintext {
+			slog.Warn("拒绝明文存储的密码",
+				"username", username,
+				"label", p.Label,
+				"timestamp", time.Now().Format(time.RFC3339Nano),
+			)
+			continue
+		}
+		ok, err := Verify(p.Password, password)
+		if err != nil {
+			slog.Warn("校验应用专用密码失败",
+				"username", username,
+				"label", p.Label,
+				"error", err,
+				"timestamp", time.Now().Format(time.RFC3339Nano),
+			)
+			continue
+		}
+		if ok {
+			if now.Sub(p.LastUsed) >= lastUsedInterval {
+				s.touchAppPassword(username, p.Label, now)
+			}
+			return p.Label, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// touchAppPassword 记录应用专用密码的使用时间并写回文件
+func (s *FileStore) touchAppPassword(username, label string, now time.Time) {
+	err := s.updateAppPasswords(username, func(passwords []AppPassword) ([]AppPassword, error) {
+		i := slices.IndexFunc(passwords, func(p AppPassword) bool { return p.Label == label })
+		if i < 0 {
+			return nil, ErrAppPasswordNotFound
+		}
+		passwords[i].LastUsed = now.Truncate(time.Second)
+		return passwords, nil
+	})
+	// 期间用户被删除或标签被吊销时不再记录
+	if errors.Is(err, ErrUserNotFound) || errors.Is(err, ErrAppPasswordNotFound) {
+		return
+	}
+	if err != nil {
+		slog.Error("记录应用专用密码使用时间失败",
+			"username", username,
+			"label", label,
+			"error", err,
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+	}
+}
+
+// AddAppPassword 为用户添加应用专用密码，使用配置的方案（默认 bcrypt）哈希后写回文件
+func (s *FileStore) AddAppPassword(username, label, password string, expiresAt time.Time) error {
+	if label == "" {
+		return fmt.Errorf("app password label is required")
+	}
+	scheme := s.opts.PasswordScheme
+	if scheme == SchemeUnknown || scheme.challengeResponse() {
+		scheme = SchemeBcrypt
+	}
+	hash, err := Hash(scheme, password)
+	if err != nil {
+		return err
+	}
+
+	err = s.updateAppPasswords(username, func(passwords []AppPassword) ([]AppPassword, error) {
+		if slices.ContainsFunc(passwords, func(p AppPassword) bool { return p.Label == label }) {
+			return nil, fmt.Errorf("app password %q already exists", label)
+		}
+		return append(passwords, AppPassword{
+			Label:     label,
+			Password:  hash,
+			CreatedAt: time.Now().Truncate(time.Second),
+			ExpiresAt: expiresAt,
+		}), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.Info("添加应用专用密码",
+		"username", username,
+		"label", label,
+		"timestamp", time.Now().Format(time.RFC3339Nano),
+	)
+	return nil
+}
+
+// RevokeAppPassword 吊销用户的应用专用密码，不影响账户密码和其他应用专用密码
+func (s *FileStore) RevokeAppPassword(username, label string) error {
+	err := s.updateAppPasswords(username, func(passwords []AppPassword) ([]AppPassword, error) {
+		i := slices.IndexFunc(passwords, func(p AppPassword) bool { return p.Label == label })
+		if i < 0 {
+			return nil, ErrAppPasswordNotFound
+		}
+		return slices.Delete(passwords, i, i+1), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.Info("吊销应用专用密码",
+		"username", username,
+		"label", label,
+		"timestamp", time.Now().Format(time.RFC3339Nano),
+	)
+	return nil
+}
+
+// updateAppPasswords 修改用户的应用专用密码列表并写回文件，文件在上次加载后被修改时先重新加载；
+// 账户记录可能正被其他会话读取，修改的是副本
+func (s *FileStore) updateAppPasswords(username string, fn func([]AppPassword) ([]AppPassword, error)) error {
+	if s.format.name != jsonFormat.name {
+		return fmt.Errorf("%w: app passwords require the json format", ErrUnsupported)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 在文件的最新内容上修改，不覆盖还没有重新加载的修改，如吊销的标签或删除的用户
+	if err := s.reloadIfChangedLocked(); err != nil {
+		return err
+	}
+	account, ok := s.accounts[username]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, username)
+	}
+	passwords, err := fn(slices.Clone(account.AppPasswords))
+	if err != nil {
+		return err
+	}
+
+	updated := *account
+	updated.AppPasswords = passwords
+	s.accounts[username] = &updated
+	if err := s.saveLocked(); err != nil {
+		s.accounts[username] = account
+		return err
+	}
+	return nil
+}
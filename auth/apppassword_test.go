@@ -0,0 +1,194 @@
+package auth
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAppPasswords(t *testing.T) {
+	authFile := filepath.Join(t.TempDir(), "auth.txt")
+	if err := os.WriteFile(authFile, []byte(`{"user1": "{PLAIN}password123", "other": "{PLAIN}x"}`), 0600); err != nil {
+		t.Fatalf("Failed to write auth file: %v", err)
+	}
+	store, err := NewJSONStore(authFile, Options{AllowPlaintext: true, PasswordScheme: SchemeSSHA})
+	if err != nil {
+		t.Fatalf("NewJSONStore() error = %v", err)
+	}
+	a := New(store)
+
+	if err := store.AddAppPassword("user1", "ci", "ci-secret", time.Time{}); err != nil {
+		t.Fatalf("AddAppPassword() error = %v", err)
+	}
+	if err := store.AddAppPassword("user1", "printer", "printer-secret", time.Time{}); err != nil {
+		t.Fatalf("AddAppPassword() error = %v", err)
+	}
+	if err := store.AddAppPassword("user1", "ci", "again", time.Time{}); err == nil {
+		t.Errorf("AddAppPassword() with duplicate label succeeded")
+	}
+	if err := store.AddAppPassword("user1", "old", "old-secret", time.Now().Add(-time.Minute)); err != nil {
+		t.Fatalf("AddAppPassword() error = %v", err)
+	}
+
+	tests := []struct {
+		password  string
+		wantOK    bool
+		wantLabel string
+	}{
+		{"password123", true, ""},
+		{"ci-secret", true, "ci"},
+		{"printer-secret", true, "printer"},
+		{"old-secret", false, ""},
+		{"wrong", false, ""},
+	}
+	for _, tt := range tests {
+		account, label, _ := a.Authenticate("user1", tt.password)
+		if (account != nil) != tt.wantOK || label != tt.wantLabel {
+			t.Errorf("Authenticate(%q) = %v, %q; want ok %v, label %q", tt.password, account != nil, label, tt.wantOK, tt.wantLabel)
+		}
+	}
+	// 应用专用密码只属于所在的账户
+	if account, _, _ := a.Authenticate("other", "ci-secret"); account != nil {
+		t.Errorf("Authenticate() accepted another user's app password")
+	}
+
+	// 吊销一个标签不影响其他密码
+	if err := store.RevokeAppPassword("user1", "ci"); err != nil {
+		t.Fatalf("RevokeAppPassword() error = %v", err)
+	}
+	if err := store.RevokeAppPassword("user1", "ci"); err != ErrAppPasswordNotFound {
+		t.Errorf("RevokeAppPassword() twice error = %v, want %v", err, ErrAppPasswordNotFound)
+	}
+	if account, _, _ := a.Authenticate("user1", "ci-secret"); account != nil {
+		t.Errorf("Authenticate() accepted a revoked app password")
+	}
+	if _, label, _ := a.Authenticate("user1", "printer-secret"); label != "printer" {
+		t.Errorf("Authenticate() with remaining app password label = %q, want printer", label)
+	}
+	if account, _, _ := a.Authenticate("user1", "password123"); account == nil {
+		t.Errorf("Authenticate() with account password failed after revocation")
+	}
+
+	// 创建和最近使用时间写回了文件，重新加载后仍然有效
+	data, err := os.ReadFile(authFile)
+	if err != nil {
+		t.Fatalf("Failed to read auth file: %v", err)
+	}
+	var file map[string]json.RawMessage
+	if err := json.Unmarshal(data, &file); err != nil {
+		t.Fatalf("Failed to parse auth file: %v", err)
+	}
+	var user1 struct {
+		AppPasswords []AppPassword `json:"app_passwords"`
+	}
+	if err := json.Unmarshal(file["user1"], &user1); err != nil {
+		t.Fatalf("Failed to parse account: %v", err)
+	}
+	passwords := user1.AppPasswords
+	if len(passwords) != 2 || passwords[0].Label != "printer" || passwords[0].CreatedAt.IsZero() || passwords[0].LastUsed.IsZero() {
+		t.Errorf("Stored app passwords = %+v", passwords)
+	}
+	if Identify(passwords[0].Password) != SchemeSSHA {
+		t.Errorf("App password stored as %q, want %q", Identify(passwords[0].Password), SchemeSSHA)
+	}
+	if err := store.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if _, label, _ := a.Authenticate("user1", "printer-secret"); label != "printer" {
+		t.Errorf("Authenticate() after reload label = %q, want printer", label)
+	}
+}
+
+func TestAppPasswordOnlyAccount(t *testing.T) {
+	authFile := filepath.Join(t.TempDir(), "auth.txt")
+	hash, err := Hash(SchemeSSHA, "ci-secret")
+	if err != nil {
+		t.Fatalf("Hash() error = %v", err)
+	}
+	content := `{"bot": {"app_passwords": [{"label": "ci", "password": "` + hash + `"}]}}`
+	if err := os.WriteFile(authFile, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write auth file: %v", err)
+	}
+	store, err := NewJSONStore(authFile, Options{AllowPlaintext: true})
+	if err != nil {
+		t.Fatalf("NewJSONStore() error = %v", err)
+	}
+	a := New(store)
+
+	if account, _, _ := a.Authenticate("bot", ""); account != nil {
+		t.Errorf("Authenticate() with empty password succeeded")
+	}
+	if _, label, _ := a.Authenticate("bot", "ci-secret"); label != "ci" {
+		t.Errorf("Authenticate() label = %q, want ci", label)
+	}
+}
+
+func TestAppPasswordPlaintext(t *testing.T) {
+	authFile := filepath.Join(t.TempDir(), "auth.txt")
+	content := `{"user1": {"password": "{PLAIN}password123", "app_passwords": [
+		{"label": "phone", "password": "{PLAIN}phone-secret"},
+		{"label": "laptop", "password": "laptop-secret"}
+	]}}`
+	if err := os.WriteFile(authFile, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write auth file: %v", err)
+	}
+
+	tests := []struct {
+		name           string
+		allowPlaintext bool
+		password       string
+		want           bool
+	}{
+		{"prefixed plaintext allowed", true, "phone-secret", true},
+		{"unprefixed plaintext allowed", true, "laptop-secret", true},
+		{"prefixed plaintext rejected", false, "phone-secret", false},
+		{"unprefixed plaintext rejected", false, "laptop-secret", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := NewJSONStore(authFile, Options{AllowPlaintext: tt.allowPlaintext})
+			if err != nil {
+				t.Fatalf("NewJSONStore() error = %v", err)
+			}
+			if _, ok, _ := store.VerifyAppPassword("user1", tt.password); ok != tt.want {
+				t.Errorf("VerifyAppPassword() = %v, want %v", ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestAppPasswordTouchKeepsExternalChanges(t *testing.T) {
+	authFile := filepath.Join(t.TempDir(), "auth.txt")
+	if err := os.WriteFile(authFile, []byte(`{"user1": "{PLAIN}password123"}`), 0600); err != nil {
+		t.Fatalf("Failed to write auth file: %v", err)
+	}
+	store, err := NewJSONStore(authFile, Options{AllowPlaintext: true, PasswordScheme: SchemeSSHA})
+	if err != nil {
+		t.Fatalf("NewJSONStore() error = %v", err)
+	}
+	if err := store.AddAppPassword("user1", "ci", "ci-secret", time.Time{}); err != nil {
+		t.Fatalf("AddAppPassword() error = %v", err)
+	}
+
+	// 标签在文件中被吊销，服务还没有重新加载
+	changed := `{"user1": "{PLAIN}password123", "user2": "{PLAIN}secret"}`
+	if err := os.WriteFile(authFile, []byte(changed), 0600); err != nil {
+		t.Fatalf("Failed to write auth file: %v", err)
+	}
+	// 内存中的标签仍然可以登录，但记录使用时间不能把它写回文件
+	if _, label, _ := New(store).Authenticate("user1", "ci-secret"); label != "ci" {
+		t.Fatalf("Authenticate() label = %q, want ci", label)
+	}
+	data, err := os.ReadFile(authFile)
+	if err != nil {
+		t.Fatalf("Failed to read auth file: %v", err)
+	}
+	if string(data) != changed {
+		t.Errorf("Auth file was overwritten:\n%s", data)
+	}
+	if ok, _ := store.Lookup("user2"); !ok {
+		t.Errorf("Lookup(user2) failed after reloading changed file")
+	}
+}
@@ -1,83 +1,159 @@
 package auth
 
 import (
-	"encoding/json"
+	"errors"
 	"log/slog"
-	"os"
-	"sync"
 	"time"
 )
 
+// dummyHash 用户不存在时参与比较的哈希，避免通过响应时间探测用户名
+const dummyHash = "$2a$10$CXE0xzYERfDImxSOf.H3p.JsmU6G.H9pzsRRP6DfX2KXmVfOVfcXu"
+
 // Authenticator 处理认证相关的功能
 type Authenticator struct {
-	mu          sync.RWMutex
-	credentials map[string]string
+	store Store
 }
 
 // New 创建新的认证器实例
-func New() *Authenticator {
+func New(store Store) *Authenticator {
 	return &Authenticator{
-		credentials: make(map[string]string),
+		store: store,
+	}
+}
+
+// Store 返回认证器使用的凭据存储
+func (a *Authenticator) Store() Store {
+	return a.store
+}
+
+// SupportsSecrets 凭据存储是否能提供质询-响应机制所需的密钥
+func (a *Authenticator) SupportsSecrets() bool {
+	_, ok := a.store.(SecretStore)
+	return ok
+}
+
+// SupportsMechanism 凭据存储能否为质询-响应机制提供可用的密钥：CRAM-MD5 需要
+// 明文或 {CRAM-MD5} 密钥，SCRAM-SHA-256 需要明文或 {SCRAM-SHA-256} 密钥
+func (a *Authenticator) SupportsMechanism(mech string) bool {
+	if !a.SupportsSecrets() {
+		return false
 	}
+	ss, ok := a.store.(SchemeStore)
+	if !ok {
+		return true
+	}
+	for _, scheme := range ss.Schemes() {
+		switch {
+		case scheme == SchemePlain:
+			return true
+		case scheme == SchemeCRAMMD5 && mech == CRAMMD5:
+			return true
+		case scheme == SchemeSCRAMSHA256 && (mech == SCRAMSHA256 || mech == SCRAMSHA256Plus):
+			return true
+		}
+	}
+	return false
 }
 
-// LoadCredentials 从文件加载认证信息
-func (a *Authenticator) LoadCredentials(filename string) error {
-	data, err := os.ReadFile(filename)
+// secret 从凭据存储中获取用户已存储的密码哈希或密钥
+func (a *Authenticator) secret(username string) (string, bool, error) {
+	ss, ok := a.store.(SecretStore)
+	if !ok {
+		return "", false, ErrUnsupported
+	}
+	return ss.Secret(username)
+}
+
+// Account 返回用户的账户记录；凭据存储不提供账户属性时返回只有用户名的记录，
+// 用户不在存储中时返回 nil
+func (a *Authenticator) Account(username string) (*Account, error) {
+	as, ok := a.store.(AccountStore)
+	if !ok {
+		return &Account{Username: username}, nil
+	}
+	account, exists, err := as.Account(username)
+	if err != nil || !exists {
+		return nil, err
+	}
+	return account, nil
+}
+
+// Authenticate 验证用户名和密码，密码可以是账户密码或任一有效的应用专用密码；
+// 成功且账户可用时返回账户记录和匹配的应用专用密码标签（账户密码匹配时为空），
+// 否则返回 nil。凭据存储暂时不可用时返回包装了 ErrTemporary 的错误
+func (a *Authenticator) Authenticate(username, password string) (*Account, string, error) {
+	return a.AuthenticateClient(username, password, ClientInfo{})
+}
+
+// AuthenticateClient 与 Authenticate 相同，凭据存储需要时将客户端信息一并交给它
+func (a *Authenticator) AuthenticateClient(username, password string, info ClientInfo) (*Account, string, error) {
+	var ok bool
+	var err error
+	if cv, isClientVerifier := a.store.(ClientVerifier); isClientVerifier {
+		ok, err = cv.VerifyClient(username, password, info)
+	} else {
+		ok, err = a.store.Verify(username, password)
+	}
 	if err != nil {
-		slog.Error("读取认证文件失败",
+		slog.Error("校验密码失败",
+			"username", username,
 			"error", err,
-			"file", filename,
 			"timestamp", time.Now().Format(time.RFC3339Nano),
 		)
-		return err
+		return nil, "", temporary(err)
 	}
 
-	a.mu.Lock()
-	defer a.mu.Unlock()
-
-	if err := json.Unmarshal(data, &a.credentials); err != nil {
-		slog.Error("解析认证文件失败",
-			"error", err,
-			"file", filename,
+	label := ""
+	if aps, isAppStore := a.store.(AppPasswordStore); !ok && isAppStore {
+		label, ok, err = aps.VerifyAppPassword(username, password)
+		if err != nil {
+			slog.Error("校验应用专用密码失败",
+				"username", username,
+				"error", err,
+				"timestamp", time.Now().Format(time.RFC3339Nano),
+			)
+			return nil, "", temporary(err)
+		}
+	}
+	if !ok {
+		slog.Debug("密码不匹配",
+			"username", username,
 			"timestamp", time.Now().Format(time.RFC3339Nano),
 		)
-		return err
+		return nil, "", nil
 	}
 
-	slog.Info("加载认证信息成功",
-		"file", filename,
-		"count", len(a.credentials),
-		"timestamp", time.Now().Format(time.RFC3339Nano),
-	)
-	return nil
-}
-
-// Authenticate 验证用户名和密码
-func (a *Authenticator) Authenticate(username, password string) bool {
-	a.mu.RLock()
-	defer a.mu.RUnlock()
-
-	storedPassword, exists := a.credentials[username]
-	if !exists {
-		slog.Debug("用户不存在",
+	account, err := a.Account(username)
+	if err != nil || account == nil {
+		// 校验通过后账户又被删除
+		slog.Warn("查询账户失败",
 			"username", username,
+			"error", err,
 			"timestamp", time.Now().Format(time.RFC3339Nano),
 		)
-		return false
+		return nil, "", nil
 	}
-
-	if storedPassword != password {
-		slog.Debug("密码不匹配",
+	if err := account.Usable(time.Now()); err != nil {
+		slog.Warn("账户不可用",
 			"username", username,
+			"error", err,
 			"timestamp", time.Now().Format(time.RFC3339Nano),
 		)
-		return false
+		return nil, "", nil
 	}
 
 	slog.Debug("认证成功",
 		"username", username,
+		"app_password", label,
 		"timestamp", time.Now().Format(time.RFC3339Nano),
 	)
-	return true
+	return account, label, nil
+}
+
+// temporary 只保留暂时失败的错误，其他错误按认证失败处理
+func temporary(err error) error {
+	if errors.Is(err, ErrTemporary) {
+		return err
+	}
+	return nil
 }
@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// LDAP 使用的 BER 标签
+const (
+	berTagBoolean     = 0x01
+	berTagInteger     = 0x02
+	berTagOctetString = 0x04
+	berTagEnumerated  = 0x0a
+	berTagSequence    = 0x30
+	berTagSet         = 0x31
+)
+
+// berMaxLength 单个 BER 元素允许的最大长度，避免异常数据耗尽内存
+const berMaxLength = 1 << 20
+
+// berElement 解码后的 BER 元素
+type berElement struct {
+	tag     byte
+	content []byte
+}
+
+// berTLV 编码一个 TLV 元素
+func berTLV(tag byte, content []byte) []byte {
+	out := []byte{tag}
+	n := len(content)
+	switch {
+	case n < 0x80:
+		out = append(out, byte(n))
+	case n <= 0xff:
+		out = append(out, 0x81, byte(n))
+	case n <= 0xffff:
+		out = append(out, 0x82, byte(n>>8), byte(n))
+	default:
+		out = append(out, 0x83, byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(out, content...)
+}
+
+// berSeq 编码一个由多个元素组成的结构
+func berSeq(tag byte, parts ...[]byte) []byte {
+	var content []byte
+	for _, p := range parts {
+		content = append(content, p...)
+	}
+	return berTLV(tag, content)
+}
+
+// berInt 编码整数
+func berInt(tag byte, n int) []byte {
+	var content []byte
+	for v := n; ; v >>= 8 {
+		content = append([]byte{byte(v)}, content...)
+		if (v >= -0x80 && v < 0x80) || len(content) >= 8 {
+			break
+		}
+	}
+	return berTLV(tag, content)
+}
+
+// berString 编码字符串
+func berString(tag byte, s string) []byte {
+	return berTLV(tag, []byte(s))
+}
+
+// berBool 编码布尔值
+func berBool(b bool) []byte {
+	if b {
+		return berTLV(berTagBoolean, []byte{0xff})
+	}
+	return berTLV(berTagBoolean, []byte{0x00})
+}
+
+// readBER 从流中读取一个完整的 BER 元素
+func readBER(r *bufio.Reader) (berElement, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return berElement{}, err
+	}
+	first, err := r.ReadByte()
+	if err != nil {
+		return berElement{}, err
+	}
+
+	n := int(first)
+	if first&0x80 != 0 {
+		count := int(first & 0x7f)
+		if count == 0 || count > 3 {
+			return berElement{}, fmt.Errorf("unsupported BER length encoding")
+		}
+		n = 0
+		for i := 0; i < count; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return berElement{}, err
+			}
+			n = n<<8 | int(b)
+		}
+	}
+	if n > berMaxLength {
+		return berElement{}, fmt.Errorf("BER element too large: %d", n)
+	}
+
+	content := make([]byte, n)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return berElement{}, err
+	}
+	return berElement{tag: tag, content: content}, nil
+}
+
+// berChildren 解码结构类型元素中的子元素
+func berChildren(content []byte) ([]berElement, error) {
+	var children []berElement
+	r := bufio.NewReader(bytes.NewReader(content))
+	for {
+		e, err := readBER(r)
+		if errors.Is(err, io.EOF) {
+			return children, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, e)
+	}
+}
+
+// int 将元素内容解码为整数
+func (e berElement) int() int {
+	n := 0
+	for i, b := range e.content {
+		if i == 0 && b&0x80 != 0 {
+			n = -1
+		}
+		n = n<<8 | int(b)
+	}
+	return n
+}
@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// checkpassword 程序的退出码
+const (
+	checkpasswordOK       = 0
+	checkpasswordReject   = 1
+	checkpasswordMisuse   = 2
+	checkpasswordTempFail = 111
+)
+
+// checkpasswordMaxInput 协议规定 fd 3 上的数据不超过 512 字节
+const checkpasswordMaxInput = 512
+
+// CheckpasswordOptions checkpassword 凭据存储的配置
+type CheckpasswordOptions struct {
+	// Command 程序及其参数，校验成功后程序会执行追加的 true 命令
+	Command []string
+	// Timeout 等待程序结束的超时，超时视为暂时失败，默认 10 秒
+	Timeout time.Duration
+	// MaxConcurrent 同时运行的程序数量上限，默认 4；
+	// 超出时等待空闲，直到超时
+	MaxConcurrent int
+}
+
+// CheckpasswordStore 通过 qmail/DJB checkpassword 协议调用外部程序校验密码：
+// 程序从 fd 3 读取 "username\0password\0timestamp\0"，退出码 0 表示通过，
+// 1 表示拒绝，111 表示暂时失败
+type CheckpasswordStore struct {
+	opts CheckpasswordOptions
+	sem  chan struct{}
+}
+
+// NewCheckpasswordStore 创建 checkpassword 凭据存储
+func NewCheckpasswordStore(opts CheckpasswordOptions) (*CheckpasswordStore, error) {
+	if len(opts.Command) == 0 || opts.Command[0] == "" {
+		return nil, fmt.Errorf("checkpassword command is required")
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.MaxConcurrent <= 0 {
+		opts.MaxConcurrent = 4
+	}
+	return &CheckpasswordStore{
+		opts: opts,
+		sem:  make(chan struct{}, opts.MaxConcurrent),
+	}, nil
+}
+
+// Lookup checkpassword 协议不支持查询用户
+func (s *CheckpasswordStore) Lookup(username string) (bool, error) {
+	return false, ErrUnsupported
+}
+
+// List checkpassword 协议不支持列出用户
+func (s *CheckpasswordStore) List() ([]string, error) {
+	return nil, ErrUnsupported
+}
+
+// Verify 运行 checkpassword 程序校验用户名和密码；
+// 程序暂时失败、超时或并发已满时返回包装了 ErrTemporary 的错误
+func (s *CheckpasswordStore) Verify(username, password string) (bool, error) {
+	// 字段以 NUL 分隔，含 NUL 的用户名或密码会改变程序看到的字段
+	if username == "" || password == "" || strings.ContainsRune(username+password, 0) {
+		return false, nil
+	}
+	input := []byte(username + "\x00" + password + "\x00\x00")
+	if len(input) > checkpasswordMaxInput {
+		return false, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts.Timeout)
+	defer cancel()
+
+	select {
+	case s.sem <- struct{}{}:
+		defer func() { <-s.sem }()
+	case <-ctx.Done():
+		return false, fmt.Errorf("%w: too many concurrent checkpassword processes", ErrTemporary)
+	}
+
+	code, stderr, err := s.run(ctx, input)
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", ErrTemporary, err)
+	}
+
+	switch code {
+	case checkpasswordOK:
+		return true, nil
+	case checkpasswordReject:
+		return false, nil
+	case checkpasswordTempFail:
+		return false, fmt.Errorf("%w: checkpassword exited with %d", ErrTemporary, code)
+	case checkpasswordMisuse:
+		return false, fmt.Errorf("checkpassword reported misuse: %s", stderr)
+	default:
+		slog.Warn("checkpassword 程序返回未知的退出码，视为拒绝",
+			"command", s.opts.Command[0],
+			"username", username,
+			"exit_code", code,
+			"stderr", stderr,
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+		return false, nil
+	}
+}
+
+// run 运行程序并通过 fd 3 传入 input，返回退出码和标准错误输出
+func (s *CheckpasswordStore) run(ctx context.Context, input []byte) (int, string, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, "", err
+	}
+
+	args := append(s.opts.Command[1:len(s.opts.Command):len(s.opts.Command)], "true")
+	cmd := exec.CommandContext(ctx, s.opts.Command[0], args...)
+	cmd.ExtraFiles = []*os.File{r} // 子进程中的 fd 3
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	// 超时后子进程被杀死，但它的子进程可能仍持有标准错误输出
+	cmd.WaitDelay = time.Second
+
+	err = cmd.Start()
+	r.Close()
+	if err != nil {
+		w.Close()
+		return 0, "", err
+	}
+
+	// 程序可能不读取 fd 3 就退出，写入失败时以退出码为准
+	w.Write(input)
+	w.Close()
+
+	err = cmd.Wait()
+	if err != nil && ctx.Err() != nil {
+		return 0, "", fmt.Errorf("checkpassword timed out after %s", s.opts.Timeout)
+	}
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return 0, "", err
+	}
+	return cmd.ProcessState.ExitCode(), strings.TrimSpace(stderr.String()), nil
+}
@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// checkpasswordScript 测试用的 checkpassword 程序：alice/secret 通过，
+// 用户 temp 暂时失败，用户 slow 超时，其余拒绝
+const checkpasswordScript = `#!/bin/sh
+input=$(tr '\0' '\n' <&3)
+user=$(printf '%s\n' "$input" | sed -n 1p)
+pass=$(printf '%s\n' "$input" | sed -n 2p)
+case "$user" in
+temp) exit 111 ;;
+slow) sleep 5; exit 1 ;;
+misuse) echo "bad input" >&2; exit 2 ;;
+esac
+if [ "$user" = alice ] && [ "$pass" = secret ]; then
+	exec "$@"
+fi
+exit 1
+`
+
+func writeCheckpassword(t *testing.T) string {
+	t.Helper()
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("/bin/sh not available")
+	}
+	path := filepath.Join(t.TempDir(), "checkpassword")
+	if err := os.WriteFile(path, []byte(checkpasswordScript), 0755); err != nil {
+		t.Fatalf("Failed to write checkpassword program: %v", err)
+	}
+	return path
+}
+
+func TestCheckpasswordStore(t *testing.T) {
+	store, err := NewCheckpasswordStore(CheckpasswordOptions{
+		Command: []string{writeCheckpassword(t)},
+		Timeout: 500 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewCheckpasswordStore() error = %v", err)
+	}
+
+	tests := []struct {
+		username, password string
+		want               bool
+		wantTemporary      bool
+		wantErr            bool
+	}{
+		{username: "alice", password: "secret", want: true},
+		{username: "alice", password: "wrong"},
+		{username: "bob", password: "secret"},
+		{username: "alice", password: ""},
+		{username: "alice\x00secret", password: "x"},
+		{username: "alice", password: "secret\x00x"},
+		{username: "temp", password: "x", wantTemporary: true},
+		{username: "slow", password: "x", wantTemporary: true},
+		{username: "misuse", password: "x", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := store.Verify(tt.username, tt.password)
+		if got != tt.want {
+			t.Errorf("Verify(%q, %q) = %v, want %v", tt.username, tt.password, got, tt.want)
+		}
+		if errors.Is(err, ErrTemporary) != tt.wantTemporary || (err != nil) != (tt.wantTemporary || tt.wantErr) {
+			t.Errorf("Verify(%q, %q) error = %v", tt.username, tt.password, err)
+		}
+	}
+}
+
+func TestCheckpasswordConcurrency(t *testing.T) {
+	store, err := NewCheckpasswordStore(CheckpasswordOptions{
+		Command:       []string{writeCheckpassword(t)},
+		Timeout:       300 * time.Millisecond,
+		MaxConcurrent: 1,
+	})
+	if err != nil {
+		t.Fatalf("NewCheckpasswordStore() error = %v", err)
+	}
+
+	// 第一个程序占满并发直到超时，第二个请求等不到空闲
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		store.Verify("slow", "x")
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if _, err := store.Verify("alice", "secret"); !errors.Is(err, ErrTemporary) {
+		t.Errorf("Verify() while busy error = %v, want %v", err, ErrTemporary)
+	}
+	wg.Wait()
+
+	if ok, err := store.Verify("alice", "secret"); !ok || err != nil {
+		t.Errorf("Verify() after slot freed = %v, %v; want true", ok, err)
+	}
+}
@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-sasl"
+)
+
+// CRAMMD5 CRAM-MD5 机制名称（RFC 2195）
+const CRAMMD5 = "CRAM-MD5"
+
+// cramMD5Prefix Dovecot 兼容的 CRAM-MD5 密钥前缀，后跟 64 个十六进制字符
+const cramMD5Prefix = "{CRAM-MD5}"
+
+// cramMD5Context 计算 HMAC-MD5 以密码为密钥时内外两层 MD5 的中间状态
+//
+// 格式与 Dovecot 相同：外层状态在前、内层状态在后，各 4 个小端序 32 位字。
+// 保存中间状态而不是明文，服务端仍可计算任意挑战的摘要。
+func cramMD5Context(password string) []byte {
+	key := []byte(password)
+	if len(key) > md5.BlockSize {
+		sum := md5.Sum(key)
+		key = sum[:]
+	}
+
+	out := make([]byte, 0, 32)
+	for _, pad := range []byte{0x5c, 0x36} {
+		block := make([]byte, md5.BlockSize)
+		copy(block, key)
+		for i := range block {
+			block[i] ^= pad
+		}
+		h := md5.New()
+		h.Write(block)
+		state, _ := h.(encoding.BinaryMarshaler).MarshalBinary()
+		// MarshalBinary 输出 "md5\x01" 后跟 4 个大端序状态字
+		for i := 0; i < 4; i++ {
+			word := binary.BigEndian.Uint32(state[4+4*i:])
+			out = binary.LittleEndian.AppendUint32(out, word)
+		}
+	}
+	return out
+}
+
+// md5FromState 从一个 32 位字的中间状态恢复已处理一个分组的 MD5
+func md5FromState(context []byte) (hash.Hash, error) {
+	state := []byte("md5\x01")
+	for i := 0; i < 4; i++ {
+		state = binary.BigEndian.AppendUint32(state, binary.LittleEndian.Uint32(context[4*i:]))
+	}
+	state = append(state, make([]byte, md5.BlockSize)...)
+	state = binary.BigEndian.AppendUint64(state, md5.BlockSize)
+
+	h := md5.New()
+	if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// cramMD5Digest 根据已存储的凭据计算挑战的 HMAC-MD5 摘要
+func cramMD5Digest(stored string, challenge []byte) ([]byte, error) {
+	switch Identify(stored) {
+	case SchemePlain:
+		mac := hmac.New(md5.New, []byte(strings.TrimPrefix(stored, plainPrefix)))
+		mac.Write(challenge)
+		return mac.Sum(nil), nil
+	case SchemeCRAMMD5:
+		context, err := hex.DecodeString(strings.TrimPrefix(stored, cramMD5Prefix))
+		if err != nil || len(context) != 32 {
+			return nil, fmt.Errorf("malformed CRAM-MD5 hash")
+		}
+		outer, err := md5FromState(context[:16])
+		if err != nil {
+			return nil, err
+		}
+		inner, err := md5FromState(context[16:])
+		if err != nil {
+			return nil, err
+		}
+		inner.Write(challenge)
+		outer.Write(inner.Sum(nil))
+		return outer.Sum(nil), nil
+	default:
+		return nil, fmt.Errorf("%w: %s cannot be used for CRAM-MD5", ErrUnsupported, Identify(stored))
+	}
+}
+
+// cramMD5Server CRAM-MD5 服务端
+type cramMD5Server struct {
+	a         *Authenticator
+	hostname  string
+	challenge []byte
+	done      func(username string, ok bool) error
+}
+
+// NewCRAMMD5Server 创建 CRAM-MD5 服务端，认证结束后以用户名和结果调用 done，
+// 其返回值作为认证结果返回给客户端
+func (a *Authenticator) NewCRAMMD5Server(hostname string, done func(username string, ok bool) error) sasl.Server {
+	return &cramMD5Server{a: a, hostname: hostname, done: done}
+}
+
+func (s *cramMD5Server) Next(response []byte) (challenge []byte, done bool, err error) {
+	if s.challenge == nil {
+		if response != nil {
+			return nil, false, sasl.ErrUnexpectedClientResponse
+		}
+		nonce := make([]byte, 8)
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, false, err
+		}
+		s.challenge = fmt.Appendf(nil, "<%x.%d@%s>", nonce, time.Now().Unix(), s.hostname)
+		return s.challenge, false, nil
+	}
+
+	// 响应格式为 "username hex-digest"
+	i := bytes.LastIndexByte(response, ' ')
+	if i <= 0 {
+		return nil, true, fmt.Errorf("malformed CRAM-MD5 response")
+	}
+	username := string(response[:i])
+	digest, err := hex.DecodeString(string(response[i+1:]))
+	if err != nil {
+		return nil, true, fmt.Errorf("malformed CRAM-MD5 response")
+	}
+
+	stored, exists, err := s.a.secret(username)
+	if err != nil {
+		return nil, true, err
+	}
+	ok := false
+	if exists {
+		expected, err := cramMD5Digest(stored, s.challenge)
+		if err != nil {
+			slog.Warn("已存储的密码无法用于 CRAM-MD5 认证",
+				"username", username,
+				"error", err,
+				"timestamp", time.Now().Format(time.RFC3339Nano),
+			)
+		} else {
+			ok = subtle.ConstantTimeCompare(expected, digest) == 1
+		}
+	}
+	return nil, true, s.done(username, ok)
+}
@@ -0,0 +1,234 @@
+package auth
+
+import (
+	"crypto/md5"
+	"crypto/sha512"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SHA-512-crypt 参数，参见 https://www.akkadia.org/drepper/SHA-crypt.txt
+const (
+	sha512DefaultRounds = 5000
+	sha512MinRounds     = 1000
+	sha512MaxRounds     = 999999999
+	sha512MaxSalt       = 16
+)
+
+// cryptAlphabet crypt(3) 使用的 base64 字母表
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// sha512Crypt 计算 $6$ 格式的密码哈希
+func sha512Crypt(password, salt []byte, rounds int, customRounds bool) string {
+	if len(salt) > sha512MaxSalt {
+		salt = salt[:sha512MaxSalt]
+	}
+	rounds = min(max(rounds, sha512MinRounds), sha512MaxRounds)
+
+	// 摘要 B = SHA512(P + S + P)
+	h := sha512.New()
+	h.Write(password)
+	h.Write(salt)
+	h.Write(password)
+	b := h.Sum(nil)
+
+	// 摘要 A
+	h.Reset()
+	h.Write(password)
+	h.Write(salt)
+	for i := len(password); i > 0; i -= sha512.Size {
+		h.Write(b[:min(i, sha512.Size)])
+	}
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(password)
+		}
+	}
+	a := h.Sum(nil)
+
+	// 序列 P
+	h.Reset()
+	for range password {
+		h.Write(password)
+	}
+	dp := h.Sum(nil)
+	p := make([]byte, 0, len(password))
+	for i := len(password); i > 0; i -= sha512.Size {
+		p = append(p, dp[:min(i, sha512.Size)]...)
+	}
+
+	// 序列 S
+	h.Reset()
+	for i := 0; i < 16+int(a[0]); i++ {
+		h.Write(salt)
+	}
+	ds := h.Sum(nil)
+	s := make([]byte, 0, len(salt))
+	for i := len(salt); i > 0; i -= sha512.Size {
+		s = append(s, ds[:min(i, sha512.Size)]...)
+	}
+
+	c := a
+	for r := 0; r < rounds; r++ {
+		h.Reset()
+		if r&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(c)
+		}
+		if r%3 != 0 {
+			h.Write(s)
+		}
+		if r%7 != 0 {
+			h.Write(p)
+		}
+		if r&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(p)
+		}
+		c = h.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString("$6$")
+	if customRounds {
+		fmt.Fprintf(&out, "rounds=%d$", rounds)
+	}
+	out.Write(salt)
+	out.WriteByte('$')
+
+	order := [][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+		{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+		{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+		{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+		{62, 20, 41},
+	}
+	for _, o := range order {
+		writeCrypt24(&out, c[o[0]], c[o[1]], c[o[2]], 4)
+	}
+	writeCrypt24(&out, 0, 0, c[63], 2)
+
+	return out.String()
+}
+
+// parseSHA512Crypt 从 $6$[rounds=N$]salt$hash 中解析盐值与轮数
+func parseSHA512Crypt(stored string) (salt []byte, rounds int, customRounds bool, err error) {
+	rest := strings.TrimPrefix(stored, "$6$")
+	rounds = sha512DefaultRounds
+	if strings.HasPrefix(rest, "rounds=") {
+		value, after, ok := strings.Cut(strings.TrimPrefix(rest, "rounds="), "$")
+		if !ok {
+			return nil, 0, false, fmt.Errorf("malformed sha512-crypt hash")
+		}
+		rounds, err = strconv.Atoi(value)
+		if err != nil {
+			return nil, 0, false, fmt.Errorf("malformed sha512-crypt rounds: %w", err)
+		}
+		customRounds = true
+		rest = after
+	}
+
+	i := strings.LastIndexByte(rest, '$')
+	if i < 0 {
+		return nil, 0, false, fmt.Errorf("malformed sha512-crypt hash")
+	}
+	return []byte(rest[:i]), rounds, customRounds, nil
+}
+
+// md5Crypt 计算 $1$ 或 Apache $apr1$ 格式的密码哈希
+func md5Crypt(password []byte, magic string, salt []byte) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	h := md5.New()
+	h.Write(password)
+	h.Write(salt)
+	h.Write(password)
+	final := h.Sum(nil)
+
+	h.Reset()
+	h.Write(password)
+	h.Write([]byte(magic))
+	h.Write(salt)
+	for i := len(password); i > 0; i -= md5.Size {
+		h.Write(final[:min(i, md5.Size)])
+	}
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(password[:1])
+		}
+	}
+	final = h.Sum(nil)
+
+	for r := 0; r < 1000; r++ {
+		h.Reset()
+		if r&1 != 0 {
+			h.Write(password)
+		} else {
+			h.Write(final)
+		}
+		if r%3 != 0 {
+			h.Write(salt)
+		}
+		if r%7 != 0 {
+			h.Write(password)
+		}
+		if r&1 != 0 {
+			h.Write(final)
+		} else {
+			h.Write(password)
+		}
+		final = h.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString(magic)
+	out.Write(salt)
+	out.WriteByte('$')
+	for _, o := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		writeCrypt24(&out, final[o[0]], final[o[1]], final[o[2]], 4)
+	}
+	writeCrypt24(&out, 0, 0, final[11], 2)
+
+	return out.String()
+}
+
+// parseMD5Crypt 从 $1$salt$hash 或 $apr1$salt$hash 中解析前缀与盐值
+func parseMD5Crypt(stored string) (magic string, salt []byte, err error) {
+	magic = "$1$"
+	if strings.HasPrefix(stored, "$apr1$") {
+		magic = "$apr1$"
+	}
+	rest := strings.TrimPrefix(stored, magic)
+	i := strings.IndexByte(rest, '$')
+	if i < 0 {
+		return "", nil, fmt.Errorf("malformed md5-crypt hash")
+	}
+	return magic, []byte(rest[:i]), nil
+}
+
+// writeCrypt24 将 3 个字节按 crypt(3) 规则编码为 n 个字符
+func writeCrypt24(out *strings.Builder, b2, b1, b0 byte, n int) {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for ; n > 0; n-- {
+		out.WriteByte(cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+}
+
+// cryptEncode 使用 crypt(3) 字母表编码随机字节，用于生成盐值
+func cryptEncode(b []byte) string {
+	var out strings.Builder
+	for i := 0; i+2 < len(b); i += 3 {
+		writeCrypt24(&out, b[i], b[i+1], b[i+2], 4)
+	}
+	return out.String()
+}
@@ -0,0 +1,385 @@
+package auth
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-sasl"
+)
+
+// dovecotConversationTimeout 一次认证会话的最长时间；客户端中途放弃认证时
+// go-smtp 不会通知 SASL 服务端，到期后关闭与 Dovecot 的连接
+const dovecotConversationTimeout = 5 * time.Minute
+
+// DovecotOptions Dovecot 认证客户端的配置
+type DovecotOptions struct {
+	// Socket Dovecot 认证服务的 unix 套接字，如 /var/run/dovecot/auth-client
+	Socket string
+	// Service 传给 Dovecot 的服务名，默认 smtp
+	Service string
+	// Timeout 连接和等待 Dovecot 回复的超时，默认 10 秒
+	Timeout time.Duration
+}
+
+// DovecotStore 通过 Dovecot 认证协议（auth-client 套接字）校验凭据，
+// 每次认证使用一个新连接
+type DovecotStore struct {
+	opts   DovecotOptions
+	nextID atomic.Uint32
+
+	mu         sync.RWMutex
+	mechanisms []string
+}
+
+// NewDovecotStore 创建 Dovecot 凭据存储，并尝试连接以获取支持的认证机制；
+// 连接失败时只记录日志，之后每次认证会重新连接
+func NewDovecotStore(opts DovecotOptions) (*DovecotStore, error) {
+	if opts.Socket == "" {
+		return nil, fmt.Errorf("dovecot auth socket is required")
+	}
+	if opts.Service == "" {
+		opts.Service = "smtp"
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	s := &DovecotStore{opts: opts}
+
+	c, err := s.dial()
+	if err != nil {
+		slog.Warn("连接 Dovecot 认证服务失败",
+			"socket", opts.Socket,
+			"error", err,
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+		return s, nil
+	}
+	c.Close()
+	slog.Info("连接 Dovecot 认证服务成功",
+		"socket", opts.Socket,
+		"mechanisms", s.Mechanisms(),
+		"timestamp", time.Now().Format(time.RFC3339Nano),
+	)
+	return s, nil
+}
+
+// Mechanisms 返回 Dovecot 最近一次握手时公布的认证机制
+func (s *DovecotStore) Mechanisms() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.mechanisms
+}
+
+// Supports 判断 Dovecot 是否支持该认证机制
+func (s *DovecotStore) Supports(mech string) bool {
+	return slices.Contains(s.Mechanisms(), mech)
+}
+
+// Lookup Dovecot 认证协议不支持查询用户
+func (s *DovecotStore) Lookup(username string) (bool, error) {
+	return false, ErrUnsupported
+}
+
+// List Dovecot 认证协议不支持列出用户
+func (s *DovecotStore) List() ([]string, error) {
+	return nil, ErrUnsupported
+}
+
+// Verify 使用 PLAIN 机制校验用户名和密码
+func (s *DovecotStore) Verify(username, password string) (bool, error) {
+	return s.VerifyClient(username, password, ClientInfo{})
+}
+
+// VerifyClient 使用 PLAIN 机制校验用户名和密码，并附带客户端信息；
+// Dovecot 不可用或回复暂时失败时返回包装了 ErrTemporary 的错误
+func (s *DovecotStore) VerifyClient(username, password string, info ClientInfo) (bool, error) {
+	if username == "" || password == "" {
+		return false, nil
+	}
+	ir := []byte("\x00" + username + "\x00" + password)
+
+	c, err := s.dial()
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", ErrTemporary, err)
+	}
+	defer c.Close()
+
+	id := s.nextID.Add(1)
+	if err := c.send(s.authCommand(id, sasl.Plain, info, ir)...); err != nil {
+		return false, fmt.Errorf("%w: %v", ErrTemporary, err)
+	}
+	r, err := c.reply(id)
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", ErrTemporary, err)
+	}
+	switch {
+	case r.command == "OK":
+		return true, nil
+	case r.command == "FAIL" && r.has("temp"):
+		return false, fmt.Errorf("%w: dovecot: %s", ErrTemporary, r.params["reason"])
+	default:
+		// PLAIN 带初始响应时不应再收到 CONT
+		return false, nil
+	}
+}
+
+// authCommand 构造 AUTH 命令，ir 为 nil 时不带初始响应
+func (s *DovecotStore) authCommand(id uint32, mech string, info ClientInfo, ir []byte) []string {
+	args := []string{"AUTH", strconv.FormatUint(uint64(id), 10), mech, "service=" + s.opts.Service}
+	if info.SessionID != "" {
+		args = append(args, "session="+info.SessionID)
+	}
+	for _, addr := range []struct{ ip, port, value string }{
+		{"lip", "lport", info.LocalAddr},
+		{"rip", "rport", info.RemoteAddr},
+	} {
+		if host, port, err := net.SplitHostPort(addr.value); err == nil {
+			args = append(args, addr.ip+"="+host, addr.port+"="+port)
+		}
+	}
+	if info.Secured {
+		args = append(args, "secured")
+	}
+	if ir != nil {
+		args = append(args, "resp="+base64.StdEncoding.EncodeToString(ir))
+	}
+	return args
+}
+
+// NewServer 创建将认证会话转发给 Dovecot 的 SASL 服务端，
+// 认证结束后以 Dovecot 返回的用户名调用 done；
+// Dovecot 不可用或回复暂时失败时 Next 返回包装了 ErrTemporary 的错误
+func (s *DovecotStore) NewServer(mech string, info ClientInfo, done func(username string, ok bool) error) sasl.Server {
+	return &dovecotServer{store: s, mech: mech, info: info, done: done}
+}
+
+// dovecotServer 转发认证会话的 SASL 服务端
+type dovecotServer struct {
+	store *DovecotStore
+	mech  string
+	info  ClientInfo
+	done  func(username string, ok bool) error
+
+	conn  *dovecotConn
+	timer *time.Timer
+	id    uint32
+	// username 认证已成功、等待客户端确认服务端最终数据时的用户名
+	username string
+}
+
+func (s *dovecotServer) Next(response []byte) ([]byte, bool, error) {
+	if s.username != "" {
+		return nil, true, s.done(s.username, true)
+	}
+
+	var err error
+	if s.conn == nil {
+		if s.conn, err = s.store.dial(); err != nil {
+			return nil, false, fmt.Errorf("%w: %v", ErrTemporary, err)
+		}
+		s.timer = time.AfterFunc(dovecotConversationTimeout, func() { s.conn.Close() })
+		s.id = s.store.nextID.Add(1)
+		err = s.conn.send(s.store.authCommand(s.id, s.mech, s.info, response)...)
+	} else {
+		err = s.conn.send("CONT", strconv.FormatUint(uint64(s.id), 10), base64.StdEncoding.EncodeToString(response))
+	}
+	if err != nil {
+		s.close()
+		return nil, false, fmt.Errorf("%w: %v", ErrTemporary, err)
+	}
+
+	r, err := s.conn.reply(s.id)
+	if err != nil {
+		s.close()
+		return nil, false, fmt.Errorf("%w: %v", ErrTemporary, err)
+	}
+	switch r.command {
+	case "CONT":
+		challenge, err := base64.StdEncoding.DecodeString(r.data)
+		if err != nil {
+			s.close()
+			return nil, false, fmt.Errorf("%w: invalid challenge from dovecot", ErrTemporary)
+		}
+		return challenge, false, nil
+	case "OK":
+		s.close()
+		username := r.params["user"]
+		if username == "" {
+			return nil, true, s.done("", false)
+		}
+		// 服务端最终数据（如 SCRAM 的 server-final-message）需要作为质询发出，
+		// 客户端回复空响应后才结束认证
+		if data, ok := r.params["resp"]; ok && data != "" {
+			final, err := base64.StdEncoding.DecodeString(data)
+			if err != nil {
+				return nil, true, s.done(username, false)
+			}
+			s.username = username
+			return final, false, nil
+		}
+		return nil, true, s.done(username, true)
+	default:
+		s.close()
+		if r.has("temp") {
+			return nil, false, fmt.Errorf("%w: dovecot: %s", ErrTemporary, r.params["reason"])
+		}
+		return nil, true, s.done(r.params["user"], false)
+	}
+}
+
+func (s *dovecotServer) close() {
+	s.timer.Stop()
+	s.conn.Close()
+}
+
+// dovecotReply Dovecot 对认证请求的回复：OK、FAIL 或 CONT
+type dovecotReply struct {
+	command string
+	// data CONT 回复中的质询
+	data   string
+	params map[string]string
+}
+
+// has 判断回复是否带有该参数或标志
+func (r *dovecotReply) has(name string) bool {
+	_, ok := r.params[name]
+	return ok
+}
+
+// dovecotConn 与 Dovecot 认证服务之间完成了握手的连接
+type dovecotConn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+}
+
+// dial 连接 Dovecot 认证服务并完成握手，同时更新支持的认证机制
+func (s *DovecotStore) dial() (*dovecotConn, error) {
+	conn, err := net.DialTimeout("unix", s.opts.Socket, s.opts.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &dovecotConn{Conn: conn, r: bufio.NewReader(conn), timeout: s.opts.Timeout}
+
+	mechanisms, err := c.handshake()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s.mu.Lock()
+	s.mechanisms = mechanisms
+	s.mu.Unlock()
+	return c, nil
+}
+
+// handshake 交换协议版本，读取服务端公布的认证机制直到 DONE
+func (c *dovecotConn) handshake() ([]string, error) {
+	if err := c.send("VERSION", "1", "2"); err != nil {
+		return nil, err
+	}
+	if err := c.send("CPID", strconv.Itoa(os.Getpid())); err != nil {
+		return nil, err
+	}
+
+	var mechanisms []string
+	versionOK := false
+	for {
+		fields, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		switch fields[0] {
+		case "VERSION":
+			if len(fields) < 2 || fields[1] != "1" {
+				return nil, fmt.Errorf("unsupported dovecot auth protocol version: %s", strings.Join(fields[1:], "."))
+			}
+			versionOK = true
+		case "MECH":
+			if len(fields) >= 2 {
+				mechanisms = append(mechanisms, strings.ToUpper(fields[1]))
+			}
+		case "DONE":
+			if !versionOK {
+				return nil, errors.New("dovecot auth handshake without version")
+			}
+			return mechanisms, nil
+		}
+	}
+}
+
+// reply 读取对请求 id 的回复
+func (c *dovecotConn) reply(id uint32) (*dovecotReply, error) {
+	fields, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) < 2 || fields[1] != strconv.FormatUint(uint64(id), 10) {
+		return nil, fmt.Errorf("unexpected reply from dovecot: %q", strings.Join(fields, " "))
+	}
+
+	r := &dovecotReply{command: fields[0], params: make(map[string]string)}
+	args := fields[2:]
+	switch r.command {
+	case "CONT":
+		if len(args) > 0 {
+			r.data = args[0]
+		}
+	case "OK", "FAIL":
+		for _, arg := range args {
+			name, value, _ := strings.Cut(arg, "=")
+			r.params[name] = value
+		}
+	default:
+		return nil, fmt.Errorf("unexpected reply from dovecot: %s", r.command)
+	}
+	return r, nil
+}
+
+// send 发送一行以制表符分隔的命令，参数中的特殊字符会被转义
+func (c *dovecotConn) send(fields ...string) error {
+	for i := range fields {
+		fields[i] = dovecotEscape(fields[i])
+	}
+	c.SetWriteDeadline(time.Now().Add(c.timeout))
+	_, err := c.Write([]byte(strings.Join(fields, "\t") + "\n"))
+	return err
+}
+
+// readLine 读取一行并拆分为反转义后的字段
+func (c *dovecotConn) readLine() ([]string, error) {
+	c.SetReadDeadline(time.Now().Add(c.timeout))
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Split(strings.TrimSuffix(line, "\n"), "\t")
+	for i := range fields {
+		fields[i] = dovecotUnescape(fields[i])
+	}
+	return fields, nil
+}
+
+// dovecotEscaper 和 dovecotUnescaper 实现 Dovecot 的制表符转义，以 \x01 为转义字符
+var (
+	dovecotEscaper   = strings.NewReplacer("\x01", "\x011", "\x00", "\x010", "\t", "\x01t", "\r", "\x01r", "\n", "\x01n")
+	dovecotUnescaper = strings.NewReplacer("\x011", "\x01", "\x010", "\x00", "\x01t", "\t", "\x01r", "\r", "\x01n", "\n")
+)
+
+func dovecotEscape(s string) string {
+	return dovecotEscaper.Replace(s)
+}
+
+func dovecotUnescape(s string) string {
+	return dovecotUnescaper.Replace(s)
+}
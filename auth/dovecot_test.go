@@ -0,0 +1,316 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-sasl"
+)
+
+// fakeDovecot 最小的 Dovecot 认证服务，支持 PLAIN、LOGIN 和 CRAM-MD5，
+// 用户 temp 总是暂时失败；FINAL 机制在成功时返回服务端最终数据
+type fakeDovecot struct {
+	users map[string]string
+
+	mu       sync.Mutex
+	requests [][]string
+}
+
+func (f *fakeDovecot) start(t *testing.T) string {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "auth-client")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return socket
+}
+
+func (f *fakeDovecot) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	fmt.Fprint(conn, "VERSION\t1\t2\nMECH\tPLAIN\tplaintext\nMECH\tLOGIN\tplaintext\n"+
+		"MECH\tCRAM-MD5\tdictionary\nMECH\tFINAL\nSPID\t1\nCUID\t1\nCOOKIE\t0123\nDONE\n")
+
+	read := func() []string {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil
+		}
+		return strings.Split(strings.TrimSuffix(line, "\n"), "\t")
+	}
+	cont := func(id, challenge string) []byte {
+		fmt.Fprintf(conn, "CONT\t%s\t%s\n", id, base64.StdEncoding.EncodeToString([]byte(challenge)))
+		fields := read()
+		if len(fields) < 3 {
+			return nil
+		}
+		data, _ := base64.StdEncoding.DecodeString(fields[2])
+		return data
+	}
+
+	for {
+		fields := read()
+		if fields == nil {
+			return
+		}
+		if fields[0] != "AUTH" {
+			continue
+		}
+		f.mu.Lock()
+		f.requests = append(f.requests, fields)
+		f.mu.Unlock()
+
+		id, mech := fields[1], fields[2]
+		var ir []byte
+		for _, arg := range fields[3:] {
+			if v, ok := strings.CutPrefix(arg, "resp="); ok {
+				ir, _ = base64.StdEncoding.DecodeString(v)
+			}
+		}
+
+		var username, password string
+		ok := false
+		switch mech {
+		case "PLAIN", "FINAL":
+			if ir == nil {
+				ir = cont(id, "")
+			}
+			parts := strings.Split(string(ir), "\x00")
+			if len(parts) == 3 {
+				username, password = parts[1], parts[2]
+				ok = password != "" && f.users[username] == password
+			}
+		case "LOGIN":
+			// 客户端可以在初始响应中发送用户名
+			if username = string(ir); ir == nil {
+				username = string(cont(id, "Username:"))
+			}
+			password = string(cont(id, "Password:"))
+			ok = password != "" && f.users[username] == password
+		case "CRAM-MD5":
+			challenge := "<1896.697170952@dovecot.example.com>"
+			response := strings.Fields(string(cont(id, challenge)))
+			if len(response) == 2 {
+				username = response[0]
+				mac := hmac.New(md5.New, []byte(f.users[username]))
+				mac.Write([]byte(challenge))
+				ok = f.users[username] != "" && hex.EncodeToString(mac.Sum(nil)) == response[1]
+			}
+		}
+
+		switch {
+		case username == "temp":
+			fmt.Fprintf(conn, "FAIL\t%s\ttemp\treason=backend down\n", id)
+		case !ok:
+			fmt.Fprintf(conn, "FAIL\t%s\tuser=%s\n", id, username)
+		case mech == "FINAL":
+			fmt.Fprintf(conn, "OK\t%s\tuser=%s\tresp=%s\n", id, username, base64.StdEncoding.EncodeToString([]byte("v=final")))
+		default:
+			fmt.Fprintf(conn, "OK\t%s\tuser=%s\n", id, username)
+		}
+	}
+}
+
+// lastRequest 返回最近一次 AUTH 命令的字段
+func (f *fakeDovecot) lastRequest() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.requests) == 0 {
+		return nil
+	}
+	return f.requests[len(f.requests)-1]
+}
+
+func newFakeDovecot(t *testing.T) (*fakeDovecot, *DovecotStore) {
+	t.Helper()
+	f := &fakeDovecot{users: map[string]string{"alice": "secret", "temp": "secret"}}
+	store, err := NewDovecotStore(DovecotOptions{Socket: f.start(t)})
+	if err != nil {
+		t.Fatalf("NewDovecotStore() error = %v", err)
+	}
+	return f, store
+}
+
+func TestDovecotStoreVerify(t *testing.T) {
+	_, store := newFakeDovecot(t)
+
+	if got := store.Mechanisms(); strings.Join(got, " ") != "PLAIN LOGIN CRAM-MD5 FINAL" {
+		t.Errorf("Mechanisms() = %v", got)
+	}
+
+	tests := []struct {
+		username, password string
+		want               bool
+		wantTemporary      bool
+	}{
+		{username: "alice", password: "secret", want: true},
+		{username: "alice", password: "wrong"},
+		{username: "bob", password: "secret"},
+		{username: "alice", password: ""},
+		{username: "temp", password: "secret", wantTemporary: true},
+	}
+	for _, tt := range tests {
+		got, err := store.Verify(tt.username, tt.password)
+		if got != tt.want {
+			t.Errorf("Verify(%q, %q) = %v, want %v", tt.username, tt.password, got, tt.want)
+		}
+		if errors.Is(err, ErrTemporary) != tt.wantTemporary || (err != nil && !tt.wantTemporary) {
+			t.Errorf("Verify(%q, %q) error = %v", tt.username, tt.password, err)
+		}
+	}
+}
+
+func TestDovecotStoreUnavailable(t *testing.T) {
+	store, err := NewDovecotStore(DovecotOptions{Socket: filepath.Join(t.TempDir(), "missing")})
+	if err != nil {
+		t.Fatalf("NewDovecotStore() error = %v", err)
+	}
+	if _, err := store.Verify("alice", "secret"); !errors.Is(err, ErrTemporary) {
+		t.Errorf("Verify() error = %v, want %v", err, ErrTemporary)
+	}
+}
+
+// runSASL 用客户端驱动服务端完成认证会话
+func runSASL(client sasl.Client, server sasl.Server) error {
+	_, response, err := client.Start()
+	if err != nil {
+		return err
+	}
+	for {
+		challenge, done, err := server.Next(response)
+		if err != nil || done {
+			return err
+		}
+		if response, err = client.Next(challenge); err != nil {
+			return err
+		}
+	}
+}
+
+// finalClient 以 PLAIN 格式发送凭据，并检查服务端最终数据
+type finalClient struct {
+	username, password string
+	final              string
+}
+
+func (c *finalClient) Start() (string, []byte, error) {
+	return "FINAL", []byte("\x00" + c.username + "\x00" + c.password), nil
+}
+
+func (c *finalClient) Next(challenge []byte) ([]byte, error) {
+	c.final = string(challenge)
+	return nil, nil
+}
+
+// dovecotCRAMClient CRAM-MD5 客户端
+type dovecotCRAMClient struct {
+	username, password string
+}
+
+func (c *dovecotCRAMClient) Start() (string, []byte, error) {
+	return CRAMMD5, nil, nil
+}
+
+func (c *dovecotCRAMClient) Next(challenge []byte) ([]byte, error) {
+	mac := hmac.New(md5.New, []byte(c.password))
+	mac.Write(challenge)
+	return []byte(c.username + " " + hex.EncodeToString(mac.Sum(nil))), nil
+}
+
+func TestDovecotServer(t *testing.T) {
+	f, store := newFakeDovecot(t)
+	info := ClientInfo{
+		SessionID:  "abc",
+		LocalAddr:  "192.0.2.1:587",
+		RemoteAddr: "[2001:db8::1]:40000",
+		Secured:    true,
+	}
+
+	tests := []struct {
+		name          string
+		client        sasl.Client
+		wantUser      string
+		wantOK        bool
+		wantTemporary bool
+	}{
+		{name: "plain", client: sasl.NewPlainClient("", "alice", "secret"), wantUser: "alice", wantOK: true},
+		{name: "plain wrong password", client: sasl.NewPlainClient("", "alice", "wrong"), wantUser: "alice"},
+		{name: "login", client: sasl.NewLoginClient("alice", "secret"), wantUser: "alice", wantOK: true},
+		{name: "cram-md5", client: &dovecotCRAMClient{"alice", "secret"}, wantUser: "alice", wantOK: true},
+		{name: "cram-md5 wrong password", client: &dovecotCRAMClient{"alice", "wrong"}, wantUser: "alice"},
+		{name: "final data", client: &finalClient{username: "alice", password: "secret"}, wantUser: "alice", wantOK: true},
+		{name: "temporary failure", client: sasl.NewPlainClient("", "temp", "secret"), wantTemporary: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotUser string
+			var gotOK, called bool
+			mech, _, _ := tt.client.Start()
+			server := store.NewServer(mech, info, func(username string, ok bool) error {
+				gotUser, gotOK, called = username, ok, true
+				if !ok {
+					return errors.New("auth failed")
+				}
+				return nil
+			})
+
+			err := runSASL(tt.client, server)
+			if tt.wantTemporary {
+				if !errors.Is(err, ErrTemporary) || called {
+					t.Errorf("Expected temporary failure, got %v (done called: %v)", err, called)
+				}
+				return
+			}
+			if !called || gotUser != tt.wantUser || gotOK != tt.wantOK {
+				t.Errorf("done(%q, %v) called: %v; want done(%q, %v)", gotUser, gotOK, called, tt.wantUser, tt.wantOK)
+			}
+			if (err == nil) != tt.wantOK {
+				t.Errorf("Authentication error = %v", err)
+			}
+			if c, ok := tt.client.(*finalClient); ok && c.final != "v=final" {
+				t.Errorf("Final data = %q, want %q", c.final, "v=final")
+			}
+		})
+	}
+
+	request := strings.Join(f.lastRequest(), " ")
+	for _, want := range []string{"service=smtp", "session=abc", "lip=192.0.2.1", "lport=587", "rip=2001:db8::1", "rport=40000", "secured"} {
+		if !strings.Contains(request, want) {
+			t.Errorf("AUTH request %q missing %q", request, want)
+		}
+	}
+}
+
+func TestDovecotEscape(t *testing.T) {
+	for _, s := range []string{"plain", "tab\there", "line\nbreak\r", "\x01one", "nul\x00"} {
+		escaped := dovecotEscape(s)
+		if strings.ContainsAny(escaped, "\t\n\r\x00") {
+			t.Errorf("dovecotEscape(%q) = %q contains special characters", s, escaped)
+		}
+		if got := dovecotUnescape(escaped); got != s {
+			t.Errorf("dovecotUnescape(dovecotEscape(%q)) = %q", s, got)
+		}
+	}
+}
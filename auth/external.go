@@ -0,0 +1,204 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/catroll/smtpd/internal/textfile"
+	"github.com/emersion/go-sasl"
+)
+
+// External EXTERNAL 机制名称（RFC 4422 附录 A）
+const External = sasl.External
+
+// 证书映射规则的类型，按优先级从高到低排列
+const (
+	CertMatchFingerprint = "fingerprint" // 证书 DER 编码的 SHA-256 指纹
+	CertMatchSubject     = "subject"     // RFC 2253 格式的主题，如 CN=reports,O=Example
+	CertMatchSAN         = "san"         // 主题备用名称：DNS 名称、邮箱、URI 或 IP
+)
+
+// certRules 某一类型的映射规则，键为规范化后的值
+type certRules map[string]string
+
+// CertMap 将 TLS 客户端证书映射为用户名
+//
+// 映射文件每行一条规则："类型:值 用户名"，# 开头的行为注释，例如
+//
+//	fingerprint:9f86d081884c7d65...  svc-backup
+//	subject:CN=reports,O=Example     svc-reports
+//	san:reports.internal.example.com svc-reports
+type CertMap struct {
+	mu       sync.RWMutex
+	rules    map[string]certRules
+	filename string
+}
+
+// NewCertMap 加载证书映射文件
+func NewCertMap(filename string) (*CertMap, error) {
+	m := &CertMap{filename: filename}
+	if err := m.Reload(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Reload 重新加载映射文件，失败时保留原有规则
+func (m *CertMap) Reload() error {
+	data, err := os.ReadFile(m.filename)
+	if err != nil {
+		slog.Error("读取证书映射文件失败",
+			"file", m.filename,
+			"error", err,
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+		return err
+	}
+
+	rules := map[string]certRules{
+		CertMatchFingerprint: {},
+		CertMatchSubject:     {},
+		CertMatchSAN:         {},
+	}
+	count := 0
+	err = textfile.ScanLines(data, func(lineno int, line string) error {
+		i := strings.LastIndexAny(line, " \t")
+		if i < 0 {
+			return fmt.Errorf("line %d: expected type:value username", lineno)
+		}
+		selector, username := strings.TrimSpace(line[:i]), line[i+1:]
+		kind, value, ok := strings.Cut(selector, ":")
+		if !ok || value == "" {
+			return fmt.Errorf("line %d: expected type:value username", lineno)
+		}
+		r, ok := rules[kind]
+		if !ok {
+			return fmt.Errorf("line %d: unknown match type %q", lineno, kind)
+		}
+		r[normalizeCertValue(kind, value)] = username
+		count++
+		return nil
+	})
+	if err != nil {
+		slog.Error("解析证书映射文件失败",
+			"file", m.filename,
+			"error", err,
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+		return err
+	}
+
+	m.mu.Lock()
+	m.rules = rules
+	m.mu.Unlock()
+
+	slog.Info("加载证书映射成功",
+		"file", m.filename,
+		"count", count,
+		"timestamp", time.Now().Format(time.RFC3339Nano),
+	)
+	return nil
+}
+
+// normalizeCertValue 规范化规则或证书中的值：指纹去掉冒号并转为小写，SAN 不区分大小写
+func normalizeCertValue(kind, value string) string {
+	switch kind {
+	case CertMatchFingerprint:
+		return strings.ToLower(strings.ReplaceAll(value, ":", ""))
+	case CertMatchSAN:
+		return strings.ToLower(value)
+	default:
+		return value
+	}
+}
+
+// CertFingerprint 返回证书的 SHA-256 指纹（小写十六进制）
+func CertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// Lookup 查找证书对应的用户名，同时返回命中的规则类型
+func (m *CertMap) Lookup(cert *x509.Certificate) (username, matchedBy string, ok bool) {
+	m.mu.RLock()
+	rules := m.rules
+	m.mu.RUnlock()
+
+	if username, ok := rules[CertMatchFingerprint][CertFingerprint(cert)]; ok {
+		return username, CertMatchFingerprint, true
+	}
+	if username, ok := rules[CertMatchSubject][cert.Subject.String()]; ok {
+		return username, CertMatchSubject, true
+	}
+
+	var sans []string
+	sans = append(sans, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		sans = append(sans, u.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, san := range sans {
+		if username, ok := rules[CertMatchSAN][normalizeCertValue(CertMatchSAN, san)]; ok {
+			return username, CertMatchSAN, true
+		}
+	}
+	return "", "", false
+}
+
+// externalServer EXTERNAL 服务端
+type externalServer struct {
+	m    *CertMap
+	cert *x509.Certificate
+	done func(username string, ok bool) error
+}
+
+// NewExternalServer 创建基于 TLS 客户端证书的 EXTERNAL 服务端，cert 必须是已验证的证书；
+// 认证结束后以用户名和结果调用 done，其返回值作为认证结果返回给客户端
+func (m *CertMap) NewExternalServer(cert *x509.Certificate, done func(username string, ok bool) error) sasl.Server {
+	return &externalServer{m: m, cert: cert, done: done}
+}
+
+func (s *externalServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	if response == nil {
+		// 客户端未发送初始响应，授权身份在下一次响应中发送
+		return []byte{}, false, nil
+	}
+	authzid := string(response)
+
+	username, matchedBy, ok := s.m.Lookup(s.cert)
+	if !ok {
+		slog.Warn("客户端证书没有对应的用户",
+			"subject", s.cert.Subject.String(),
+			"fingerprint", CertFingerprint(s.cert),
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+		return nil, true, s.done(authzid, false)
+	}
+	// 授权身份为空或与证书对应的用户相同时才允许
+	if authzid != "" && authzid != username {
+		slog.Warn("授权身份与证书对应的用户不一致",
+			"username", username,
+			"identity", authzid,
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+		return nil, true, s.done(username, false)
+	}
+
+	slog.Debug("客户端证书匹配",
+		"username", username,
+		"matched_by", matchedBy,
+		"subject", s.cert.Subject.String(),
+		"timestamp", time.Now().Format(time.RFC3339Nano),
+	)
+	return nil, true, s.done(username, true)
+}
@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCertMapLookup(t *testing.T) {
+	cert := &x509.Certificate{
+		Raw:            []byte("certificate"),
+		Subject:        pkix.Name{CommonName: "reports", Organization: []string{"Example"}},
+		DNSNames:       []string{"Reports.Internal.Example.com"},
+		EmailAddresses: []string{"reports@example.com"},
+	}
+	fingerprint := CertFingerprint(cert)
+	colons := strings.ToUpper(fingerprint[:2] + ":" + fingerprint[2:4] + ":" + fingerprint[4:])
+
+	tests := []struct {
+		name      string
+		mapping   string
+		want      string
+		matchedBy string
+		ok        bool
+	}{
+		{
+			name:      "fingerprint takes precedence",
+			mapping:   "subject:CN=reports,O=Example svc-subject\nfingerprint:" + colons + " svc-fingerprint\n",
+			want:      "svc-fingerprint",
+			matchedBy: CertMatchFingerprint,
+			ok:        true,
+		},
+		{
+			name:      "subject",
+			mapping:   "san:reports@example.com svc-san\nsubject:CN=reports,O=Example svc-subject\n",
+			want:      "svc-subject",
+			matchedBy: CertMatchSubject,
+			ok:        true,
+		},
+		{
+			name:      "DNS SAN is case insensitive",
+			mapping:   "san:reports.internal.example.com svc-san\n",
+			want:      "svc-san",
+			matchedBy: CertMatchSAN,
+			ok:        true,
+		},
+		{
+			name:    "no match",
+			mapping: "subject:CN=other svc-other\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "client-certs")
+			if err := os.WriteFile(filename, []byte(tt.mapping), 0600); err != nil {
+				t.Fatalf("Failed to write file: %v", err)
+			}
+			m, err := NewCertMap(filename)
+			if err != nil {
+				t.Fatalf("NewCertMap() error = %v", err)
+			}
+
+			got, matchedBy, ok := m.Lookup(cert)
+			if got != tt.want || matchedBy != tt.matchedBy || ok != tt.ok {
+				t.Errorf("Lookup() = %q, %q, %v; want %q, %q, %v", got, matchedBy, ok, tt.want, tt.matchedBy, tt.ok)
+			}
+		})
+	}
+}
+
+func TestCertMapRejectsUnknownType(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "client-certs")
+	if err := os.WriteFile(filename, []byte("issuer:CN=Test CA svc\n"), 0600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if _, err := NewCertMap(filename); err == nil {
+		t.Errorf("NewCertMap() error = nil, want error for unknown match type")
+	}
+}
@@ -0,0 +1,498 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/catroll/smtpd/internal/textfile"
+	"github.com/catroll/smtpd/statefile"
+)
+
+// Options 文件凭据存储的选项
+type Options struct {
+	// PasswordScheme 登录成功后，弱于该方案的已存储密码会被自动重新哈希；
+	// 为空时不做升级
+	PasswordScheme Scheme
+	// AllowPlaintext 是否接受明文存储的密码，仅用于兼容旧的认证文件
+	AllowPlaintext bool
+}
+
+// fileFormat 描述一种凭据文件格式
+type fileFormat struct {
+	name  string
+	parse func(data []byte) (map[string]*Account, error)
+	// encode 将账户写回文件内容，为 nil 时不支持写回（如哈希升级）
+	encode func(accounts map[string]*Account) ([]byte, error)
+	// lineBased 每行一个账户，解析时去掉行首尾的空白并跳过 # 开头的行
+	lineBased bool
+}
+
+// checkUsername 检查用户名能否原样写入该格式的文件并被读回
+func (f fileFormat) checkUsername(username string) error {
+	if username == "" {
+		return fmt.Errorf("username is required")
+	}
+	if strings.ContainsAny(username, ":\r\n\x00") {
+		return fmt.Errorf("username must not contain ':', CR, LF or NUL")
+	}
+	if f.lineBased && (strings.IndexFunc(username, unicode.IsSpace) >= 0 || strings.HasPrefix(username, "#")) {
+		return fmt.Errorf("username must not contain whitespace or start with '#' in %s files", f.name)
+	}
+	return nil
+}
+
+// FileStore 基于本地文件的凭据存储，支持 JSON、htpasswd 和 Dovecot passwd-file 格式
+type FileStore struct {
+	mu       sync.RWMutex
+	accounts map[string]*Account
+	filename string
+	format   fileFormat
+	opts     Options
+
+	// 最近一次加载时文件的修改时间和大小，用于轮询检测变更
+	modTime time.Time
+	size    int64
+}
+
+// NewJSONStore 加载 JSON 格式（用户名到密码哈希的对象）的认证文件
+func NewJSONStore(filename string, opts Options) (*FileStore, error) {
+	return newFileStore(filename, jsonFormat, opts)
+}
+
+// NewHtpasswdStore 加载 Apache htpasswd 格式的认证文件
+func NewHtpasswdStore(filename string, opts Options) (*FileStore, error) {
+	return newFileStore(filename, htpasswdFormat, opts)
+}
+
+// NewPasswdFileStore 加载 Dovecot passwd-file 格式的认证文件
+func NewPasswdFileStore(filename string, opts Options) (*FileStore, error) {
+	return newFileStore(filename, passwdFileFormat, opts)
+}
+
+func newFileStore(filename string, format fileFormat, opts Options) (*FileStore, error) {
+	s := &FileStore{
+		accounts: make(map[string]*Account),
+		filename: filename,
+		format:   format,
+		opts:     opts,
+	}
+	if err := s.load(false); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load 从文件加载认证信息，解析成功后才替换内存中的凭据，失败时保留原有凭据
+func (s *FileStore) load(reload bool) error {
+	accounts, fi, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	plaintext := 0
+	for username, account := range accounts {
+		if account.Password == "" {
+			continue
+		}
+		switch Identify(account.Password) {
+		case SchemePlain:
+			plaintext++
+		case SchemeUnknown:
+			slog.Warn("无法识别的密码格式",
+				"file", s.filename,
+				"username", username,
+				"timestamp", time.Now().Format(time.RFC3339Nano),
+			)
+		}
+	}
+	if plaintext > 0 && !s.opts.AllowPlaintext {
+		slog.Warn("认证文件中存在明文密码，这些账户将无法登录",
+			"file", s.filename,
+			"count", plaintext,
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+	}
+
+	s.mu.Lock()
+	old := s.accounts
+	s.accounts = accounts
+	s.modTime, s.size = fi.ModTime(), fi.Size()
+	s.mu.Unlock()
+
+	if reload {
+		added, removed, changed := diffAccounts(old, accounts)
+		slog.Info("重新加载认证信息成功",
+			"file", s.filename,
+			"format", s.format.name,
+			"count", len(accounts),
+			"added", added,
+			"removed", removed,
+			"changed", changed,
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+		return nil
+	}
+
+	slog.Info("加载认证信息成功",
+		"file", s.filename,
+		"format", s.format.name,
+		"count", len(accounts),
+		"plaintext", plaintext,
+		"timestamp", time.Now().Format(time.RFC3339Nano),
+	)
+	return nil
+}
+
+// read 读取并解析认证文件，返回账户和读取前的文件状态
+func (s *FileStore) read() (map[string]*Account, os.FileInfo, error) {
+	// 先记录文件状态再读取，读取期间发生的修改会在下一次轮询时被发现
+	fi, err := os.Stat(s.filename)
+	if err != nil {
+		slog.Error("读取认证文件失败",
+			"error", err,
+			"file", s.filename,
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+		return nil, nil, err
+	}
+	data, err := os.ReadFile(s.filename)
+	if err != nil {
+		slog.Error("读取认证文件失败",
+			"error", err,
+			"file", s.filename,
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+		return nil, nil, err
+	}
+
+	accounts, err := s.format.parse(data)
+	if err != nil {
+		slog.Error("解析认证文件失败",
+			"error", err,
+			"file", s.filename,
+			"format", s.format.name,
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+		return nil, nil, err
+	}
+	for username, account := range accounts {
+		// 账户记录加载后不再修改，用户名随记录保存便于调用方使用
+		account.Username = username
+	}
+	return accounts, fi, nil
+}
+
+// reloadIfChangedLocked 写回文件之前检查文件在上次加载之后是否被修改（如 smtpd user 或手工编辑），
+// 是则先重新加载，避免写回内存中的旧数据覆盖这些修改；调用方需持有写锁
+func (s *FileStore) reloadIfChangedLocked() error {
+	fi, err := os.Stat(s.filename)
+	if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(s.modTime) && fi.Size() == s.size {
+		return nil
+	}
+	accounts, fi, err := s.read()
+	if err != nil {
+		return err
+	}
+	s.accounts = accounts
+	s.modTime, s.size = fi.ModTime(), fi.Size()
+
+	slog.Info("认证文件已被修改，写回前重新加载",
+		"file", s.filename,
+		"count", len(accounts),
+		"timestamp", time.Now().Format(time.RFC3339Nano),
+	)
+	return nil
+}
+
+// Lookup 查询用户是否存在
+func (s *FileStore) Lookup(username string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, exists := s.accounts[username]
+	return exists, nil
+}
+
+// List 返回所有用户名
+func (s *FileStore) List() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names := make([]string, 0, len(s.accounts))
+	for username := range s.accounts {
+		names = append(names, username)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Account 返回用户的账户记录，调用方不应修改返回的记录
+func (s *FileStore) Account(username string) (*Account, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	account, exists := s.accounts[username]
+	return account, exists, nil
+}
+
+// Secret 返回用户已存储的密码哈希或密钥；未允许明文密码时，明文条目视为不存在
+func (s *FileStore) Secret(username string) (string, bool, error) {
+	s.mu.RLock()
+	account, exists := s.accounts[username]
+	s.mu.RUnlock()
+	if !exists || account.Password == "" {
+		return "", false, nil
+	}
+
+	if Identify(account.Password) == SchemePlain && !s.opts.AllowPlaintext {
+		slog.Warn("拒绝明文存储的密码",
+			"username", username,
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+		return "", false, nil
+	}
+	return account.Password, true, nil
+}
+
+// Schemes 返回账户密码所用的方案；未允许明文密码时不包括明文
+func (s *FileStore) Schemes() []Scheme {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var schemes []Scheme
+	for _, account := range s.accounts {
+		if account.Password == "" {
+			continue
+		}
+		scheme := Identify(account.Password)
+		if scheme == SchemePlain && !s.opts.AllowPlaintext || slices.Contains(schemes, scheme) {
+			continue
+		}
+		schemes = append(schemes, scheme)
+	}
+	return schemes
+}
+
+// Verify 校验用户名和密码
+func (s *FileStore) Verify(username, password string) (bool, error) {
+	s.mu.RLock()
+	account, exists := s.accounts[username]
+	s.mu.RUnlock()
+
+	// 只有应用专用密码的账户没有账户密码
+	if !exists || account.Password == "" {
+		Verify(dummyHash, password)
+		slog.Debug("用户不存在",
+			"username", username,
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+		return false, nil
+	}
+
+	stored := account.Password
+	scheme := Identify(stored)
+	if scheme == SchemePlain && !s.opts.AllowPlaintext {
+		slog.Warn("拒绝明文存储的密码",
+			"username", username,
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+		return false, nil
+	}
+
+	ok, err := Verify(stored, password)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	// CRAM-MD5 和 SCRAM 密钥是为质询-响应机制准备的，不做升级以免这些机制失效
+	if s.format.encode != nil && !scheme.challengeResponse() && s.opts.PasswordScheme.Stronger(scheme) {
+		s.rehash(username, stored, password)
+	}
+	return true, nil
+}
+
+// rehash 使用配置的方案重新哈希密码并写回认证文件
+func (s *FileStore) rehash(username, oldStored, password string) {
+	newStored, err := Hash(s.opts.PasswordScheme, password)
+	if err != nil {
+		slog.Error("重新哈希密码失败",
+			"username", username,
+			"scheme", s.opts.PasswordScheme,
+			"error", err,
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 认证文件或内存中的认证信息可能已被修改，此时放弃本次升级
+	if err := s.reloadIfChangedLocked(); err != nil {
+		slog.Error("重新加载认证文件失败，放弃升级密码哈希",
+			"file", s.filename,
+			"username", username,
+			"error", err,
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+		return
+	}
+	account, ok := s.accounts[username]
+	if !ok || account.Password != oldStored {
+		return
+	}
+	// 记录可能正被其他会话读取，替换为副本而不是原地修改
+	upgraded := *account
+	upgraded.Password = newStored
+	s.accounts[username] = &upgraded
+
+	if err := s.saveLocked(); err != nil {
+		slog.Error("保存认证文件失败",
+			"file", s.filename,
+			"error", err,
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+		return
+	}
+
+	slog.Info("密码哈希已升级",
+		"username", username,
+		"from", Identify(oldStored),
+		"to", s.opts.PasswordScheme,
+		"timestamp", time.Now().Format(time.RFC3339Nano),
+	)
+}
+
+// saveLocked 原子地将认证信息写回文件，调用方需持有写锁
+func (s *FileStore) saveLocked() error {
+	data, err := s.format.encode(s.accounts)
+	if err != nil {
+		return err
+	}
+	if err := statefile.WriteAtomic(s.filename, data); err != nil {
+		return err
+	}
+
+	// 记录新的文件状态，避免轮询时把自己的写入当作外部修改
+	if fi, err := os.Stat(s.filename); err == nil {
+		s.modTime, s.size = fi.ModTime(), fi.Size()
+	}
+	return nil
+}
+
+// jsonFormat {"username": "password-hash"} 格式，值也可以是带属性的账户对象：
+// {"username": {"password": "...", "enabled": true, "expires": "2025-12-31", ...}}
+var jsonFormat = fileFormat{
+	name: "json",
+	parse: func(data []byte) (map[string]*Account, error) {
+		accounts := make(map[string]*Account)
+		if err := json.Unmarshal(data, &accounts); err != nil {
+			return nil, err
+		}
+		for username, account := range accounts {
+			if account == nil {
+				return nil, fmt.Errorf("account %q: missing password", username)
+			}
+		}
+		return accounts, nil
+	},
+	encode: func(accounts map[string]*Account) ([]byte, error) {
+		data, err := json.MarshalIndent(accounts, "", "    ")
+		if err != nil {
+			return nil, err
+		}
+		return append(data, '\n'), nil
+	},
+}
+
+// htpasswdFormat 每行 "username:password-hash"，# 开头的行为注释
+var htpasswdFormat = fileFormat{
+	name:      "htpasswd",
+	lineBased: true,
+	parse: func(data []byte) (map[string]*Account, error) {
+		accounts := make(map[string]*Account)
+		err := textfile.ScanLines(data, func(lineno int, line string) error {
+			username, stored, ok := strings.Cut(line, ":")
+			if !ok || username == "" {
+				return fmt.Errorf("line %d: expected username:password", lineno)
+			}
+			accounts[username] = &Account{Password: stored}
+			return nil
+		})
+		return accounts, err
+	},
+	encode: func(accounts map[string]*Account) ([]byte, error) {
+		names := make([]string, 0, len(accounts))
+		for username := range accounts {
+			names = append(names, username)
+		}
+		sort.Strings(names)
+
+		var buf bytes.Buffer
+		for _, username := range names {
+			fmt.Fprintf(&buf, "%s:%s\n", username, accounts[username].Password)
+		}
+		return buf.Bytes(), nil
+	},
+}
+
+// passwdFileFormat Dovecot passwd-file 格式：
+// "user:{SCHEME}password:uid:gid:gecos:home:shell:extra_fields"，
+// 只使用前两个字段。由于写回会丢失其余字段，该格式不支持哈希升级。
+var passwdFileFormat = fileFormat{
+	name:      "passwd-file",
+	lineBased: true,
+	parse: func(data []byte) (map[string]*Account, error) {
+		accounts := make(map[string]*Account)
+		err := textfile.ScanLines(data, func(lineno int, line string) error {
+			fields := strings.SplitN(line, ":", 3)
+			if len(fields) < 2 || fields[0] == "" {
+				return fmt.Errorf("line %d: expected user:password", lineno)
+			}
+			accounts[fields[0]] = &Account{Password: fromDovecotScheme(fields[1])}
+			return nil
+		})
+		return accounts, err
+	},
+}
+
+// fromDovecotScheme 将 Dovecot 的 {SCHEME} 前缀转换为 Identify 能识别的格式
+func fromDovecotScheme(stored string) string {
+	if !strings.HasPrefix(stored, "{") {
+		// 没有前缀时 Dovecot 默认使用 CRYPT
+		return stored
+	}
+	end := strings.IndexByte(stored, '}')
+	if end < 0 {
+		return stored
+	}
+
+	switch value := stored[end+1:]; strings.ToUpper(stored[1:end]) {
+	case "PLAIN", "CLEARTEXT":
+		return plainPrefix + value
+	case "CRYPT", "MD5-CRYPT", "SHA512-CRYPT", "BLF-CRYPT", "ARGON2ID":
+		return value
+	case "SHA", "SHA1":
+		return "{SHA}" + value
+	case "SSHA":
+		return "{SSHA}" + value
+	case "CRAM-MD5":
+		return cramMD5Prefix + value
+	case "SCRAM-SHA-256":
+		return scramPrefix + value
+	default:
+		return stored
+	}
+}
@@ -0,0 +1,148 @@
+package auth
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestFileStoreFormats(t *testing.T) {
+	tests := []struct {
+		name    string
+		open    func(string, Options) (*FileStore, error)
+		content string
+	}{
+		{
+			name:    "json",
+			open:    NewJSONStore,
+			content: `{"user1": "$apr1$r31abcde$ouL8QL9v/FwrkrtBccxbL.", "admin": "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g="}`,
+		},
+		{
+			name: "htpasswd",
+			open: NewHtpasswdStore,
+			content: "# comment\n" +
+				"user1:$apr1$r31abcde$ouL8QL9v/FwrkrtBccxbL.\n" +
+				"admin:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n",
+		},
+		{
+			name: "passwd-file",
+			open: NewPasswdFileStore,
+			content: "user1:{MD5-CRYPT}$apr1$r31abcde$ouL8QL9v/FwrkrtBccxbL.:1000:1000::/home/user1::\n" +
+				"admin:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=::::::userdb_quota_rule=*:storage=1G\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "users")
+			if err := os.WriteFile(filename, []byte(tt.content), 0600); err != nil {
+				t.Fatalf("Failed to write file: %v", err)
+			}
+
+			store, err := tt.open(filename, Options{})
+			if err != nil {
+				t.Fatalf("open error = %v", err)
+			}
+
+			for _, username := range []string{"user1", "admin"} {
+				if ok, err := store.Verify(username, "password"); err != nil || !ok {
+					t.Errorf("Verify(%q) = %v, %v; want true", username, ok, err)
+				}
+				if ok, _ := store.Verify(username, "wrong"); ok {
+					t.Errorf("Verify(%q, wrong) = true; want false", username)
+				}
+			}
+
+			if ok, _ := store.Lookup("nobody"); ok {
+				t.Errorf("Lookup(nobody) = true; want false")
+			}
+			names, _ := store.List()
+			if !slices.Equal(names, []string{"admin", "user1"}) {
+				t.Errorf("List() = %v, want [admin user1]", names)
+			}
+		})
+	}
+}
+
+func TestAuthenticateRehash(t *testing.T) {
+	authFile := filepath.Join(t.TempDir(), "auth.txt")
+	if err := os.WriteFile(authFile, []byte(`{"user1": "{PLAIN}password123"}`), 0640); err != nil {
+		t.Fatalf("Failed to write auth file: %v", err)
+	}
+
+	store, err := NewJSONStore(authFile, Options{PasswordScheme: SchemeBcrypt, AllowPlaintext: true})
+	if err != nil {
+		t.Fatalf("NewJSONStore() error = %v", err)
+	}
+	a := New(store)
+	if account, _, _ := a.Authenticate("user1", "password123"); account == nil {
+		t.Fatalf("Authenticate() = nil, want account")
+	}
+
+	data, err := os.ReadFile(authFile)
+	if err != nil {
+		t.Fatalf("Failed to read auth file: %v", err)
+	}
+	var credentials map[string]string
+	if err := json.Unmarshal(data, &credentials); err != nil {
+		t.Fatalf("Failed to parse auth file: %v", err)
+	}
+	if got := Identify(credentials["user1"]); got != SchemeBcrypt {
+		t.Errorf("Stored scheme = %q, want %q", got, SchemeBcrypt)
+	}
+	if fi, err := os.Stat(authFile); err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("Auth file mode not preserved: %v, %v", fi.Mode(), err)
+	}
+
+	if account, _, _ := a.Authenticate("user1", "password123"); account == nil {
+		t.Errorf("Authenticate() after rehash = nil, want account")
+	}
+}
+
+func TestAuthenticateRejectsPlaintextByDefault(t *testing.T) {
+	authFile := filepath.Join(t.TempDir(), "auth.txt")
+	if err := os.WriteFile(authFile, []byte(`{"user1": "password123"}`), 0600); err != nil {
+		t.Fatalf("Failed to write auth file: %v", err)
+	}
+
+	store, err := NewJSONStore(authFile, Options{})
+	if err != nil {
+		t.Fatalf("NewJSONStore() error = %v", err)
+	}
+	a := New(store)
+	if account, _, _ := a.Authenticate("user1", "password123"); account != nil {
+		t.Errorf("Authenticate() returned an account for plaintext entry")
+	}
+}
+
+func TestRehashKeepsExternalChanges(t *testing.T) {
+	authFile := filepath.Join(t.TempDir(), "auth.txt")
+	if err := os.WriteFile(authFile, []byte(`{"user1": "{PLAIN}password123", "user2": "{PLAIN}secret"}`), 0600); err != nil {
+		t.Fatalf("Failed to write auth file: %v", err)
+	}
+	store, err := NewJSONStore(authFile, Options{PasswordScheme: SchemeBcrypt, AllowPlaintext: true})
+	if err != nil {
+		t.Fatalf("NewJSONStore() error = %v", err)
+	}
+
+	// 服务器还没有重新加载时，smtpd user 删除了 user2 并修改了 user1 的密码
+	if err := os.WriteFile(authFile, []byte(`{"user1": "{PLAIN}changed"}`), 0600); err != nil {
+		t.Fatalf("Failed to write auth file: %v", err)
+	}
+	if ok, err := store.Verify("user1", "password123"); err != nil || !ok {
+		t.Fatalf("Verify() = %v, %v; want true from the loaded credentials", ok, err)
+	}
+
+	data, err := os.ReadFile(authFile)
+	if err != nil {
+		t.Fatalf("Failed to read auth file: %v", err)
+	}
+	if string(data) != `{"user1": "{PLAIN}changed"}` {
+		t.Errorf("Rehash overwrote external changes: %s", data)
+	}
+	if ok, _ := store.Lookup("user2"); ok {
+		t.Errorf("Lookup(user2) = true after external deletion")
+	}
+}
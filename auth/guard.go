@@ -0,0 +1,212 @@
+package auth
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/catroll/smtpd/statefile"
+)
+
+// GuardOptions 暴力破解防护的阈值
+type GuardOptions struct {
+	// Window 统计失败次数的滑动窗口
+	Window time.Duration
+	// MaxIPFailures 窗口内同一 IP 允许的失败次数，达到后锁定该 IP，0 表示不限制
+	MaxIPFailures int
+	// MaxUserFailures 窗口内同一用户名允许的失败次数，达到后锁定该用户名，0 表示不限制
+	MaxUserFailures int
+	// Lockout 锁定时长
+	Lockout time.Duration
+	// BaseDelay 第一次失败后回复前的延迟，之后每失败一次翻倍，0 表示不延迟
+	BaseDelay time.Duration
+	// MaxDelay 延迟的上限
+	MaxDelay time.Duration
+	// StateFile 保存失败计数和锁定状态的文件，为空时不持久化
+	StateFile string
+}
+
+// failureRecord 某个 IP 或用户名的失败记录
+type failureRecord struct {
+	Failures    []time.Time `json:"failures,omitempty"`
+	LockedUntil time.Time   `json:"locked_until,omitzero"`
+}
+
+// guardState 持久化的状态
+type guardState struct {
+	IPs   map[string]*failureRecord `json:"ips"`
+	Users map[string]*failureRecord `json:"users"`
+}
+
+// Guard 按 IP 和用户名统计认证失败次数，提供指数退避延迟和临时锁定
+type Guard struct {
+	mu    sync.Mutex
+	opts  GuardOptions
+	state guardState
+	file  statefile.File
+
+	// now 当前时间，测试时可替换
+	now func() time.Time
+}
+
+// NewGuard 创建暴力破解防护，配置了状态文件时从中恢复之前的计数
+func NewGuard(opts GuardOptions) (*Guard, error) {
+	g := &Guard{
+		opts: opts,
+		state: guardState{
+			IPs:   make(map[string]*failureRecord),
+			Users: make(map[string]*failureRecord),
+		},
+		file: statefile.New(opts.StateFile),
+		now:  time.Now,
+	}
+	loaded, err := g.file.Load(&g.state)
+	if err != nil {
+		return nil, err
+	}
+	if !loaded {
+		return g, nil
+	}
+	if g.state.IPs == nil {
+		g.state.IPs = make(map[string]*failureRecord)
+	}
+	if g.state.Users == nil {
+		g.state.Users = make(map[string]*failureRecord)
+	}
+	g.prune(g.now())
+
+	slog.Info("加载认证失败记录成功",
+		"file", opts.StateFile,
+		"ips", len(g.state.IPs),
+		"users", len(g.state.Users),
+		"timestamp", time.Now().Format(time.RFC3339Nano),
+	)
+	return g, nil
+}
+
+// IPLocked 返回 IP 是否处于锁定状态及解锁时间
+func (g *Guard) IPLocked(ip string) (time.Time, bool) {
+	return g.locked(g.state.IPs, ip)
+}
+
+// UserLocked 返回用户名是否处于锁定状态及解锁时间
+func (g *Guard) UserLocked(username string) (time.Time, bool) {
+	return g.locked(g.state.Users, username)
+}
+
+func (g *Guard) locked(records map[string]*failureRecord, key string) (time.Time, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	r, ok := records[key]
+	if !ok || !g.now().Before(r.LockedUntil) {
+		return time.Time{}, false
+	}
+	return r.LockedUntil, true
+}
+
+// Fail 记录一次认证失败，返回回复客户端前应等待的时间；
+// 窗口内的失败次数达到阈值时锁定对应的 IP 或用户名
+func (g *Guard) Fail(ip, username string) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	ipFailures := g.record(g.state.IPs, "ip", ip, g.opts.MaxIPFailures, now)
+	userFailures := 0
+	if username != "" {
+		userFailures = g.record(g.state.Users, "username", username, g.opts.MaxUserFailures, now)
+	}
+	g.file.Changed()
+
+	return g.delay(max(ipFailures, userFailures))
+}
+
+// record 记录一次失败并返回窗口内的失败次数，达到 limit 时锁定；kind 用于日志
+func (g *Guard) record(records map[string]*failureRecord, kind, key string, limit int, now time.Time) int {
+	r, ok := records[key]
+	if !ok {
+		r = &failureRecord{}
+		records[key] = r
+	}
+	r.Failures = append(pruneFailures(r.Failures, now.Add(-g.opts.Window)), now)
+
+	if limit > 0 && len(r.Failures) >= limit && !now.Before(r.LockedUntil) {
+		r.LockedUntil = now.Add(g.opts.Lockout)
+		// 锁定后重新计数，避免解锁后第一次失败就再次锁定
+		r.Failures = nil
+		slog.Warn("认证失败次数过多，临时锁定",
+			kind, key,
+			"locked_until", r.LockedUntil.Format(time.RFC3339),
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+		return limit
+	}
+	return len(r.Failures)
+}
+
+// delay 计算第 n 次失败后的退避延迟
+func (g *Guard) delay(n int) time.Duration {
+	if g.opts.BaseDelay <= 0 || n <= 0 {
+		return 0
+	}
+	d := g.opts.BaseDelay
+	for i := 1; i < n; i++ {
+		d *= 2
+		if g.opts.MaxDelay > 0 && d >= g.opts.MaxDelay {
+			return g.opts.MaxDelay
+		}
+	}
+	if g.opts.MaxDelay > 0 && d > g.opts.MaxDelay {
+		return g.opts.MaxDelay
+	}
+	return d
+}
+
+// Succeed 认证成功后清除该用户名的失败记录；IP 的记录仍按窗口过期，
+// 以免攻击者用一个已知的账户掩护对其他账户的猜测
+func (g *Guard) Succeed(username string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if r, ok := g.state.Users[username]; ok && len(r.Failures) > 0 {
+		r.Failures = nil
+		g.file.Changed()
+	}
+}
+
+// prune 删除已过期的失败记录，调用方需持有锁
+func (g *Guard) prune(now time.Time) {
+	since := now.Add(-g.opts.Window)
+	for _, records := range []map[string]*failureRecord{g.state.IPs, g.state.Users} {
+		for key, r := range records {
+			r.Failures = pruneFailures(r.Failures, since)
+			if len(r.Failures) == 0 && !now.Before(r.LockedUntil) {
+				delete(records, key)
+			}
+		}
+	}
+}
+
+// pruneFailures 去掉 since 之前的失败时间，failures 按时间递增
+func pruneFailures(failures []time.Time, since time.Time) []time.Time {
+	i := 0
+	for i < len(failures) && !failures[i].After(since) {
+		i++
+	}
+	return failures[i:]
+}
+
+// Save 清理过期记录，并在有变化时写入状态文件
+func (g *Guard) Save() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.prune(g.now())
+	return g.file.Save(g.state)
+}
+
+// Persist 按 interval 清理过期记录并保存状态，直到 stop 被关闭，退出前再保存一次
+func (g *Guard) Persist(interval time.Duration, stop <-chan struct{}) {
+	statefile.Persist(g, interval, stop)
+}
@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/catroll/smtpd/internal/testclock"
+)
+
+// newTestGuard 返回使用可控时钟的暴力破解防护
+func newTestGuard(t *testing.T, opts GuardOptions) (*Guard, *testclock.Clock) {
+	t.Helper()
+	g, err := NewGuard(opts)
+	if err != nil {
+		t.Fatalf("NewGuard() error = %v", err)
+	}
+	clock := testclock.New()
+	g.now = clock.Now
+	return g, clock
+}
+
+func TestGuardLockout(t *testing.T) {
+	g, clock := newTestGuard(t, GuardOptions{
+		Window:          10 * time.Minute,
+		MaxIPFailures:   5,
+		MaxUserFailures: 3,
+		Lockout:         15 * time.Minute,
+	})
+
+	// 用户名先达到阈值
+	for i := 0; i < 3; i++ {
+		if _, locked := g.UserLocked("user1"); locked {
+			t.Fatalf("user locked after %d failures", i)
+		}
+		g.Fail("192.0.2.1", "user1")
+	}
+	until, locked := g.UserLocked("user1")
+	if !locked || !until.Equal(clock.Now().Add(15*time.Minute)) {
+		t.Errorf("UserLocked() = %v, %v; want locked until %v", until, locked, clock.Now().Add(15*time.Minute))
+	}
+	if _, locked := g.IPLocked("192.0.2.1"); locked {
+		t.Errorf("IP locked after 3 failures, limit is 5")
+	}
+
+	// 换用户名继续猜测，IP 达到阈值
+	g.Fail("192.0.2.1", "user2")
+	g.Fail("192.0.2.1", "user3")
+	if _, locked := g.IPLocked("192.0.2.1"); !locked {
+		t.Errorf("IP not locked after 5 failures")
+	}
+	if _, locked := g.IPLocked("192.0.2.2"); locked {
+		t.Errorf("unrelated IP locked")
+	}
+
+	// 锁定到期后解锁
+	clock.Advance(15 * time.Minute)
+	if _, locked := g.UserLocked("user1"); locked {
+		t.Errorf("user still locked after lockout expired")
+	}
+	if _, locked := g.IPLocked("192.0.2.1"); locked {
+		t.Errorf("IP still locked after lockout expired")
+	}
+}
+
+func TestGuardSlidingWindow(t *testing.T) {
+	g, clock := newTestGuard(t, GuardOptions{
+		Window:          10 * time.Minute,
+		MaxUserFailures: 3,
+		Lockout:         time.Minute,
+	})
+
+	g.Fail("192.0.2.1", "user1")
+	clock.Advance(6 * time.Minute)
+	g.Fail("192.0.2.1", "user1")
+	// 第一次失败已滑出窗口
+	clock.Advance(5 * time.Minute)
+	g.Fail("192.0.2.1", "user1")
+	if _, locked := g.UserLocked("user1"); locked {
+		t.Errorf("user locked with only 2 failures inside the window")
+	}
+
+	// 成功后清零
+	g.Succeed("user1")
+	g.Fail("192.0.2.1", "user1")
+	if _, locked := g.UserLocked("user1"); locked {
+		t.Errorf("user locked although success reset the counter")
+	}
+}
+
+func TestGuardDelay(t *testing.T) {
+	g, _ := newTestGuard(t, GuardOptions{
+		Window:    time.Hour,
+		Lockout:   time.Hour,
+		BaseDelay: time.Second,
+		MaxDelay:  5 * time.Second,
+	})
+
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, w := range want {
+		if got := g.Fail("192.0.2.1", "user1"); got != w {
+			t.Errorf("Fail() #%d delay = %v, want %v", i+1, got, w)
+		}
+	}
+}
+
+func TestGuardPersistence(t *testing.T) {
+	opts := GuardOptions{
+		Window:          time.Hour,
+		MaxUserFailures: 2,
+		Lockout:         time.Hour,
+		StateFile:       filepath.Join(t.TempDir(), "guard.json"),
+	}
+
+	g, err := NewGuard(opts)
+	if err != nil {
+		t.Fatalf("NewGuard() error = %v", err)
+	}
+	g.Fail("192.0.2.1", "user1")
+	g.Fail("192.0.2.1", "user1")
+	g.Fail("192.0.2.1", "user2")
+	if err := g.Save(); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	// 重启后锁定状态和计数保留
+	restored, err := NewGuard(opts)
+	if err != nil {
+		t.Fatalf("NewGuard() error = %v", err)
+	}
+	if _, locked := restored.UserLocked("user1"); !locked {
+		t.Errorf("lockout was not restored")
+	}
+	restored.Fail("192.0.2.1", "user2")
+	if _, locked := restored.UserLocked("user2"); !locked {
+		t.Errorf("failure count was not restored")
+	}
+}
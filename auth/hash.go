@@ -0,0 +1,257 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Scheme 密码存储方案
+type Scheme string
+
+const (
+	SchemeUnknown     Scheme = ""
+	SchemePlain       Scheme = "plain"         // 明文，仅用于兼容旧的认证文件
+	SchemeSHA         Scheme = "sha"           // {SHA}，不加盐的 SHA-1，仅用于读取 htpasswd
+	SchemeMD5Crypt    Scheme = "md5-crypt"     // $1$ / $apr1$，仅用于读取 htpasswd
+	SchemeCRAMMD5     Scheme = "cram-md5"      // {CRAM-MD5}，Dovecot 兼容的 HMAC-MD5 中间状态，可用于 CRAM-MD5
+	SchemeSSHA        Scheme = "ssha"          // {SSHA}，加盐 SHA-1
+	SchemeSCRAMSHA256 Scheme = "scram-sha-256" // {SCRAM-SHA-256}，SCRAM 加盐密钥，可用于 SCRAM-SHA-256
+	SchemeSHA512Crypt Scheme = "sha512-crypt"  // $6$，SHA-512-crypt
+	SchemeBcrypt      Scheme = "bcrypt"        // $2a$ / $2b$ / $2y$
+	SchemeArgon2id    Scheme = "argon2id"      // $argon2id$
+)
+
+// plainPrefix 显式标记明文密码的前缀
+const plainPrefix = "{PLAIN}"
+
+// argon2id 默认参数
+const (
+	argon2Memory  = 64 * 1024
+	argon2Time    = 3
+	argon2Threads = 4
+	argon2KeyLen  = 32
+)
+
+// ErrUnknownScheme 表示无法识别密码哈希格式
+var ErrUnknownScheme = errors.New("unknown password scheme")
+
+// schemeStrength 各方案的相对强度，用于判断是否需要升级哈希
+var schemeStrength = map[Scheme]int{
+	SchemePlain:       0,
+	SchemeSHA:         1,
+	SchemeCRAMMD5:     1,
+	SchemeMD5Crypt:    2,
+	SchemeSSHA:        2,
+	SchemeSCRAMSHA256: 3,
+	SchemeSHA512Crypt: 3,
+	SchemeBcrypt:      4,
+	SchemeArgon2id:    5,
+}
+
+// ParseScheme 解析配置中的方案名称，只接受可用于生成新哈希的方案
+func ParseScheme(name string) (Scheme, error) {
+	s := Scheme(strings.ToLower(name))
+	if _, ok := schemeStrength[s]; !ok || s == SchemeSHA || s == SchemeMD5Crypt {
+		return SchemeUnknown, fmt.Errorf("%w: %s", ErrUnknownScheme, name)
+	}
+	return s, nil
+}
+
+// Stronger 判断方案 s 是否强于 other
+func (s Scheme) Stronger(other Scheme) bool {
+	return schemeStrength[s] > schemeStrength[other]
+}
+
+// challengeResponse 判断方案是否为质询-响应机制专用的密钥
+func (s Scheme) challengeResponse() bool {
+	return s == SchemeCRAMMD5 || s == SchemeSCRAMSHA256
+}
+
+// Identify 根据前缀识别已存储密码的方案
+//
+// 没有任何前缀的值被视为旧格式的明文密码；以 "$" 或 "{" 开头但无法识别的值
+// 返回 SchemeUnknown，避免把未知哈希当作明文比较。
+func Identify(stored string) Scheme {
+	switch {
+	case strings.HasPrefix(stored, "$2a$"), strings.HasPrefix(stored, "$2b$"), strings.HasPrefix(stored, "$2y$"):
+		return SchemeBcrypt
+	case strings.HasPrefix(stored, "$argon2id$"):
+		return SchemeArgon2id
+	case strings.HasPrefix(stored, "$6$"):
+		return SchemeSHA512Crypt
+	case strings.HasPrefix(stored, "$1$"), strings.HasPrefix(stored, "$apr1$"):
+		return SchemeMD5Crypt
+	case strings.HasPrefix(stored, "{SSHA}"):
+		return SchemeSSHA
+	case strings.HasPrefix(stored, "{SHA}"):
+		return SchemeSHA
+	case strings.HasPrefix(stored, cramMD5Prefix):
+		return SchemeCRAMMD5
+	case strings.HasPrefix(stored, scramPrefix):
+		return SchemeSCRAMSHA256
+	case strings.HasPrefix(stored, plainPrefix):
+		return SchemePlain
+	case strings.HasPrefix(stored, "$"), strings.HasPrefix(stored, "{"):
+		return SchemeUnknown
+	default:
+		return SchemePlain
+	}
+}
+
+// Hash 使用指定方案生成密码哈希
+func Hash(scheme Scheme, password string) (string, error) {
+	switch scheme {
+	case SchemeBcrypt:
+		h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return "", err
+		}
+		return string(h), nil
+	case SchemeArgon2id:
+		salt, err := randomBytes(16)
+		if err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version, argon2Memory, argon2Time, argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(key),
+		), nil
+	case SchemeSHA512Crypt:
+		salt, err := randomBytes(12)
+		if err != nil {
+			return "", err
+		}
+		return sha512Crypt([]byte(password), []byte(cryptEncode(salt)), sha512DefaultRounds, false), nil
+	case SchemeSSHA:
+		salt, err := randomBytes(8)
+		if err != nil {
+			return "", err
+		}
+		sum := sha1.Sum(append([]byte(password), salt...))
+		return "{SSHA}" + base64.StdEncoding.EncodeToString(append(sum[:], salt...)), nil
+	case SchemeCRAMMD5:
+		return cramMD5Prefix + hex.EncodeToString(cramMD5Context(password)), nil
+	case SchemeSCRAMSHA256:
+		salt, err := randomBytes(16)
+		if err != nil {
+			return "", err
+		}
+		return newSCRAMKeys(password, salt, scramIterations).String(), nil
+	case SchemePlain:
+		return plainPrefix + password, nil
+	default:
+		return "", fmt.Errorf("%w: %s", ErrUnknownScheme, scheme)
+	}
+}
+
+// Verify 以常量时间比较密码与已存储的值
+func Verify(stored, password string) (bool, error) {
+	switch Identify(stored) {
+	case SchemeBcrypt:
+		err := bcrypt.CompareHashAndPassword([]byte(stored), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	case SchemeArgon2id:
+		return verifyArgon2id(stored, password)
+	case SchemeSHA512Crypt:
+		salt, rounds, custom, err := parseSHA512Crypt(stored)
+		if err != nil {
+			return false, err
+		}
+		computed := sha512Crypt([]byte(password), salt, rounds, custom)
+		return subtle.ConstantTimeCompare([]byte(computed), []byte(stored)) == 1, nil
+	case SchemeMD5Crypt:
+		magic, salt, err := parseMD5Crypt(stored)
+		if err != nil {
+			return false, err
+		}
+		computed := md5Crypt([]byte(password), magic, salt)
+		return subtle.ConstantTimeCompare([]byte(computed), []byte(stored)) == 1, nil
+	case SchemeSHA:
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, "{SHA}"))
+		if err != nil || len(raw) != sha1.Size {
+			return false, fmt.Errorf("malformed SHA hash")
+		}
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare(sum[:], raw) == 1, nil
+	case SchemeSSHA:
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, "{SSHA}"))
+		if err != nil || len(raw) <= sha1.Size {
+			return false, fmt.Errorf("malformed SSHA hash")
+		}
+		sum := sha1.Sum(append([]byte(password), raw[sha1.Size:]...))
+		return subtle.ConstantTimeCompare(sum[:], raw[:sha1.Size]) == 1, nil
+	case SchemeCRAMMD5:
+		context, err := hex.DecodeString(strings.TrimPrefix(stored, cramMD5Prefix))
+		if err != nil || len(context) != 32 {
+			return false, fmt.Errorf("malformed CRAM-MD5 hash")
+		}
+		return subtle.ConstantTimeCompare(cramMD5Context(password), context) == 1, nil
+	case SchemeSCRAMSHA256:
+		keys, err := parseSCRAMKeys(stored)
+		if err != nil {
+			return false, err
+		}
+		computed := newSCRAMKeys(password, keys.salt, keys.iterations)
+		return subtle.ConstantTimeCompare(computed.storedKey, keys.storedKey) == 1, nil
+	case SchemePlain:
+		plain := strings.TrimPrefix(stored, plainPrefix)
+		return subtle.ConstantTimeCompare([]byte(plain), []byte(password)) == 1, nil
+	default:
+		return false, ErrUnknownScheme
+	}
+}
+
+// verifyArgon2id 校验 PHC 格式的 argon2id 哈希
+func verifyArgon2id(stored, password string) (bool, error) {
+	// $argon2id$v=19$m=65536,t=3,p=4$salt$key
+	parts := strings.Split(stored, "$")
+	if len(parts) != 6 {
+		return false, fmt.Errorf("malformed argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, fmt.Errorf("unsupported argon2id version: %s", parts[2])
+	}
+
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, fmt.Errorf("malformed argon2id parameters: %w", err)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, fmt.Errorf("malformed argon2id salt: %w", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, fmt.Errorf("malformed argon2id key: %w", err)
+	}
+
+	computed := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(computed, key) == 1, nil
+}
+
+// randomBytes 生成指定长度的随机字节
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestCryptVectors(t *testing.T) {
+	tests := []struct {
+		password string
+		stored   string
+	}{
+		{
+			password: "Hello world!",
+			stored:   "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1",
+		},
+		{
+			password: "Hello world!",
+			stored:   "$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v.",
+		},
+		{
+			password: "password",
+			stored:   "$1$saltsalt$qjXMvbEw8oaL.CzflDtaK/",
+		},
+		{
+			password: "password",
+			stored:   "$apr1$r31abcde$ouL8QL9v/FwrkrtBccxbL.",
+		},
+		{
+			password: "password",
+			stored:   "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+		},
+		{
+			// RFC 7677 示例
+			password: "pencil",
+			stored:   "{SCRAM-SHA-256}4096,W22ZaJ0SNY7soEsUEjb6gQ==,WG5d8oPm3OtcPnkdi4Uo7BkeZkBFzpcXkuLmtbsT4qY=,wfPLwcE6nTWhTAmQ7tl2KeoiWGPlZqQxSrmfPwDl2dU=",
+		},
+	}
+
+	for _, tt := range tests {
+		ok, err := Verify(tt.stored, tt.password)
+		if err != nil || !ok {
+			t.Errorf("Verify(%q) = %v, %v; want true", tt.stored, ok, err)
+		}
+	}
+}
+
+func TestHashRoundTrip(t *testing.T) {
+	for _, scheme := range []Scheme{SchemeBcrypt, SchemeArgon2id, SchemeSHA512Crypt, SchemeSSHA, SchemeCRAMMD5, SchemeSCRAMSHA256, SchemePlain} {
+		t.Run(string(scheme), func(t *testing.T) {
+			stored, err := Hash(scheme, "s3cret")
+			if err != nil {
+				t.Fatalf("Hash() error = %v", err)
+			}
+			if got := Identify(stored); got != scheme {
+				t.Errorf("Identify() = %q, want %q", got, scheme)
+			}
+			if ok, err := Verify(stored, "s3cret"); err != nil || !ok {
+				t.Errorf("Verify(correct) = %v, %v; want true", ok, err)
+			}
+			if ok, _ := Verify(stored, "wrong"); ok {
+				t.Errorf("Verify(wrong) = true; want false")
+			}
+		})
+	}
+}
+
+func TestCRAMMD5Digest(t *testing.T) {
+	challenge := []byte("<1896.697170952@postoffice.reston.mci.net>")
+	for _, password := range []string{"tanstaaftanstaaf", strings.Repeat("long", 20)} {
+		stored, err := Hash(SchemeCRAMMD5, password)
+		if err != nil {
+			t.Fatalf("Hash() error = %v", err)
+		}
+		got, err := cramMD5Digest(stored, challenge)
+		if err != nil {
+			t.Fatalf("cramMD5Digest() error = %v", err)
+		}
+		want, _ := cramMD5Digest(plainPrefix+password, challenge)
+		if !bytes.Equal(got, want) {
+			t.Errorf("cramMD5Digest(%q) = %x, want %x", password, got, want)
+		}
+	}
+
+	// RFC 2195 示例
+	want := "b913a602c7eda7a495b4e6e7334d3890"
+	if got, _ := cramMD5Digest("{PLAIN}tanstaaftanstaaf", challenge); hex.EncodeToString(got) != want {
+		t.Errorf("cramMD5Digest() = %x, want %s", got, want)
+	}
+}
+
+func TestIdentify(t *testing.T) {
+	tests := []struct {
+		stored string
+		want   Scheme
+	}{
+		{"$2y$10$abcdefghijklmnopqrstuu", SchemeBcrypt},
+		{"$argon2id$v=19$m=65536,t=3,p=4$c2FsdA$a2V5", SchemeArgon2id},
+		{"$6$salt$hash", SchemeSHA512Crypt},
+		{"{SSHA}c29tZXRoaW5n", SchemeSSHA},
+		{"{PLAIN}secret", SchemePlain},
+		{"legacy-password", SchemePlain},
+		{"$apr1$salt$hash", SchemeMD5Crypt},
+		{"{SHA}c29tZXRoaW5n", SchemeSHA},
+		{"$5$sha256crypt$hash", SchemeUnknown},
+	}
+
+	for _, tt := range tests {
+		if got := Identify(tt.stored); got != tt.want {
+			t.Errorf("Identify(%q) = %q, want %q", tt.stored, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HTTP 回调的判定结果
+const (
+	httpVerdictAllow    = "allow"
+	httpVerdictDeny     = "deny"
+	httpVerdictTempFail = "tempfail"
+)
+
+// httpCacheMaxEntries 缓存条目数量的上限，超出时先清理过期条目，仍然超出则不再缓存
+const httpCacheMaxEntries = 10000
+
+// HTTPOptions HTTP 回调凭据存储的配置
+type HTTPOptions struct {
+	// URL 接收认证请求的地址
+	URL string
+	// Headers 附加的请求头，如 Authorization
+	Headers map[string]string
+	// Timeout 单次请求的超时，超时视为暂时失败，默认 5 秒
+	Timeout time.Duration
+	// CacheTTL 缓存允许结果的时长，0 表示不缓存
+	CacheTTL time.Duration
+	// BreakerThreshold 连续失败多少次后熔断，默认 5
+	BreakerThreshold int
+	// BreakerCooldown 熔断持续时间，期间不再发送请求，直接按暂时失败处理，
+	// 到期后放行一个试探请求，默认 30 秒
+	BreakerCooldown time.Duration
+	// Client 发送请求使用的客户端，为空时使用带超时的默认客户端
+	Client *http.Client
+}
+
+// httpAuthRequest 发送给回调地址的请求
+type httpAuthRequest struct {
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+	RemoteIP  string `json:"remote_ip,omitempty"`
+	Mechanism string `json:"mechanism,omitempty"`
+	SessionID string `json:"session_id,omitempty"`
+}
+
+// httpAuthResponse 回调地址返回的判定
+type httpAuthResponse struct {
+	Verdict string `json:"verdict"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// HTTPStore 通过 HTTP 回调校验凭据：以 JSON 格式 POST 用户名、密码、客户端地址
+// 和认证机制，回调返回 {"verdict": "allow" | "deny" | "tempfail"}
+type HTTPStore struct {
+	opts HTTPOptions
+
+	mu sync.Mutex
+	// cache 允许结果的过期时间，键为用户名、密码和客户端 IP 的哈希
+	cache map[string]time.Time
+	// failures 连续失败次数，openUntil 熔断结束时间，probing 是否有试探请求在进行
+	failures  int
+	openUntil time.Time
+	probing   bool
+
+	// now 当前时间，测试时可替换
+	now func() time.Time
+}
+
+// NewHTTPStore 创建 HTTP 回调凭据存储
+func NewHTTPStore(opts HTTPOptions) (*HTTPStore, error) {
+	if opts.URL == "" {
+		return nil, fmt.Errorf("http auth url is required")
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	if opts.BreakerThreshold <= 0 {
+		opts.BreakerThreshold = 5
+	}
+	if opts.BreakerCooldown <= 0 {
+		opts.BreakerCooldown = 30 * time.Second
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: opts.Timeout}
+	}
+	return &HTTPStore{
+		opts:  opts,
+		cache: make(map[string]time.Time),
+		now:   time.Now,
+	}, nil
+}
+
+// Lookup HTTP 回调不支持查询用户
+func (s *HTTPStore) Lookup(username string) (bool, error) {
+	return false, ErrUnsupported
+}
+
+// List HTTP 回调不支持列出用户
+func (s *HTTPStore) List() ([]string, error) {
+	return nil, ErrUnsupported
+}
+
+// Verify 校验用户名和密码，不附带客户端信息
+func (s *HTTPStore) Verify(username, password string) (bool, error) {
+	return s.VerifyClient(username, password, ClientInfo{})
+}
+
+// VerifyClient 校验用户名和密码；回调失败、超时、返回 tempfail 或已熔断时
+// 返回包装了 ErrTemporary 的错误
+func (s *HTTPStore) VerifyClient(username, password string, info ClientInfo) (bool, error) {
+	if username == "" || password == "" {
+		return false, nil
+	}
+	remoteIP := info.RemoteAddr
+	if host, _, err := net.SplitHostPort(remoteIP); err == nil {
+		remoteIP = host
+	}
+
+	key := cacheKey(username, password, remoteIP)
+	if s.cached(key) {
+		return true, nil
+	}
+	if !s.allowRequest() {
+		return false, fmt.Errorf("%w: http auth circuit breaker is open", ErrTemporary)
+	}
+
+	resp, err := s.post(httpAuthRequest{
+		Username:  username,
+		Password:  password,
+		RemoteIP:  remoteIP,
+		Mechanism: info.Mechanism,
+		SessionID: info.SessionID,
+	})
+	s.recordResult(err == nil)
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", ErrTemporary, err)
+	}
+
+	switch resp.Verdict {
+	case httpVerdictAllow:
+		s.store(key)
+		return true, nil
+	case httpVerdictDeny:
+		return false, nil
+	default:
+		return false, fmt.Errorf("%w: http auth: %s", ErrTemporary, resp.Reason)
+	}
+}
+
+// post 发送认证请求并解析判定，非 2xx 状态码或无法识别的判定视为失败
+func (s *HTTPStore) post(body httpAuthRequest) (*httpAuthResponse, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.opts.URL, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	for name, value := range s.opts.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := s.opts.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("http auth returned status %d", resp.StatusCode)
+	}
+
+	var v httpAuthResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&v); err != nil {
+		return nil, fmt.Errorf("invalid http auth response: %w", err)
+	}
+	switch v.Verdict {
+	case httpVerdictAllow, httpVerdictDeny, httpVerdictTempFail:
+		return &v, nil
+	default:
+		return nil, fmt.Errorf("invalid http auth verdict %q", v.Verdict)
+	}
+}
+
+// cacheKey 缓存的键，不在内存中保存明文密码
+func cacheKey(username, password, remoteIP string) string {
+	sum := sha256.Sum256([]byte(username + "\x00" + password + "\x00" + remoteIP))
+	return hex.EncodeToString(sum[:])
+}
+
+// cached 判断是否有未过期的允许结果
+func (s *HTTPStore) cached(key string) bool {
+	if s.opts.CacheTTL <= 0 {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.now().Before(s.cache[key])
+}
+
+// store 缓存允许结果
+func (s *HTTPStore) store(key string) {
+	if s.opts.CacheTTL <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if len(s.cache) >= httpCacheMaxEntries {
+		for k, expires := range s.cache {
+			if !now.Before(expires) {
+				delete(s.cache, k)
+			}
+		}
+		if len(s.cache) >= httpCacheMaxEntries {
+			return
+		}
+	}
+	s.cache[key] = now.Add(s.opts.CacheTTL)
+}
+
+// allowRequest 判断熔断器是否放行请求：未熔断时放行，
+// 熔断到期后只放行一个试探请求
+func (s *HTTPStore) allowRequest() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.failures < s.opts.BreakerThreshold {
+		return true
+	}
+	if s.now().Before(s.openUntil) || s.probing {
+		return false
+	}
+	s.probing = true
+	return true
+}
+
+// recordResult 记录请求结果，连续失败达到阈值或试探失败时熔断
+func (s *HTTPStore) recordResult(ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.probing = false
+	if ok {
+		if s.failures >= s.opts.BreakerThreshold {
+			slog.Info("HTTP 认证回调已恢复",
+				"url", s.opts.URL,
+				"timestamp", time.Now().Format(time.RFC3339Nano),
+			)
+		}
+		s.failures = 0
+		return
+	}
+
+	s.failures++
+	if s.failures >= s.opts.BreakerThreshold {
+		s.openUntil = s.now().Add(s.opts.BreakerCooldown)
+		slog.Warn("HTTP 认证回调连续失败，暂停请求",
+			"url", s.opts.URL,
+			"failures", s.failures,
+			"until", s.openUntil.Format(time.RFC3339),
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+	}
+}
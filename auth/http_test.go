@@ -0,0 +1,170 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestHTTPAuth 启动回调服务：alice/secret 允许，temp 返回 tempfail，
+// broken 返回 500，slow 超时，其余拒绝；返回请求计数
+func newTestHTTPAuth(t *testing.T, check func(r *http.Request, body httpAuthRequest)) (string, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		var body httpAuthRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if check != nil {
+			check(r, body)
+		}
+
+		verdict := httpVerdictDeny
+		switch {
+		case body.Username == "alice" && body.Password == "secret":
+			verdict = httpVerdictAllow
+		case body.Username == "temp":
+			verdict = httpVerdictTempFail
+		case body.Username == "broken":
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		case body.Username == "slow":
+			time.Sleep(200 * time.Millisecond)
+		}
+		json.NewEncoder(w).Encode(httpAuthResponse{Verdict: verdict, Reason: "test"})
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, &requests
+}
+
+func TestHTTPStoreVerify(t *testing.T) {
+	url, _ := newTestHTTPAuth(t, func(r *http.Request, body httpAuthRequest) {
+		if r.Method != http.MethodPost || r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("Unexpected request: %s, Authorization %q", r.Method, r.Header.Get("Authorization"))
+		}
+		if body.Username == "alice" && (body.RemoteIP != "192.0.2.10" || body.Mechanism != "PLAIN") {
+			t.Errorf("Unexpected request body: %+v", body)
+		}
+	})
+	store, err := NewHTTPStore(HTTPOptions{
+		URL:     url,
+		Headers: map[string]string{"Authorization": "Bearer token"},
+	})
+	if err != nil {
+		t.Fatalf("NewHTTPStore() error = %v", err)
+	}
+	info := ClientInfo{RemoteAddr: "192.0.2.10:52000", Mechanism: "PLAIN"}
+
+	tests := []struct {
+		username, password string
+		want               bool
+		wantTemporary      bool
+	}{
+		{username: "alice", password: "secret", want: true},
+		{username: "alice", password: "wrong"},
+		{username: "bob", password: "secret"},
+		{username: "alice", password: ""},
+		{username: "temp", password: "x", wantTemporary: true},
+		{username: "broken", password: "x", wantTemporary: true},
+	}
+	for _, tt := range tests {
+		got, err := store.VerifyClient(tt.username, tt.password, info)
+		if got != tt.want {
+			t.Errorf("VerifyClient(%q, %q) = %v, want %v", tt.username, tt.password, got, tt.want)
+		}
+		if errors.Is(err, ErrTemporary) != tt.wantTemporary || (err != nil && !tt.wantTemporary) {
+			t.Errorf("VerifyClient(%q, %q) error = %v", tt.username, tt.password, err)
+		}
+	}
+}
+
+func TestHTTPStoreCache(t *testing.T) {
+	url, requests := newTestHTTPAuth(t, nil)
+	store, err := NewHTTPStore(HTTPOptions{URL: url, CacheTTL: time.Minute})
+	if err != nil {
+		t.Fatalf("NewHTTPStore() error = %v", err)
+	}
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	info := ClientInfo{RemoteAddr: "192.0.2.10:52000"}
+
+	verify := func(password string, wantRequests int32) {
+		t.Helper()
+		store.VerifyClient("alice", password, info)
+		if got := requests.Load(); got != wantRequests {
+			t.Errorf("Requests = %d, want %d", got, wantRequests)
+		}
+	}
+
+	verify("secret", 1)
+	verify("secret", 1) // 命中缓存
+	verify("wrong", 2)  // 拒绝结果不缓存
+	verify("wrong", 3)
+
+	// 其他客户端地址不共用缓存
+	store.VerifyClient("alice", "secret", ClientInfo{RemoteAddr: "192.0.2.11:52000"})
+	if got := requests.Load(); got != 4 {
+		t.Errorf("Requests = %d, want 4", got)
+	}
+
+	now = now.Add(time.Minute)
+	verify("secret", 5) // 缓存过期
+}
+
+func TestHTTPStoreCircuitBreaker(t *testing.T) {
+	url, requests := newTestHTTPAuth(t, nil)
+	store, err := NewHTTPStore(HTTPOptions{
+		URL:              url,
+		Timeout:          50 * time.Millisecond,
+		BreakerThreshold: 2,
+		BreakerCooldown:  time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("NewHTTPStore() error = %v", err)
+	}
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	// 连续两次超时后熔断，之后不再发送请求
+	for range 2 {
+		if _, err := store.Verify("slow", "x"); !errors.Is(err, ErrTemporary) {
+			t.Errorf("Verify() error = %v, want %v", err, ErrTemporary)
+		}
+	}
+	start := time.Now()
+	if _, err := store.Verify("alice", "secret"); !errors.Is(err, ErrTemporary) {
+		t.Errorf("Verify() while open error = %v, want %v", err, ErrTemporary)
+	}
+	if elapsed := time.Since(start); elapsed > 20*time.Millisecond {
+		t.Errorf("Verify() while open took %v", elapsed)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("Requests = %d, want 2", got)
+	}
+
+	// 熔断到期后的试探失败，继续熔断
+	now = now.Add(time.Minute)
+	store.Verify("broken", "x")
+	if _, err := store.Verify("alice", "secret"); !errors.Is(err, ErrTemporary) {
+		t.Errorf("Verify() after failed probe error = %v, want %v", err, ErrTemporary)
+	}
+
+	// 试探成功后恢复
+	now = now.Add(time.Minute)
+	if ok, err := store.Verify("alice", "secret"); !ok || err != nil {
+		t.Errorf("Verify() probe = %v, %v; want true", ok, err)
+	}
+	if ok, err := store.Verify("bob", "secret"); ok || err != nil {
+		t.Errorf("Verify() after recovery = %v, %v; want false, nil", ok, err)
+	}
+	if got := requests.Load(); got != 5 {
+		t.Errorf("Requests = %d, want 5", got)
+	}
+}
@@ -0,0 +1,431 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// LDAP 协议操作标签（RFC 4511）
+const (
+	ldapBindRequest       = 0x60
+	ldapBindResponse      = 0x61
+	ldapUnbindRequest     = 0x42
+	ldapSearchRequest     = 0x63
+	ldapSearchResultEntry = 0x64
+	ldapSearchResultDone  = 0x65
+	ldapSearchResultRef   = 0x73
+	ldapSimpleAuth        = 0x80
+	ldapFilterEquality    = 0xa3
+	ldapFilterPresent     = 0x87
+)
+
+// LDAP 结果码
+const (
+	ldapSuccess            = 0
+	ldapInvalidCredentials = 49
+)
+
+// LDAPOptions LDAP 凭据存储的配置
+type LDAPOptions struct {
+	// URL 服务器地址，支持 ldap:// 和 ldaps://
+	URL string
+	// UserDN 用户 DN 模板，%s 会被替换为转义后的用户名，
+	// 如 "uid=%s,ou=people,dc=example,dc=com"。为空时通过搜索查找用户 DN
+	UserDN string
+	// BaseDN 搜索用户时使用的根 DN
+	BaseDN string
+	// UserAttribute 保存用户名的属性，默认 uid
+	UserAttribute string
+	// BindDN 和 BindPassword 为执行搜索时使用的服务账户，为空时匿名搜索
+	BindDN       string
+	BindPassword string
+	// Timeout 连接和请求超时，默认 10 秒
+	Timeout time.Duration
+	// TLSConfig 使用 ldaps:// 时的 TLS 配置
+	TLSConfig *tls.Config
+}
+
+// LDAPStore 通过 LDAP 简单绑定校验密码的凭据存储
+type LDAPStore struct {
+	opts LDAPOptions
+}
+
+// NewLDAPStore 创建 LDAP 凭据存储
+func NewLDAPStore(opts LDAPOptions) (*LDAPStore, error) {
+	if opts.URL == "" {
+		return nil, fmt.Errorf("ldap url is required")
+	}
+	if opts.UserDN == "" && opts.BaseDN == "" {
+		return nil, fmt.Errorf("ldap user dn template or base dn is required")
+	}
+	if opts.UserAttribute == "" {
+		opts.UserAttribute = "uid"
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	return &LDAPStore{opts: opts}, nil
+}
+
+// Lookup 查询用户是否存在，需要配置 BaseDN
+func (s *LDAPStore) Lookup(username string) (bool, error) {
+	if s.opts.BaseDN == "" {
+		return false, ErrUnsupported
+	}
+
+	conn, err := s.dial()
+	if err != nil {
+		return false, err
+	}
+	defer conn.close()
+
+	if err := conn.serviceBind(s.opts); err != nil {
+		return false, err
+	}
+	entries, err := conn.search(s.opts.BaseDN, s.opts.UserAttribute, username)
+	if err != nil {
+		return false, err
+	}
+	return len(entries) > 0, nil
+}
+
+// Verify 以用户的 DN 和密码执行简单绑定；服务器不可用、忙或返回
+// 密码错误以外的结果时返回包装了 ErrTemporary 的错误
+func (s *LDAPStore) Verify(username, password string) (bool, error) {
+	// 空密码的简单绑定在 LDAP 中是"未认证绑定"，服务器会返回成功
+	if username == "" || password == "" {
+		return false, nil
+	}
+
+	conn, err := s.dial()
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", ErrTemporary, err)
+	}
+	defer conn.close()
+
+	dn := ""
+	if s.opts.UserDN != "" {
+		dn = fmt.Sprintf(s.opts.UserDN, escapeDN(username))
+	} else {
+		if err := conn.serviceBind(s.opts); err != nil {
+			return false, fmt.Errorf("%w: %v", ErrTemporary, err)
+		}
+		entries, err := conn.search(s.opts.BaseDN, s.opts.UserAttribute, username)
+		if err != nil {
+			return false, fmt.Errorf("%w: %v", ErrTemporary, err)
+		}
+		if len(entries) != 1 {
+			slog.Debug("LDAP 用户不存在或不唯一",
+				"username", username,
+				"count", len(entries),
+				"timestamp", time.Now().Format(time.RFC3339Nano),
+			)
+			return false, nil
+		}
+		dn = entries[0]
+	}
+
+	code, err := conn.bind(dn, password)
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", ErrTemporary, err)
+	}
+	switch code {
+	case ldapSuccess:
+		return true, nil
+	case ldapInvalidCredentials:
+		return false, nil
+	default:
+		// 如 busy（51）、unavailable（52）
+		return false, fmt.Errorf("%w: ldap bind failed with result code %d", ErrTemporary, code)
+	}
+}
+
+// List 列出 BaseDN 下所有带有用户名属性的条目，需要配置 BaseDN
+func (s *LDAPStore) List() ([]string, error) {
+	if s.opts.BaseDN == "" {
+		return nil, ErrUnsupported
+	}
+
+	conn, err := s.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.close()
+
+	if err := conn.serviceBind(s.opts); err != nil {
+		return nil, err
+	}
+	return conn.searchValues(s.opts.BaseDN, s.opts.UserAttribute)
+}
+
+// ldapConn 一个 LDAP 连接
+type ldapConn struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	msgID   atomic.Int32
+	timeout time.Duration
+}
+
+// dial 建立到 LDAP 服务器的连接
+func (s *LDAPStore) dial() (*ldapConn, error) {
+	u, err := url.Parse(s.opts.URL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing ldap url: %w", err)
+	}
+
+	dialer := &net.Dialer{Timeout: s.opts.Timeout}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ldap":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "389")
+		}
+		conn, err = dialer.Dial("tcp", host)
+	case "ldaps":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "636")
+		}
+		cfg := s.opts.TLSConfig
+		if cfg == nil {
+			cfg = &tls.Config{ServerName: u.Hostname()}
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, cfg)
+	default:
+		return nil, fmt.Errorf("unsupported ldap url scheme: %s", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &ldapConn{
+		conn:    conn,
+		r:       bufio.NewReader(conn),
+		timeout: s.opts.Timeout,
+	}, nil
+}
+
+// close 发送 UnbindRequest 并关闭连接
+func (c *ldapConn) close() {
+	c.send(berTLV(ldapUnbindRequest, nil))
+	c.conn.Close()
+}
+
+// send 发送一个 LDAPMessage，返回其消息 ID
+func (c *ldapConn) send(op []byte) (int, error) {
+	id := int(c.msgID.Add(1))
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	_, err := c.conn.Write(berSeq(berTagSequence, berInt(berTagInteger, id), op))
+	return id, err
+}
+
+// receive 读取一个 LDAPMessage，返回协议操作元素
+func (c *ldapConn) receive(id int) (berElement, error) {
+	msg, err := readBER(c.r)
+	if err != nil {
+		return berElement{}, err
+	}
+	parts, err := berChildren(msg.content)
+	if err != nil {
+		return berElement{}, err
+	}
+	if len(parts) < 2 || parts[0].tag != berTagInteger {
+		return berElement{}, fmt.Errorf("malformed ldap message")
+	}
+	if parts[0].int() != id {
+		return berElement{}, fmt.Errorf("unexpected ldap message id %d", parts[0].int())
+	}
+	return parts[1], nil
+}
+
+// bind 执行简单绑定，返回结果码
+func (c *ldapConn) bind(dn, password string) (int, error) {
+	id, err := c.send(berSeq(ldapBindRequest,
+		berInt(berTagInteger, 3),
+		berString(berTagOctetString, dn),
+		berString(ldapSimpleAuth, password),
+	))
+	if err != nil {
+		return 0, err
+	}
+
+	op, err := c.receive(id)
+	if err != nil {
+		return 0, err
+	}
+	if op.tag != ldapBindResponse {
+		return 0, fmt.Errorf("unexpected ldap response tag 0x%02x", op.tag)
+	}
+	return ldapResultCode(op)
+}
+
+// serviceBind 使用服务账户绑定，未配置服务账户时保持匿名
+func (c *ldapConn) serviceBind(opts LDAPOptions) error {
+	if opts.BindDN == "" {
+		return nil
+	}
+	code, err := c.bind(opts.BindDN, opts.BindPassword)
+	if err != nil {
+		return err
+	}
+	if code != ldapSuccess {
+		return fmt.Errorf("ldap service bind failed with result code %d", code)
+	}
+	return nil
+}
+
+// search 查找属性等于指定值的条目，返回它们的 DN
+func (c *ldapConn) search(baseDN, attr, value string) ([]string, error) {
+	filter := berSeq(ldapFilterEquality,
+		berString(berTagOctetString, attr),
+		berString(berTagOctetString, value),
+	)
+	entries, err := c.doSearch(baseDN, filter, "1.1")
+	if err != nil {
+		return nil, err
+	}
+
+	dns := make([]string, 0, len(entries))
+	for _, e := range entries {
+		dns = append(dns, e.dn)
+	}
+	return dns, nil
+}
+
+// searchValues 查找所有带有指定属性的条目，返回该属性的值
+func (c *ldapConn) searchValues(baseDN, attr string) ([]string, error) {
+	entries, err := c.doSearch(baseDN, berString(ldapFilterPresent, attr), attr)
+	if err != nil {
+		return nil, err
+	}
+
+	var values []string
+	for _, e := range entries {
+		values = append(values, e.attrs[strings.ToLower(attr)]...)
+	}
+	return values, nil
+}
+
+// ldapEntry 搜索结果中的一个条目
+type ldapEntry struct {
+	dn    string
+	attrs map[string][]string
+}
+
+// doSearch 在 baseDN 的整个子树上执行搜索
+func (c *ldapConn) doSearch(baseDN string, filter []byte, attr string) ([]ldapEntry, error) {
+	id, err := c.send(berSeq(ldapSearchRequest,
+		berString(berTagOctetString, baseDN),
+		berInt(berTagEnumerated, 2), // wholeSubtree
+		berInt(berTagEnumerated, 0), // neverDerefAliases
+		berInt(berTagInteger, 0),
+		berInt(berTagInteger, int(c.timeout/time.Second)),
+		berBool(false),
+		filter,
+		berSeq(berTagSequence, berString(berTagOctetString, attr)),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []ldapEntry
+	for {
+		op, err := c.receive(id)
+		if err != nil {
+			return nil, err
+		}
+
+		switch op.tag {
+		case ldapSearchResultEntry:
+			entry, err := parseLDAPEntry(op)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		case ldapSearchResultRef:
+			// 不跟随引用
+		case ldapSearchResultDone:
+			code, err := ldapResultCode(op)
+			if err != nil {
+				return nil, err
+			}
+			if code != ldapSuccess {
+				return nil, fmt.Errorf("ldap search failed with result code %d", code)
+			}
+			return entries, nil
+		default:
+			return nil, fmt.Errorf("unexpected ldap response tag 0x%02x", op.tag)
+		}
+	}
+}
+
+// parseLDAPEntry 解析 SearchResultEntry
+func parseLDAPEntry(op berElement) (ldapEntry, error) {
+	parts, err := berChildren(op.content)
+	if err != nil {
+		return ldapEntry{}, err
+	}
+	if len(parts) < 2 {
+		return ldapEntry{}, fmt.Errorf("malformed ldap search entry")
+	}
+
+	entry := ldapEntry{dn: string(parts[0].content), attrs: make(map[string][]string)}
+	attrs, err := berChildren(parts[1].content)
+	if err != nil {
+		return ldapEntry{}, err
+	}
+	for _, a := range attrs {
+		fields, err := berChildren(a.content)
+		if err != nil || len(fields) != 2 {
+			return ldapEntry{}, fmt.Errorf("malformed ldap attribute")
+		}
+		values, err := berChildren(fields[1].content)
+		if err != nil {
+			return ldapEntry{}, err
+		}
+		name := strings.ToLower(string(fields[0].content))
+		for _, v := range values {
+			entry.attrs[name] = append(entry.attrs[name], string(v.content))
+		}
+	}
+	return entry, nil
+}
+
+// ldapResultCode 从 LDAPResult 中取出结果码
+func ldapResultCode(op berElement) (int, error) {
+	parts, err := berChildren(op.content)
+	if err != nil {
+		return 0, err
+	}
+	if len(parts) < 1 || parts[0].tag != berTagEnumerated {
+		return 0, fmt.Errorf("malformed ldap result")
+	}
+	return parts[0].int(), nil
+}
+
+// escapeDN 按 RFC 4514 转义 DN 中的属性值
+func escapeDN(value string) string {
+	var b strings.Builder
+	for i, r := range value {
+		switch {
+		case strings.ContainsRune(`,+"\<>;=`, r),
+			r == '#' && i == 0,
+			r == ' ' && (i == 0 || i == len(value)-1):
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == 0:
+			b.WriteString(`\00`)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,237 @@
+package auth
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// fakeLDAPServer 进程内的最小 LDAP 服务器，支持简单绑定和按属性搜索
+type fakeLDAPServer struct {
+	// users 用户 DN 到密码的映射
+	users map[string]string
+	// serviceDN 允许执行搜索的服务账户
+	serviceDN string
+	// bindResult 不为零时所有绑定都返回该结果码
+	bindResult int
+}
+
+func (f *fakeLDAPServer) start(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return "ldap://" + l.Addr().String()
+}
+
+func (f *fakeLDAPServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	bound := ""
+	for {
+		msg, err := readBER(r)
+		if err != nil {
+			return
+		}
+		parts, err := berChildren(msg.content)
+		if err != nil || len(parts) < 2 {
+			return
+		}
+		id := parts[0].int()
+		op := parts[1]
+
+		reply := func(ops ...[]byte) {
+			for _, o := range ops {
+				conn.Write(berSeq(berTagSequence, berInt(berTagInteger, id), o))
+			}
+		}
+		result := func(tag byte, code int) []byte {
+			return berSeq(tag,
+				berInt(berTagEnumerated, code),
+				berString(berTagOctetString, ""),
+				berString(berTagOctetString, ""),
+			)
+		}
+
+		switch op.tag {
+		case ldapBindRequest:
+			fields, _ := berChildren(op.content)
+			dn, password := string(fields[1].content), string(fields[2].content)
+			if f.bindResult != 0 {
+				reply(result(ldapBindResponse, f.bindResult))
+			} else if stored, ok := f.users[dn]; ok && stored == password {
+				bound = dn
+				reply(result(ldapBindResponse, ldapSuccess))
+			} else {
+				reply(result(ldapBindResponse, ldapInvalidCredentials))
+			}
+		case ldapSearchRequest:
+			if bound != f.serviceDN {
+				reply(result(ldapSearchResultDone, 50)) // insufficientAccessRights
+				continue
+			}
+			fields, _ := berChildren(op.content)
+			filter := fields[6]
+
+			var entries [][]byte
+			for dn := range f.users {
+				uid := strings.TrimPrefix(strings.Split(dn, ",")[0], "uid=")
+				if !strings.HasPrefix(dn, "uid=") {
+					continue
+				}
+				if filter.tag == ldapFilterEquality {
+					ava, _ := berChildren(filter.content)
+					if string(ava[1].content) != uid {
+						continue
+					}
+				}
+				entries = append(entries, berSeq(ldapSearchResultEntry,
+					berString(berTagOctetString, dn),
+					berSeq(berTagSequence,
+						berSeq(berTagSequence,
+							berString(berTagOctetString, "uid"),
+							berSeq(berTagSet, berString(berTagOctetString, uid)),
+						),
+					),
+				))
+			}
+			reply(append(entries, result(ldapSearchResultDone, ldapSuccess))...)
+		case ldapUnbindRequest:
+			return
+		}
+	}
+}
+
+func newFakeLDAP(t *testing.T) string {
+	f := &fakeLDAPServer{
+		users: map[string]string{
+			"uid=user1,ou=people,dc=example,dc=com":  "password123",
+			"uid=admin,ou=people,dc=example,dc=com":  "strongpassword",
+			"cn=smtpd,ou=services,dc=example,dc=com": "service",
+		},
+		serviceDN: "cn=smtpd,ou=services,dc=example,dc=com",
+	}
+	return f.start(t)
+}
+
+func TestLDAPStoreUserDNTemplate(t *testing.T) {
+	store, err := NewLDAPStore(LDAPOptions{
+		URL:    newFakeLDAP(t),
+		UserDN: "uid=%s,ou=people,dc=example,dc=com",
+	})
+	if err != nil {
+		t.Fatalf("NewLDAPStore() error = %v", err)
+	}
+
+	tests := []struct {
+		username string
+		password string
+		want     bool
+	}{
+		{"user1", "password123", true},
+		{"user1", "wrong", false},
+		{"user1", "", false},
+		{"nobody", "password123", false},
+		{"user1,ou=people", "password123", false},
+	}
+	for _, tt := range tests {
+		got, err := store.Verify(tt.username, tt.password)
+		if err != nil {
+			t.Errorf("Verify(%q) error = %v", tt.username, err)
+		}
+		if got != tt.want {
+			t.Errorf("Verify(%q, %q) = %v, want %v", tt.username, tt.password, got, tt.want)
+		}
+	}
+
+	if _, err := store.List(); err != ErrUnsupported {
+		t.Errorf("List() error = %v, want ErrUnsupported", err)
+	}
+}
+
+func TestLDAPStoreSearch(t *testing.T) {
+	store, err := NewLDAPStore(LDAPOptions{
+		URL:          newFakeLDAP(t),
+		BaseDN:       "dc=example,dc=com",
+		BindDN:       "cn=smtpd,ou=services,dc=example,dc=com",
+		BindPassword: "service",
+	})
+	if err != nil {
+		t.Fatalf("NewLDAPStore() error = %v", err)
+	}
+
+	if ok, err := store.Verify("admin", "strongpassword"); err != nil || !ok {
+		t.Errorf("Verify(admin) = %v, %v; want true", ok, err)
+	}
+	if ok, err := store.Verify("admin", "password123"); err != nil || ok {
+		t.Errorf("Verify(admin, wrong) = %v, %v; want false", ok, err)
+	}
+
+	if ok, err := store.Lookup("user1"); err != nil || !ok {
+		t.Errorf("Lookup(user1) = %v, %v; want true", ok, err)
+	}
+	if ok, err := store.Lookup("nobody"); err != nil || ok {
+		t.Errorf("Lookup(nobody) = %v, %v; want false", ok, err)
+	}
+
+	names, err := store.List()
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	slices.Sort(names)
+	if !slices.Equal(names, []string{"admin", "user1"}) {
+		t.Errorf("List() = %v, want [admin user1]", names)
+	}
+}
+
+func TestLDAPStoreTemporaryFailure(t *testing.T) {
+	// 监听后立即关闭，连接被拒绝
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	down := "ldap://" + l.Addr().String()
+	l.Close()
+
+	// 所有绑定都返回 busy（51）
+	busy := (&fakeLDAPServer{bindResult: 51}).start(t)
+
+	tests := []struct {
+		name string
+		opts LDAPOptions
+	}{
+		{"server down", LDAPOptions{URL: down, UserDN: "uid=%s,ou=people,dc=example,dc=com"}},
+		{"server down with search", LDAPOptions{URL: down, BaseDN: "dc=example,dc=com"}},
+		{"server busy", LDAPOptions{URL: busy, UserDN: "uid=%s,ou=people,dc=example,dc=com"}},
+		{"service bind busy", LDAPOptions{URL: busy, BaseDN: "dc=example,dc=com", BindDN: "cn=smtpd", BindPassword: "service"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := NewLDAPStore(tt.opts)
+			if err != nil {
+				t.Fatalf("NewLDAPStore() error = %v", err)
+			}
+			ok, err := store.Verify("user1", "password123")
+			if ok || !errors.Is(err, ErrTemporary) {
+				t.Errorf("Verify() = %v, %v; want ErrTemporary", ok, err)
+			}
+		})
+	}
+}
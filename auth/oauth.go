@@ -0,0 +1,289 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// OAuth 机制名称
+const (
+	OAuthBearer = sasl.OAuthBearer // RFC 7628
+	XOAuth2     = "XOAUTH2"        // Google 的非标准机制
+)
+
+// oauthMethods 接受的 JWT 签名算法，只允许非对称算法
+var oauthMethods = []string{
+	"RS256", "RS384", "RS512",
+	"PS256", "PS384", "PS512",
+	"ES256", "ES384", "ES512",
+	"EdDSA",
+}
+
+// OAuthOptions 本地校验 OAuth 2.0 持有者令牌（JWT）的选项
+type OAuthOptions struct {
+	// JWKS 签名公钥所在的 JWKS 文件，或包含多个 .json JWKS 文件的目录
+	JWKS string
+	// Issuer 要求的 iss 声明
+	Issuer string
+	// Audience 要求包含在 aud 声明中的值
+	Audience string
+	// UsernameClaim 作为用户名的声明，默认 sub
+	UsernameClaim string
+	// Leeway 校验 exp、nbf、iat 时允许的时钟偏差
+	Leeway time.Duration
+}
+
+// TokenValidator 使用本地 JWKS 校验 JWT 持有者令牌
+type TokenValidator struct {
+	mu   sync.RWMutex
+	keys *keySet
+	opts OAuthOptions
+}
+
+// NewTokenValidator 加载 JWKS 并创建令牌校验器
+func NewTokenValidator(opts OAuthOptions) (*TokenValidator, error) {
+	if opts.UsernameClaim == "" {
+		opts.UsernameClaim = "sub"
+	}
+	v := &TokenValidator{opts: opts}
+	if err := v.Reload(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Reload 重新加载 JWKS，失败时保留原有密钥
+func (v *TokenValidator) Reload() error {
+	keys, err := loadJWKS(v.opts.JWKS)
+	if err != nil {
+		slog.Error("加载 JWKS 失败",
+			"path", v.opts.JWKS,
+			"error", err,
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+		return err
+	}
+
+	v.mu.Lock()
+	v.keys = keys
+	v.mu.Unlock()
+
+	slog.Info("加载 JWKS 成功",
+		"path", v.opts.JWKS,
+		"count", len(keys.byID)+len(keys.anonymous),
+		"timestamp", time.Now().Format(time.RFC3339Nano),
+	)
+	return nil
+}
+
+// Validate 校验令牌的签名、签发者、受众和有效期，返回用户名声明的值
+func (v *TokenValidator) Validate(token string) (string, error) {
+	v.mu.RLock()
+	keys := v.keys
+	v.mu.RUnlock()
+
+	parsed, err := jwt.Parse(token, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		if kid == "" {
+			set := jwt.VerificationKeySet{}
+			for _, key := range keys.anonymous {
+				set.Keys = append(set.Keys, key)
+			}
+			return set, nil
+		}
+		key, ok := keys.byID[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown key id %q", kid)
+		}
+		return key, nil
+	},
+		jwt.WithValidMethods(oauthMethods),
+		jwt.WithIssuer(v.opts.Issuer),
+		jwt.WithAudience(v.opts.Audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(v.opts.Leeway),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	claims, ok := parsed.Claims.(jwt.MapClaims)
+	if !ok {
+		return "", fmt.Errorf("unexpected claims type")
+	}
+	username, _ := claims[v.opts.UsernameClaim].(string)
+	if username == "" {
+		return "", fmt.Errorf("token has no %q claim", v.opts.UsernameClaim)
+	}
+	return username, nil
+}
+
+// oauthError RFC 7628 第 3.2.2 节定义的错误挑战
+type oauthError struct {
+	Status  string `json:"status"`
+	Schemes string `json:"schemes,omitempty"`
+	Scope   string `json:"scope,omitempty"`
+}
+
+// oauthServer OAUTHBEARER 和 XOAUTH2 服务端
+//
+// 令牌无效时先发送 JSON 错误挑战，待客户端发送空响应或 %x01 后再结束认证。
+type oauthServer struct {
+	v    *TokenValidator
+	mech string
+	done func(username string, ok bool) error
+
+	started  bool
+	username string
+	// failed 已发送错误挑战，等待客户端确认
+	failed bool
+}
+
+// NewOAuthBearerServer 创建 OAUTHBEARER 服务端，认证结束后以用户名和结果调用 done，
+// 其返回值作为认证结果返回给客户端
+func (v *TokenValidator) NewOAuthBearerServer(done func(username string, ok bool) error) sasl.Server {
+	return &oauthServer{v: v, mech: OAuthBearer, done: done}
+}
+
+// NewXOAuth2Server 创建 XOAUTH2 服务端，done 的含义同 NewOAuthBearerServer
+func (v *TokenValidator) NewXOAuth2Server(done func(username string, ok bool) error) sasl.Server {
+	return &oauthServer{v: v, mech: XOAuth2, done: done}
+}
+
+func (s *oauthServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	if s.failed {
+		return nil, true, s.done(s.username, false)
+	}
+	if s.started {
+		return nil, true, sasl.ErrUnexpectedClientResponse
+	}
+	if response == nil {
+		// 客户端未发送初始响应
+		return []byte{}, false, nil
+	}
+	s.started = true
+
+	var authzid, token string
+	if s.mech == OAuthBearer {
+		authzid, token, err = parseOAuthBearer(response)
+	} else {
+		authzid, token, err = parseXOAuth2(response)
+	}
+	if err != nil {
+		return s.fail(authzid, "invalid_request", err)
+	}
+
+	username, err := s.v.Validate(token)
+	if err != nil {
+		return s.fail(authzid, "invalid_token", err)
+	}
+	// 授权身份必须与令牌中的用户一致
+	if authzid != "" && authzid != username {
+		return s.fail(username, "invalid_token", fmt.Errorf("authorization identity %q does not match token", authzid))
+	}
+	s.username = username
+	return nil, true, s.done(username, true)
+}
+
+// fail 记录失败原因并发送错误挑战
+func (s *oauthServer) fail(username, status string, reason error) ([]byte, bool, error) {
+	slog.Warn("OAuth 令牌校验失败",
+		"username", username,
+		"auth_method", s.mech,
+		"status", status,
+		"error", reason,
+		"timestamp", time.Now().Format(time.RFC3339Nano),
+	)
+
+	s.username = username
+	s.failed = true
+	challenge, err := json.Marshal(oauthError{Status: status, Schemes: "bearer"})
+	if err != nil {
+		return nil, true, err
+	}
+	return challenge, false, nil
+}
+
+// errOAuthMalformed 客户端消息格式错误
+var errOAuthMalformed = errors.New("malformed OAuth message")
+
+// parseOAuthBearer 解析 OAUTHBEARER 初始响应：
+// gs2-header %x01 *(key "=" value %x01) %x01
+func parseOAuthBearer(response []byte) (authzid, token string, err error) {
+	header, rest, ok := bytes.Cut(response, []byte{0x01})
+	if !ok {
+		return "", "", errOAuthMalformed
+	}
+
+	// gs2-header: "n," [ "a=" authzid ] ","，不支持通道绑定
+	parts := strings.Split(string(header), ",")
+	if len(parts) != 3 || parts[2] != "" || (parts[0] != "n" && parts[0] != "y") {
+		return "", "", errOAuthMalformed
+	}
+	if parts[1] != "" {
+		if !strings.HasPrefix(parts[1], "a=") {
+			return "", "", errOAuthMalformed
+		}
+		if authzid, err = scramUnescape(parts[1][2:]); err != nil {
+			return "", "", errOAuthMalformed
+		}
+	}
+
+	token, err = parseOAuthKVPairs(rest)
+	return authzid, token, err
+}
+
+// parseXOAuth2 解析 XOAUTH2 初始响应：
+// "user=" user %x01 "auth=Bearer " token %x01 %x01
+func parseXOAuth2(response []byte) (user, token string, err error) {
+	if !bytes.HasPrefix(response, []byte("user=")) {
+		return "", "", errOAuthMalformed
+	}
+	u, rest, ok := bytes.Cut(response[len("user="):], []byte{0x01})
+	if !ok {
+		return "", "", errOAuthMalformed
+	}
+	token, err = parseOAuthKVPairs(rest)
+	return string(u), token, err
+}
+
+// parseOAuthKVPairs 解析以 %x01 分隔的键值对并返回 auth 中的持有者令牌
+func parseOAuthKVPairs(data []byte) (string, error) {
+	if !bytes.HasSuffix(data, []byte{0x01}) {
+		return "", errOAuthMalformed
+	}
+
+	token := ""
+	for _, kv := range bytes.Split(bytes.TrimSuffix(data, []byte{0x01}), []byte{0x01}) {
+		if len(kv) == 0 {
+			continue
+		}
+		key, value, ok := bytes.Cut(kv, []byte{'='})
+		if !ok {
+			return "", errOAuthMalformed
+		}
+		if string(key) != "auth" {
+			// host、port 等其他键被忽略
+			continue
+		}
+		scheme, credentials, ok := strings.Cut(string(value), " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") || credentials == "" {
+			return "", fmt.Errorf("unsupported authorization scheme")
+		}
+		token = strings.TrimSpace(credentials)
+	}
+	if token == "" {
+		return "", fmt.Errorf("missing bearer token")
+	}
+	return token, nil
+}
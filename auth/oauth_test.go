@@ -0,0 +1,207 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testKeys 测试用的签名密钥
+type testKeys struct {
+	rsa *rsa.PrivateKey
+	ec  *ecdsa.PrivateKey
+}
+
+func newTestKeys(t *testing.T) testKeys {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate EC key: %v", err)
+	}
+	return testKeys{rsa: rsaKey, ec: ecKey}
+}
+
+// writeJWKS 将 RSA 公钥（kid=rsa-1）和没有 kid 的 EC 公钥分别写入目录中的两个文件
+func (k testKeys) writeJWKS(t *testing.T, dir string) {
+	t.Helper()
+	b64 := base64.RawURLEncoding.EncodeToString
+	files := map[string]any{
+		"rsa.json": map[string]any{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "rsa-1", "use": "sig", "alg": "RS256",
+			"n": b64(k.rsa.N.Bytes()),
+			"e": b64(big.NewInt(int64(k.rsa.E)).Bytes()),
+		}}},
+		"ec.json": map[string]any{"keys": []map[string]string{{
+			"kty": "EC", "crv": "P-256",
+			"x": b64(k.ec.X.FillBytes(make([]byte, 32))),
+			"y": b64(k.ec.Y.FillBytes(make([]byte, 32))),
+		}}},
+	}
+	for name, set := range files {
+		data, _ := json.Marshal(set)
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatalf("Failed to write JWKS: %v", err)
+		}
+	}
+}
+
+// validClaims 返回可以通过校验的声明
+func validClaims() jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":   "https://idp.example.com",
+		"aud":   "smtpd",
+		"sub":   "svc-reports",
+		"email": "reports@example.com",
+		"iat":   now.Unix(),
+		"exp":   now.Add(5 * time.Minute).Unix(),
+	}
+}
+
+func signToken(t *testing.T, method jwt.SigningMethod, kid string, key any, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	return signed
+}
+
+func TestTokenValidator(t *testing.T) {
+	keys := newTestKeys(t)
+	dir := t.TempDir()
+	keys.writeJWKS(t, dir)
+
+	v, err := NewTokenValidator(OAuthOptions{
+		JWKS:     dir,
+		Issuer:   "https://idp.example.com",
+		Audience: "smtpd",
+	})
+	if err != nil {
+		t.Fatalf("NewTokenValidator() error = %v", err)
+	}
+
+	with := func(key string, value any) jwt.MapClaims {
+		claims := validClaims()
+		if value == nil {
+			delete(claims, key)
+		} else {
+			claims[key] = value
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "RS256 with kid",
+			token: signToken(t, jwt.SigningMethodRS256, "rsa-1", keys.rsa, validClaims()),
+			want:  "svc-reports",
+		},
+		{
+			name:  "ES256 without kid",
+			token: signToken(t, jwt.SigningMethodES256, "", keys.ec, validClaims()),
+			want:  "svc-reports",
+		},
+		{
+			name:    "unknown kid",
+			token:   signToken(t, jwt.SigningMethodRS256, "rsa-2", keys.rsa, validClaims()),
+			wantErr: true,
+		},
+		{
+			name:    "wrong issuer",
+			token:   signToken(t, jwt.SigningMethodRS256, "rsa-1", keys.rsa, with("iss", "https://evil.example.com")),
+			wantErr: true,
+		},
+		{
+			name:    "wrong audience",
+			token:   signToken(t, jwt.SigningMethodRS256, "rsa-1", keys.rsa, with("aud", "other")),
+			wantErr: true,
+		},
+		{
+			name:    "expired",
+			token:   signToken(t, jwt.SigningMethodRS256, "rsa-1", keys.rsa, with("exp", time.Now().Add(-time.Minute).Unix())),
+			wantErr: true,
+		},
+		{
+			name:    "missing expiry",
+			token:   signToken(t, jwt.SigningMethodRS256, "rsa-1", keys.rsa, with("exp", nil)),
+			wantErr: true,
+		},
+		{
+			name:    "missing username claim",
+			token:   signToken(t, jwt.SigningMethodRS256, "rsa-1", keys.rsa, with("sub", nil)),
+			wantErr: true,
+		},
+		{
+			name:    "HMAC signed with public key",
+			token:   signToken(t, jwt.SigningMethodHS256, "rsa-1", keys.rsa.N.Bytes(), validClaims()),
+			wantErr: true,
+		},
+		{
+			name:    "signed by another key",
+			token:   signToken(t, jwt.SigningMethodRS256, "rsa-1", newTestKeys(t).rsa, validClaims()),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := v.Validate(tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Validate() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenValidatorUsernameClaim(t *testing.T) {
+	keys := newTestKeys(t)
+	dir := t.TempDir()
+	keys.writeJWKS(t, dir)
+
+	v, err := NewTokenValidator(OAuthOptions{
+		JWKS:          filepath.Join(dir, "rsa.json"),
+		Issuer:        "https://idp.example.com",
+		Audience:      "smtpd",
+		UsernameClaim: "email",
+	})
+	if err != nil {
+		t.Fatalf("NewTokenValidator() error = %v", err)
+	}
+
+	got, err := v.Validate(signToken(t, jwt.SigningMethodRS256, "rsa-1", keys.rsa, validClaims()))
+	if err != nil || got != "reports@example.com" {
+		t.Errorf("Validate() = %q, %v; want reports@example.com", got, err)
+	}
+
+	// 只加载了 RSA 密钥文件，EC 签名的令牌无法校验
+	if _, err := v.Validate(signToken(t, jwt.SigningMethodES256, "", keys.ec, validClaims())); err == nil {
+		t.Errorf("Validate() with key outside JWKS file succeeded")
+	}
+}
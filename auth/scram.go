@@ -0,0 +1,387 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-sasl"
+)
+
+// SCRAM 机制名称（RFC 7677、RFC 5802）
+const (
+	SCRAMSHA256     = "SCRAM-SHA-256"
+	SCRAMSHA256Plus = "SCRAM-SHA-256-PLUS"
+)
+
+// 通道绑定类型
+const (
+	ChannelBindingTLSUnique   = "tls-unique"
+	ChannelBindingTLSExporter = "tls-exporter"
+)
+
+// scramPrefix Dovecot 兼容的 SCRAM 密钥前缀，格式为
+// "{SCRAM-SHA-256}iterations,salt,StoredKey,ServerKey"，后三项为 base64
+const scramPrefix = "{SCRAM-SHA-256}"
+
+// scramIterations 生成新密钥时使用的 PBKDF2 迭代次数
+const scramIterations = 4096
+
+// scramFakeSecret 为不存在的用户生成稳定的假盐值，避免通过盐值变化探测用户名
+var scramFakeSecret = func() []byte {
+	b, _ := randomBytes(32)
+	return b
+}()
+
+// scramKeys SCRAM 加盐密钥，服务端只需保存这些值即可完成认证
+type scramKeys struct {
+	iterations int
+	salt       []byte
+	storedKey  []byte
+	serverKey  []byte
+}
+
+// newSCRAMKeys 从密码派生 SCRAM-SHA-256 密钥
+func newSCRAMKeys(password string, salt []byte, iterations int) scramKeys {
+	salted, _ := pbkdf2.Key(sha256.New, password, salt, iterations, sha256.Size)
+	clientKey := hmacSHA256(salted, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	return scramKeys{
+		iterations: iterations,
+		salt:       salt,
+		storedKey:  storedKey[:],
+		serverKey:  hmacSHA256(salted, []byte("Server Key")),
+	}
+}
+
+// String 返回可写入认证文件的形式
+func (k scramKeys) String() string {
+	return fmt.Sprintf("%s%d,%s,%s,%s", scramPrefix, k.iterations,
+		base64.StdEncoding.EncodeToString(k.salt),
+		base64.StdEncoding.EncodeToString(k.storedKey),
+		base64.StdEncoding.EncodeToString(k.serverKey),
+	)
+}
+
+// parseSCRAMKeys 解析 {SCRAM-SHA-256} 格式的密钥
+func parseSCRAMKeys(stored string) (scramKeys, error) {
+	parts := strings.Split(strings.TrimPrefix(stored, scramPrefix), ",")
+	if len(parts) != 4 {
+		return scramKeys{}, fmt.Errorf("malformed SCRAM-SHA-256 hash")
+	}
+	iterations, err := strconv.Atoi(parts[0])
+	if err != nil || iterations <= 0 {
+		return scramKeys{}, fmt.Errorf("malformed SCRAM-SHA-256 iterations: %s", parts[0])
+	}
+
+	var fields [3][]byte
+	for i, p := range parts[1:] {
+		fields[i], err = base64.StdEncoding.DecodeString(p)
+		if err != nil {
+			return scramKeys{}, fmt.Errorf("malformed SCRAM-SHA-256 hash: %w", err)
+		}
+	}
+	if len(fields[1]) != sha256.Size || len(fields[2]) != sha256.Size {
+		return scramKeys{}, fmt.Errorf("malformed SCRAM-SHA-256 hash")
+	}
+	return scramKeys{iterations: iterations, salt: fields[0], storedKey: fields[1], serverKey: fields[2]}, nil
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// SCRAMOptions SCRAM 服务端选项
+type SCRAMOptions struct {
+	// Plus 客户端选择了 -PLUS 机制，必须使用通道绑定
+	Plus bool
+	// PlusAdvertised 服务端公布了 -PLUS 机制，此时客户端声明 "y" 说明可能遭到降级攻击
+	PlusAdvertised bool
+	// ChannelBinding 返回指定类型的通道绑定数据
+	ChannelBinding func(cbType string) ([]byte, error)
+}
+
+// errSCRAMMalformed 客户端消息格式错误
+var errSCRAMMalformed = errors.New("malformed SCRAM message")
+
+// scramServer SCRAM-SHA-256 服务端
+type scramServer struct {
+	a    *Authenticator
+	opts SCRAMOptions
+	done func(username string, ok bool) error
+
+	step            int
+	username        string
+	gs2Header       string
+	cbType          string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+	keys            scramKeys
+	// valid 用户存在且密钥可用，为 false 时认证必定失败
+	valid bool
+}
+
+// NewSCRAMServer 创建 SCRAM-SHA-256 服务端，认证结束后以用户名和结果调用 done，
+// 其返回值作为认证结果返回给客户端；校验成功时在客户端确认服务端签名之后才调用 done
+func (a *Authenticator) NewSCRAMServer(opts SCRAMOptions, done func(username string, ok bool) error) sasl.Server {
+	return &scramServer{a: a, opts: opts, done: done}
+}
+
+func (s *scramServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	switch s.step {
+	case 0:
+		// SCRAM 由客户端先发送消息，没有初始响应时发送空挑战
+		s.step++
+		if response == nil {
+			return []byte{}, false, nil
+		}
+		return s.Next(response)
+	case 1:
+		s.step++
+		if err := s.handleClientFirst(string(response)); err != nil {
+			if errors.Is(err, ErrTemporary) {
+				return nil, true, err
+			}
+			// 格式错误等协商失败同样计为认证失败
+			slog.Warn("SCRAM 协商失败",
+				"username", s.username,
+				"error", err,
+				"timestamp", time.Now().Format(time.RFC3339Nano),
+			)
+			if err := s.done(s.username, false); err != nil {
+				return nil, true, err
+			}
+			return nil, true, err
+		}
+		return []byte(s.serverFirst), false, nil
+	case 2:
+		s.step++
+		signature, err := s.handleClientFinal(string(response))
+		if err != nil {
+			return nil, true, err
+		}
+		return []byte("v=" + base64.StdEncoding.EncodeToString(signature)), false, nil
+	case 3:
+		// 客户端确认服务端签名后发送空响应，此时才完成认证
+		s.step++
+		if len(response) != 0 {
+			return nil, true, sasl.ErrUnexpectedClientResponse
+		}
+		return nil, true, s.done(s.username, true)
+	default:
+		return nil, true, sasl.ErrUnexpectedClientResponse
+	}
+}
+
+// handleClientFirst 解析 client-first-message 并生成 server-first-message
+func (s *scramServer) handleClientFirst(msg string) error {
+	// gs2-header: ("n" / "y" / "p=" cb-name) "," [ "a=" authzid ] ","
+	cbFlag, rest, ok := strings.Cut(msg, ",")
+	if !ok {
+		return errSCRAMMalformed
+	}
+	authzid, bare, ok := strings.Cut(rest, ",")
+	if !ok {
+		return errSCRAMMalformed
+	}
+	s.gs2Header = msg[:len(msg)-len(bare)]
+	s.clientFirstBare = bare
+
+	switch {
+	case cbFlag == "n":
+		if s.opts.Plus {
+			return fmt.Errorf("channel binding is required for %s", SCRAMSHA256Plus)
+		}
+	case cbFlag == "y":
+		if s.opts.Plus {
+			return fmt.Errorf("channel binding is required for %s", SCRAMSHA256Plus)
+		}
+		if s.opts.PlusAdvertised {
+			return fmt.Errorf("client does not use offered channel binding")
+		}
+	case strings.HasPrefix(cbFlag, "p="):
+		if !s.opts.Plus {
+			return fmt.Errorf("channel binding is only allowed with %s", SCRAMSHA256Plus)
+		}
+		s.cbType = strings.TrimPrefix(cbFlag, "p=")
+		if s.cbType != ChannelBindingTLSUnique && s.cbType != ChannelBindingTLSExporter {
+			return fmt.Errorf("unsupported channel binding type: %s", s.cbType)
+		}
+	default:
+		return errSCRAMMalformed
+	}
+
+	attrs := strings.Split(bare, ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "n=") || !strings.HasPrefix(attrs[1], "r=") {
+		return errSCRAMMalformed
+	}
+	username, err := scramUnescape(strings.TrimPrefix(attrs[0], "n="))
+	if err != nil {
+		return err
+	}
+	clientNonce := strings.TrimPrefix(attrs[1], "r=")
+	if clientNonce == "" {
+		return errSCRAMMalformed
+	}
+	s.username = username
+
+	if err := s.lookupKeys(); err != nil {
+		return err
+	}
+
+	// 只允许以认证用户本身的身份操作，否则继续协商但认证必定失败
+	if authzid != "" {
+		identity, err := scramUnescape(strings.TrimPrefix(authzid, "a="))
+		if err != nil || !strings.HasPrefix(authzid, "a=") {
+			return errSCRAMMalformed
+		}
+		if identity != username {
+			s.valid = false
+		}
+	}
+
+	nonce, err := randomBytes(18)
+	if err != nil {
+		return err
+	}
+	s.nonce = clientNonce + base64.RawStdEncoding.EncodeToString(nonce)
+	s.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d", s.nonce,
+		base64.StdEncoding.EncodeToString(s.keys.salt), s.keys.iterations)
+	return nil
+}
+
+// lookupKeys 查找用户的 SCRAM 密钥，用户不存在或密钥不可用时使用假密钥继续协商
+func (s *scramServer) lookupKeys() error {
+	stored, exists, err := s.a.secret(s.username)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		switch Identify(stored) {
+		case SchemeSCRAMSHA256:
+			keys, err := parseSCRAMKeys(stored)
+			if err != nil {
+				return err
+			}
+			s.keys, s.valid = keys, true
+			return nil
+		case SchemePlain:
+			salt, err := randomBytes(16)
+			if err != nil {
+				return err
+			}
+			s.keys = newSCRAMKeys(strings.TrimPrefix(stored, plainPrefix), salt, scramIterations)
+			s.valid = true
+			return nil
+		default:
+			slog.Warn("已存储的密码无法用于 SCRAM 认证",
+				"username", s.username,
+				"scheme", Identify(stored),
+				"timestamp", time.Now().Format(time.RFC3339Nano),
+			)
+		}
+	}
+
+	s.keys = scramKeys{
+		iterations: scramIterations,
+		salt:       hmacSHA256(scramFakeSecret, []byte(s.username))[:16],
+		storedKey:  make([]byte, sha256.Size),
+		serverKey:  make([]byte, sha256.Size),
+	}
+	return nil
+}
+
+// handleClientFinal 校验 client-final-message，成功时返回服务端签名
+func (s *scramServer) handleClientFinal(msg string) ([]byte, error) {
+	i := strings.LastIndex(msg, ",p=")
+	if i < 0 {
+		return nil, errSCRAMMalformed
+	}
+	withoutProof := msg[:i]
+	proof, err := base64.StdEncoding.DecodeString(msg[i+len(",p="):])
+	if err != nil || len(proof) != sha256.Size {
+		return nil, errSCRAMMalformed
+	}
+
+	attrs := strings.Split(withoutProof, ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "c=") || !strings.HasPrefix(attrs[1], "r=") {
+		return nil, errSCRAMMalformed
+	}
+	cbind, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(attrs[0], "c="))
+	if err != nil {
+		return nil, errSCRAMMalformed
+	}
+	if strings.TrimPrefix(attrs[1], "r=") != s.nonce {
+		return nil, fmt.Errorf("SCRAM nonce mismatch")
+	}
+
+	// c= 必须是 gs2-header 加上通道绑定数据
+	expected := []byte(s.gs2Header)
+	if s.cbType != "" {
+		if s.opts.ChannelBinding == nil {
+			return nil, fmt.Errorf("channel binding is not available")
+		}
+		data, err := s.opts.ChannelBinding(s.cbType)
+		if err != nil {
+			return nil, fmt.Errorf("getting %s channel binding: %w", s.cbType, err)
+		}
+		expected = append(expected, data...)
+	}
+	cbindOK := subtle.ConstantTimeCompare(cbind, expected) == 1
+
+	authMessage := []byte(s.clientFirstBare + "," + s.serverFirst + "," + withoutProof)
+	clientSignature := hmacSHA256(s.keys.storedKey, authMessage)
+	clientKey := make([]byte, sha256.Size)
+	for i := range clientKey {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	ok := subtle.ConstantTimeCompare(storedKey[:], s.keys.storedKey) == 1 && cbindOK && s.valid
+
+	if !ok {
+		if err := s.done(s.username, false); err != nil {
+			return nil, err
+		}
+		// done 应在失败时返回错误，这里兜底避免误判为成功
+		return nil, fmt.Errorf("SCRAM authentication failed")
+	}
+	// 校验通过后先发送服务端签名，客户端确认后再调用 done 完成认证
+	return hmacSHA256(s.keys.serverKey, authMessage), nil
+}
+
+// scramUnescape 还原 SCRAM 用户名中的 "=2C" 和 "=3D"
+func scramUnescape(s string) (string, error) {
+	if !strings.Contains(s, "=") {
+		return s, nil
+	}
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] != '=' {
+			buf.WriteByte(s[i])
+			continue
+		}
+		switch {
+		case strings.HasPrefix(s[i:], "=2C"):
+			buf.WriteByte(',')
+		case strings.HasPrefix(s[i:], "=3D"):
+			buf.WriteByte('=')
+		default:
+			return "", errSCRAMMalformed
+		}
+		i += 2
+	}
+	return buf.String(), nil
+}
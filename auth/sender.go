@@ -0,0 +1,113 @@
+package auth
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/catroll/smtpd/internal/mailaddr"
+	"github.com/catroll/smtpd/internal/textfile"
+)
+
+// SenderMap 记录每个登录用户可以使用的发件人地址
+//
+// 映射文件每行一个用户，用户名后跟以空白或逗号分隔的地址规则，# 开头的行为注释：
+//
+//	user1    user1@example.com, sales@example.com
+//	reports  *-reports@example.com
+//	admin    @example.com @example.org
+//
+// 规则可以是完整地址、含 * 或 ? 通配符的地址，或以 @ 开头表示整个域名，
+// 比较时不区分大小写，国际化域名与其 punycode 形式等价。同一用户可以出现在多行中。
+type SenderMap struct {
+	mu       sync.RWMutex
+	rules    map[string][]string
+	filename string
+}
+
+// NewSenderMap 加载发件人映射文件
+func NewSenderMap(filename string) (*SenderMap, error) {
+	m := &SenderMap{filename: filename}
+	if err := m.Reload(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Reload 重新加载映射文件，失败时保留原有规则
+func (m *SenderMap) Reload() error {
+	data, err := os.ReadFile(m.filename)
+	if err != nil {
+		slog.Error("读取发件人映射文件失败",
+			"file", m.filename,
+			"error", err,
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+		return err
+	}
+
+	rules := make(map[string][]string)
+	err = textfile.ScanLines(data, func(lineno int, line string) error {
+		fields := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+		if len(fields) < 2 {
+			return fmt.Errorf("line %d: expected username followed by addresses", lineno)
+		}
+		for _, field := range fields[1:] {
+			// 域名统一转换为 punycode，与信封地址的形式一致
+			pattern, err := mailaddr.Pattern(field)
+			if err != nil {
+				return fmt.Errorf("line %d: invalid pattern %q: %w", lineno, field, err)
+			}
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("line %d: invalid pattern %q", lineno, field)
+			}
+			rules[fields[0]] = append(rules[fields[0]], pattern)
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("解析发件人映射文件失败",
+			"file", m.filename,
+			"error", err,
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+		return err
+	}
+
+	m.mu.Lock()
+	m.rules = rules
+	m.mu.Unlock()
+
+	slog.Info("加载发件人映射成功",
+		"file", m.filename,
+		"users", len(rules),
+		"timestamp", time.Now().Format(time.RFC3339Nano),
+	)
+	return nil
+}
+
+// Allowed 判断用户是否可以使用该发件人地址；
+// 用户名本身是邮件地址时总是可以使用该地址
+func (m *SenderMap) Allowed(username, address string) bool {
+	address = strings.ToLower(address)
+	if strings.Contains(username, "@") && strings.ToLower(username) == address {
+		return true
+	}
+
+	m.mu.RLock()
+	patterns := m.rules[username]
+	m.mu.RUnlock()
+
+	for _, pattern := range patterns {
+		if mailaddr.Match(pattern, address) {
+			return true
+		}
+	}
+	return false
+}
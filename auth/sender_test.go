@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSenderMapAllowed(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "senders")
+	content := "# 发件人映射\n" +
+		"user1    user1@example.com, Sales@Example.com\n" +
+		"reports  *-reports@example.com\n" +
+		"admin    @example.com @example.org\n" +
+		"user1    @lists.example.com\n" +
+		"intl     @Bücher.example, *@xn--mnchen-3ya.example\n"
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	m, err := NewSenderMap(filename)
+	if err != nil {
+		t.Fatalf("NewSenderMap() error = %v", err)
+	}
+
+	tests := []struct {
+		username string
+		address  string
+		want     bool
+	}{
+		{"user1", "user1@example.com", true},
+		{"user1", "USER1@EXAMPLE.COM", true},
+		{"user1", "sales@example.com", true},
+		{"user1", "news@lists.example.com", true},
+		{"user1", "admin@example.com", false},
+		{"reports", "daily-reports@example.com", true},
+		{"reports", "reports@example.com", false},
+		{"admin", "anyone@example.org", true},
+		{"admin", "anyone@sub.example.org", false},
+		{"admin", "anyone@example.net", false},
+		{"unknown", "unknown@example.com", false},
+		// 国际化域名与 punycode 等价
+		{"intl", "x@xn--bcher-kva.example", true},
+		{"intl", "x@xn--mnchen-3ya.example", true},
+		{"intl", "x@bucher.example", false},
+		// 用户名本身是邮件地址
+		{"alice@example.net", "Alice@example.net", true},
+		{"alice@example.net", "bob@example.net", false},
+	}
+
+	for _, tt := range tests {
+		if got := m.Allowed(tt.username, tt.address); got != tt.want {
+			t.Errorf("Allowed(%q, %q) = %v, want %v", tt.username, tt.address, got, tt.want)
+		}
+	}
+}
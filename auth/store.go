@@ -0,0 +1,60 @@
+package auth
+
+import "errors"
+
+// ErrUnsupported 表示凭据存储不支持该操作
+var ErrUnsupported = errors.New("operation not supported by credential store")
+
+// ErrTemporary 表示凭据存储暂时无法给出结果，客户端应稍后重试
+var ErrTemporary = errors.New("temporary authentication failure")
+
+// Store 凭据存储，Authenticator 通过它查询和校验用户
+type Store interface {
+	// Lookup 查询用户是否存在
+	Lookup(username string) (bool, error)
+	// Verify 校验用户名和密码，用户不存在或密码错误时返回 false
+	Verify(username, password string) (bool, error)
+	// List 返回所有用户名
+	List() ([]string, error)
+}
+
+// SecretStore 能够返回已存储凭据的存储，CRAM-MD5、SCRAM 等质询-响应机制需要它
+type SecretStore interface {
+	Store
+	// Secret 返回用户已存储的密码哈希或密钥，用户不存在时返回 false
+	Secret(username string) (string, bool, error)
+}
+
+// SchemeStore 能够列出已存储凭据所用方案的存储，用于判断质询-响应机制是否可用
+type SchemeStore interface {
+	SecretStore
+	// Schemes 返回当前可用于认证的已存储凭据的方案
+	Schemes() []Scheme
+}
+
+// AccountStore 能够返回账户属性的存储
+type AccountStore interface {
+	Store
+	// Account 返回用户的账户记录，用户不存在时返回 false
+	Account(username string) (*Account, bool, error)
+}
+
+// ClientInfo 认证请求的客户端信息，转发给外部认证服务，用于其日志和策略
+type ClientInfo struct {
+	// SessionID 会话 ID
+	SessionID string
+	// LocalAddr 和 RemoteAddr 为 host:port 格式的本地和客户端地址
+	LocalAddr  string
+	RemoteAddr string
+	// Secured 连接是否已加密
+	Secured bool
+	// Mechanism 客户端使用的认证机制
+	Mechanism string
+}
+
+// ClientVerifier 校验时需要客户端信息的存储
+type ClientVerifier interface {
+	Store
+	// VerifyClient 校验用户名和密码，info 为发起认证的客户端
+	VerifyClient(username, password string, info ClientInfo) (bool, error)
+}
@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"time"
+)
+
+// 管理用户时的错误
+var (
+	ErrUserExists   = errors.New("user already exists")
+	ErrUserNotFound = errors.New("user not found")
+)
+
+// AddUser 添加用户，使用配置的方案（默认 bcrypt）哈希密码后写回文件
+func (s *FileStore) AddUser(username, password string) error {
+	if err := s.format.checkUsername(username); err != nil {
+		return err
+	}
+	hash, err := s.hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	err = s.updateAccounts(func(accounts map[string]*Account) error {
+		if _, ok := accounts[username]; ok {
+			return fmt.Errorf("%w: %s", ErrUserExists, username)
+		}
+		accounts[username] = &Account{Username: username, Password: hash}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.Info("添加用户",
+		"username", username,
+		"file", s.filename,
+		"timestamp", time.Now().Format(time.RFC3339Nano),
+	)
+	return nil
+}
+
+// SetPassword 修改用户的账户密码，账户的其他属性和应用专用密码保持不变
+func (s *FileStore) SetPassword(username, password string) error {
+	hash, err := s.hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	err = s.updateAccounts(func(accounts map[string]*Account) error {
+		account, ok := accounts[username]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrUserNotFound, username)
+		}
+		// 记录可能正被其他会话读取，替换为副本而不是原地修改
+		updated := *account
+		updated.Password = hash
+		accounts[username] = &updated
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.Info("修改用户密码",
+		"username", username,
+		"file", s.filename,
+		"timestamp", time.Now().Format(time.RFC3339Nano),
+	)
+	return nil
+}
+
+// DeleteUser 删除用户
+func (s *FileStore) DeleteUser(username string) error {
+	err := s.updateAccounts(func(accounts map[string]*Account) error {
+		if _, ok := accounts[username]; !ok {
+			return fmt.Errorf("%w: %s", ErrUserNotFound, username)
+		}
+		delete(accounts, username)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.Info("删除用户",
+		"username", username,
+		"file", s.filename,
+		"timestamp", time.Now().Format(time.RFC3339Nano),
+	)
+	return nil
+}
+
+// hashPassword 使用配置的方案哈希新密码，未配置时使用 bcrypt
+func (s *FileStore) hashPassword(password string) (string, error) {
+	if password == "" {
+		return "", fmt.Errorf("password must not be empty")
+	}
+	scheme := s.opts.PasswordScheme
+	if scheme == SchemeUnknown {
+		scheme = SchemeBcrypt
+	}
+	return Hash(scheme, password)
+}
+
+// updateAccounts 在账户表的副本上执行修改并原子地写回文件，写入失败时保留原有账户
+func (s *FileStore) updateAccounts(fn func(accounts map[string]*Account) error) error {
+	if s.format.encode == nil {
+		return fmt.Errorf("%w: %s files cannot be written", ErrUnsupported, s.format.name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	accounts := maps.Clone(s.accounts)
+	if err := fn(accounts); err != nil {
+		return err
+	}
+
+	old := s.accounts
+	s.accounts = accounts
+	if err := s.saveLocked(); err != nil {
+		s.accounts = old
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestManageUsers(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		content string
+		open    func(string, Options) (*FileStore, error)
+	}{
+		{"json", `{"user1": {"password": "{PLAIN}password123", "tags": ["ops"]}}`, NewJSONStore},
+		{"htpasswd", "user1:{PLAIN}password123\n", NewHtpasswdStore},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authFile := filepath.Join(dir, tt.name)
+			if err := os.WriteFile(authFile, []byte(tt.content), 0640); err != nil {
+				t.Fatalf("Failed to write auth file: %v", err)
+			}
+			store, err := tt.open(authFile, Options{AllowPlaintext: true})
+			if err != nil {
+				t.Fatalf("Failed to open store: %v", err)
+			}
+
+			if err := store.AddUser("user2", "secret2"); err != nil {
+				t.Fatalf("AddUser() error = %v", err)
+			}
+			if err := store.AddUser("user2", "again"); !errors.Is(err, ErrUserExists) {
+				t.Errorf("AddUser() existing user error = %v, want %v", err, ErrUserExists)
+			}
+			if err := store.SetPassword("user1", "newpass"); err != nil {
+				t.Fatalf("SetPassword() error = %v", err)
+			}
+			if err := store.SetPassword("nobody", "x"); !errors.Is(err, ErrUserNotFound) {
+				t.Errorf("SetPassword() unknown user error = %v, want %v", err, ErrUserNotFound)
+			}
+
+			// 重新加载文件，确认修改已写入且密码已哈希
+			reloaded, err := tt.open(authFile, Options{})
+			if err != nil {
+				t.Fatalf("Failed to reload store: %v", err)
+			}
+			for username, password := range map[string]string{"user1": "newpass", "user2": "secret2"} {
+				if ok, _ := reloaded.Verify(username, password); !ok {
+					t.Errorf("Verify(%q) after reload failed", username)
+				}
+				account, _, _ := reloaded.Account(username)
+				if Identify(account.Password) != SchemeBcrypt {
+					t.Errorf("Password for %q stored as %s, want bcrypt", username, Identify(account.Password))
+				}
+			}
+			if account, _, _ := reloaded.Account("user1"); tt.name == "json" && len(account.Tags) != 1 {
+				t.Errorf("SetPassword() lost account attributes: %+v", account)
+			}
+
+			if err := store.DeleteUser("user2"); err != nil {
+				t.Fatalf("DeleteUser() error = %v", err)
+			}
+			if err := store.DeleteUser("user2"); !errors.Is(err, ErrUserNotFound) {
+				t.Errorf("DeleteUser() twice error = %v, want %v", err, ErrUserNotFound)
+			}
+			data, err := os.ReadFile(authFile)
+			if err != nil {
+				t.Fatalf("Failed to read auth file: %v", err)
+			}
+			if strings.Contains(string(data), "user2") || strings.Contains(string(data), "newpass") {
+				t.Errorf("Unexpected auth file content: %s", data)
+			}
+
+			fi, err := os.Stat(authFile)
+			if err != nil {
+				t.Fatalf("Failed to stat auth file: %v", err)
+			}
+			if fi.Mode().Perm() != 0640 {
+				t.Errorf("Auth file mode = %v, want 0640", fi.Mode().Perm())
+			}
+		})
+	}
+}
+
+func TestManageUsersReadOnlyFormat(t *testing.T) {
+	authFile := filepath.Join(t.TempDir(), "passwd")
+	if err := os.WriteFile(authFile, []byte("user1:{PLAIN}password123::::::\n"), 0600); err != nil {
+		t.Fatalf("Failed to write auth file: %v", err)
+	}
+	store, err := NewPasswdFileStore(authFile, Options{})
+	if err != nil {
+		t.Fatalf("NewPasswdFileStore() error = %v", err)
+	}
+	if err := store.AddUser("user2", "secret"); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("AddUser() error = %v, want %v", err, ErrUnsupported)
+	}
+}
+
+func TestAddUserInvalidName(t *testing.T) {
+	dir := t.TempDir()
+	empty := map[string]string{"json": "{}", "htpasswd": ""}
+	tests := []struct {
+		format   string
+		open     func(string, Options) (*FileStore, error)
+		username string
+		wantErr  bool
+	}{
+		{"json", NewJSONStore, "user name", false},
+		{"json", NewJSONStore, "", true},
+		{"json", NewJSONStore, "user:name", true},
+		{"json", NewJSONStore, "user\nname", true},
+		{"json", NewJSONStore, "user\x00", true},
+		{"htpasswd", NewHtpasswdStore, "user@example.com", false},
+		{"htpasswd", NewHtpasswdStore, "user:name", true},
+		{"htpasswd", NewHtpasswdStore, "user\r", true},
+		{"htpasswd", NewHtpasswdStore, "user name", true},
+		{"htpasswd", NewHtpasswdStore, "\tuser", true},
+		{"htpasswd", NewHtpasswdStore, "#user", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format+"/"+tt.username, func(t *testing.T) {
+			authFile := filepath.Join(dir, tt.format)
+			if err := os.WriteFile(authFile, []byte(empty[tt.format]), 0600); err != nil {
+				t.Fatalf("Failed to write auth file: %v", err)
+			}
+			store, err := tt.open(authFile, Options{})
+			if err != nil {
+				t.Fatalf("Failed to open store: %v", err)
+			}
+			if err := store.AddUser(tt.username, "secret"); (err != nil) != tt.wantErr {
+				t.Errorf("AddUser(%q) error = %v, wantErr %v", tt.username, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"log/slog"
+	"os"
+	"time"
+)
+
+// Reload 重新读取认证文件并原子地替换内存中的凭据；
+// 文件无法读取或解析时保留原有凭据并返回错误
+func (s *FileStore) Reload() error {
+	return s.load(true)
+}
+
+// Watch 按 interval 轮询认证文件，发现修改时间或大小变化后重新加载，
+// 直到 stop 被关闭
+func (s *FileStore) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		fi, err := os.Stat(s.filename)
+		if err != nil {
+			// 编辑器保存文件时可能短暂不存在，等待下一次轮询
+			slog.Debug("检查认证文件失败",
+				"file", s.filename,
+				"error", err,
+				"timestamp", time.Now().Format(time.RFC3339Nano),
+			)
+			continue
+		}
+
+		s.mu.RLock()
+		unchanged := fi.ModTime().Equal(s.modTime) && fi.Size() == s.size
+		s.mu.RUnlock()
+		if unchanged {
+			continue
+		}
+
+		// 失败时已记录日志并保留原有凭据
+		s.Reload()
+	}
+}
+
+// diffAccounts 统计两组账户之间新增、删除和修改的用户数
+func diffAccounts(old, new map[string]*Account) (added, removed, changed int) {
+	for username, account := range new {
+		prev, ok := old[username]
+		switch {
+		case !ok:
+			added++
+		case !prev.equal(account):
+			changed++
+		}
+	}
+	for username := range old {
+		if _, ok := new[username]; !ok {
+			removed++
+		}
+	}
+	return added, removed, changed
+}
@@ -0,0 +1,53 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStoreWatch(t *testing.T) {
+	authFile := filepath.Join(t.TempDir(), "auth.txt")
+	if err := os.WriteFile(authFile, []byte(`{"user1": "{PLAIN}a"}`), 0600); err != nil {
+		t.Fatalf("Failed to write auth file: %v", err)
+	}
+
+	store, err := NewJSONStore(authFile, Options{AllowPlaintext: true})
+	if err != nil {
+		t.Fatalf("NewJSONStore() error = %v", err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go store.Watch(10*time.Millisecond, stop)
+
+	waitFor := func(username string, want bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			if ok, _ := store.Lookup(username); ok == want {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Lookup(%q) did not become %v", username, want)
+	}
+
+	// 新增用户并撤销旧用户
+	if err := os.WriteFile(authFile, []byte(`{"user2": "{PLAIN}bb"}`), 0600); err != nil {
+		t.Fatalf("Failed to write auth file: %v", err)
+	}
+	waitFor("user2", true)
+	waitFor("user1", false)
+
+	// 解析失败时保留原有凭据
+	if err := os.WriteFile(authFile, []byte(`{"user3": `), 0600); err != nil {
+		t.Fatalf("Failed to write auth file: %v", err)
+	}
+	if err := store.Reload(); err == nil {
+		t.Fatalf("Reload() of broken file succeeded")
+	}
+	if ok, _ := store.Verify("user2", "bb"); !ok {
+		t.Errorf("Existing credentials lost after failed reload")
+	}
+}
@@ -2,20 +2,55 @@ package config
 
 import (
 	"fmt"
+	"net/netip"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
-// Load 从文件加载配置
+// DefaultAuthMechanisms 未配置时公布的认证机制
+var DefaultAuthMechanisms = []string{"PLAIN", "LOGIN"}
+
+// New 创建带有默认值的配置
+func New() *Config {
+	cfg := &Config{}
+	cfg.Server.Host = "127.0.0.1"
+	cfg.Server.Port = 2525
+	cfg.Server.InstanceName = "smtpd"
+	cfg.Server.RejectMessage = "Access denied"
+	cfg.Server.RateLimit.MaxTrackedIPs = 10000
+	cfg.SMTP.Hostname = "localhost"
+	cfg.SMTP.MaxSize = 10 << 20
+	cfg.SMTP.MaxRecipients = 100
+	cfg.SMTP.RecipientDelimiter = "+"
+	cfg.SMTP.AuthReloadInterval = 5 * time.Second
+	cfg.SMTP.BruteForce.Window = 15 * time.Minute
+	cfg.SMTP.BruteForce.MaxIPFailures = 20
+	cfg.SMTP.BruteForce.MaxUserFailures = 5
+	cfg.SMTP.BruteForce.Lockout = 15 * time.Minute
+	cfg.SMTP.BruteForce.BaseDelay = time.Second
+	cfg.SMTP.BruteForce.MaxDelay = 30 * time.Second
+	cfg.SMTP.BruteForce.MaxSessionFailures = 3
+	cfg.SMTP.Greylist.Delay = 5 * time.Minute
+	cfg.SMTP.Greylist.RetryWindow = 4 * time.Hour
+	cfg.SMTP.Greylist.Expire = 36 * 24 * time.Hour
+	cfg.Storage.Path = "./maildata"
+	return cfg
+}
+
+// Load 从文件加载配置，未设置的字段使用 New 中的默认值
 func Load(filename string) (*Config, error) {
 	data, err := os.ReadFile(filename)
 	if err != nil {
 		return nil, fmt.Errorf("reading config file: %w", err)
 	}
 
-	cfg := &Config{}
+	cfg := New()
 	if err := yaml.Unmarshal(data, cfg); err != nil {
 		return nil, fmt.Errorf("parsing config file: %w", err)
 	}
@@ -50,14 +85,121 @@ func (c *Config) Validate() error {
 	if c.SMTP.MaxRecipients <= 0 {
 		return fmt.Errorf("invalid smtp max recipients")
 	}
-	if !c.SMTP.AllowAnonymous && c.SMTP.AuthFile == "" {
-		return fmt.Errorf("auth file is required when anonymous access is disabled")
+	switch c.SMTP.AuthStore {
+	case "", "json", "htpasswd", "passwd-file":
+		if !c.SMTP.AllowAnonymous && c.SMTP.AuthFile == "" && c.SMTP.OAuth.JWKS == "" && c.TLS.ClientCertMap == "" && len(c.SMTP.TrustedNetworks) == 0 {
+			return fmt.Errorf("auth file is required when anonymous access is disabled")
+		}
+		if c.SMTP.AuthFile != "" {
+			if _, err := os.Stat(c.SMTP.AuthFile); err != nil {
+				return fmt.Errorf("auth file not found: %w", err)
+			}
+		}
+	case "ldap":
+		if c.SMTP.LDAP.URL == "" {
+			return fmt.Errorf("ldap url is required when auth store is ldap")
+		}
+		if c.SMTP.LDAP.UserDN == "" && c.SMTP.LDAP.BaseDN == "" {
+			return fmt.Errorf("ldap user_dn or base_dn is required when auth store is ldap")
+		}
+	case "checkpassword":
+		if len(c.SMTP.Checkpassword.Command) == 0 {
+			return fmt.Errorf("checkpassword command is required when auth store is checkpassword")
+		}
+		if c.SMTP.Checkpassword.Timeout < 0 || c.SMTP.Checkpassword.MaxConcurrent < 0 {
+			return fmt.Errorf("invalid checkpassword timeout or concurrency limit")
+		}
+	case "dovecot":
+		if c.SMTP.Dovecot.Socket == "" {
+			return fmt.Errorf("dovecot socket is required when auth store is dovecot")
+		}
+		if c.SMTP.Dovecot.Timeout < 0 {
+			return fmt.Errorf("invalid dovecot timeout")
+		}
+	case "http":
+		h := c.SMTP.HTTPAuth
+		if u, err := url.Parse(h.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("http_auth url must be an http or https url when auth store is http")
+		}
+		if h.Timeout < 0 || h.CacheTTL < 0 || h.BreakerThreshold < 0 || h.BreakerCooldown < 0 {
+			return fmt.Errorf("http_auth timeout, cache ttl and breaker settings must not be negative")
+		}
+	default:
+		return fmt.Errorf("invalid smtp auth store: %s", c.SMTP.AuthStore)
+	}
+	if err := validateAuthMechanisms(c.SMTP.AuthMechanisms); err != nil {
+		return err
 	}
-	if c.SMTP.AuthFile != "" {
-		if _, err := os.Stat(c.SMTP.AuthFile); err != nil {
-			return fmt.Errorf("auth file not found: %w", err)
+	if c.SMTP.OAuth.JWKS != "" {
+		if _, err := os.Stat(c.SMTP.OAuth.JWKS); err != nil {
+			return fmt.Errorf("oauth jwks not found: %w", err)
+		}
+		if c.SMTP.OAuth.Issuer == "" || c.SMTP.OAuth.Audience == "" {
+			return fmt.Errorf("oauth issuer and audience are required when jwks is set")
 		}
 	}
+	if c.SMTP.SenderLoginMap != "" {
+		if _, err := os.Stat(c.SMTP.SenderLoginMap); err != nil {
+			return fmt.Errorf("sender login map not found: %w", err)
+		}
+	} else if c.SMTP.CheckFromHeader {
+		return fmt.Errorf("sender login map is required when check_from_header is enabled")
+	}
+	if c.SMTP.VirtualAliasMap != "" {
+		if _, err := os.Stat(c.SMTP.VirtualAliasMap); err != nil {
+			return fmt.Errorf("virtual alias map not found: %w", err)
+		}
+	}
+	if lr := c.SMTP.LocalRecipients; lr.File != "" {
+		if _, err := os.Stat(lr.File); err != nil {
+			return fmt.Errorf("local recipients file not found: %w", err)
+		}
+	} else if (lr.DelayReject || len(lr.Domains) > 0) && !lr.FromUsers {
+		return fmt.Errorf("local recipients file or from_users is required when domains or delay_reject is set")
+	}
+	for _, ps := range c.SMTP.PolicyServices {
+		if err := validatePolicyService(ps); err != nil {
+			return err
+		}
+	}
+	for _, m := range c.SMTP.Milters {
+		if err := validateMilter(m); err != nil {
+			return err
+		}
+	}
+	if bf := c.SMTP.BruteForce; bf.Enabled {
+		if bf.Window <= 0 || bf.Lockout <= 0 {
+			return fmt.Errorf("brute force window and lockout must be positive")
+		}
+		if bf.MaxIPFailures < 0 || bf.MaxUserFailures < 0 || bf.MaxSessionFailures < 0 {
+			return fmt.Errorf("brute force failure limits must not be negative")
+		}
+		if bf.BaseDelay < 0 || bf.MaxDelay < 0 {
+			return fmt.Errorf("brute force delays must not be negative")
+		}
+	}
+	if gl := c.SMTP.Greylist; gl.Enabled {
+		if gl.Delay <= 0 || gl.RetryWindow <= gl.Delay || gl.Expire <= 0 {
+			return fmt.Errorf("greylist delay and expire must be positive and retry window longer than delay")
+		}
+		for _, network := range gl.WhitelistNetworks {
+			if _, err := netip.ParsePrefix(network); err != nil {
+				if _, err := netip.ParseAddr(network); err != nil {
+					return fmt.Errorf("invalid greylist whitelist network %q", network)
+				}
+			}
+		}
+	}
+	for _, l := range []QuotaLimits{c.SMTP.Quota.User, c.SMTP.Quota.IP} {
+		if l.MessagesPerHour < 0 || l.MessagesPerDay < 0 || l.RecipientsPerDay < 0 || l.BytesPerDay < 0 {
+			return fmt.Errorf("quota limits must not be negative")
+		}
+	}
+	switch c.SMTP.PasswordScheme {
+	case "", "bcrypt", "argon2id", "sha512-crypt", "ssha", "scram-sha-256", "cram-md5":
+	default:
+		return fmt.Errorf("invalid smtp password scheme: %s", c.SMTP.PasswordScheme)
+	}
 
 	// 验证存储配置
 	if c.Storage.Path == "" {
@@ -81,6 +223,59 @@ func (c *Config) Validate() error {
 			return fmt.Errorf("key file not found: %w", err)
 		}
 	}
+	if c.TLS.ClientCAFile != "" || c.TLS.ClientCertMap != "" {
+		if !c.TLS.Enabled {
+			return fmt.Errorf("tls must be enabled to use client certificates")
+		}
+		if c.TLS.ClientCAFile == "" || c.TLS.ClientCertMap == "" {
+			return fmt.Errorf("client ca file and client cert map must be set together")
+		}
+		if _, err := os.Stat(c.TLS.ClientCAFile); err != nil {
+			return fmt.Errorf("client ca file not found: %w", err)
+		}
+		if _, err := os.Stat(c.TLS.ClientCertMap); err != nil {
+			return fmt.Errorf("client cert map not found: %w", err)
+		}
+	}
+
+	if rl := c.Server.RateLimit; rl.MaxConnections < 0 || rl.MaxConnectionsPerIP < 0 ||
+		rl.ConnectionRate < 0 || rl.ConnectionRatePerIP < 0 || rl.CommandRate < 0 {
+		return fmt.Errorf("rate limits must not be negative")
+	} else if rl.MaxTrackedIPs <= 0 {
+		return fmt.Errorf("rate limit max tracked ips must be positive")
+	}
+
+	for _, network := range c.SMTP.TrustedNetworks {
+		if _, err := netip.ParsePrefix(network); err != nil {
+			if _, err := netip.ParseAddr(network); err != nil {
+				return fmt.Errorf("invalid trusted network %q", network)
+			}
+		}
+	}
+
+	if c.Server.AccessList != "" {
+		if _, err := os.Stat(c.Server.AccessList); err != nil {
+			return fmt.Errorf("access list not found: %w", err)
+		}
+	}
+
+	// 验证监听器配置
+	for i, l := range c.Server.Listeners {
+		if l.Port <= 0 || l.Port > 65535 {
+			return fmt.Errorf("invalid port for listener %d", i)
+		}
+		if l.ImplicitTLS && !c.TLS.Enabled {
+			return fmt.Errorf("listener %d uses implicit TLS but TLS is not enabled", i)
+		}
+		if err := validateAuthMechanisms(l.AuthMechanisms); err != nil {
+			return fmt.Errorf("listener %d: %w", i, err)
+		}
+		if l.AccessList != "" {
+			if _, err := os.Stat(l.AccessList); err != nil {
+				return fmt.Errorf("listener %d: access list not found: %w", i, err)
+			}
+		}
+	}
 
 	// 验证日志配置
 	if c.Log.Level != "" {
@@ -106,3 +301,84 @@ func (c *Config) Validate() error {
 
 	return nil
 }
+
+// validateAuthMechanisms 检查认证机制名称是否受支持
+func validateAuthMechanisms(mechanisms []string) error {
+	for _, mech := range mechanisms {
+		switch mech {
+		case "PLAIN", "LOGIN", "CRAM-MD5", "SCRAM-SHA-256", "SCRAM-SHA-256-PLUS", "OAUTHBEARER", "XOAUTH2", "EXTERNAL":
+		default:
+			return fmt.Errorf("invalid auth mechanism: %s", mech)
+		}
+	}
+	return nil
+}
+
+// validatePolicyService 检查策略服务的地址、阶段和超时
+func validatePolicyService(ps PolicyService) error {
+	if !strings.HasPrefix(ps.Address, "inet:") && !strings.HasPrefix(ps.Address, "unix:") {
+		return fmt.Errorf("invalid policy service address %q: expected inet:host:port or unix:/path", ps.Address)
+	}
+	for _, stage := range ps.Stages {
+		switch stage {
+		case "rcpt", "data", "end-of-message":
+		default:
+			return fmt.Errorf("invalid policy service stage: %s", stage)
+		}
+	}
+	if ps.Timeout < 0 {
+		return fmt.Errorf("invalid policy service timeout")
+	}
+	return nil
+}
+
+// validateMilter 检查 milter 的地址、超时和默认动作
+func validateMilter(m Milter) error {
+	if !strings.HasPrefix(m.Address, "inet:") && !strings.HasPrefix(m.Address, "unix:") {
+		return fmt.Errorf("invalid milter address %q: expected inet:host:port or unix:/path", m.Address)
+	}
+	if m.Timeout < 0 {
+		return fmt.Errorf("invalid milter timeout")
+	}
+	switch m.DefaultAction {
+	case "", "tempfail", "accept", "reject":
+	default:
+		return fmt.Errorf("invalid milter default action: %s", m.DefaultAction)
+	}
+	return nil
+}
+
+// Listeners 返回所有监听器：server.host:port 上的默认监听器在前，
+// 其后是 server.listeners 中的监听器，未配置的字段已填入默认值
+func (c *Config) Listeners() []Listener {
+	mechanisms := c.SMTP.AuthMechanisms
+	if len(mechanisms) == 0 {
+		mechanisms = DefaultAuthMechanisms
+		if c.SMTP.OAuth.JWKS != "" {
+			mechanisms = append(slices.Clone(mechanisms), "OAUTHBEARER", "XOAUTH2")
+		}
+		if c.TLS.ClientCertMap != "" {
+			mechanisms = append(slices.Clone(mechanisms), "EXTERNAL")
+		}
+	}
+
+	listeners := []Listener{{
+		Name:           "default",
+		Host:           c.Server.Host,
+		Port:           c.Server.Port,
+		AuthMechanisms: mechanisms,
+	}}
+	for i, l := range c.Server.Listeners {
+		if l.Name == "" {
+			l.Name = fmt.Sprintf("listener-%d", i)
+		}
+		if l.Host == "" {
+			l.Host = c.Server.Host
+		}
+		if len(l.AuthMechanisms) == 0 {
+			l.AuthMechanisms = mechanisms
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners
+}
@@ -4,6 +4,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestLoadConfig(t *testing.T) {
@@ -15,6 +16,7 @@ server:
 
 smtp:
   hostname: "test.local"
+  allow_anonymous: true
   max_size: 5242880
   max_recipients: 50
 
@@ -48,6 +50,13 @@ tls:
 	}
 }
 
+// newAnonymousConfig 返回允许匿名访问、可以通过验证的默认配置，各用例在其上修改
+func newAnonymousConfig() *Config {
+	cfg := New()
+	cfg.SMTP.AllowAnonymous = true
+	return cfg
+}
+
 func TestConfigValidation(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -55,14 +64,19 @@ func TestConfigValidation(t *testing.T) {
 		wantErr bool
 	}{
 		{
-			name:    "Valid default config",
-			config:  New(),
+			name:    "Valid anonymous config",
+			config:  newAnonymousConfig(),
 			wantErr: false,
 		},
+		{
+			name:    "Default config without auth",
+			config:  New(),
+			wantErr: true,
+		},
 		{
 			name: "Invalid port",
 			config: func() *Config {
-				cfg := New()
+				cfg := newAnonymousConfig()
 				cfg.Server.Port = 70000
 				return cfg
 			}(),
@@ -71,7 +85,7 @@ func TestConfigValidation(t *testing.T) {
 		{
 			name: "Invalid max size",
 			config: func() *Config {
-				cfg := New()
+				cfg := newAnonymousConfig()
 				cfg.SMTP.MaxSize = 0
 				return cfg
 			}(),
@@ -80,12 +94,150 @@ func TestConfigValidation(t *testing.T) {
 		{
 			name: "Invalid max recipients",
 			config: func() *Config {
-				cfg := New()
+				cfg := newAnonymousConfig()
 				cfg.SMTP.MaxRecipients = -1
 				return cfg
 			}(),
 			wantErr: true,
 		},
+		{
+			name: "Invalid auth mechanism",
+			config: func() *Config {
+				cfg := newAnonymousConfig()
+				cfg.SMTP.AuthMechanisms = []string{"PLAIN", "DIGEST-MD5"}
+				return cfg
+			}(),
+			wantErr: true,
+		},
+		{
+			name: "Implicit TLS listener without TLS",
+			config: func() *Config {
+				cfg := newAnonymousConfig()
+				cfg.Server.Listeners = []Listener{{Port: 4650, ImplicitTLS: true}}
+				return cfg
+			}(),
+			wantErr: true,
+		},
+		{
+			name: "Brute force protection without lockout",
+			config: func() *Config {
+				cfg := newAnonymousConfig()
+				cfg.SMTP.BruteForce.Enabled = true
+				cfg.SMTP.BruteForce.Lockout = 0
+				return cfg
+			}(),
+			wantErr: true,
+		},
+		{
+			name: "Invalid trusted network",
+			config: func() *Config {
+				cfg := newAnonymousConfig()
+				cfg.SMTP.TrustedNetworks = []string{"10.0.0.0/33"}
+				return cfg
+			}(),
+			wantErr: true,
+		},
+		{
+			name: "Trusted networks without auth file",
+			config: func() *Config {
+				cfg := newAnonymousConfig()
+				cfg.SMTP.AllowAnonymous = false
+				cfg.SMTP.TrustedNetworks = []string{"10.0.0.0/8", "192.0.2.1"}
+				return cfg
+			}(),
+		},
+		{
+			name: "Negative quota",
+			config: func() *Config {
+				cfg := newAnonymousConfig()
+				cfg.SMTP.Quota.IP.MessagesPerHour = -1
+				return cfg
+			}(),
+			wantErr: true,
+		},
+		{
+			name: "Negative connection rate",
+			config: func() *Config {
+				cfg := newAnonymousConfig()
+				cfg.Server.RateLimit.ConnectionRatePerIP = -1
+				return cfg
+			}(),
+			wantErr: true,
+		},
+		{
+			name: "Greylist retry window shorter than delay",
+			config: func() *Config {
+				cfg := newAnonymousConfig()
+				cfg.SMTP.Greylist.Enabled = true
+				cfg.SMTP.Greylist.RetryWindow = time.Minute
+				return cfg
+			}(),
+			wantErr: true,
+		},
+		{
+			name: "Missing virtual alias map",
+			config: func() *Config {
+				cfg := newAnonymousConfig()
+				cfg.SMTP.VirtualAliasMap = "/nonexistent/virtual"
+				return cfg
+			}(),
+			wantErr: true,
+		},
+		{
+			name: "Local recipient domains without source",
+			config: func() *Config {
+				cfg := newAnonymousConfig()
+				cfg.SMTP.LocalRecipients.Domains = []string{"example.com"}
+				return cfg
+			}(),
+			wantErr: true,
+		},
+		{
+			name: "Invalid policy service stage",
+			config: func() *Config {
+				cfg := newAnonymousConfig()
+				cfg.SMTP.PolicyServices = []PolicyService{{Address: "inet:127.0.0.1:10023", Stages: []string{"mail"}}}
+				return cfg
+			}(),
+			wantErr: true,
+		},
+		{
+			name: "Policy service without address type",
+			config: func() *Config {
+				cfg := newAnonymousConfig()
+				cfg.SMTP.PolicyServices = []PolicyService{{Address: "127.0.0.1:10023"}}
+				return cfg
+			}(),
+			wantErr: true,
+		},
+		{
+			name: "Milter without address type",
+			config: func() *Config {
+				cfg := newAnonymousConfig()
+				cfg.SMTP.Milters = []Milter{{Address: "127.0.0.1:8891"}}
+				return cfg
+			}(),
+			wantErr: true,
+		},
+		{
+			name: "Invalid milter default action",
+			config: func() *Config {
+				cfg := newAnonymousConfig()
+				cfg.SMTP.Milters = []Milter{{Address: "unix:/run/opendkim.sock", DefaultAction: "discard"}}
+				return cfg
+			}(),
+			wantErr: true,
+		},
+		{
+			name: "HTTP auth store without url scheme",
+			config: func() *Config {
+				cfg := newAnonymousConfig()
+				cfg.SMTP.AuthStore = "http"
+				cfg.SMTP.HTTPAuth.URL = "auth.example.com/verify"
+				return cfg
+			}(),
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -1,20 +1,154 @@
 package config
 
+import "time"
+
 // Config 配置结构体
 type Config struct {
 	Server struct {
 		Host         string `yaml:"host"`          // 服务器主机名
 		Port         int    `yaml:"port"`          // 服务器端口
 		InstanceName string `yaml:"instance_name"` // 实例名称
+
+		// 额外的监听地址，每个监听器可单独配置 TLS 和公布的认证机制
+		Listeners []Listener `yaml:"listeners"`
+
+		// 连接访问控制规则文件，每行 "allow|deny 网段"，第一条匹配的规则生效，
+		// 监听器自己的规则先于全局规则匹配，都不匹配时允许连接
+		AccessList    string `yaml:"access_list"`
+		RejectMessage string `yaml:"reject_message"` // 被拒绝的连接收到的 554 回复
+
+		// 连接和命令的速率限制，0 表示不限制；超出连接限制的客户端在问候前收到 421
+		RateLimit struct {
+			MaxConnections      int     `yaml:"max_connections"`        // 全局并发连接数
+			MaxConnectionsPerIP int     `yaml:"max_connections_per_ip"` // 每个 IP 的并发连接数
+			ConnectionRate      float64 `yaml:"connection_rate"`        // 全局每秒新建连接数
+			ConnectionRatePerIP float64 `yaml:"connection_rate_per_ip"` // 每个 IP 每秒新建连接数
+			CommandRate         float64 `yaml:"command_rate"`           // 每个会话每秒的命令数，超出时延迟处理
+			MaxTrackedIPs       int     `yaml:"max_tracked_ips"`        // 保存每个 IP 状态的 LRU 容量，默认 10000
+		} `yaml:"rate_limit"`
 	} `yaml:"server"`
 
 	SMTP struct {
-		Hostname          string `yaml:"hostname"`            // SMTP 服务器主机名
-		MaxSize           int    `yaml:"max_size"`            // 最大邮件大小
-		MaxRecipients     int    `yaml:"max_recipients"`      // 最大收件人数量
-		AuthFile          string `yaml:"auth_file"`           // 认证文件路径
-		AllowAnonymous    bool   `yaml:"allow_anonymous"`     // 是否允许匿名访问
-		AllowInsecureAuth bool   `yaml:"allow_insecure_auth"` // 是否允许不安全的认证
+		Hostname                string `yaml:"hostname"`                  // SMTP 服务器主机名
+		MaxSize                 int    `yaml:"max_size"`                  // 最大邮件大小
+		MaxRecipients           int    `yaml:"max_recipients"`            // 最大收件人数量
+		AuthFile                string `yaml:"auth_file"`                 // 认证文件路径
+		AllowAnonymous          bool   `yaml:"allow_anonymous"`           // 是否允许匿名访问
+		AllowInsecureAuth       bool   `yaml:"allow_insecure_auth"`       // 是否允许不安全的认证
+		PasswordScheme          string `yaml:"password_scheme"`           // 密码哈希方案：bcrypt, argon2id, sha512-crypt, ssha；登录成功后自动升级较弱的哈希
+		AllowPlaintextPasswords bool   `yaml:"allow_plaintext_passwords"` // 是否接受认证文件中的明文密码（不推荐）
+		AuthStore               string `yaml:"auth_store"`                // 凭据存储类型：json（默认）, htpasswd, passwd-file, ldap, checkpassword, dovecot, http
+
+		// 公布的认证机制：PLAIN, LOGIN, CRAM-MD5, SCRAM-SHA-256, SCRAM-SHA-256-PLUS,
+		// OAUTHBEARER, XOAUTH2, EXTERNAL；为空时公布 PLAIN 和 LOGIN，配置了 oauth 时
+		// 另外公布 OAUTHBEARER 和 XOAUTH2，配置了客户端证书映射时另外公布 EXTERNAL，
+		// 可被监听器的配置覆盖
+		AuthMechanisms []string `yaml:"auth_mechanisms"`
+
+		// 受信任的客户端网段（CIDR 或单个 IP），来自这些地址的会话即使未认证、
+		// allow_anonymous 为 false 也可以发信，适用于无法进行 SMTP AUTH 的应用服务器
+		TrustedNetworks []string `yaml:"trusted_networks"`
+
+		// 轮询认证文件变更的间隔，0 表示只在收到 SIGHUP 时重新加载
+		AuthReloadInterval time.Duration `yaml:"auth_reload_interval"`
+
+		LDAP struct {
+			URL           string        `yaml:"url"`            // 服务器地址，如 ldap://127.0.0.1:389 或 ldaps://ldap.example.com
+			UserDN        string        `yaml:"user_dn"`        // 用户 DN 模板，如 uid=%s,ou=people,dc=example,dc=com
+			BaseDN        string        `yaml:"base_dn"`        // 搜索用户的根 DN，未配置 user_dn 时必填
+			UserAttribute string        `yaml:"user_attribute"` // 用户名属性，默认 uid
+			BindDN        string        `yaml:"bind_dn"`        // 搜索使用的服务账户 DN，为空时匿名搜索
+			BindPassword  string        `yaml:"bind_password"`  // 服务账户密码
+			Timeout       time.Duration `yaml:"timeout"`        // 连接和请求超时
+		} `yaml:"ldap"`
+
+		// auth_store 为 checkpassword 时调用的外部程序（qmail/DJB checkpassword 协议）
+		Checkpassword struct {
+			Command       []string      `yaml:"command"`        // 程序及其参数
+			Timeout       time.Duration `yaml:"timeout"`        // 等待程序结束的超时，默认 10 秒
+			MaxConcurrent int           `yaml:"max_concurrent"` // 同时运行的程序数量上限，默认 4
+		} `yaml:"checkpassword"`
+
+		// auth_store 为 dovecot 时使用的 Dovecot 认证服务
+		Dovecot struct {
+			Socket  string        `yaml:"socket"`  // auth-client 套接字，如 /var/run/dovecot/auth-client
+			Service string        `yaml:"service"` // 传给 Dovecot 的服务名，默认 smtp
+			Timeout time.Duration `yaml:"timeout"` // 连接和等待回复的超时，默认 10 秒
+		} `yaml:"dovecot"`
+
+		// auth_store 为 http 时使用的 HTTP 认证回调
+		HTTPAuth struct {
+			URL              string            `yaml:"url"`               // 接收 POST 请求的地址
+			Headers          map[string]string `yaml:"headers"`           // 附加的请求头，如 Authorization
+			Timeout          time.Duration     `yaml:"timeout"`           // 单次请求超时，默认 5 秒
+			CacheTTL         time.Duration     `yaml:"cache_ttl"`         // 缓存允许结果的时长，0 表示不缓存
+			BreakerThreshold int               `yaml:"breaker_threshold"` // 连续失败多少次后熔断，默认 5
+			BreakerCooldown  time.Duration     `yaml:"breaker_cooldown"`  // 熔断持续时间，默认 30 秒
+		} `yaml:"http_auth"`
+
+		// OAUTHBEARER / XOAUTH2 使用的 JWT 校验配置，配置 jwks 后启用
+		OAuth struct {
+			JWKS          string        `yaml:"jwks"`           // JWKS 文件，或包含多个 .json JWKS 文件的目录
+			Issuer        string        `yaml:"issuer"`         // 要求的签发者（iss）
+			Audience      string        `yaml:"audience"`       // 要求的受众（aud）
+			UsernameClaim string        `yaml:"username_claim"` // 作为用户名的声明，默认 sub
+			Leeway        time.Duration `yaml:"leeway"`         // 校验有效期时允许的时钟偏差
+		} `yaml:"oauth"`
+
+		// 已认证用户可使用的发件人地址，为空时不限制
+		SenderLoginMap  string `yaml:"sender_login_map"`  // 用户名到发件人地址规则的映射文件
+		CheckFromHeader bool   `yaml:"check_from_header"` // 是否同时检查邮件的 From: 头
+
+		// 虚拟别名：在保存前改写收件人，支持 @域名 的 catch-all 和递归展开
+		VirtualAliasMap    string `yaml:"virtual_alias_map"`   // 收件人地址到目标地址的映射文件，为空时不改写
+		RecipientDelimiter string `yaml:"recipient_delimiter"` // 子地址分隔符，user+tag@example.com 按 user@example.com 查找别名并保存，标签记录在元数据中；为空时不拆分，默认 +
+
+		// 本地收件人表：本地域名下不存在的收件人回复 550 5.1.1，其他域名的收件人不检查
+		LocalRecipients struct {
+			File        string   `yaml:"file"`         // 收件人文件，每行一个地址或 @域名
+			FromUsers   bool     `yaml:"from_users"`   // 凭据存储中以邮件地址为用户名的用户也是本地收件人
+			Domains     []string `yaml:"domains"`      // 本地域名，收件人文件和用户名中出现的域名自动视为本地域名
+			DelayReject bool     `yaml:"delay_reject"` // 推迟到 DATA 阶段再拒绝，避免通过 RCPT 探测收件人
+		} `yaml:"local_recipients"`
+
+		// 策略委托：按 Postfix SMTP 访问策略委托协议依次查询的策略服务
+		PolicyServices []PolicyService `yaml:"policy_services"`
+
+		// 内容过滤：按 sendmail milter 协议依次交给 milter 检查和修改邮件
+		Milters []Milter `yaml:"milters"`
+
+		// 暴力破解防护：按 IP 和用户名统计滑动窗口内的认证失败次数
+		BruteForce struct {
+			Enabled            bool          `yaml:"enabled"`              // 是否启用
+			Window             time.Duration `yaml:"window"`               // 统计失败次数的滑动窗口
+			MaxIPFailures      int           `yaml:"max_ip_failures"`      // 窗口内同一 IP 允许的失败次数，达到后锁定，0 表示不限制
+			MaxUserFailures    int           `yaml:"max_user_failures"`    // 窗口内同一用户名允许的失败次数，达到后锁定，0 表示不限制
+			Lockout            time.Duration `yaml:"lockout"`              // 锁定时长
+			BaseDelay          time.Duration `yaml:"base_delay"`           // 第一次失败后的回复延迟，之后每次失败翻倍
+			MaxDelay           time.Duration `yaml:"max_delay"`            // 回复延迟的上限
+			MaxSessionFailures int           `yaml:"max_session_failures"` // 单个连接允许的失败次数，达到后断开连接，0 表示不限制
+			StateFile          string        `yaml:"state_file"`           // 保存计数和锁定状态的文件，为空时重启后清零
+		} `yaml:"brute_force"`
+
+		// 发送额度，按已认证用户和客户端 IP 分别统计，超出时在 RCPT / DATA 阶段回复 452 4.7.0
+		Quota struct {
+			User      QuotaLimits `yaml:"user"`       // 每个已认证用户的额度
+			IP        QuotaLimits `yaml:"ip"`         // 每个客户端 IP 的额度
+			StateFile string      `yaml:"state_file"` // 保存用量的文件，为空时重启后清零
+		} `yaml:"quota"`
+
+		// 灰名单，在 RCPT 阶段对未认证会话的 (客户端 /24 或 /64 网段, 发件人, 收件人) 三元组生效，
+		// 首次出现时回复 451 4.7.1
+		Greylist struct {
+			Enabled                   bool          `yaml:"enabled"`                     // 是否启用
+			Delay                     time.Duration `yaml:"delay"`                       // 首次出现后至少等待多久才接受重试
+			RetryWindow               time.Duration `yaml:"retry_window"`                // 首次出现后多久内的重试有效，超过后重新计时
+			Expire                    time.Duration `yaml:"expire"`                      // 通过的三元组在最后一次出现后保留多久
+			StateFile                 string        `yaml:"state_file"`                  // 保存三元组的文件，为空时重启后清空
+			WhitelistNetworks         []string      `yaml:"whitelist_networks"`          // 不检查的客户端网段
+			WhitelistSenders          []string      `yaml:"whitelist_senders"`           // 不检查的发件人：完整地址、通配符或 @域名
+			WhitelistRecipientDomains []string      `yaml:"whitelist_recipient_domains"` // 不检查的收件人域名
+		} `yaml:"greylist"`
 	} `yaml:"smtp"`
 
 	Storage struct {
@@ -25,6 +159,10 @@ type Config struct {
 		Enabled  bool   `yaml:"enabled"`   // 是否启用 TLS
 		CertFile string `yaml:"cert_file"` // 证书文件路径
 		KeyFile  string `yaml:"key_file"`  // 私钥文件路径
+
+		// 客户端证书认证（SASL EXTERNAL）
+		ClientCAFile  string `yaml:"client_ca_file"`  // 用于验证客户端证书的 CA 文件，配置后接受客户端证书
+		ClientCertMap string `yaml:"client_cert_map"` // 客户端证书到用户名的映射文件
 	} `yaml:"tls"`
 
 	Log struct {
@@ -34,3 +172,36 @@ type Config struct {
 		AddSource bool   `yaml:"add_source"` // 是否添加源代码位置
 	} `yaml:"log"`
 }
+
+// Listener 监听器配置
+type Listener struct {
+	Name           string   `yaml:"name"`            // 监听器名称，用于日志
+	Host           string   `yaml:"host"`            // 监听地址，为空时使用 server.host
+	Port           int      `yaml:"port"`            // 监听端口
+	ImplicitTLS    bool     `yaml:"implicit_tls"`    // 连接建立即进行 TLS 握手（如 465 端口），否则通过 STARTTLS
+	AuthMechanisms []string `yaml:"auth_mechanisms"` // 公布的认证机制，为空时使用 smtp.auth_mechanisms
+	AccessList     string   `yaml:"access_list"`     // 监听器的连接访问控制规则文件，先于 server.access_list 匹配
+}
+
+// PolicyService 策略委托服务的配置
+type PolicyService struct {
+	Address       string        `yaml:"address"`        // 服务地址：inet:host:port 或 unix:/path
+	Stages        []string      `yaml:"stages"`         // 查询的阶段：rcpt, data, end-of-message，默认 rcpt
+	Timeout       time.Duration `yaml:"timeout"`        // 连接和等待回复的超时，默认 10 秒
+	DefaultAction string        `yaml:"default_action"` // 服务不可用时采用的动作，默认 451 4.3.5 Server configuration problem
+}
+
+// Milter 内容过滤器的配置
+type Milter struct {
+	Address       string        `yaml:"address"`        // milter 地址：inet:host:port 或 unix:/path
+	Timeout       time.Duration `yaml:"timeout"`        // 连接和等待每个回复的超时，默认 30 秒
+	DefaultAction string        `yaml:"default_action"` // milter 不可用时采用的动作：tempfail（默认）、accept 或 reject
+}
+
+// QuotaLimits 发送额度，0 表示不限制
+type QuotaLimits struct {
+	MessagesPerHour  int   `yaml:"messages_per_hour"`  // 每小时邮件数
+	MessagesPerDay   int   `yaml:"messages_per_day"`   // 每天邮件数
+	RecipientsPerDay int   `yaml:"recipients_per_day"` // 每天收件人数
+	BytesPerDay      int64 `yaml:"bytes_per_day"`      // 每天邮件字节数
+}
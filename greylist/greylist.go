@@ -0,0 +1,215 @@
+package greylist
+
+import (
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/catroll/smtpd/internal/mailaddr"
+	"github.com/catroll/smtpd/statefile"
+)
+
+// Options 灰名单的配置
+type Options struct {
+	// Delay 三元组首次出现后至少等待多久，重试才会被接受，默认 5 分钟
+	Delay time.Duration
+	// RetryWindow 首次出现后多久内的重试有效，超过后重新计时，默认 4 小时
+	RetryWindow time.Duration
+	// Expire 通过的三元组在最后一次出现后保留多久，默认 36 天
+	Expire time.Duration
+	// StateFile 保存三元组的文件，为空时不持久化
+	StateFile string
+
+	// Networks 不做灰名单检查的客户端网段
+	Networks []netip.Prefix
+	// Senders 不做灰名单检查的发件人，规则与发件人映射相同：完整地址、通配符或 @域名
+	Senders []string
+	// RecipientDomains 不做灰名单检查的收件人域名
+	RecipientDomains []string
+}
+
+// Result 灰名单的检查结果
+type Result int
+
+const (
+	// Whitelisted 命中白名单，不记录三元组
+	Whitelisted Result = iota
+	// Passed 三元组已通过灰名单
+	Passed
+	// Deferred 三元组首次出现或还未到可以重试的时间
+	Deferred
+)
+
+// entry 一个三元组的记录
+type entry struct {
+	// FirstSeen 本轮首次出现的时间，Passed 表示已通过灰名单
+	FirstSeen time.Time `json:"first_seen"`
+	Passed    bool      `json:"passed,omitempty"`
+	// LastSeen 最后一次出现的时间
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// List 按 (客户端 IP 所在的 /24 或 /64 网段, 发件人, 收件人) 三元组实施灰名单：
+// 首次出现的三元组被暂时拒绝，Delay 之后、RetryWindow 之内的重试被接受，
+// 通过的三元组在 Expire 内不再检查
+type List struct {
+	mu      sync.Mutex
+	opts    Options
+	entries map[string]*entry
+	file    statefile.File
+
+	// now 当前时间，测试时可替换
+	now func() time.Time
+}
+
+// New 创建灰名单，配置了状态文件时从中恢复之前的三元组
+func New(opts Options) (*List, error) {
+	if opts.Delay <= 0 {
+		opts.Delay = 5 * time.Minute
+	}
+	if opts.RetryWindow <= 0 {
+		opts.RetryWindow = 4 * time.Hour
+	}
+	if opts.Expire <= 0 {
+		opts.Expire = 36 * 24 * time.Hour
+	}
+	// 域名统一转换为 punycode，与信封地址的形式一致
+	senders := make([]string, len(opts.Senders))
+	for i, sender := range opts.Senders {
+		pattern, err := mailaddr.Pattern(sender)
+		if err != nil {
+			return nil, fmt.Errorf("invalid greylist whitelist sender %q: %w", sender, err)
+		}
+		senders[i] = pattern
+	}
+	opts.Senders = senders
+	domains := make([]string, len(opts.RecipientDomains))
+	for i, domain := range opts.RecipientDomains {
+		key, err := mailaddr.Key("@" + strings.TrimPrefix(domain, "@"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid greylist whitelist recipient domain %q: %w", domain, err)
+		}
+		domains[i] = strings.TrimPrefix(key, "@")
+	}
+	opts.RecipientDomains = domains
+
+	g := &List{
+		opts:    opts,
+		entries: make(map[string]*entry),
+		file:    statefile.New(opts.StateFile),
+		now:     time.Now,
+	}
+	loaded, err := g.file.Load(&g.entries)
+	if err != nil {
+		return nil, err
+	}
+	if !loaded {
+		return g, nil
+	}
+	if g.entries == nil {
+		g.entries = make(map[string]*entry)
+	}
+	g.prune(g.now())
+
+	slog.Info("加载灰名单成功",
+		"file", opts.StateFile,
+		"entries", len(g.entries),
+		"timestamp", time.Now().Format(time.RFC3339Nano),
+	)
+	return g, nil
+}
+
+// Check 检查来自 ip 的 from 到 to 的投递，返回结果和暂时拒绝时还需等待的时间
+func (g *List) Check(ip netip.Addr, from, to string) (Result, time.Duration) {
+	ip = ip.Unmap()
+	from = strings.ToLower(from)
+	to = strings.ToLower(to)
+	if g.whitelisted(ip, from, to) {
+		return Whitelisted, 0
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	key := tripletKey(ip, from, to)
+	e, ok := g.entries[key]
+	g.file.Changed()
+	switch {
+	case !ok || !e.Passed && now.Sub(e.FirstSeen) > g.opts.RetryWindow:
+		// 首次出现，或上一轮没有在有效期内重试
+		g.entries[key] = &entry{FirstSeen: now, LastSeen: now}
+		return Deferred, g.opts.Delay
+	case !e.Passed && now.Sub(e.FirstSeen) < g.opts.Delay:
+		e.LastSeen = now
+		return Deferred, g.opts.Delay - now.Sub(e.FirstSeen)
+	default:
+		e.Passed = true
+		e.LastSeen = now
+		return Passed, 0
+	}
+}
+
+// whitelisted 判断客户端网段、发件人或收件人域名是否在白名单中
+func (g *List) whitelisted(ip netip.Addr, from, to string) bool {
+	for _, prefix := range g.opts.Networks {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	for _, pattern := range g.opts.Senders {
+		if mailaddr.Match(pattern, from) {
+			return true
+		}
+	}
+	if i := strings.LastIndex(to, "@"); i >= 0 {
+		for _, domain := range g.opts.RecipientDomains {
+			if to[i+1:] == domain {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tripletKey 三元组的键，IPv4 取 /24 网段，IPv6 取 /64 网段，
+// 以便接受同一发信集群中不同服务器的重试
+func tripletKey(ip netip.Addr, from, to string) string {
+	bits := 64
+	if ip.Is4() {
+		bits = 24
+	}
+	network := ip.String()
+	if prefix, err := ip.Prefix(bits); err == nil {
+		network = prefix.String()
+	}
+	return network + " " + from + " " + to
+}
+
+// prune 删除过期的三元组，调用方需持有锁
+func (g *List) prune(now time.Time) {
+	for key, e := range g.entries {
+		if e.Passed && now.Sub(e.LastSeen) > g.opts.Expire ||
+			!e.Passed && now.Sub(e.FirstSeen) > g.opts.RetryWindow {
+			delete(g.entries, key)
+			g.file.Changed()
+		}
+	}
+}
+
+// Save 清理过期的三元组，并在有变化时写入状态文件
+func (g *List) Save() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.prune(g.now())
+	return g.file.Save(g.entries)
+}
+
+// Persist 按 interval 清理过期的三元组并保存状态，直到 stop 被关闭，退出前再保存一次
+func (g *List) Persist(interval time.Duration, stop <-chan struct{}) {
+	statefile.Persist(g, interval, stop)
+}
@@ -0,0 +1,121 @@
+package greylist
+
+import (
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/catroll/smtpd/internal/testclock"
+)
+
+// newTestGreylist 返回使用可控时钟的灰名单
+func newTestGreylist(t *testing.T, opts Options) (*List, *testclock.Clock) {
+	t.Helper()
+	g, err := New(opts)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	clock := testclock.New()
+	g.now = clock.Now
+	return g, clock
+}
+
+func TestGreylist(t *testing.T) {
+	g, clock := newTestGreylist(t, Options{
+		Delay:       5 * time.Minute,
+		RetryWindow: time.Hour,
+		Expire:      24 * time.Hour,
+	})
+	ip := netip.MustParseAddr("192.0.2.10")
+
+	tests := []struct {
+		name    string
+		advance time.Duration
+		ip      string
+		from    string
+		to      string
+		want    Result
+	}{
+		{name: "first sight", from: "a@example.org", to: "b@example.com", want: Deferred},
+		{name: "retry too early", advance: time.Minute, from: "a@example.org", to: "b@example.com", want: Deferred},
+		{name: "retry after delay", advance: 4 * time.Minute, from: "a@example.org", to: "b@example.com", want: Passed},
+		{name: "same /24 and case", ip: "192.0.2.200", from: "A@Example.org", to: "b@example.com", want: Passed},
+		{name: "other network", ip: "198.51.100.1", from: "a@example.org", to: "b@example.com", want: Deferred},
+		{name: "other recipient", from: "a@example.org", to: "c@example.com", want: Deferred},
+		{name: "passed triplet kept", advance: 23 * time.Hour, from: "a@example.org", to: "b@example.com", want: Passed},
+		{name: "retry window missed", from: "a@example.org", to: "c@example.com", want: Deferred},
+		{name: "new round too early", advance: 4 * time.Minute, from: "a@example.org", to: "c@example.com", want: Deferred},
+		{name: "passed triplet expired", advance: 25 * time.Hour, from: "a@example.org", to: "b@example.com", want: Deferred},
+	}
+	for _, tt := range tests {
+		clock.Advance(tt.advance)
+		if tt.advance > time.Hour {
+			// 模拟定期保存时的清理
+			g.Save()
+		}
+		addr := ip
+		if tt.ip != "" {
+			addr = netip.MustParseAddr(tt.ip)
+		}
+		if got, _ := g.Check(addr, tt.from, tt.to); got != tt.want {
+			t.Errorf("%s: Check() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGreylistWhitelist(t *testing.T) {
+	g, _ := newTestGreylist(t, Options{
+		Networks:         []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		Senders:          []string{"@Partner.example", "alerts-*@example.org", "@bücher.example"},
+		RecipientDomains: []string{"postmaster.example.com", "@München.example"},
+	})
+
+	tests := []struct {
+		ip, from, to string
+		want         Result
+	}{
+		{ip: "10.1.2.3", from: "a@example.org", to: "b@example.com", want: Whitelisted},
+		{ip: "::ffff:10.1.2.3", from: "a@example.org", to: "b@example.com", want: Whitelisted},
+		{ip: "192.0.2.1", from: "sales@partner.example", to: "b@example.com", want: Whitelisted},
+		{ip: "192.0.2.1", from: "alerts-db@example.org", to: "b@example.com", want: Whitelisted},
+		{ip: "192.0.2.1", from: "a@example.org", to: "abuse@Postmaster.Example.com", want: Whitelisted},
+		{ip: "192.0.2.1", from: "x@xn--bcher-kva.example", to: "b@example.com", want: Whitelisted},
+		{ip: "192.0.2.1", from: "a@example.org", to: "b@xn--mnchen-3ya.example", want: Whitelisted},
+		{ip: "192.0.2.1", from: "a@example.org", to: "b@example.com", want: Deferred},
+	}
+	for _, tt := range tests {
+		if got, _ := g.Check(netip.MustParseAddr(tt.ip), tt.from, tt.to); got != tt.want {
+			t.Errorf("Check(%s, %s, %s) = %v, want %v", tt.ip, tt.from, tt.to, got, tt.want)
+		}
+	}
+	if len(g.entries) != 1 {
+		t.Errorf("Whitelisted triplets recorded: %v", g.entries)
+	}
+}
+
+func TestGreylistStateFile(t *testing.T) {
+	opts := Options{
+		Delay:     time.Minute,
+		StateFile: filepath.Join(t.TempDir(), "greylist.json"),
+	}
+	g, clock := newTestGreylist(t, opts)
+	// 加载状态文件时按真实时间清理过期的三元组
+	clock.Set(time.Now())
+	ip := netip.MustParseAddr("2001:db8:1:2::10")
+	g.Check(ip, "a@example.org", "b@example.com")
+	if err := g.Save(); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	// 重启后恢复三元组，同一 /64 中其他地址的重试被接受
+	restored, err := New(opts)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	clock.Advance(time.Minute)
+	restored.now = clock.Now
+	if got, _ := restored.Check(netip.MustParseAddr("2001:db8:1:2::20"), "a@example.org", "b@example.com"); got != Passed {
+		t.Errorf("Check() after restore = %v, want %v", got, Passed)
+	}
+}
@@ -0,0 +1,50 @@
+package mailaddr
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// Match 判断小写的地址是否匹配规则：完整地址、path.Match 通配符或 @域名
+func Match(pattern, address string) bool {
+	if strings.HasPrefix(pattern, "@") {
+		i := strings.LastIndex(address, "@")
+		return i >= 0 && address[i:] == pattern
+	}
+	if strings.ContainsAny(pattern, "*?[") {
+		ok, _ := path.Match(pattern, address)
+		return ok
+	}
+	return pattern == address
+}
+
+// Key 把地址或 @域名 转换为比较用的形式：本地部分小写，域名转换为小写的 punycode
+func Key(address string) (string, error) {
+	i := strings.LastIndex(address, "@")
+	if i < 0 {
+		return "", fmt.Errorf("missing domain")
+	}
+	domain := address[i+1:]
+	if strings.HasPrefix(domain, "[") {
+		// 地址字面量原样比较
+		return strings.ToLower(address), nil
+	}
+	ascii, err := idna.Lookup.ToASCII(domain)
+	if err != nil || ascii == "" {
+		return "", fmt.Errorf("invalid domain %q", domain)
+	}
+	return strings.ToLower(address[:i]) + "@" + ascii, nil
+}
+
+// Pattern 把 Match 使用的规则转换为比较用的形式：域名部分不含通配符时与 Key 相同，
+// 否则只转换为小写
+func Pattern(pattern string) (string, error) {
+	i := strings.LastIndex(pattern, "@")
+	if i < 0 || strings.ContainsAny(pattern[i+1:], "*?[") {
+		return strings.ToLower(pattern), nil
+	}
+	return Key(pattern)
+}
@@ -0,0 +1,42 @@
+package netaddr
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// ParsePrefix 解析 CIDR 网段，单个 IP 地址视为只包含该地址的网段
+func ParsePrefix(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid network %q", s)
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid network %q", s)
+	}
+	return prefix.Masked(), nil
+}
+
+// ParseSocket 把策略服务、milter 使用的 inet:host:port 或 unix:/path 形式的地址
+// 转换为 net.Dial 的参数
+func ParseSocket(s string) (network, address string, err error) {
+	switch {
+	case strings.HasPrefix(s, "inet:"):
+		address = strings.TrimPrefix(s, "inet:")
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return "", "", fmt.Errorf("invalid socket address %q: %w", s, err)
+		}
+		return "tcp", address, nil
+	case strings.HasPrefix(s, "unix:") && len(s) > len("unix:"):
+		return "unix", strings.TrimPrefix(s, "unix:"), nil
+	default:
+		return "", "", fmt.Errorf("invalid socket address %q: expected inet:host:port or unix:/path", s)
+	}
+}
@@ -0,0 +1,28 @@
+package netaddr
+
+import "testing"
+
+func TestParseSocket(t *testing.T) {
+	tests := []struct {
+		address     string
+		wantNetwork string
+		wantAddress string
+		wantErr     bool
+	}{
+		{address: "inet:127.0.0.1:10023", wantNetwork: "tcp", wantAddress: "127.0.0.1:10023"},
+		{address: "unix:/var/run/policy.sock", wantNetwork: "unix", wantAddress: "/var/run/policy.sock"},
+		{address: "inet:127.0.0.1", wantErr: true},
+		{address: "unix:", wantErr: true},
+		{address: "127.0.0.1:10023", wantErr: true},
+	}
+	for _, tt := range tests {
+		network, address, err := ParseSocket(tt.address)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseSocket(%q) error = %v, wantErr %v", tt.address, err, tt.wantErr)
+			continue
+		}
+		if network != tt.wantNetwork || address != tt.wantAddress {
+			t.Errorf("ParseSocket(%q) = %q, %q", tt.address, network, address)
+		}
+	}
+}
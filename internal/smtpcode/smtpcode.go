@@ -0,0 +1,28 @@
+package smtpcode
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ParseEnhanced 解析文本开头的增强状态码，首位必须与回复码的类别 class 一致；
+// 返回状态码和其余的文本，没有时返回零值和原文本
+func ParseEnhanced(text string, class int) ([3]int, string) {
+	first, rest, _ := strings.Cut(text, " ")
+	parts := strings.Split(first, ".")
+	if len(parts) != 3 {
+		return [3]int{}, text
+	}
+	var enhanced [3]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return [3]int{}, text
+		}
+		enhanced[i] = n
+	}
+	if enhanced[0] != class {
+		return [3]int{}, text
+	}
+	return enhanced, strings.TrimSpace(rest)
+}
@@ -0,0 +1,28 @@
+package testclock
+
+import "time"
+
+// Clock 测试使用的时钟，只在调用 Advance 时前进
+type Clock struct {
+	now time.Time
+}
+
+// New 返回停在 2024-01-01 00:00:00 UTC 的时钟
+func New() *Clock {
+	return &Clock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+// Now 返回时钟的当前时间，可以替换组件中的 time.Now
+func (c *Clock) Now() time.Time {
+	return c.now
+}
+
+// Advance 让时钟前进 d
+func (c *Clock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+// Set 把时钟设为 t
+func (c *Clock) Set(t time.Time) {
+	c.now = t
+}
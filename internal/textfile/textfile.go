@@ -0,0 +1,24 @@
+package textfile
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+)
+
+// ScanLines 逐行处理文件内容，跳过空行和 # 开头的注释行
+func ScanLines(data []byte, fn func(lineno int, line string) error) error {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := fn(lineno, line); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
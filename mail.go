@@ -7,7 +7,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"net"
 	"os"
 	"path/filepath"
 	"strings"
@@ -46,14 +45,14 @@ func GenerateID(instanceName, username string) (string, error) {
 	h.Write(append([]byte(fmt.Sprintf("%s-%s-", instanceName, username)), randStr...))
 	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
 	hash := enc.EncodeToString(h.Sum(nil))
-	fmt.Println(hash)
 
 	return fmt.Sprintf("%d-%s", timestamp, hash[:16]), nil
 }
 
-func (m *Mail) ToEml() (*os.File, error) {
+// ToEml 在 dir 中创建临时文件并写入元数据头部；与目标文件位于同一目录，才能原子地重命名
+func (m *Mail) ToEml(dir string) (*os.File, error) {
 	// Create a temporary file for writing
-	tmpFile, err := os.CreateTemp("", "mail-*.eml")
+	tmpFile, err := os.CreateTemp(dir, ".mail-*.eml.tmp")
 	if err != nil {
 		return nil, fmt.Errorf("failed to create temporary file: %w", err)
 	}
@@ -70,14 +69,18 @@ func (m *Mail) ToEml() (*os.File, error) {
 	jsonData := string(metadataJSON)
 
 	// Format current time in PST for Received header
-	loc, _ := time.LoadLocation("America/Los_Angeles")
+	loc, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		// 缺少时区数据库时退回本地时区
+		loc = time.Local
+	}
 	pstTime := m.ReceivedAt.In(loc)
 	timeStr := pstTime.Format("Mon, 2 Jan 2006 15:04:05 -0700 (PST)")
 
-	// Get client hostname if available
-	clientHost := m.ClientIP
-	if names, err := net.LookupAddr(m.ClientIP); err == nil && len(names) > 0 {
-		clientHost = strings.TrimSuffix(names[0], ".")
+	// 不做反向解析，避免每封邮件同步等待 DNS；主机名使用客户端的 HELO 名称
+	clientHost := m.Extras["helo"]
+	if clientHost == "" {
+		clientHost = m.ClientIP
 	}
 
 	// Build TLS info if available
@@ -91,12 +94,12 @@ func (m *Mail) ToEml() (*os.File, error) {
 
 	// Write email headers with metadata
 	headers := fmt.Sprintf("X-SMTPD-DATA: %s\r\n"+
-		"Received: from %s (%s [%s])\r\n"+
+		"Received: from %s ([%s])\r\n"+
 		"        by %s with ESMTP%s id %s\r\n"+
 		"        for <%s>%s;\r\n"+
 		"        %s\r\n",
 		jsonData,
-		clientHost, clientHost, m.ClientIP,
+		clientHost, m.ClientIP,
 		m.Extras["server_name"],
 		strings.ToUpper(m.Extras["protocol"]),
 		m.ID,
@@ -114,8 +117,14 @@ func (m *Mail) ToEml() (*os.File, error) {
 }
 
 func (m *Mail) Save(targetPath string) error {
-	// Create temporary file with .eml format
-	tmpFile, err := m.ToEml()
+	// Ensure the target directory exists
+	targetDir := filepath.Dir(targetPath)
+	if err := os.MkdirAll(targetDir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	// Create temporary file with .eml format in the target directory
+	tmpFile, err := m.ToEml(targetDir)
 	if err != nil {
 		return err
 	}
@@ -129,12 +138,6 @@ func (m *Mail) Save(targetPath string) error {
 		return fmt.Errorf("failed to write email body: %w", err)
 	}
 
-	// Ensure the target directory exists
-	targetDir := filepath.Dir(targetPath)
-	if err := os.MkdirAll(targetDir, 0755); err != nil {
-		return fmt.Errorf("failed to create directory: %w", err)
-	}
-
 	// Sync the temporary file to ensure all data is written
 	if err := tmpFile.Sync(); err != nil {
 		return fmt.Errorf("failed to sync temporary file: %w", err)
@@ -2,11 +2,14 @@ package main
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
 	"log/slog"
+	"net"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/catroll/smtpd/auth"
@@ -31,6 +34,12 @@ func main() {
 		os.Exit(1)
 	}
 
+	// smtpd user 子命令管理认证文件中的用户，只在出错时输出日志
+	if flag.Arg(0) == "user" {
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})))
+		os.Exit(runUserCommand(cfg, flag.Args()[1:]))
+	}
+
 	// 设置日志
 	if err := cfg.SetupLogger(); err != nil {
 		slog.Error("设置日志失败",
@@ -40,16 +49,48 @@ func main() {
 		os.Exit(1)
 	}
 
-	// 初始化认证器
-	authenticator := auth.New()
-	if err := authenticator.LoadCredentials(cfg.SMTP.AuthFile); err != nil {
-		slog.Error("加载认证信息失败",
+	// 初始化认证等共享组件
+	svc, err := newServices(cfg)
+	if err != nil {
+		slog.Error("初始化服务组件失败",
 			"error", err,
 			"timestamp", time.Now().Format(time.RFC3339Nano),
 		)
 		os.Exit(1)
 	}
 
+	// 后台任务在 stop 关闭后退出，退出前各自最后保存一次状态
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	background := func(run func(interval time.Duration, stop <-chan struct{}), interval time.Duration) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			run(interval, stop)
+		}()
+	}
+
+	// 认证文件变更后自动重新加载
+	if svc.authenticator != nil && cfg.SMTP.AuthReloadInterval > 0 {
+		if fs, ok := svc.authenticator.Store().(*auth.FileStore); ok {
+			background(fs.Watch, cfg.SMTP.AuthReloadInterval)
+		}
+	}
+	// 定期清理过期的认证失败记录并保存到状态文件
+	if svc.guard != nil {
+		background(svc.guard.Persist, 30*time.Second)
+	}
+	// 定期清理过期的发送额度用量并保存到状态文件
+	if svc.quota != nil {
+		background(svc.quota.Persist, 30*time.Second)
+	}
+	// 定期清理过期的灰名单三元组并保存到状态文件
+	if svc.greylist != nil {
+		background(svc.greylist.Persist, 30*time.Second)
+	}
+	reloadOnSIGHUP(svc.reloaders...)
+	shutdown := notifyShutdown()
+
 	// 创建邮件存储目录
 	mailDataPath := cfg.Storage.Path
 	if !filepath.IsAbs(mailDataPath) {
@@ -64,50 +105,115 @@ func main() {
 		os.Exit(1)
 	}
 
-	// 初始化后端
-	bkd := NewBackend(cfg, mailDataPath, authenticator)
+	// 每个监听器使用独立的后端和 SMTP 服务器，任一服务器退出即终止进程
+	listeners := cfg.Listeners()
+	errc := make(chan error, len(listeners))
+	var servers []*gosmtp.Server
+	for _, listener := range listeners {
+		bkd := NewBackend(cfg, listener, mailDataPath, svc)
+
+		// 创建 SMTP 服务器
+		s, err := newServer(cfg, listener, bkd)
+		if err != nil {
+			slog.Error("加载 TLS 证书失败",
+				"error", err,
+				"timestamp", time.Now().Format(time.RFC3339Nano),
+			)
+			os.Exit(1)
+		}
+		s.Debug = os.Stdout
+		servers = append(servers, s)
+
+		// 记录服务器状态
+		slog.Info("SMTP 服务器启动",
+			"listener", listener.Name,
+			"addr", s.Addr,
+			"data_dir", mailDataPath,
+			"tls", map[bool]string{true: "已启用", false: "已禁用"}[cfg.TLS.Enabled],
+			"implicit_tls", listener.ImplicitTLS,
+			"insecure_auth", map[bool]string{true: "允许", false: "禁止"}[cfg.SMTP.AllowInsecureAuth],
+			"max_size", cfg.SMTP.MaxSize,
+			"max_recipients", cfg.SMTP.MaxRecipients,
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+
+		go func() {
+			l, err := net.Listen("tcp", s.Addr)
+			if err != nil {
+				errc <- err
+				return
+			}
+			var implicitTLS *tls.Config
+			if listener.ImplicitTLS {
+				implicitTLS = s.TLSConfig
+			}
+			errc <- s.Serve(bkd.listen(l, implicitTLS))
+		}()
+	}
 
-	// 创建 SMTP 服务器
+	// 任一服务器退出或收到 SIGTERM / SIGINT 时停止所有服务器，等待后台任务保存状态后退出
+	exitCode := 0
+	select {
+	case err := <-errc:
+		if err != nil {
+			slog.Error("服务器启动失败",
+				"error", err,
+				"timestamp", time.Now().Format(time.RFC3339Nano),
+			)
+			exitCode = 1
+		}
+	case sig := <-shutdown:
+		slog.Info("收到退出信号，停止服务",
+			"signal", sig.String(),
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+	}
+	for _, s := range servers {
+		s.Close()
+	}
+	close(stop)
+	wg.Wait()
+	os.Exit(exitCode)
+}
+
+// newServer 根据配置为监听器创建 SMTP 服务器
+func newServer(cfg *config.Config, listener config.Listener, bkd *Backend) (*gosmtp.Server, error) {
 	s := gosmtp.NewServer(bkd)
 
-	s.Addr = fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port)
+	s.Addr = fmt.Sprintf("%s:%d", listener.Host, listener.Port)
 	s.Domain = cfg.SMTP.Hostname
 	s.MaxMessageBytes = int64(cfg.SMTP.MaxSize)
 	s.MaxRecipients = cfg.SMTP.MaxRecipients
 	s.AllowInsecureAuth = cfg.SMTP.AllowInsecureAuth
 	s.EnableSMTPUTF8 = true // 支持 UTF8，以便正确处理中文
-	s.Debug = os.Stdout
+	// 命令速率在每次读取命令前设置读超时时限制，需要设置 ReadTimeout
+	if cfg.Server.RateLimit.CommandRate > 0 {
+		s.ReadTimeout = commandReadTimeout
+	}
 
 	if cfg.TLS.Enabled {
+		cert, err := tls.LoadX509KeyPair(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err != nil {
+			return nil, err
+		}
 		s.TLSConfig = &tls.Config{
-			Certificates: make([]tls.Certificate, 1),
+			Certificates: []tls.Certificate{cert},
 		}
-		s.TLSConfig.Certificates[0], err = tls.LoadX509KeyPair(cfg.TLS.CertFile, cfg.TLS.KeyFile)
-		if err != nil {
-			slog.Error("加载 TLS 证书失败",
-				"error", err,
-				"timestamp", time.Now().Format(time.RFC3339Nano),
-			)
-			os.Exit(1)
+
+		// 配置了客户端 CA 时请求客户端证书，未提供证书的客户端仍可使用其他认证方式
+		if cfg.TLS.ClientCAFile != "" {
+			pem, err := os.ReadFile(cfg.TLS.ClientCAFile)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", cfg.TLS.ClientCAFile)
+			}
+			s.TLSConfig.ClientCAs = pool
+			s.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
 		}
 	}
 
-	// 记录服务器状态
-	slog.Info("SMTP 服务器启动",
-		"addr", s.Addr,
-		"data_dir", mailDataPath,
-		"tls", map[bool]string{true: "已启用", false: "已禁用"}[cfg.TLS.Enabled],
-		"insecure_auth", map[bool]string{true: "允许", false: "禁止"}[cfg.SMTP.AllowInsecureAuth],
-		"max_size", cfg.SMTP.MaxSize,
-		"max_recipients", cfg.SMTP.MaxRecipients,
-		"timestamp", time.Now().Format(time.RFC3339Nano),
-	)
-
-	if err := s.ListenAndServe(); err != nil {
-		slog.Error("服务器启动失败",
-			"error", err,
-			"timestamp", time.Now().Format(time.RFC3339Nano),
-		)
-		os.Exit(1)
-	}
+	return s, nil
 }
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/catroll/smtpd/config"
+	"github.com/catroll/smtpd/milter"
+	gosmtp "github.com/emersion/go-smtp"
+)
+
+// 发送给 milter 的事件阶段，用于日志和确定 accept 的作用范围
+const (
+	milterStageConnect = "connect"
+	milterStageHelo    = "helo"
+	milterStageMail    = "mail"
+	milterStageRcpt    = "rcpt"
+	milterStageMessage = "end-of-message"
+)
+
+// milterService 一个 milter 及其不可用时的默认动作
+type milterService struct {
+	client        *milter.Client
+	defaultAction string
+}
+
+// newMilterServices 根据配置创建 milter，未配置默认动作时为 tempfail
+func newMilterServices(cfg *config.Config) ([]*milterService, error) {
+	var services []*milterService
+	for _, mc := range cfg.SMTP.Milters {
+		client, err := milter.NewClient(milter.Options{
+			Address: mc.Address,
+			Timeout: mc.Timeout,
+		})
+		if err != nil {
+			return nil, err
+		}
+		svc := &milterService{client: client, defaultAction: mc.DefaultAction}
+		if svc.defaultAction == "" {
+			svc.defaultAction = "tempfail"
+		}
+		services = append(services, svc)
+	}
+	return services, nil
+}
+
+// defaultResponse 返回 milter 不可用时代替它的回复
+func (ms *milterService) defaultResponse() *milter.Response {
+	switch ms.defaultAction {
+	case "accept":
+		return &milter.Response{Action: milter.Accept}
+	case "reject":
+		return &milter.Response{Action: milter.Reject}
+	default:
+		return &milter.Response{Action: milter.Tempfail}
+	}
+}
+
+// milterSession 会话与一个 milter 的连接，conn 为 nil 表示 milter 不可用
+type milterSession struct {
+	svc  *milterService
+	conn *milter.Conn
+	// sessionAccepted milter 在连接或 HELO 阶段接受了整个会话，accepted 为接受了当前邮件，
+	// 之后不再向它发送相应的事件
+	sessionAccepted bool
+	accepted        bool
+	// inMessage 已向 milter 发送当前邮件的事件，但还没有完成邮件结束事件
+	inMessage bool
+}
+
+// errMilterReject、errMilterTempfail milter 拒绝和暂时拒绝时的回复
+var (
+	errMilterReject = &gosmtp.SMTPError{
+		Code:         550,
+		EnhancedCode: gosmtp.EnhancedCode{5, 7, 1},
+		Message:      "Command rejected",
+	}
+	errMilterTempfail = &gosmtp.SMTPError{
+		Code:         451,
+		EnhancedCode: gosmtp.EnhancedCode{4, 7, 1},
+		Message:      "Service unavailable - try again later",
+	}
+)
+
+// startMilters 连接所有 milter，发送连接和 HELO 事件；milter 拒绝时关闭所有连接并返回拒绝的回复
+func (s *Session) startMilters() error {
+	if len(s.backend.milters) == 0 {
+		return nil
+	}
+	for _, ms := range s.backend.milters {
+		m := &milterSession{svc: ms}
+		conn, err := ms.client.Open()
+		if err != nil {
+			slog.Error("连接 milter 失败",
+				"session_id", s.sessionID,
+				"remote_addr", s.remoteAddr,
+				"milter", ms.client.Address(),
+				"default_action", ms.defaultAction,
+				"error", err,
+				"timestamp", time.Now().Format(time.RFC3339Nano),
+			)
+		} else {
+			m.conn = conn
+		}
+		s.milters = append(s.milters, m)
+	}
+
+	addrPort, _ := netip.ParseAddrPort(s.remoteAddr)
+	err := s.milterEvent(milterStageConnect, func(m *milterSession) (*milter.Response, error) {
+		return m.conn.Connect("["+s.clientIP()+"]", addrPort, map[string]string{
+			"j":             s.backend.cfg.SMTP.Hostname,
+			"{daemon_name}": "smtpd",
+			"{client_addr}": s.clientIP(),
+			"{client_port}": strconv.Itoa(int(addrPort.Port())),
+		})
+	})
+	if err == nil {
+		macros := make(map[string]string)
+		if state, ok := s.conn.TLSConnectionState(); ok {
+			macros["{tls_version}"] = tls.VersionName(state.Version)
+			macros["{cipher}"] = tls.CipherSuiteName(state.CipherSuite)
+			macros["{cipher_bits}"] = cipherBits(state.CipherSuite)
+		}
+		if cert := s.peerCertificate(); cert != nil {
+			macros["{cert_subject}"] = cert.Subject.String()
+			macros["{cert_issuer}"] = cert.Issuer.String()
+		}
+		err = s.milterEvent(milterStageHelo, func(m *milterSession) (*milter.Response, error) {
+			return m.conn.Helo(s.conn.Hostname(), macros)
+		})
+	}
+	if err != nil {
+		s.closeMilters()
+	}
+	return err
+}
+
+// closeMilters 关闭会话的所有 milter 连接
+func (s *Session) closeMilters() {
+	for _, m := range s.milters {
+		if m.conn != nil {
+			m.conn.Close()
+		}
+	}
+	s.milters = nil
+}
+
+// resetMilters 清除各 milter 对当前邮件的状态，放弃还没有结束的邮件
+func (s *Session) resetMilters() {
+	for _, m := range s.milters {
+		if m.inMessage && m.conn != nil {
+			if err := m.conn.Abort(); err != nil {
+				s.milterFailed(m, "abort", err)
+			}
+		}
+		m.inMessage = false
+		m.accepted = false
+	}
+	s.milterDiscard = false
+}
+
+// milterFailed 记录与 milter 通信失败并关闭连接，之后的事件采用它的默认动作
+func (s *Session) milterFailed(m *milterSession, stage string, err error) {
+	slog.Error("与 milter 通信失败",
+		"session_id", s.sessionID,
+		"remote_addr", s.remoteAddr,
+		"milter", m.svc.client.Address(),
+		"stage", stage,
+		"default_action", m.svc.defaultAction,
+		"error", err,
+		"timestamp", time.Now().Format(time.RFC3339Nano),
+	)
+	m.conn.Close()
+	m.conn = nil
+}
+
+// milterEvent 依次把 stage 阶段的事件交给还没有接受会话或当前邮件的 milter：continue 继续下一个，
+// accept 之后不再询问该 milter，discard 标记丢弃当前邮件，reject、tempfail 和自定义回复码
+// 结束处理并返回相应的 SMTP 回复；milter 不可用时采用它的默认动作
+func (s *Session) milterEvent(stage string, send func(*milterSession) (*milter.Response, error)) error {
+	for _, m := range s.milters {
+		if m.sessionAccepted || m.accepted {
+			continue
+		}
+
+		var resp *milter.Response
+		if m.conn != nil {
+			var err error
+			if resp, err = send(m); err != nil {
+				s.milterFailed(m, stage, err)
+			}
+		}
+		if m.conn == nil {
+			resp = m.svc.defaultResponse()
+		}
+		if resp.Action == milter.Continue {
+			continue
+		}
+
+		slog.Info("milter 返回动作",
+			"session_id", s.sessionID,
+			"remote_addr", s.remoteAddr,
+			"milter", m.svc.client.Address(),
+			"stage", stage,
+			"action", string(resp.Action),
+			"code", resp.Code,
+			"text", resp.Text,
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+		session := stage == milterStageConnect || stage == milterStageHelo
+		switch resp.Action {
+		case milter.Accept:
+			if session {
+				m.sessionAccepted = true
+			} else {
+				m.accepted = true
+			}
+		case milter.Discard:
+			// 丢弃只对邮件有意义，与 Postfix 相同，在连接和 HELO 阶段视为 continue
+			if !session {
+				s.milterDiscard = true
+				m.accepted = true
+			}
+		case milter.Reject:
+			return errMilterReject
+		case milter.Tempfail:
+			return errMilterTempfail
+		case milter.ReplyCode:
+			return milterReply(resp)
+		}
+	}
+	return nil
+}
+
+// milterReply 把 milter 自定义的回复转换为 SMTP 回复，未指定增强状态码时按回复码的类别
+// 使用 5.7.1 或 4.7.1
+func milterReply(resp *milter.Response) *gosmtp.SMTPError {
+	reply := &gosmtp.SMTPError{
+		Code:         resp.Code,
+		EnhancedCode: gosmtp.EnhancedCode(resp.Enhanced),
+		Message:      resp.Text,
+	}
+	if resp.Enhanced == [3]int{} {
+		reply.EnhancedCode = gosmtp.EnhancedCode{resp.Code / 100, 7, 1}
+	}
+	if reply.Message == "" {
+		reply.Message = "Command rejected"
+	}
+	return reply
+}
+
+// milterMail 把 MAIL FROM 交给 milter，args 为重建的 ESMTP 参数
+func (s *Session) milterMail(from Address, opts *gosmtp.MailOptions) error {
+	if len(s.milters) == 0 {
+		return nil
+	}
+
+	var args []string
+	if opts != nil {
+		if opts.Size > 0 {
+			args = append(args, "SIZE="+strconv.FormatInt(opts.Size, 10))
+		}
+		if opts.Body != "" {
+			args = append(args, "BODY="+string(opts.Body))
+		}
+		if opts.UTF8 {
+			args = append(args, "SMTPUTF8")
+		}
+	}
+	macros := map[string]string{"{mail_addr}": from.String()}
+	if s.authenticated {
+		macros["{auth_type}"] = s.authMethod
+		macros["{auth_authen}"] = s.username
+	}
+	return s.milterEvent(milterStageMail, func(m *milterSession) (*milter.Response, error) {
+		m.inMessage = true
+		return m.conn.Mail("<"+from.String()+">", args, macros)
+	})
+}
+
+// milterRcpt 把 RCPT TO 中的原始收件人交给 milter
+func (s *Session) milterRcpt(rcpt Address) error {
+	return s.milterEvent(milterStageRcpt, func(m *milterSession) (*milter.Response, error) {
+		return m.conn.Rcpt("<"+rcpt.String()+">", nil, map[string]string{"{rcpt_addr}": rcpt.String()})
+	})
+}
+
+// milterMessage 依次把邮件交给 milter，每个 milter 看到的是前一个修改后的邮件；
+// 返回修改后的邮件内容，milter 要求丢弃时 s.milterDiscard 为 true
+func (s *Session) milterMessage(id string, data []byte) ([]byte, error) {
+	if len(s.milters) == 0 || s.milterDiscard {
+		return data, nil
+	}
+
+	msg := parseMilterMessage(data)
+	macros := map[string]string{"i": id}
+	err := s.milterEvent(milterStageMessage, func(m *milterSession) (*milter.Response, error) {
+		resp, mods, err := m.conn.Message(msg.milterHeaders(), msg.body, macros)
+		if err != nil {
+			return nil, err
+		}
+		m.inMessage = false
+		if len(mods) > 0 {
+			slog.Info("milter 修改邮件",
+				"session_id", s.sessionID,
+				"remote_addr", s.remoteAddr,
+				"milter", m.svc.client.Address(),
+				"modifications", len(mods),
+				"timestamp", time.Now().Format(time.RFC3339Nano),
+			)
+			msg.apply(mods)
+		}
+		return resp, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return msg.bytes(), nil
+}
+
+// milterField 邮件头部中的一个头，raw 为未修改的头的原始字节（含折行和行尾），
+// 修改或添加的头为 nil
+type milterField struct {
+	milter.Header
+	raw []byte
+}
+
+// milterContent 交给 milter 检查的邮件，未修改的头原样写回
+type milterContent struct {
+	data     []byte
+	headers  []milterField
+	body     []byte
+	modified bool
+}
+
+// parseMilterMessage 拆分邮件的头部和邮件体；遇到不是头的行时，从该行开始视为邮件体。
+// 发送给 milter 的值去掉开头的空白和行尾，折行以 \n 分隔
+func parseMilterMessage(data []byte) *milterContent {
+	msg := &milterContent{data: data}
+	pos := 0
+	for pos < len(data) {
+		end := len(data)
+		if i := bytes.IndexByte(data[pos:], '\n'); i >= 0 {
+			end = pos + i + 1
+		}
+		line := data[pos:end]
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			pos = end
+			break
+		}
+		if n := len(msg.headers); n > 0 && (line[0] == ' ' || line[0] == '\t') {
+			// 折行属于上一个头，原始字节在 data 中是连续的
+			h := &msg.headers[n-1]
+			h.raw = data[end-len(h.raw)-len(line) : end]
+			pos = end
+			continue
+		}
+		name, _, ok := bytes.Cut(line, []byte(":"))
+		if !ok || !validHeaderLine(string(name)+":") {
+			break
+		}
+		msg.headers = append(msg.headers, milterField{
+			Header: milter.Header{Name: string(name)},
+			raw:    line,
+		})
+		pos = end
+	}
+	msg.body = data[pos:]
+
+	for i := range msg.headers {
+		h := &msg.headers[i]
+		_, value, _ := strings.Cut(string(h.raw), ":")
+		value = strings.TrimRight(strings.TrimLeft(value, " \t"), "\r\n")
+		h.Value = strings.ReplaceAll(value, "\r\n", "\n")
+	}
+	return msg
+}
+
+// milterHeaders 返回发送给 milter 的头
+func (msg *milterContent) milterHeaders() []milter.Header {
+	headers := make([]milter.Header, len(msg.headers))
+	for i, h := range msg.headers {
+		headers[i] = h.Header
+	}
+	return headers
+}
+
+// apply 执行 milter 要求的修改：添加、插入、修改或删除头，以及替换邮件体
+func (msg *milterContent) apply(mods []milter.Modification) {
+	var body []byte
+	replaced := false
+	for _, mod := range mods {
+		field := milterField{Header: milter.Header{Name: mod.Name, Value: mod.Value}}
+		switch mod.Kind {
+		case milter.AddHeader:
+			msg.headers = append(msg.headers, field)
+		case milter.InsertHeader:
+			index := min(max(mod.Index, 0), len(msg.headers))
+			msg.headers = slices.Insert(msg.headers, index, field)
+		case milter.ChangeHeader:
+			msg.changeHeader(mod)
+		case milter.ReplaceBody:
+			body = append(body, mod.Body...)
+			replaced = true
+		}
+	}
+	if replaced {
+		msg.body = body
+	}
+	msg.modified = true
+}
+
+// changeHeader 修改第 Index 个（从 1 开始，0 视为 1）同名的头，值为空时删除；
+// 不存在时添加到头部末尾
+func (msg *milterContent) changeHeader(mod milter.Modification) {
+	n := 0
+	for i, h := range msg.headers {
+		if !strings.EqualFold(h.Name, mod.Name) {
+			continue
+		}
+		if n++; n < max(mod.Index, 1) {
+			continue
+		}
+		if mod.Value == "" {
+			msg.headers = slices.Delete(msg.headers, i, i+1)
+		} else {
+			msg.headers[i] = milterField{Header: milter.Header{Name: h.Name, Value: mod.Value}}
+		}
+		return
+	}
+	if mod.Value != "" {
+		msg.headers = append(msg.headers, milterField{Header: milter.Header{Name: mod.Name, Value: mod.Value}})
+	}
+}
+
+// bytes 返回修改后的邮件，没有修改时返回原始内容
+func (msg *milterContent) bytes() []byte {
+	if !msg.modified {
+		return msg.data
+	}
+	var b bytes.Buffer
+	for _, h := range msg.headers {
+		if h.raw != nil {
+			b.Write(h.raw)
+			continue
+		}
+		value := strings.ReplaceAll(h.Value, "\r\n", "\n")
+		fmt.Fprintf(&b, "%s: %s\r\n", h.Name, strings.ReplaceAll(value, "\n", "\r\n"))
+	}
+	b.WriteString("\r\n")
+	b.Write(msg.body)
+	return b.Bytes()
+}
@@ -0,0 +1,495 @@
+package milter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/catroll/smtpd/internal/netaddr"
+	"github.com/catroll/smtpd/internal/smtpcode"
+)
+
+// milter 协议的命令（MTA 发给 milter）
+const (
+	cmdAbort   = 'A'
+	cmdBody    = 'B'
+	cmdConnect = 'C'
+	cmdMacro   = 'D'
+	cmdEOB     = 'E'
+	cmdHelo    = 'H'
+	cmdHeader  = 'L'
+	cmdMail    = 'M'
+	cmdEOH     = 'N'
+	cmdOptNeg  = 'O'
+	cmdQuit    = 'Q'
+	cmdRcpt    = 'R'
+	cmdData    = 'T'
+)
+
+// milter 协议的回复和修改动作（milter 发给 MTA）
+const (
+	replyProgress = 'p'
+	replyOptNeg   = 'O'
+)
+
+// protocolVersion 协商的协议版本
+const protocolVersion = 6
+
+// bodyChunk 每个 body 命令的最大数据长度
+const bodyChunk = 65535
+
+// maxPacket 接受的 milter 回复的最大长度
+const maxPacket = 64 << 20
+
+// 协商时 MTA 允许 milter 执行的修改动作：添加、修改头部和替换邮件体
+const (
+	actionAddHeaders    = 0x01
+	actionChangeBody    = 0x02
+	actionChangeHeaders = 0x10
+	allActions          = actionAddHeaders | actionChangeBody | actionChangeHeaders
+)
+
+// 协议选项：milter 可以要求不发送某些事件（no*），或不等待某些事件的回复（nr*）
+const (
+	optNoConnect = 0x01
+	optNoHelo    = 0x02
+	optNoMail    = 0x04
+	optNoRcpt    = 0x08
+	optNoBody    = 0x10
+	optNoHeaders = 0x20
+	optNoEOH     = 0x40
+	optNRHeader  = 0x80
+	optNoUnknown = 0x100
+	optNoData    = 0x200
+	optSkip      = 0x400
+	optNRConnect = 0x1000
+	optNRHelo    = 0x2000
+	optNRMail    = 0x4000
+	optNRRcpt    = 0x8000
+	optNRData    = 0x10000
+	optNRUnknown = 0x20000
+	optNREOH     = 0x40000
+	optNRBody    = 0x80000
+
+	// allOptions MTA 支持的全部协议选项
+	allOptions = optNoConnect | optNoHelo | optNoMail | optNoRcpt | optNoBody |
+		optNoHeaders | optNoEOH | optNRHeader | optNoUnknown | optNoData | optSkip |
+		optNRConnect | optNRHelo | optNRMail | optNRRcpt | optNRData | optNRUnknown |
+		optNREOH | optNRBody
+)
+
+// Action milter 对一个事件的回复
+type Action byte
+
+const (
+	// Continue 继续处理
+	Continue Action = 'c'
+	// Accept 接受，不再发送这封邮件（连接阶段为整个会话）的后续事件
+	Accept Action = 'a'
+	// Reject 拒绝
+	Reject Action = 'r'
+	// Tempfail 暂时拒绝
+	Tempfail Action = 't'
+	// Discard 接受但丢弃邮件
+	Discard Action = 'd'
+	// ReplyCode 使用 milter 给出的 SMTP 回复拒绝
+	ReplyCode Action = 'y'
+	// Skip 不再发送剩余的邮件体
+	Skip Action = 's'
+)
+
+// Response milter 的回复
+type Response struct {
+	Action Action
+	// Code、Enhanced 和 Text 为 ReplyCode 回复中的 SMTP 回复，没有增强状态码时为零值
+	Code     int
+	Enhanced [3]int
+	Text     string
+}
+
+// 邮件结束时 milter 可以返回的修改动作
+const (
+	// AddHeader 在头部末尾添加 Name: Value
+	AddHeader byte = 'h'
+	// InsertHeader 在第 Index 个头部（从 0 开始）之前插入 Name: Value
+	InsertHeader byte = 'i'
+	// ChangeHeader 修改第 Index 个（从 1 开始）名为 Name 的头部，Value 为空时删除
+	ChangeHeader byte = 'm'
+	// ReplaceBody 替换邮件体，多个动作的 Body 依次拼接
+	ReplaceBody byte = 'b'
+)
+
+// Modification milter 在邮件结束时要求的修改
+type Modification struct {
+	// Kind 修改动作：AddHeader、InsertHeader、ChangeHeader 或 ReplaceBody
+	Kind  byte
+	Index int
+	Name  string
+	// Value 头部的值，折行以 \n 分隔
+	Value string
+	Body  []byte
+}
+
+// Header 发送给 milter 的邮件头，Value 不含开头的空白，折行以 \n 分隔
+type Header struct {
+	Name  string
+	Value string
+}
+
+// Options milter 客户端的配置
+type Options struct {
+	// Address milter 地址：inet:host:port 或 unix:/path
+	Address string
+	// Timeout 连接和等待每个回复的超时，默认 30 秒
+	Timeout time.Duration
+}
+
+// Client 按 sendmail milter 协议与内容过滤器通信，每个 SMTP 会话使用一个连接
+type Client struct {
+	opts    Options
+	network string
+	address string
+}
+
+// NewClient 创建 milter 客户端，不会立即连接
+func NewClient(opts Options) (*Client, error) {
+	network, address, err := netaddr.ParseSocket(opts.Address)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 30 * time.Second
+	}
+	return &Client{opts: opts, network: network, address: address}, nil
+}
+
+// Address 返回配置中的 milter 地址
+func (m *Client) Address() string {
+	return m.opts.Address
+}
+
+// Open 连接 milter 并协商协议版本、修改动作和协议选项
+func (m *Client) Open() (*Conn, error) {
+	conn, err := net.DialTimeout(m.network, m.address, m.opts.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{conn: conn, timeout: m.opts.Timeout}
+
+	var data [12]byte
+	binary.BigEndian.PutUint32(data[0:], protocolVersion)
+	binary.BigEndian.PutUint32(data[4:], allActions)
+	binary.BigEndian.PutUint32(data[8:], allOptions)
+	if err := c.send(cmdOptNeg, data[:]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	cmd, reply, err := c.read()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if cmd != replyOptNeg || len(reply) < 12 {
+		conn.Close()
+		return nil, fmt.Errorf("milter %s: unexpected negotiation reply %q", m.opts.Address, cmd)
+	}
+	if version := binary.BigEndian.Uint32(reply[0:]); version < 2 || version > protocolVersion {
+		conn.Close()
+		return nil, fmt.Errorf("milter %s: unsupported protocol version %d", m.opts.Address, version)
+	}
+	// 只接受 MTA 提供的动作和选项
+	c.actions = binary.BigEndian.Uint32(reply[4:]) & allActions
+	c.protocol = binary.BigEndian.Uint32(reply[8:]) & allOptions
+	return c, nil
+}
+
+// Conn 与 milter 的一个连接，方法不能并发调用
+type Conn struct {
+	conn     net.Conn
+	timeout  time.Duration
+	actions  uint32
+	protocol uint32
+}
+
+// Connect 发送客户端连接信息，hostname 为客户端主机名，addr 为客户端地址
+func (c *Conn) Connect(hostname string, addr netip.AddrPort, macros map[string]string) (*Response, error) {
+	var b bytes.Buffer
+	b.WriteString(hostname)
+	b.WriteByte(0)
+	ip := addr.Addr().Unmap()
+	switch {
+	case ip.Is4():
+		b.WriteByte('4')
+	case ip.Is6():
+		b.WriteByte('6')
+	default:
+		b.WriteByte('U')
+	}
+	if ip.IsValid() {
+		binary.Write(&b, binary.BigEndian, addr.Port())
+		b.WriteString(ip.String())
+		b.WriteByte(0)
+	}
+	return c.event(cmdConnect, b.Bytes(), macros, optNoConnect, optNRConnect)
+}
+
+// Helo 发送 HELO / EHLO 的参数
+func (c *Conn) Helo(name string, macros map[string]string) (*Response, error) {
+	return c.event(cmdHelo, cstrings(name), macros, optNoHelo, optNRHelo)
+}
+
+// Mail 发送 MAIL FROM 的地址（含尖括号）和 ESMTP 参数
+func (c *Conn) Mail(from string, args []string, macros map[string]string) (*Response, error) {
+	return c.event(cmdMail, cstrings(append([]string{from}, args...)...), macros, optNoMail, optNRMail)
+}
+
+// Rcpt 发送 RCPT TO 的地址（含尖括号）和 ESMTP 参数
+func (c *Conn) Rcpt(to string, args []string, macros map[string]string) (*Response, error) {
+	return c.event(cmdRcpt, cstrings(append([]string{to}, args...)...), macros, optNoRcpt, optNRRcpt)
+}
+
+// Message 发送 DATA、邮件头、头部结束、邮件体和邮件结束事件，返回最终回复和 milter 要求的修改，
+// 协商时未允许的修改被忽略；中途收到 accept、reject 等最终回复时不再发送后续事件，也没有修改
+func (c *Conn) Message(headers []Header, body []byte, macros map[string]string) (*Response, []Modification, error) {
+	resp, err := c.event(cmdData, nil, macros, optNoData, optNRData)
+	if err != nil || resp.Action != Continue {
+		return resp, nil, err
+	}
+	for _, h := range headers {
+		resp, err := c.event(cmdHeader, cstrings(h.Name, h.Value), nil, optNoHeaders, optNRHeader)
+		if err != nil || resp.Action != Continue {
+			return resp, nil, err
+		}
+	}
+	resp, err = c.event(cmdEOH, nil, nil, optNoEOH, optNREOH)
+	if err != nil || resp.Action != Continue {
+		return resp, nil, err
+	}
+	for len(body) > 0 && c.protocol&optNoBody == 0 {
+		chunk := body[:min(len(body), bodyChunk)]
+		body = body[len(chunk):]
+		resp, err := c.event(cmdBody, chunk, nil, optNoBody, optNRBody)
+		if err != nil {
+			return nil, nil, err
+		}
+		if resp.Action == Skip {
+			break
+		}
+		if resp.Action != Continue {
+			return resp, nil, err
+		}
+	}
+
+	if err := c.macros(cmdEOB, macros); err != nil {
+		return nil, nil, err
+	}
+	if err := c.send(cmdEOB, nil); err != nil {
+		return nil, nil, err
+	}
+	var mods []Modification
+	for {
+		cmd, data, err := c.read()
+		if err != nil {
+			return nil, nil, err
+		}
+		if cmd == replyProgress {
+			continue
+		}
+		if resp, ok, err := parseResponse(cmd, data); ok || err != nil {
+			return resp, mods, err
+		}
+		mod, err := parseModification(cmd, data)
+		if err != nil {
+			return nil, nil, err
+		}
+		if c.permits(mod.Kind) {
+			mods = append(mods, mod)
+		}
+	}
+}
+
+// Abort 放弃当前邮件，连接可以继续用于下一封邮件
+func (c *Conn) Abort() error {
+	return c.send(cmdAbort, nil)
+}
+
+// Close 通知 milter 会话结束并关闭连接
+func (c *Conn) Close() error {
+	c.send(cmdQuit, nil)
+	return c.conn.Close()
+}
+
+// event 发送宏和事件并读取回复；milter 要求不发送该事件时直接继续，要求不回复时不等待回复
+func (c *Conn) event(cmd byte, data []byte, macros map[string]string, skip, noReply uint32) (*Response, error) {
+	if c.protocol&skip != 0 {
+		return &Response{Action: Continue}, nil
+	}
+	if err := c.macros(cmd, macros); err != nil {
+		return nil, err
+	}
+	if err := c.send(cmd, data); err != nil {
+		return nil, err
+	}
+	if c.protocol&noReply != 0 {
+		return &Response{Action: Continue}, nil
+	}
+	for {
+		reply, data, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		if reply == replyProgress {
+			continue
+		}
+		resp, ok, err := parseResponse(reply, data)
+		if err != nil {
+			return nil, err
+		}
+		if !ok || resp.Action == Skip && cmd != cmdBody {
+			return nil, fmt.Errorf("milter: unexpected reply %q to command %q", reply, cmd)
+		}
+		return resp, nil
+	}
+}
+
+// permits 判断协商时是否允许了该修改动作
+func (c *Conn) permits(kind byte) bool {
+	switch kind {
+	case AddHeader, InsertHeader:
+		return c.actions&actionAddHeaders != 0
+	case ChangeHeader:
+		return c.actions&actionChangeHeaders != 0
+	case ReplaceBody:
+		return c.actions&actionChangeBody != 0
+	}
+	return false
+}
+
+// macros 在命令之前发送宏定义，没有宏时不发送
+func (c *Conn) macros(cmd byte, macros map[string]string) error {
+	if len(macros) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(macros))
+	for name := range macros {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	fields := make([]string, 0, 2*len(names))
+	for _, name := range names {
+		fields = append(fields, name, macros[name])
+	}
+	return c.send(cmdMacro, append([]byte{cmd}, cstrings(fields...)...))
+}
+
+// send 发送一个数据包：4 字节长度、命令字节和数据，每次发送都重新计算超时
+func (c *Conn) send(cmd byte, data []byte) error {
+	packet := make([]byte, 5+len(data))
+	binary.BigEndian.PutUint32(packet, uint32(1+len(data)))
+	packet[4] = cmd
+	copy(packet[5:], data)
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	_, err := c.conn.Write(packet)
+	return err
+}
+
+// read 读取一个数据包，每次读取都重新计算超时
+func (c *Conn) read() (byte, []byte, error) {
+	c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+	var header [4]byte
+	if _, err := io.ReadFull(c.conn, header[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(header[:])
+	if n == 0 || n > maxPacket {
+		return 0, nil, fmt.Errorf("milter: invalid packet length %d", n)
+	}
+	packet := make([]byte, n)
+	if _, err := io.ReadFull(c.conn, packet); err != nil {
+		return 0, nil, err
+	}
+	return packet[0], packet[1:], nil
+}
+
+// parseResponse 解析最终回复，不是最终回复时返回 false
+func parseResponse(cmd byte, data []byte) (*Response, bool, error) {
+	switch action := Action(cmd); action {
+	case Continue, Accept, Reject, Tempfail, Discard, Skip:
+		return &Response{Action: action}, true, nil
+	case ReplyCode:
+		text := strings.TrimRight(string(data), "\x00")
+		// 多行回复只取第一行
+		text, _, _ = strings.Cut(text, "\r\n")
+		if len(text) < 3 {
+			return nil, true, fmt.Errorf("milter: invalid reply code %q", text)
+		}
+		code, err := strconv.Atoi(text[:3])
+		if err != nil || code < 400 || code > 599 {
+			return nil, true, fmt.Errorf("milter: invalid reply code %q", text)
+		}
+		resp := &Response{Action: action, Code: code, Text: strings.TrimSpace(text[3:])}
+		resp.Text = strings.TrimPrefix(resp.Text, "-")
+		resp.Enhanced, resp.Text = smtpcode.ParseEnhanced(resp.Text, code/100)
+		return resp, true, nil
+	}
+	return nil, false, nil
+}
+
+// parseModification 解析邮件结束时的修改动作，不支持的动作只记录命令字节
+func parseModification(cmd byte, data []byte) (Modification, error) {
+	mod := Modification{Kind: cmd}
+	switch cmd {
+	case AddHeader:
+		fields := splitCStrings(data)
+		if len(fields) < 2 {
+			return mod, errors.New("milter: malformed add header")
+		}
+		mod.Name, mod.Value = fields[0], fields[1]
+	case InsertHeader, ChangeHeader:
+		if len(data) < 4 {
+			return mod, errors.New("milter: malformed change header")
+		}
+		fields := splitCStrings(data[4:])
+		if len(fields) < 2 {
+			return mod, errors.New("milter: malformed change header")
+		}
+		mod.Index = int(binary.BigEndian.Uint32(data))
+		mod.Name, mod.Value = fields[0], fields[1]
+	case ReplaceBody:
+		mod.Body = data
+	}
+	return mod, nil
+}
+
+// cstrings 把字符串编码为以 NUL 结尾的序列
+func cstrings(fields ...string) []byte {
+	var b bytes.Buffer
+	for _, field := range fields {
+		b.WriteString(field)
+		b.WriteByte(0)
+	}
+	return b.Bytes()
+}
+
+// splitCStrings 拆分以 NUL 结尾的字符串序列
+func splitCStrings(data []byte) []string {
+	var fields []string
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, 0)
+		if i < 0 {
+			fields = append(fields, string(data))
+			break
+		}
+		fields = append(fields, string(data[:i]))
+		data = data[i+1:]
+	}
+	return fields
+}
@@ -0,0 +1,266 @@
+package milter
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// milterPacket 测试用 milter 收发的数据包
+type milterPacket struct {
+	cmd  byte
+	data []byte
+}
+
+// startFakeMilter 启动一个 milter：协商时回复 actions 和 protocol，其余命令交给 handle，
+// 按它返回的数据包回复；返回 inet: 地址和收到的全部数据包
+func startFakeMilter(t *testing.T, actions, protocol uint32, handle func(milterPacket) []milterPacket) (string, func() []milterPacket) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	var mu sync.Mutex
+	var received []milterPacket
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					var header [4]byte
+					if _, err := io.ReadFull(conn, header[:]); err != nil {
+						return
+					}
+					packet := make([]byte, binary.BigEndian.Uint32(header[:]))
+					if _, err := io.ReadFull(conn, packet); err != nil {
+						return
+					}
+					p := milterPacket{cmd: packet[0], data: packet[1:]}
+					mu.Lock()
+					received = append(received, p)
+					mu.Unlock()
+
+					var replies []milterPacket
+					if p.cmd == cmdOptNeg {
+						var data [12]byte
+						binary.BigEndian.PutUint32(data[0:], 6)
+						binary.BigEndian.PutUint32(data[4:], actions)
+						binary.BigEndian.PutUint32(data[8:], protocol)
+						replies = []milterPacket{{replyOptNeg, data[:]}}
+					} else if p.cmd != cmdMacro && p.cmd != cmdAbort && p.cmd != cmdQuit {
+						replies = handle(p)
+					}
+					for _, r := range replies {
+						out := make([]byte, 5+len(r.data))
+						binary.BigEndian.PutUint32(out, uint32(1+len(r.data)))
+						out[4] = r.cmd
+						copy(out[5:], r.data)
+						conn.Write(out)
+					}
+				}
+			}()
+		}
+	}()
+
+	return "inet:" + l.Addr().String(), func() []milterPacket {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]milterPacket(nil), received...)
+	}
+}
+
+// continueMilter 对所有事件回复 continue
+func continueMilter(milterPacket) []milterPacket {
+	return []milterPacket{{cmd: byte(Continue)}}
+}
+
+func TestSession(t *testing.T) {
+	addr, received := startFakeMilter(t, allActions|0x20, 0, func(p milterPacket) []milterPacket {
+		switch p.cmd {
+		case cmdRcpt:
+			if strings.Contains(string(p.data), "blocked") {
+				return []milterPacket{{byte(ReplyCode), cstrings("550 5.7.1 Recipient blocked")}}
+			}
+		case cmdEOB:
+			index := make([]byte, 4)
+			binary.BigEndian.PutUint32(index, 1)
+			return []milterPacket{
+				{replyProgress, nil},
+				{AddHeader, cstrings("X-Client", "checked")},
+				{ChangeHeader, append(index, cstrings("Subject", "")...)},
+				{ReplaceBody, []byte("new ")},
+				{ReplaceBody, []byte("body\r\n")},
+				// 未协商的隔离动作被忽略
+				{'q', cstrings("quarantined")},
+				{byte(Accept), nil},
+			}
+		}
+		return continueMilter(p)
+	})
+
+	m, err := NewClient(Options{Address: addr})
+	if err != nil {
+		t.Fatalf("Failed to create milter: %v", err)
+	}
+	conn, err := m.Open()
+	if err != nil {
+		t.Fatalf("Failed to open milter: %v", err)
+	}
+	defer conn.Close()
+
+	resp, err := conn.Connect("[192.0.2.1]", netip.MustParseAddrPort("192.0.2.1:2525"), map[string]string{"j": "mx.example.com"})
+	if err != nil || resp.Action != Continue {
+		t.Fatalf("Failed to send connect: %+v, %v", resp, err)
+	}
+	if resp, err = conn.Helo("client.example.com", nil); err != nil || resp.Action != Continue {
+		t.Fatalf("Failed to send helo: %+v, %v", resp, err)
+	}
+	if resp, err = conn.Mail("<alice@example.com>", []string{"SIZE=100"}, nil); err != nil || resp.Action != Continue {
+		t.Fatalf("Failed to send mail: %+v, %v", resp, err)
+	}
+	resp, err = conn.Rcpt("<blocked@example.com>", nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to send rcpt: %v", err)
+	}
+	want := Response{Action: ReplyCode, Code: 550, Enhanced: [3]int{5, 7, 1}, Text: "Recipient blocked"}
+	if *resp != want {
+		t.Errorf("Rcpt() = %+v, want %+v", *resp, want)
+	}
+	if resp, err = conn.Rcpt("<bob@example.com>", nil, nil); err != nil || resp.Action != Continue {
+		t.Fatalf("Failed to send rcpt: %+v, %v", resp, err)
+	}
+
+	headers := []Header{{Name: "Subject", Value: "hello"}, {Name: "To", Value: "bob@example.com"}}
+	resp, mods, err := conn.Message(headers, []byte("hello\r\n"), map[string]string{"i": "queue-id"})
+	if err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	if resp.Action != Accept {
+		t.Errorf("Message() action = %q, want accept", resp.Action)
+	}
+	wantMods := []Modification{
+		{Kind: AddHeader, Name: "X-Client", Value: "checked"},
+		{Kind: ChangeHeader, Index: 1, Name: "Subject"},
+		{Kind: ReplaceBody, Body: []byte("new ")},
+		{Kind: ReplaceBody, Body: []byte("body\r\n")},
+	}
+	if len(mods) != len(wantMods) {
+		t.Fatalf("Message() modifications = %+v, want %+v", mods, wantMods)
+	}
+	for i, mod := range mods {
+		w := wantMods[i]
+		if mod.Kind != w.Kind || mod.Index != w.Index || mod.Name != w.Name || mod.Value != w.Value || string(mod.Body) != string(w.Body) {
+			t.Errorf("modification %d = %+v, want %+v", i, mod, w)
+		}
+	}
+
+	// 每个事件之前发送各自的宏，邮件头逐个发送
+	var cmds []string
+	for _, p := range received() {
+		cmds = append(cmds, string(p.cmd))
+	}
+	if got, want := strings.Join(cmds, ""), "ODCHMRRDTLLNBDE"; got != want {
+		t.Errorf("milter received commands %q, want %q", got, want)
+	}
+	for _, p := range received() {
+		switch p.cmd {
+		case cmdConnect:
+			if want := "[192.0.2.1]\x004\x09\xdd192.0.2.1\x00"; string(p.data) != want {
+				t.Errorf("connect data = %q, want %q", p.data, want)
+			}
+		case cmdMail:
+			if want := "<alice@example.com>\x00SIZE=100\x00"; string(p.data) != want {
+				t.Errorf("mail data = %q, want %q", p.data, want)
+			}
+		case cmdMacro:
+			if p.data[0] == cmdEOB && string(p.data[1:]) != "i\x00queue-id\x00" {
+				t.Errorf("end of message macros = %q", p.data[1:])
+			}
+		}
+	}
+}
+
+func TestProtocolOptions(t *testing.T) {
+	// milter 不需要 HELO，不回复 RCPT，不需要邮件体
+	addr, received := startFakeMilter(t, allActions, optNoHelo|optNRRcpt|optNoBody, func(p milterPacket) []milterPacket {
+		if p.cmd == cmdRcpt {
+			return nil
+		}
+		if p.cmd == cmdHeader {
+			return []milterPacket{{byte(Discard), nil}}
+		}
+		return continueMilter(p)
+	})
+
+	m, err := NewClient(Options{Address: addr})
+	if err != nil {
+		t.Fatalf("Failed to create milter: %v", err)
+	}
+	conn, err := m.Open()
+	if err != nil {
+		t.Fatalf("Failed to open milter: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Helo("client.example.com", nil); err != nil {
+		t.Fatalf("Failed to send helo: %v", err)
+	}
+	if resp, err := conn.Rcpt("<bob@example.com>", nil, nil); err != nil || resp.Action != Continue {
+		t.Fatalf("Failed to send rcpt: %+v, %v", resp, err)
+	}
+	// 第一个邮件头就被丢弃，不再发送其余的事件
+	resp, mods, err := conn.Message([]Header{{Name: "Subject", Value: "a"}, {Name: "To", Value: "b"}}, []byte("body\r\n"), nil)
+	if err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	if resp.Action != Discard || mods != nil {
+		t.Errorf("Message() = %+v, %+v, want discard without modifications", resp, mods)
+	}
+
+	var cmds []string
+	for _, p := range received() {
+		cmds = append(cmds, string(p.cmd))
+	}
+	if got, want := strings.Join(cmds, ""), "ORTL"; got != want {
+		t.Errorf("milter received commands %q, want %q", got, want)
+	}
+}
+
+func TestParseResponse(t *testing.T) {
+	tests := []struct {
+		cmd     byte
+		data    string
+		want    Response
+		final   bool
+		wantErr bool
+	}{
+		{cmd: 'c', want: Response{Action: Continue}, final: true},
+		{cmd: 't', want: Response{Action: Tempfail}, final: true},
+		{cmd: 'y', data: "554 5.7.1 Spam detected\x00", want: Response{Action: ReplyCode, Code: 554, Enhanced: [3]int{5, 7, 1}, Text: "Spam detected"}, final: true},
+		{cmd: 'y', data: "451 Try later\x00", want: Response{Action: ReplyCode, Code: 451, Text: "Try later"}, final: true},
+		{cmd: 'y', data: "550-5.7.1 First line\r\n550 5.7.1 Second line\x00", want: Response{Action: ReplyCode, Code: 550, Enhanced: [3]int{5, 7, 1}, Text: "First line"}, final: true},
+		{cmd: 'y', data: "250 OK\x00", final: true, wantErr: true},
+		{cmd: 'y', data: "5\x00", final: true, wantErr: true},
+		{cmd: 'h'},
+	}
+	for _, tt := range tests {
+		resp, final, err := parseResponse(tt.cmd, []byte(tt.data))
+		if final != tt.final || (err != nil) != tt.wantErr {
+			t.Errorf("parseResponse(%q, %q) final = %v, error = %v", tt.cmd, tt.data, final, err)
+			continue
+		}
+		if resp != nil && *resp != tt.want {
+			t.Errorf("parseResponse(%q, %q) = %+v, want %+v", tt.cmd, tt.data, *resp, tt.want)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/catroll/smtpd/config"
+	"github.com/catroll/smtpd/milter"
+	gosmtp "github.com/emersion/go-smtp"
+)
+
+// startMilter 启动一个 milter：RCPT 按收件人本地部分回复 reject、tempfail 或 discard，
+// 邮件结束时添加 X-Milter 头、修改 Subject 头并替换邮件体；返回 inet: 地址和收到的邮件头
+func startMilter(t *testing.T) (string, func() []string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	var mu sync.Mutex
+	var headers []string
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reply := func(cmd byte, data []byte) {
+					conn.Write(append(binary.BigEndian.AppendUint32(nil, uint32(1+len(data))), append([]byte{cmd}, data...)...))
+				}
+				for {
+					var header [4]byte
+					if _, err := io.ReadFull(conn, header[:]); err != nil {
+						return
+					}
+					p := make([]byte, binary.BigEndian.Uint32(header[:]))
+					if _, err := io.ReadFull(conn, p); err != nil {
+						return
+					}
+					fields := strings.Split(string(p[1:]), "\x00")
+					switch p[0] {
+					case 'O':
+						// 协议版本 6，添加、修改头部和替换邮件体
+						reply('O', []byte{0, 0, 0, 6, 0, 0, 0, 0x13, 0, 0, 0, 0})
+					case 'D', 'A', 'Q':
+					case 'R':
+						switch {
+						case strings.HasPrefix(fields[0], "<reject@"):
+							reply('y', []byte("550 5.7.1 Rejected by milter\x00"))
+						case strings.HasPrefix(fields[0], "<tempfail@"):
+							reply('t', nil)
+						case strings.HasPrefix(fields[0], "<discard@"):
+							reply('d', nil)
+						default:
+							reply('c', nil)
+						}
+					case 'L':
+						mu.Lock()
+						headers = append(headers, fields[0]+"="+fields[1])
+						mu.Unlock()
+						reply('c', nil)
+					case 'E':
+						reply('h', []byte("X-Milter\x00checked\x00"))
+						reply('m', append([]byte{0, 0, 0, 1}, "Subject\x00filtered\x00"...))
+						reply('b', []byte("filtered body\r\n"))
+						reply('a', nil)
+					default:
+						reply('c', nil)
+					}
+				}
+			}()
+		}
+	}()
+
+	return "inet:" + l.Addr().String(), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), headers...)
+	}
+}
+
+func TestMilter(t *testing.T) {
+	milterAddr, headers := startMilter(t)
+	cfg := newAnonymousConfig()
+	cfg.SMTP.Milters = []config.Milter{{Address: milterAddr}}
+	addr, dataDir := startTestServer(t, cfg, "")
+
+	msg := "Subject: test\r\nX-Folded: first\r\n second\r\n\r\nhello\r\n"
+	for _, tt := range []struct {
+		to       string
+		wantCode int
+	}{
+		{to: "reject@example.com", wantCode: 550},
+		{to: "tempfail@example.com", wantCode: 451},
+	} {
+		err := sendTestMail(addr, nil, "sender@example.net", []string{tt.to}, msg)
+		var smtpErr *gosmtp.SMTPError
+		if !errors.As(err, &smtpErr) || smtpErr.Code != tt.wantCode {
+			t.Errorf("RCPT %s: expected %d error, got %v", tt.to, tt.wantCode, err)
+		}
+	}
+
+	// 丢弃的邮件对客户端表现为成功，但不会保存
+	if err := sendTestMail(addr, nil, "sender@example.net", []string{"discard@example.com"}, msg); err != nil {
+		t.Fatalf("SendMail failed: %v", err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dataDir, "*.eml")); len(files) != 0 {
+		t.Fatalf("Expected discarded message not to be stored, got %d", len(files))
+	}
+
+	if err := sendTestMail(addr, nil, "sender@example.net", []string{"ok@example.com"}, msg); err != nil {
+		t.Fatalf("SendMail failed: %v", err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dataDir, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("Expected 1 stored message, got %d", len(files))
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	if !strings.HasSuffix(string(data), "Subject: filtered\r\nX-Folded: first\r\n second\r\nX-Milter: checked\r\n\r\nfiltered body\r\n") {
+		t.Errorf("Message does not contain milter modifications:\n%s", data)
+	}
+
+	want := "Subject=test,X-Folded=first\n second"
+	if got := strings.Join(headers(), ","); got != want {
+		t.Errorf("milter received headers %q, want %q", got, want)
+	}
+}
+
+func TestMilterUnavailable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	milterAddr := "inet:" + l.Addr().String()
+	l.Close()
+
+	tests := []struct {
+		defaultAction string
+		wantCode      int
+	}{
+		{defaultAction: "", wantCode: 451},
+		{defaultAction: "reject", wantCode: 550},
+		{defaultAction: "accept", wantCode: 0},
+	}
+	for _, tt := range tests {
+		cfg := newAnonymousConfig()
+		cfg.SMTP.Milters = []config.Milter{{Address: milterAddr, DefaultAction: tt.defaultAction}}
+		addr, _ := startTestServer(t, cfg, "")
+
+		err := sendTestMail(addr, nil, "sender@example.net", []string{"rcpt@example.com"}, "Subject: test\r\n\r\nhello\r\n")
+		if tt.wantCode == 0 {
+			if err != nil {
+				t.Errorf("default action %q: SendMail failed: %v", tt.defaultAction, err)
+			}
+			continue
+		}
+		var smtpErr *gosmtp.SMTPError
+		if !errors.As(err, &smtpErr) || smtpErr.Code != tt.wantCode {
+			t.Errorf("default action %q: expected %d error, got %v", tt.defaultAction, tt.wantCode, err)
+		}
+	}
+}
+
+func TestMilterContentApply(t *testing.T) {
+	data := "Received: from a\r\nSubject: one\r\nsubject: two\r\n\r\nbody\r\n"
+	tests := []struct {
+		name string
+		mods []milter.Modification
+		want string
+	}{
+		{
+			name: "no modifications",
+			want: data,
+		},
+		{
+			name: "insert header first",
+			mods: []milter.Modification{{Kind: milter.InsertHeader, Index: 0, Name: "X-First", Value: "1"}},
+			want: "X-First: 1\r\nReceived: from a\r\nSubject: one\r\nsubject: two\r\n\r\nbody\r\n",
+		},
+		{
+			name: "delete second subject",
+			mods: []milter.Modification{{Kind: milter.ChangeHeader, Index: 2, Name: "Subject"}},
+			want: "Received: from a\r\nSubject: one\r\n\r\nbody\r\n",
+		},
+		{
+			name: "change missing header",
+			mods: []milter.Modification{{Kind: milter.ChangeHeader, Index: 1, Name: "X-Spam", Value: "yes\n\tscore=7"}},
+			want: "Received: from a\r\nSubject: one\r\nsubject: two\r\nX-Spam: yes\r\n\tscore=7\r\n\r\nbody\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := parseMilterMessage([]byte(data))
+			if len(tt.mods) > 0 {
+				msg.apply(tt.mods)
+			}
+			if got := string(msg.bytes()); got != tt.want {
+				t.Errorf("bytes() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/catroll/smtpd/config"
+	"github.com/catroll/smtpd/policy"
+	gosmtp "github.com/emersion/go-smtp"
+)
+
+// 查询策略服务的阶段，对应 Postfix 的 protocol_state
+const (
+	policyStageRcpt = "rcpt"
+	policyStageData = "data"
+	policyStageEOM  = "end-of-message"
+)
+
+// defaultPolicyAction 策略服务不可用时默认采用的动作，与 Postfix 相同
+const defaultPolicyAction = "451 4.3.5 Server configuration problem"
+
+// policyService 一个策略委托服务及其查询的阶段
+type policyService struct {
+	client        *policy.Client
+	stages        []string
+	defaultAction string
+}
+
+// newPolicyServices 根据配置创建策略服务，未配置阶段时只在 RCPT 阶段查询
+func newPolicyServices(cfg *config.Config) ([]*policyService, error) {
+	var services []*policyService
+	for _, ps := range cfg.SMTP.PolicyServices {
+		client, err := policy.NewClient(policy.Options{
+			Address: ps.Address,
+			Timeout: ps.Timeout,
+		})
+		if err != nil {
+			return nil, err
+		}
+		svc := &policyService{
+			client:        client,
+			stages:        ps.Stages,
+			defaultAction: ps.DefaultAction,
+		}
+		if len(svc.stages) == 0 {
+			svc.stages = []string{policyStageRcpt}
+		}
+		if svc.defaultAction == "" {
+			svc.defaultAction = defaultPolicyAction
+		}
+		services = append(services, svc)
+	}
+	return services, nil
+}
+
+// checkPolicy 在 stage 阶段依次查询策略服务：OK 结束本阶段的查询，DUNNO 继续查询下一个服务，
+// REJECT、DEFER 及数字回复码拒绝收件人或邮件；HOLD 和 PREPEND 记录下来，在保存邮件时生效，
+// 并继续查询。rcpt 为 RCPT 阶段的收件人，size 为 MAIL 命令声明或实际的邮件大小
+func (s *Session) checkPolicy(stage string, rcpt Address, size int64) error {
+	for _, ps := range s.backend.policies {
+		if !slices.Contains(ps.stages, stage) {
+			continue
+		}
+
+		action, err := ps.client.Query(s.policyAttributes(stage, rcpt, size))
+		if err != nil {
+			slog.Error("查询策略服务失败",
+				"session_id", s.sessionID,
+				"remote_addr", s.remoteAddr,
+				"policy_service", ps.client.Address(),
+				"stage", stage,
+				"default_action", ps.defaultAction,
+				"error", err,
+				"timestamp", time.Now().Format(time.RFC3339Nano),
+			)
+			action = ps.defaultAction
+		}
+
+		a := policy.ParseAction(action)
+		if a.Verb != "DUNNO" {
+			slog.Info("策略服务返回动作",
+				"session_id", s.sessionID,
+				"remote_addr", s.remoteAddr,
+				"policy_service", ps.client.Address(),
+				"stage", stage,
+				"to", rcpt.String(),
+				"action", action,
+				"timestamp", time.Now().Format(time.RFC3339Nano),
+			)
+		}
+		switch a.Verb {
+		case "OK":
+			return nil
+		case "DUNNO":
+		case "REJECT", "DEFER":
+			return policyReply(a)
+		case "HOLD":
+			s.policyHold = a.Text
+			if s.policyHold == "" {
+				s.policyHold = "held by policy service"
+			}
+		case "PREPEND":
+			if !validHeaderLine(a.Text) {
+				slog.Warn("策略服务要求添加的邮件头无效，已忽略",
+					"session_id", s.sessionID,
+					"policy_service", ps.client.Address(),
+					"header", a.Text,
+					"timestamp", time.Now().Format(time.RFC3339Nano),
+				)
+				continue
+			}
+			s.policyHeaders = append(s.policyHeaders, a.Text)
+		default:
+			slog.Warn("不支持的策略动作，按 DUNNO 处理",
+				"session_id", s.sessionID,
+				"policy_service", ps.client.Address(),
+				"action", action,
+				"timestamp", time.Now().Format(time.RFC3339Nano),
+			)
+		}
+	}
+	return nil
+}
+
+// policyAttributes 返回策略请求中的会话属性
+func (s *Session) policyAttributes(stage string, rcpt Address, size int64) map[string]string {
+	attrs := map[string]string{
+		"protocol_state":  strings.ToUpper(stage),
+		"protocol_name":   "ESMTP",
+		"helo_name":       s.conn.Hostname(),
+		"queue_id":        "",
+		"instance":        s.sessionID + "." + strconv.Itoa(s.transactions),
+		"client_address":  s.clientIP(),
+		"client_name":     "unknown",
+		"sasl_method":     "",
+		"sasl_username":   "",
+		"sender":          s.from.String(),
+		"recipient":       rcpt.String(),
+		"recipient_count": "0",
+		"size":            strconv.FormatInt(size, 10),
+	}
+	if s.authenticated {
+		attrs["sasl_method"] = s.authMethod
+		attrs["sasl_username"] = s.username
+	}
+	// 与 Postfix 相同，recipient_count 只在 DATA 和 END-OF-MESSAGE 阶段不为 0
+	if stage != policyStageRcpt {
+		attrs["recipient_count"] = strconv.Itoa(len(s.rcpts))
+	}
+	if state, ok := s.conn.TLSConnectionState(); ok {
+		attrs["encryption_protocol"] = tls.VersionName(state.Version)
+		attrs["encryption_cipher"] = tls.CipherSuiteName(state.CipherSuite)
+		attrs["encryption_keysize"] = cipherBits(state.CipherSuite)
+	}
+	return attrs
+}
+
+// policyReply 把 REJECT、DEFER 动作转换为 SMTP 回复，未指定回复码和增强状态码时
+// 分别使用 550 5.7.1 和 450 4.7.1
+func policyReply(a policy.Action) *gosmtp.SMTPError {
+	reply := &gosmtp.SMTPError{
+		Code:         550,
+		EnhancedCode: gosmtp.EnhancedCode{5, 7, 1},
+		Message:      a.Text,
+	}
+	if a.Verb == "DEFER" {
+		reply.Code = 450
+		reply.EnhancedCode = gosmtp.EnhancedCode{4, 7, 1}
+	}
+	if a.Code != 0 {
+		reply.Code = a.Code
+	}
+	if a.Enhanced != [3]int{} {
+		reply.EnhancedCode = gosmtp.EnhancedCode(a.Enhanced)
+	}
+	if reply.Message == "" {
+		reply.Message = "Access denied"
+		if a.Verb == "DEFER" {
+			reply.Message = "Try again later"
+		}
+	}
+	return reply
+}
+
+// validHeaderLine 判断是否为单行的 "名称: 值" 形式的邮件头
+func validHeaderLine(line string) bool {
+	name, _, ok := strings.Cut(line, ":")
+	if !ok || name == "" || strings.ContainsAny(line, "\r\n") {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] <= ' ' || name[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// policyHeaderBlock 返回策略服务要求添加到邮件开头的头部，没有时为空
+func (s *Session) policyHeaderBlock() string {
+	if len(s.policyHeaders) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s\r\n", strings.Join(s.policyHeaders, "\r\n"))
+}
@@ -0,0 +1,210 @@
+package policy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/catroll/smtpd/internal/netaddr"
+	"github.com/catroll/smtpd/internal/smtpcode"
+)
+
+// maxIdle 每个策略服务保留的空闲连接数
+const maxIdle = 4
+
+// Options 策略服务客户端的配置
+type Options struct {
+	// Address 服务地址：inet:host:port 或 unix:/path
+	Address string
+	// Timeout 连接和等待回复的超时，默认 10 秒
+	Timeout time.Duration
+}
+
+// Client 按 Postfix SMTP 访问策略委托协议查询策略服务：请求是若干 name=value 行，
+// 以空行结束；回复同样以空行结束，其中的 action= 为动作。连接在查询之间复用
+type Client struct {
+	opts    Options
+	network string
+	address string
+
+	mu   sync.Mutex
+	idle []*clientConn
+}
+
+// clientConn 到策略服务的连接，r 在同一连接的多次查询之间保留
+type clientConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// NewClient 创建策略服务客户端，不会立即连接
+func NewClient(opts Options) (*Client, error) {
+	network, address, err := netaddr.ParseSocket(opts.Address)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	return &Client{opts: opts, network: network, address: address}, nil
+}
+
+// Address 返回配置中的服务地址
+func (c *Client) Address() string {
+	return c.opts.Address
+}
+
+// Query 发送一次策略请求，返回回复中 action= 的值；attrs 之前总是先发送
+// request=smtpd_access_policy，其余属性按名称排序发送，值中的换行被替换为空格
+func (c *Client) Query(attrs map[string]string) (string, error) {
+	var b strings.Builder
+	b.WriteString("request=smtpd_access_policy\n")
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		value := strings.NewReplacer("\r", " ", "\n", " ").Replace(attrs[name])
+		b.WriteString(name + "=" + value + "\n")
+	}
+	b.WriteString("\n")
+	request := b.String()
+
+	// 复用的连接可能已被服务端关闭，失败时用新连接重试一次
+	conn, reused, err := c.get()
+	if err != nil {
+		return "", err
+	}
+	action, err := c.exchange(conn, request)
+	if err != nil && reused {
+		conn.Close()
+		if conn, err = c.dial(); err != nil {
+			return "", err
+		}
+		action, err = c.exchange(conn, request)
+	}
+	if err != nil {
+		conn.Close()
+		return "", err
+	}
+	c.put(conn)
+	return action, nil
+}
+
+// exchange 在连接上发送请求，读取完整的回复
+func (c *Client) exchange(conn *clientConn, request string) (string, error) {
+	conn.SetDeadline(time.Now().Add(c.opts.Timeout))
+	if _, err := conn.Write([]byte(request)); err != nil {
+		return "", err
+	}
+
+	action := ""
+	found := false
+	for {
+		line, err := conn.r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		if value, ok := strings.CutPrefix(line, "action="); ok && !found {
+			action, found = value, true
+		}
+	}
+	if !found {
+		return "", fmt.Errorf("policy service %s: reply without action", c.opts.Address)
+	}
+	return action, nil
+}
+
+// get 取出一个空闲连接，没有时新建连接
+func (c *Client) get() (*clientConn, bool, error) {
+	c.mu.Lock()
+	if n := len(c.idle); n > 0 {
+		conn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return conn, true, nil
+	}
+	c.mu.Unlock()
+	conn, err := c.dial()
+	return conn, false, err
+}
+
+// put 归还连接，空闲连接已满时关闭它
+func (c *Client) put(conn *clientConn) {
+	conn.SetDeadline(time.Time{})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.idle) >= maxIdle {
+		conn.Close()
+		return
+	}
+	c.idle = append(c.idle, conn)
+}
+
+// dial 新建到策略服务的连接
+func (c *Client) dial() (*clientConn, error) {
+	conn, err := net.DialTimeout(c.network, c.address, c.opts.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &clientConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// Close 关闭所有空闲连接
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, conn := range c.idle {
+		conn.Close()
+	}
+	c.idle = nil
+	return nil
+}
+
+// Action 解析后的策略动作
+type Action struct {
+	// Verb 大写的动作名称，如 OK、REJECT、DEFER、DUNNO、HOLD、PREPEND；
+	// 以数字回复码表示的动作为 REJECT（5xx）或 DEFER（4xx）
+	Verb string
+	// Code 和 Enhanced 为 REJECT、DEFER 的 SMTP 回复码和增强状态码，没有时为零值
+	Code     int
+	Enhanced [3]int
+	// Text 动作之后的文本：拒绝原因，或 PREPEND 的头部
+	Text string
+}
+
+// ParseAction 解析 action= 的值，如 "REJECT 5.7.1 Blocked"、"450 4.7.1 Try later"
+// 或 "PREPEND X-Policy: checked"；REJECT、DEFER 的文本以增强状态码开头时一并解析
+func ParseAction(action string) Action {
+	action = strings.TrimSpace(action)
+	verb, text, _ := strings.Cut(action, " ")
+	a := Action{Verb: strings.ToUpper(verb), Text: strings.TrimSpace(text)}
+
+	if code, err := strconv.Atoi(verb); err == nil && len(verb) == 3 && (verb[0] == '4' || verb[0] == '5') {
+		a.Code = code
+		a.Verb = "REJECT"
+		if verb[0] == '4' {
+			a.Verb = "DEFER"
+		}
+	}
+	if a.Verb != "REJECT" && a.Verb != "DEFER" {
+		return a
+	}
+
+	class := 5
+	if a.Verb == "DEFER" {
+		class = 4
+	}
+	a.Enhanced, a.Text = smtpcode.ParseEnhanced(a.Text, class)
+	return a
+}
@@ -0,0 +1,111 @@
+package policy
+
+import (
+	"bufio"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseAction(t *testing.T) {
+	tests := []struct {
+		action string
+		want   Action
+	}{
+		{"OK", Action{Verb: "OK"}},
+		{"dunno", Action{Verb: "DUNNO"}},
+		{"REJECT", Action{Verb: "REJECT"}},
+		{"REJECT Blocked by policy", Action{Verb: "REJECT", Text: "Blocked by policy"}},
+		{"REJECT 5.7.9 Blocked", Action{Verb: "REJECT", Enhanced: [3]int{5, 7, 9}, Text: "Blocked"}},
+		{"REJECT 4.7.1 Wrong class", Action{Verb: "REJECT", Text: "4.7.1 Wrong class"}},
+		{"DEFER 4.7.1 Greylisted", Action{Verb: "DEFER", Enhanced: [3]int{4, 7, 1}, Text: "Greylisted"}},
+		{"450 4.2.0 Try later", Action{Verb: "DEFER", Code: 450, Enhanced: [3]int{4, 2, 0}, Text: "Try later"}},
+		{"554 Go away", Action{Verb: "REJECT", Code: 554, Text: "Go away"}},
+		{"HOLD suspicious", Action{Verb: "HOLD", Text: "suspicious"}},
+		{"PREPEND X-Policy: 1.2.3 checked", Action{Verb: "PREPEND", Text: "X-Policy: 1.2.3 checked"}},
+		{"FILTER smtp:[127.0.0.1]:10025", Action{Verb: "FILTER", Text: "smtp:[127.0.0.1]:10025"}},
+	}
+	for _, tt := range tests {
+		if got := ParseAction(tt.action); got != tt.want {
+			t.Errorf("ParseAction(%q) = %+v, want %+v", tt.action, got, tt.want)
+		}
+	}
+}
+
+func TestClientQuery(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "policy")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	// 策略服务按收件人回复动作，第二次查询后关闭连接，以测试重新连接
+	var mu sync.Mutex
+	var requests []map[string]string
+	conns := 0
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns++
+			mu.Unlock()
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for n := 0; n < 2; n++ {
+					attrs := make(map[string]string)
+					for {
+						line, err := r.ReadString('\n')
+						if err != nil {
+							return
+						}
+						line = strings.TrimSuffix(line, "\n")
+						if line == "" {
+							break
+						}
+						name, value, _ := strings.Cut(line, "=")
+						attrs[name] = value
+					}
+					mu.Lock()
+					requests = append(requests, attrs)
+					mu.Unlock()
+					conn.Write([]byte("action=REJECT " + attrs["recipient"] + "\nextra=ignored\n\n"))
+				}
+			}()
+		}
+	}()
+
+	c, err := NewClient(Options{Address: "unix:" + socket})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer c.Close()
+
+	for _, rcpt := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		action, err := c.Query(map[string]string{"recipient": rcpt, "helo_name": "bad\nname"})
+		if err != nil {
+			t.Fatalf("Query() error = %v", err)
+		}
+		if action != "REJECT "+rcpt {
+			t.Errorf("Query() = %q, want %q", action, "REJECT "+rcpt)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requests) != 3 {
+		t.Fatalf("Expected 3 requests, got %d", len(requests))
+	}
+	if requests[0]["request"] != "smtpd_access_policy" || requests[0]["helo_name"] != "bad name" {
+		t.Errorf("Unexpected request attributes: %v", requests[0])
+	}
+	if conns != 2 {
+		t.Errorf("Expected 2 connections, got %d", conns)
+	}
+}
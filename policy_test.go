@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/catroll/smtpd/config"
+	gosmtp "github.com/emersion/go-smtp"
+)
+
+// startPolicyServer 启动按收件人本地部分回复动作的策略服务，返回 inet: 地址和收到的请求
+func startPolicyServer(t *testing.T, actions map[string]string) (string, func() []map[string]string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	var mu sync.Mutex
+	var requests []map[string]string
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					attrs := make(map[string]string)
+					for {
+						line, err := r.ReadString('\n')
+						if err != nil {
+							return
+						}
+						line = strings.TrimSuffix(line, "\n")
+						if line == "" {
+							break
+						}
+						name, value, _ := strings.Cut(line, "=")
+						attrs[name] = value
+					}
+					mu.Lock()
+					requests = append(requests, attrs)
+					mu.Unlock()
+
+					local, _, _ := strings.Cut(attrs["recipient"], "@")
+					action, ok := actions[attrs["protocol_state"]+" "+local]
+					if !ok {
+						action = "DUNNO"
+					}
+					conn.Write([]byte("action=" + action + "\n\n"))
+				}
+			}()
+		}
+	}()
+
+	return "inet:" + l.Addr().String(), func() []map[string]string {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests
+	}
+}
+
+func TestPolicyService(t *testing.T) {
+	policyAddr, requests := startPolicyServer(t, map[string]string{
+		"RCPT reject":     "REJECT 5.7.9 Blocked by policy",
+		"RCPT defer":      "450 4.7.1 Try again later",
+		"RCPT hold":       "HOLD suspicious recipient",
+		"RCPT ok":         "OK",
+		"END-OF-MESSAGE ": "PREPEND X-Policy-Checked: yes",
+	})
+	cfg := newAnonymousConfig()
+	cfg.SMTP.PolicyServices = []config.PolicyService{{
+		Address: policyAddr,
+		Stages:  []string{"rcpt", "end-of-message"},
+	}}
+	addr, dataDir := startTestServer(t, cfg, "")
+
+	for _, tt := range []struct {
+		to       string
+		wantCode int
+	}{
+		{to: "reject@example.com", wantCode: 550},
+		{to: "defer@example.com", wantCode: 450},
+	} {
+		err := sendTestMail(addr, nil, "sender@example.net", []string{tt.to}, "Subject: test\r\n\r\nhello\r\n")
+		var smtpErr *gosmtp.SMTPError
+		if !errors.As(err, &smtpErr) || smtpErr.Code != tt.wantCode {
+			t.Errorf("RCPT %s: expected %d error, got %v", tt.to, tt.wantCode, err)
+		}
+	}
+
+	// PREPEND 的头部添加到邮件开头
+	if err := sendTestMail(addr, nil, "sender@example.net", []string{"ok@example.com"}, "Subject: test\r\n\r\nhello\r\n"); err != nil {
+		t.Fatalf("SendMail failed: %v", err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dataDir, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("Expected 1 stored message, got %d", len(files))
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	if !strings.Contains(string(data), "X-Policy-Checked: yes\r\nSubject: test\r\n") {
+		t.Errorf("Message does not contain prepended header:\n%s", data)
+	}
+
+	// HOLD 的邮件保存到 hold 子目录
+	if err := sendTestMail(addr, nil, "sender@example.net", []string{"hold@example.com"}, "Subject: test\r\n\r\nhello\r\n"); err != nil {
+		t.Fatalf("SendMail failed: %v", err)
+	}
+	held, _ := filepath.Glob(filepath.Join(dataDir, "hold", "*.eml"))
+	if len(held) != 1 {
+		t.Fatalf("Expected 1 held message, got %d", len(held))
+	}
+	data, err = os.ReadFile(held[0])
+	if err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	if !strings.Contains(string(data), `"policy_hold":"suspicious recipient"`) {
+		t.Errorf("Held message does not record the hold reason")
+	}
+
+	var rcpt, eom map[string]string
+	for _, req := range requests() {
+		switch {
+		case req["protocol_state"] == "RCPT" && req["recipient"] == "ok@example.com":
+			rcpt = req
+		case req["protocol_state"] == "END-OF-MESSAGE" && eom == nil:
+			eom = req
+		}
+	}
+	if rcpt == nil || rcpt["sender"] != "sender@example.net" || rcpt["client_address"] != "127.0.0.1" || rcpt["helo_name"] != "localhost" {
+		t.Errorf("Unexpected RCPT request: %v", rcpt)
+	}
+	if eom == nil || eom["recipient_count"] != "1" || eom["size"] == "0" {
+		t.Errorf("Unexpected END-OF-MESSAGE request: %v", eom)
+	}
+}
+
+func TestPolicyServiceUnavailable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	policyAddr := "inet:" + l.Addr().String()
+	l.Close()
+
+	tests := []struct {
+		defaultAction string
+		wantCode      int
+	}{
+		{defaultAction: "", wantCode: 451},
+		{defaultAction: "DUNNO", wantCode: 0},
+	}
+	for _, tt := range tests {
+		cfg := newAnonymousConfig()
+		cfg.SMTP.PolicyServices = []config.PolicyService{{Address: policyAddr, DefaultAction: tt.defaultAction}}
+		addr, _ := startTestServer(t, cfg, "")
+
+		err := sendTestMail(addr, nil, "sender@example.net", []string{"rcpt@example.com"}, "Subject: test\r\n\r\nhello\r\n")
+		if tt.wantCode == 0 {
+			if err != nil {
+				t.Errorf("default action %q: SendMail failed: %v", tt.defaultAction, err)
+			}
+			continue
+		}
+		var smtpErr *gosmtp.SMTPError
+		if !errors.As(err, &smtpErr) || smtpErr.Code != tt.wantCode {
+			t.Errorf("default action %q: expected %d error, got %v", tt.defaultAction, tt.wantCode, err)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package quota
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/catroll/smtpd/statefile"
+)
+
+// 统计用量的时间片：每小时的额度按 5 分钟一片，每天的额度按 1 小时一片，
+// 用量在所在时间片整体移出窗口时过期
+const (
+	hourSlot = 5 * time.Minute
+	daySlot  = time.Hour
+)
+
+// 超出的额度类型
+const (
+	Messages   = "messages"
+	Recipients = "recipients"
+	Bytes      = "bytes"
+)
+
+// Limits 一个用户或 IP 的发送额度，0 表示不限制
+type Limits struct {
+	MessagesPerHour  int
+	MessagesPerDay   int
+	RecipientsPerDay int
+	BytesPerDay      int64
+}
+
+// enabled 是否设置了任一额度
+func (l Limits) enabled() bool {
+	return l != Limits{}
+}
+
+// Options 发送额度的配置
+type Options struct {
+	// User 每个已认证用户的额度
+	User Limits
+	// IP 每个客户端 IP 的额度
+	IP Limits
+	// StateFile 保存用量的文件，为空时不持久化
+	StateFile string
+}
+
+// Error 超出发送额度
+type Error struct {
+	// Scope 超出额度的是 user 还是 ip，Key 为对应的用户名或 IP
+	Scope string
+	Key   string
+	// Kind 额度类型，Period 为 hour 或 day，Limit 为额度
+	Kind   string
+	Period string
+	Limit  int64
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s %s exceeded %s quota of %d per %s", e.Scope, e.Key, e.Kind, e.Limit, e.Period)
+}
+
+// slot 一个时间片内的用量
+type slot struct {
+	Start      time.Time `json:"start"`
+	Messages   int       `json:"messages,omitempty"`
+	Recipients int       `json:"recipients,omitempty"`
+	Bytes      int64     `json:"bytes,omitempty"`
+}
+
+// usage 某个用户或 IP 的用量，时间片按开始时间递增
+type usage struct {
+	Hour []slot `json:"hour,omitempty"`
+	Day  []slot `json:"day,omitempty"`
+}
+
+// state 持久化的状态
+type state struct {
+	IPs   map[string]*usage `json:"ips"`
+	Users map[string]*usage `json:"users"`
+}
+
+// Quota 按已认证用户和客户端 IP 统计每小时、每天的邮件数、收件人数和字节数
+type Quota struct {
+	mu    sync.Mutex
+	opts  Options
+	state state
+	file  statefile.File
+
+	// now 当前时间，测试时可替换
+	now func() time.Time
+}
+
+// New 创建发送额度统计，配置了状态文件时从中恢复之前的用量
+func New(opts Options) (*Quota, error) {
+	q := &Quota{
+		opts: opts,
+		state: state{
+			IPs:   make(map[string]*usage),
+			Users: make(map[string]*usage),
+		},
+		file: statefile.New(opts.StateFile),
+		now:  time.Now,
+	}
+	loaded, err := q.file.Load(&q.state)
+	if err != nil {
+		return nil, err
+	}
+	if !loaded {
+		return q, nil
+	}
+	if q.state.IPs == nil {
+		q.state.IPs = make(map[string]*usage)
+	}
+	if q.state.Users == nil {
+		q.state.Users = make(map[string]*usage)
+	}
+	q.prune(q.now())
+
+	slog.Info("加载发送额度用量成功",
+		"file", opts.StateFile,
+		"ips", len(q.state.IPs),
+		"users", len(q.state.Users),
+		"timestamp", time.Now().Format(time.RFC3339Nano),
+	)
+	return q, nil
+}
+
+// Check 检查再接受一封 recipients 个收件人、size 字节的邮件是否超出用户或 IP 的额度，
+// 超出时返回 *Error；username 为空时只检查 IP。size 为 0 时只要求当天还有剩余字节
+func (q *Quota) Check(username, ip string, recipients int, size int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.check(username, ip, q.now(), recipients, size)
+}
+
+// check 按用户和 IP 的额度检查，调用方需持有锁
+func (q *Quota) check(username, ip string, now time.Time, recipients int, size int64) error {
+	if username != "" {
+		if err := checkUsage(q.state.Users[username], "user", username, q.opts.User, now, recipients, size); err != nil {
+			return err
+		}
+	}
+	if ip != "" {
+		return checkUsage(q.state.IPs[ip], "ip", ip, q.opts.IP, now, recipients, size)
+	}
+	return nil
+}
+
+// checkUsage 按 limits 检查 r 的用量加上一封邮件后是否超出额度，r 可以为 nil
+func checkUsage(r *usage, scope, key string, limits Limits, now time.Time, recipients int, size int64) error {
+	if !limits.enabled() {
+		return nil
+	}
+	var hour, day slot
+	if r != nil {
+		hour = sumSlots(r.Hour, now.Add(-time.Hour))
+		day = sumSlots(r.Day, now.Add(-24*time.Hour))
+	}
+
+	exceeded := func(kind, period string, limit int64) error {
+		return &Error{Scope: scope, Key: key, Kind: kind, Period: period, Limit: limit}
+	}
+	switch {
+	case limits.MessagesPerHour > 0 && hour.Messages+1 > limits.MessagesPerHour:
+		return exceeded(Messages, "hour", int64(limits.MessagesPerHour))
+	case limits.MessagesPerDay > 0 && day.Messages+1 > limits.MessagesPerDay:
+		return exceeded(Messages, "day", int64(limits.MessagesPerDay))
+	case limits.RecipientsPerDay > 0 && day.Recipients+recipients > limits.RecipientsPerDay:
+		return exceeded(Recipients, "day", int64(limits.RecipientsPerDay))
+	case limits.BytesPerDay > 0 && (day.Bytes >= limits.BytesPerDay || day.Bytes+size > limits.BytesPerDay):
+		return exceeded(Bytes, "day", limits.BytesPerDay)
+	}
+	return nil
+}
+
+// Reservation 已预占的一封邮件的用量
+type Reservation struct {
+	q          *Quota
+	username   string
+	ip         string
+	recipients int
+	size       int64
+	at         time.Time
+}
+
+// Reserve 检查再接受一封邮件是否超出额度，未超出时立即计入用户（username 不为空时）和 IP 的用量；
+// 检查和计入在同一把锁内完成，并发的会话不会同时通过检查而一起超出额度。
+// 超出时返回 *Error 且不计入；邮件最终没有被接受时调用 Release 退还用量
+func (q *Quota) Reserve(username, ip string, recipients int, size int64) (*Reservation, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := q.now()
+	if err := q.check(username, ip, now, recipients, size); err != nil {
+		return nil, err
+	}
+	if username != "" && q.opts.User.enabled() {
+		recordUsage(q.state.Users, username, now, recipients, size)
+		q.file.Changed()
+	}
+	if ip != "" && q.opts.IP.enabled() {
+		recordUsage(q.state.IPs, ip, now, recipients, size)
+		q.file.Changed()
+	}
+	return &Reservation{q: q, username: username, ip: ip, recipients: recipients, size: size, at: now}, nil
+}
+
+// Release 退还预占的用量，已移出窗口的时间片不再处理；r 为 nil 或重复调用时不做任何事
+func (r *Reservation) Release() {
+	if r == nil || r.q == nil {
+		return
+	}
+	q := r.q
+	r.q = nil
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if r.username != "" && q.opts.User.enabled() {
+		releaseUsage(q.state.Users, r.username, r.at, r.recipients, r.size)
+		q.file.Changed()
+	}
+	if r.ip != "" && q.opts.IP.enabled() {
+		releaseUsage(q.state.IPs, r.ip, r.at, r.recipients, r.size)
+		q.file.Changed()
+	}
+}
+
+// recordUsage 把一封邮件计入 key 的当前时间片，并去掉已移出窗口的时间片
+func recordUsage(records map[string]*usage, key string, now time.Time, recipients int, size int64) {
+	r, ok := records[key]
+	if !ok {
+		r = &usage{}
+		records[key] = r
+	}
+	r.Hour = addSlot(pruneSlots(r.Hour, now.Add(-time.Hour)), now.Truncate(hourSlot), recipients, size)
+	r.Day = addSlot(pruneSlots(r.Day, now.Add(-24*time.Hour)), now.Truncate(daySlot), recipients, size)
+}
+
+// releaseUsage 从 key 在 at 时计入的时间片中减去一封邮件
+func releaseUsage(records map[string]*usage, key string, at time.Time, recipients int, size int64) {
+	r, ok := records[key]
+	if !ok {
+		return
+	}
+	subSlot(r.Hour, at.Truncate(hourSlot), recipients, size)
+	subSlot(r.Day, at.Truncate(daySlot), recipients, size)
+}
+
+// subSlot 从开始于 start 的时间片中减去一封邮件，时间片已不存在时不做处理
+func subSlot(slots []slot, start time.Time, recipients int, size int64) {
+	for i := range slots {
+		if slots[i].Start.Equal(start) {
+			slots[i].Messages--
+			slots[i].Recipients -= recipients
+			slots[i].Bytes -= size
+			return
+		}
+	}
+}
+
+// addSlot 把一封邮件计入开始于 start 的时间片，需要时追加新的时间片
+func addSlot(slots []slot, start time.Time, recipients int, size int64) []slot {
+	if n := len(slots); n == 0 || !slots[n-1].Start.Equal(start) {
+		slots = append(slots, slot{Start: start})
+	}
+	last := &slots[len(slots)-1]
+	last.Messages++
+	last.Recipients += recipients
+	last.Bytes += size
+	return slots
+}
+
+// sumSlots 合计开始时间在 since 之后的时间片
+func sumSlots(slots []slot, since time.Time) slot {
+	var total slot
+	for _, s := range slots {
+		if s.Start.After(since) {
+			total.Messages += s.Messages
+			total.Recipients += s.Recipients
+			total.Bytes += s.Bytes
+		}
+	}
+	return total
+}
+
+// pruneSlots 去掉开始时间不在 since 之后的时间片
+func pruneSlots(slots []slot, since time.Time) []slot {
+	i := 0
+	for i < len(slots) && !slots[i].Start.After(since) {
+		i++
+	}
+	return slots[i:]
+}
+
+// prune 删除已过期的用量，调用方需持有锁
+func (q *Quota) prune(now time.Time) {
+	for _, records := range []map[string]*usage{q.state.IPs, q.state.Users} {
+		for key, r := range records {
+			r.Hour = pruneSlots(r.Hour, now.Add(-time.Hour))
+			r.Day = pruneSlots(r.Day, now.Add(-24*time.Hour))
+			if len(r.Hour) == 0 && len(r.Day) == 0 {
+				delete(records, key)
+			}
+		}
+	}
+}
+
+// Save 清理过期用量，并在有变化时写入状态文件
+func (q *Quota) Save() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.prune(q.now())
+	return q.file.Save(q.state)
+}
+
+// Persist 按 interval 清理过期用量并保存状态，直到 stop 被关闭，退出前再保存一次
+func (q *Quota) Persist(interval time.Duration, stop <-chan struct{}) {
+	statefile.Persist(q, interval, stop)
+}
@@ -0,0 +1,157 @@
+package quota
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/catroll/smtpd/internal/testclock"
+)
+
+// newTestQuota 返回使用可控时钟的发送额度统计
+func newTestQuota(t *testing.T, opts Options) (*Quota, *testclock.Clock) {
+	t.Helper()
+	q, err := New(opts)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	clock := testclock.New()
+	q.now = clock.Now
+	return q, clock
+}
+
+// quotaKind 返回超出的额度类型和周期，未超出时返回空字符串
+func quotaKind(t *testing.T, err error) string {
+	t.Helper()
+	if err == nil {
+		return ""
+	}
+	var qe *Error
+	if !errors.As(err, &qe) {
+		t.Fatalf("Check() error = %v, want *Error", err)
+	}
+	return qe.Scope + " " + qe.Kind + "/" + qe.Period
+}
+
+func TestQuotaLimits(t *testing.T) {
+	q, clock := newTestQuota(t, Options{
+		User: Limits{MessagesPerHour: 2, MessagesPerDay: 3, RecipientsPerDay: 5, BytesPerDay: 1000},
+		IP:   Limits{MessagesPerHour: 10},
+	})
+
+	tests := []struct {
+		name       string
+		advance    time.Duration
+		recipients int
+		size       int64
+		want       string
+		record     bool
+	}{
+		{name: "first message", recipients: 2, size: 100, record: true},
+		{name: "second message", recipients: 2, size: 100, record: true},
+		{name: "hourly messages", recipients: 1, want: "user messages/hour"},
+		{name: "hour later", advance: time.Hour, recipients: 1, size: 100},
+		{name: "daily recipients", recipients: 2, want: "user recipients/day"},
+		{name: "daily bytes", recipients: 1, size: 801, want: "user bytes/day"},
+		{name: "third message", recipients: 1, size: 800, record: true},
+		{name: "daily messages", recipients: 1, want: "user messages/day"},
+		{name: "day later", advance: 24 * time.Hour, recipients: 5, size: 1000},
+	}
+	for _, tt := range tests {
+		clock.Advance(tt.advance)
+		got := quotaKind(t, q.Check("user1", "192.0.2.1", tt.recipients, tt.size))
+		if got != tt.want {
+			t.Errorf("%s: Check() = %q, want %q", tt.name, got, tt.want)
+		}
+		if tt.record {
+			if _, err := q.Reserve("user1", "192.0.2.1", tt.recipients, tt.size); err != nil {
+				t.Fatalf("%s: Reserve() error = %v", tt.name, err)
+			}
+		}
+	}
+
+	// IP 额度独立统计，未认证的会话只检查 IP
+	if err := q.Check("", "192.0.2.1", 100, 1<<20); err != nil {
+		t.Errorf("Check() without user error = %v", err)
+	}
+	if err := q.Check("user2", "192.0.2.2", 1, 100); err != nil {
+		t.Errorf("Check() for other user error = %v", err)
+	}
+}
+
+func TestQuotaIPLimit(t *testing.T) {
+	q, _ := newTestQuota(t, Options{IP: Limits{MessagesPerHour: 1}})
+
+	if _, err := q.Reserve("user1", "192.0.2.1", 1, 100); err != nil {
+		t.Fatalf("Reserve() error = %v", err)
+	}
+	if got := quotaKind(t, q.Check("user2", "192.0.2.1", 1, 100)); got != "ip messages/hour" {
+		t.Errorf("Check() = %q, want ip messages/hour", got)
+	}
+	if err := q.Check("user1", "192.0.2.2", 1, 100); err != nil {
+		t.Errorf("Check() from other IP error = %v", err)
+	}
+}
+
+func TestQuotaReserve(t *testing.T) {
+	q, clock := newTestQuota(t, Options{User: Limits{MessagesPerHour: 1, BytesPerDay: 1000}})
+
+	// 预占后用量立即生效，并发的第二封邮件不能再通过
+	r, err := q.Reserve("user1", "", 1, 600)
+	if err != nil {
+		t.Fatalf("Reserve() error = %v", err)
+	}
+	if got := quotaKind(t, q.Check("user1", "", 1, 0)); got != "user messages/hour" {
+		t.Errorf("Check() after Reserve() = %q, want user messages/hour", got)
+	}
+	if _, err := q.Reserve("user1", "", 1, 100); quotaKind(t, err) != "user messages/hour" {
+		t.Errorf("second Reserve() error = %v", err)
+	}
+
+	// 退还后可以再次发送，重复退还无效
+	clock.Advance(time.Minute)
+	r.Release()
+	r.Release()
+	if _, err := q.Reserve("user1", "", 1, 1000); err != nil {
+		t.Errorf("Reserve() after Release() error = %v", err)
+	}
+	var none *Reservation
+	none.Release()
+}
+
+func TestQuotaStateFile(t *testing.T) {
+	opts := Options{
+		User:      Limits{MessagesPerDay: 1},
+		StateFile: filepath.Join(t.TempDir(), "quota.json"),
+	}
+	q, clock := newTestQuota(t, opts)
+	// 加载状态文件时按真实时间清理过期用量
+	clock.Set(time.Now())
+	if _, err := q.Reserve("user1", "192.0.2.1", 1, 100); err != nil {
+		t.Fatalf("Reserve() error = %v", err)
+	}
+	if err := q.Save(); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	// 重启后恢复用量
+	restored, err := New(opts)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	restored.now = clock.Now
+	if got := quotaKind(t, restored.Check("user1", "", 1, 0)); got != "user messages/day" {
+		t.Errorf("Check() after restore = %q, want user messages/day", got)
+	}
+	if len(restored.state.IPs) != 0 {
+		t.Errorf("IP usage recorded without IP limits: %v", restored.state.IPs)
+	}
+
+	// 过期的用量在保存时清理
+	clock.Advance(24 * time.Hour)
+	restored.Save()
+	if len(restored.state.Users) != 0 {
+		t.Errorf("Expired usage not pruned: %v", restored.state.Users)
+	}
+}
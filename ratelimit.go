@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/catroll/smtpd/config"
+	lru "github.com/hashicorp/golang-lru/v2"
+	"golang.org/x/time/rate"
+)
+
+// commandReadTimeout 启用命令速率限制时等待客户端命令的超时（RFC 5321 4.5.3.2.7）
+const commandReadTimeout = 5 * time.Minute
+
+// connLimiter 用令牌桶限制全局和每个 IP 的并发连接数、每秒新建连接数，
+// 以及每个会话每秒的命令数；每个 IP 的状态保存在容量有限的 LRU 中
+type connLimiter struct {
+	maxConns      int
+	maxConnsPerIP int
+	connRatePerIP float64
+	commandRate   float64
+
+	mu     sync.Mutex
+	active int
+	// rate 全局新建连接的令牌桶，不限制时为 nil
+	rate *rate.Limiter
+	// ips 每个 IP 的状态，没有每个 IP 的限制时为 nil；容量用尽时淘汰最久未见的 IP，
+	// 被淘汰 IP 的连接仍会释放到各自的状态上，只是之后的连接重新计数
+	ips *lru.Cache[netip.Addr, *ipLimit]
+}
+
+// ipLimit 一个 IP 的并发连接数和新建连接的令牌桶
+type ipLimit struct {
+	active int
+	rate   *rate.Limiter
+}
+
+// newConnLimiter 根据配置创建连接限制，未设置任何限制时返回 nil
+func newConnLimiter(cfg *config.Config) (*connLimiter, error) {
+	rl := cfg.Server.RateLimit
+	if rl.MaxConnections == 0 && rl.MaxConnectionsPerIP == 0 && rl.ConnectionRate == 0 &&
+		rl.ConnectionRatePerIP == 0 && rl.CommandRate == 0 {
+		return nil, nil
+	}
+
+	l := &connLimiter{
+		maxConns:      rl.MaxConnections,
+		maxConnsPerIP: rl.MaxConnectionsPerIP,
+		connRatePerIP: rl.ConnectionRatePerIP,
+		commandRate:   rl.CommandRate,
+	}
+	if rl.ConnectionRate > 0 {
+		l.rate = newTokenBucket(rl.ConnectionRate)
+	}
+	if rl.MaxConnectionsPerIP > 0 || rl.ConnectionRatePerIP > 0 {
+		ips, err := lru.New[netip.Addr, *ipLimit](rl.MaxTrackedIPs)
+		if err != nil {
+			return nil, err
+		}
+		l.ips = ips
+	}
+	return l, nil
+}
+
+// newTokenBucket 创建每秒 r 个令牌的令牌桶，容量为 r 向上取整，至少为 1
+func newTokenBucket(r float64) *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(r), max(1, int(math.Ceil(r))))
+}
+
+// limitKey 返回按 IP 限制时使用的键：IPv6 客户端通常拥有整个 /64，按 /64 统计，
+// 避免轮换地址绕过限制
+func limitKey(ip netip.Addr) netip.Addr {
+	if ip.Is4() {
+		return ip
+	}
+	if prefix, err := ip.Prefix(64); err == nil {
+		return prefix.Addr()
+	}
+	return ip
+}
+
+// acquire 为来自 ip 的新连接占用名额并返回包装后的连接；超出限制时返回 nil
+// 和超出的限制名称
+func (l *connLimiter) acquire(conn net.Conn, ip netip.Addr) (net.Conn, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ip = limitKey(ip)
+	var state *ipLimit
+	if l.ips != nil {
+		var ok bool
+		if state, ok = l.ips.Get(ip); !ok {
+			state = &ipLimit{}
+			if l.connRatePerIP > 0 {
+				state.rate = newTokenBucket(l.connRatePerIP)
+			}
+			l.ips.Add(ip, state)
+		}
+	} else {
+		state = &ipLimit{}
+	}
+
+	switch {
+	case l.maxConns > 0 && l.active >= l.maxConns:
+		return nil, "max_connections"
+	case l.maxConnsPerIP > 0 && state.active >= l.maxConnsPerIP:
+		return nil, "max_connections_per_ip"
+	case state.rate != nil && !state.rate.Allow():
+		// 先检查 IP 的速率，避免单个 IP 的突发耗尽全局的令牌
+		return nil, "connection_rate_per_ip"
+	case l.rate != nil && !l.rate.Allow():
+		return nil, "connection_rate"
+	}
+	l.active++
+	state.active++
+
+	c := &limitedConn{Conn: conn, limiter: l, state: state}
+	if l.commandRate > 0 {
+		c.commands = newTokenBucket(l.commandRate)
+		c.ctx, c.cancel = context.WithCancel(context.Background())
+	}
+	return c, ""
+}
+
+// release 释放连接占用的名额
+func (l *connLimiter) release(state *ipLimit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	state.active--
+}
+
+// limitedConn 关闭时释放名额，并限制会话每秒的命令数
+type limitedConn struct {
+	net.Conn
+	limiter *connLimiter
+	state   *ipLimit
+	once    sync.Once
+
+	// commands 命令的令牌桶，不限制时为 nil；ctx 在连接关闭时取消，结束等待
+	commands  *rate.Limiter
+	ctx       context.Context
+	cancel    context.CancelFunc
+	throttled bool
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(func() {
+		if c.cancel != nil {
+			c.cancel()
+		}
+		c.limiter.release(c.state)
+	})
+	return c.Conn.Close()
+}
+
+// SetReadDeadline 设置了 ReadTimeout 的 go-smtp 服务器在读取每条命令（包括 AUTH
+// 的后续响应，不包括邮件内容）之前调用，TLS 连接也会转调到这里，因此在此按命令
+// 速率等待令牌；截止时间不晚于当前时间时是在中断读取，不做等待
+func (c *limitedConn) SetReadDeadline(t time.Time) error {
+	if c.commands != nil && t.After(time.Now()) && !c.commands.Allow() {
+		if !c.throttled {
+			c.throttled = true
+			slog.Warn("命令速率超出限制，延迟处理",
+				"remote_addr", c.RemoteAddr().String(),
+				"command_rate", c.limiter.commandRate,
+				"timestamp", time.Now().Format(time.RFC3339Nano),
+			)
+		}
+		start := time.Now()
+		// 连接关闭时返回错误，随后的读取会失败
+		c.commands.Wait(c.ctx)
+		t = t.Add(time.Since(start))
+	}
+	return c.Conn.SetReadDeadline(t)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/catroll/smtpd/config"
+	gosmtp "github.com/emersion/go-smtp"
+)
+
+// dialHello 连接服务器并发送 EHLO，返回客户端和错误
+func dialHello(t *testing.T, addr string) (*gosmtp.Client, error) {
+	t.Helper()
+	c, err := gosmtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	// 客户端在第一条命令前读取问候
+	return c, c.Hello("localhost")
+}
+
+func TestConnectionLimits(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(cfg *config.Config)
+	}{
+		{name: "concurrent connections per IP", setup: func(cfg *config.Config) { cfg.Server.RateLimit.MaxConnectionsPerIP = 1 }},
+		{name: "global concurrent connections", setup: func(cfg *config.Config) { cfg.Server.RateLimit.MaxConnections = 1 }},
+		{name: "new connections per IP", setup: func(cfg *config.Config) { cfg.Server.RateLimit.ConnectionRatePerIP = 0.5 }},
+		{name: "global new connections", setup: func(cfg *config.Config) { cfg.Server.RateLimit.ConnectionRate = 0.5 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.New()
+			tt.setup(cfg)
+			addr, _ := startTestServer(t, cfg, "")
+
+			if _, err := dialHello(t, addr); err != nil {
+				t.Fatalf("Hello() error = %v", err)
+			}
+			_, err := dialHello(t, addr)
+			var smtpErr *gosmtp.SMTPError
+			if !errors.As(err, &smtpErr) || smtpErr.Code != 421 {
+				t.Errorf("Expected 421 error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestConnectionLimitReleased(t *testing.T) {
+	cfg := config.New()
+	cfg.Server.RateLimit.MaxConnectionsPerIP = 1
+	addr, _ := startTestServer(t, cfg, "")
+
+	c, err := dialHello(t, addr)
+	if err != nil {
+		t.Fatalf("Hello() error = %v", err)
+	}
+	if err := c.Quit(); err != nil {
+		t.Fatalf("Quit() error = %v", err)
+	}
+
+	// 服务器在回复 QUIT 之后才关闭连接，稍等名额释放
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, err := dialHello(t, addr)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Connection limit not released: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConnectionLimitIPv6Prefix(t *testing.T) {
+	cfg := config.New()
+	cfg.Server.RateLimit.MaxConnectionsPerIP = 1
+	l, err := newConnLimiter(cfg)
+	if err != nil {
+		t.Fatalf("newConnLimiter() error = %v", err)
+	}
+
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"2001:db8:1:1::1", ""},
+		{"2001:db8:1:1::2", "max_connections_per_ip"},
+		{"2001:db8:1:2::1", ""},
+		{"192.0.2.1", ""},
+		{"192.0.2.2", ""},
+	}
+	for _, tt := range tests {
+		server, client := net.Pipe()
+		defer client.Close()
+		conn, reason := l.acquire(server, netip.MustParseAddr(tt.ip))
+		if reason != tt.want {
+			t.Errorf("acquire(%s) = %q, want %q", tt.ip, reason, tt.want)
+		}
+		if conn != nil {
+			defer conn.Close()
+		}
+	}
+}
+
+func TestCommandRate(t *testing.T) {
+	cfg := config.New()
+	cfg.Server.RateLimit.CommandRate = 20
+	addr, _ := startTestServer(t, cfg, "")
+
+	c, err := dialHello(t, addr)
+	if err != nil {
+		t.Fatalf("Hello() error = %v", err)
+	}
+	// 令牌桶容量为 20，之后每秒 20 条命令
+	start := time.Now()
+	for range 40 {
+		if err := c.Noop(); err != nil {
+			t.Fatalf("Noop() error = %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond {
+		t.Errorf("40 commands took %v, want at least 800ms", elapsed)
+	}
+}
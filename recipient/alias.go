@@ -0,0 +1,117 @@
+package recipient
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/catroll/smtpd/internal/mailaddr"
+	"github.com/catroll/smtpd/internal/textfile"
+)
+
+// AliasMap 虚拟别名表，把收件人地址或整个域名映射到一个或多个目标地址
+//
+// 别名文件每行一个地址，后跟以空白或逗号分隔的目标，# 开头的行为注释：
+//
+//	info@example.com       alice@example.com, bob@example.com
+//	postmaster@example.com admin@example.net
+//	@example.org           catchall@example.com
+//	@old.example           @new.example
+//
+// 键可以是完整地址，或以 @ 开头表示整个域名（catch-all）；目标可以是完整地址，
+// 或以 @ 开头表示保留本地部分、改写为另一个域名。键比较时不区分大小写，
+// 国际化域名转换为 punycode 后比较。同一个键可以出现在多行中。
+type AliasMap struct {
+	mu       sync.RWMutex
+	aliases  map[string][]string
+	filename string
+}
+
+// NewAliasMap 加载别名文件
+func NewAliasMap(filename string) (*AliasMap, error) {
+	m := &AliasMap{filename: filename}
+	if err := m.Reload(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Reload 重新加载别名文件，失败时保留原有别名
+func (m *AliasMap) Reload() error {
+	data, err := os.ReadFile(m.filename)
+	if err != nil {
+		slog.Error("读取别名文件失败",
+			"file", m.filename,
+			"error", err,
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+		return err
+	}
+
+	aliases := make(map[string][]string)
+	err = textfile.ScanLines(data, func(lineno int, line string) error {
+		fields := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+		if len(fields) < 2 {
+			return fmt.Errorf("line %d: expected address followed by targets", lineno)
+		}
+		key, err := mailaddr.Key(fields[0])
+		if err != nil {
+			return fmt.Errorf("line %d: invalid address %q: %w", lineno, fields[0], err)
+		}
+		for _, target := range fields[1:] {
+			if _, err := mailaddr.Key(target); err != nil {
+				return fmt.Errorf("line %d: invalid target %q: %w", lineno, target, err)
+			}
+			aliases[key] = append(aliases[key], target)
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("解析别名文件失败",
+			"file", m.filename,
+			"error", err,
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+		return err
+	}
+
+	m.mu.Lock()
+	m.aliases = aliases
+	m.mu.Unlock()
+
+	slog.Info("加载别名文件成功",
+		"file", m.filename,
+		"aliases", len(aliases),
+		"timestamp", time.Now().Format(time.RFC3339Nano),
+	)
+	return nil
+}
+
+// Lookup 返回完整地址的别名目标，没有时返回 false；不会回退到域名的 catch-all
+func (m *AliasMap) Lookup(address string) ([]string, bool) {
+	key, err := mailaddr.Key(address)
+	if err != nil || strings.HasPrefix(key, "@") {
+		return nil, false
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	targets, ok := m.aliases[key]
+	return targets, ok
+}
+
+// LookupDomain 返回域名 catch-all 的别名目标，没有时返回 false
+func (m *AliasMap) LookupDomain(domain string) ([]string, bool) {
+	key, err := mailaddr.Key("@" + domain)
+	if err != nil {
+		return nil, false
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	targets, ok := m.aliases[key]
+	return targets, ok
+}
@@ -0,0 +1,64 @@
+package recipient
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestAliasMapLookup(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "virtual")
+	content := "# 虚拟别名\n" +
+		"Info@Example.com   alice@example.com, bob@example.com\n" +
+		"info@example.com   carol@example.com\n" +
+		"@Bücher.Example    books@example.com\n" +
+		"@old.example       @new.example\n"
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	m, err := NewAliasMap(filename)
+	if err != nil {
+		t.Fatalf("NewAliasMap() error = %v", err)
+	}
+
+	tests := []struct {
+		address string
+		domain  bool
+		want    []string
+	}{
+		{address: "info@example.com", want: []string{"alice@example.com", "bob@example.com", "carol@example.com"}},
+		{address: "INFO@EXAMPLE.COM", want: []string{"alice@example.com", "bob@example.com", "carol@example.com"}},
+		{address: "other@example.com"},
+		{address: "@example.com"},
+		{address: "xn--bcher-kva.example", domain: true, want: []string{"books@example.com"}},
+		{address: "old.example", domain: true, want: []string{"@new.example"}},
+		{address: "example.com", domain: true},
+	}
+	for _, tt := range tests {
+		lookup := m.Lookup
+		if tt.domain {
+			lookup = m.LookupDomain
+		}
+		got, ok := lookup(tt.address)
+		if ok != (tt.want != nil) || !slices.Equal(got, tt.want) {
+			t.Errorf("Lookup(%q) = %v, %v, want %v", tt.address, got, ok, tt.want)
+		}
+	}
+}
+
+func TestAliasMapInvalid(t *testing.T) {
+	for _, content := range []string{
+		"info@example.com\n",
+		"info alice@example.com\n",
+		"info@example.com alice\n",
+	} {
+		filename := filepath.Join(t.TempDir(), "virtual")
+		if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+		if _, err := NewAliasMap(filename); err == nil {
+			t.Errorf("NewAliasMap(%q) expected error", content)
+		}
+	}
+}
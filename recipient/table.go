@@ -0,0 +1,202 @@
+package recipient
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/catroll/smtpd/auth"
+	"github.com/catroll/smtpd/internal/mailaddr"
+	"github.com/catroll/smtpd/internal/textfile"
+)
+
+// userDomainsTTL 从凭据存储的用户名推导出的本地域名的缓存时间
+const userDomainsTTL = time.Minute
+
+// Options 本地收件人表的配置
+type Options struct {
+	// File 收件人文件，每行一个地址或 @域名，为空时只使用凭据存储
+	File string
+	// Store 不为 nil 时，凭据存储中以邮件地址为用户名的用户也是本地收件人
+	Store auth.Store
+	// Domains 本地域名，只检查这些域名以及收件人文件、用户名中出现的域名下的地址
+	Domains []string
+}
+
+// Status 收件人的检查结果
+type Status int
+
+const (
+	// Known 收件人在收件人表中
+	Known Status = iota
+	// Unknown 收件人属于本地域名，但不在收件人表中
+	Unknown
+	// NotLocal 收件人不属于本地域名，不做检查
+	NotLocal
+)
+
+// Table 本地收件人表，在 SMTP 会话中拒绝本地域名下不存在的收件人
+//
+// 收件人文件每行一个完整地址，或以 @ 开头表示接受整个域名的所有地址，
+// # 开头的行为注释：
+//
+//	alice@example.com
+//	bob@example.com
+//	@lists.example.com
+//
+// 比较时不区分大小写，国际化域名转换为 punycode 后比较。
+type Table struct {
+	opts Options
+
+	mu sync.RWMutex
+	// addresses 文件中的完整地址，wildcards 文件中 @域名 的域名
+	addresses map[string]bool
+	wildcards map[string]bool
+	// domains 配置和文件中出现的本地域名
+	domains map[string]bool
+
+	// userDomains 凭据存储中用户名的域名，userDomainsAt 为推导的时间
+	userDomains   map[string]bool
+	userDomainsAt time.Time
+
+	// now 当前时间，测试时可替换
+	now func() time.Time
+}
+
+// NewTable 创建本地收件人表，配置了收件人文件时加载它
+func NewTable(opts Options) (*Table, error) {
+	t := &Table{opts: opts, now: time.Now}
+	if err := t.Reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Reload 重新加载收件人文件，失败时保留原有收件人；凭据存储中的用户总是实时查询
+func (t *Table) Reload() error {
+	addresses := make(map[string]bool)
+	wildcards := make(map[string]bool)
+	domains := make(map[string]bool)
+	for _, domain := range t.opts.Domains {
+		key, err := mailaddr.Key("@" + strings.TrimPrefix(domain, "@"))
+		if err != nil {
+			return fmt.Errorf("invalid local domain %q: %w", domain, err)
+		}
+		domains[key[1:]] = true
+	}
+
+	if t.opts.File != "" {
+		data, err := os.ReadFile(t.opts.File)
+		if err != nil {
+			slog.Error("读取收件人文件失败",
+				"file", t.opts.File,
+				"error", err,
+				"timestamp", time.Now().Format(time.RFC3339Nano),
+			)
+			return err
+		}
+		err = textfile.ScanLines(data, func(lineno int, line string) error {
+			key, err := mailaddr.Key(line)
+			if err != nil {
+				return fmt.Errorf("line %d: invalid address %q: %w", lineno, line, err)
+			}
+			i := strings.LastIndex(key, "@")
+			if i == 0 {
+				wildcards[key[1:]] = true
+			} else {
+				addresses[key] = true
+			}
+			domains[key[i+1:]] = true
+			return nil
+		})
+		if err != nil {
+			slog.Error("解析收件人文件失败",
+				"file", t.opts.File,
+				"error", err,
+				"timestamp", time.Now().Format(time.RFC3339Nano),
+			)
+			return err
+		}
+
+		slog.Info("加载收件人文件成功",
+			"file", t.opts.File,
+			"addresses", len(addresses),
+			"domains", len(domains),
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+	}
+
+	t.mu.Lock()
+	t.addresses = addresses
+	t.wildcards = wildcards
+	t.domains = domains
+	// 下次检查时重新推导用户名的域名
+	t.userDomainsAt = time.Time{}
+	t.mu.Unlock()
+	return nil
+}
+
+// Check 检查收件人是否存在；查询凭据存储失败时返回错误，
+// 存储不支持查询用户时只使用收件人文件
+func (t *Table) Check(address string) (Status, error) {
+	key, err := mailaddr.Key(address)
+	if err != nil {
+		return Unknown, err
+	}
+	domain := key[strings.LastIndex(key, "@")+1:]
+
+	t.mu.RLock()
+	known := t.addresses[key] || t.wildcards[domain]
+	local := t.domains[domain]
+	t.mu.RUnlock()
+	if known {
+		return Known, nil
+	}
+
+	if t.opts.Store != nil {
+		// 存储不能查询用户时视为不在存储中
+		ok, err := t.opts.Store.Lookup(address)
+		if err != nil && !errors.Is(err, auth.ErrUnsupported) {
+			return Unknown, err
+		}
+		if ok {
+			return Known, nil
+		}
+		if !local {
+			if local, err = t.userDomain(domain); err != nil {
+				return Unknown, err
+			}
+		}
+	}
+	if !local {
+		return NotLocal, nil
+	}
+	return Unknown, nil
+}
+
+// userDomain 判断域名是否出现在凭据存储的用户名中；存储不能列出用户时视为不出现
+func (t *Table) userDomain(domain string) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	if t.userDomains == nil || now.Sub(t.userDomainsAt) > userDomainsTTL {
+		names, err := t.opts.Store.List()
+		if err != nil && !errors.Is(err, auth.ErrUnsupported) {
+			return false, err
+		}
+		domains := make(map[string]bool)
+		for _, name := range names {
+			if key, err := mailaddr.Key(name); err == nil {
+				domains[key[strings.LastIndex(key, "@")+1:]] = true
+			}
+		}
+		t.userDomains = domains
+		t.userDomainsAt = now
+	}
+	return t.userDomains[domain], nil
+}
@@ -0,0 +1,136 @@
+package recipient
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/catroll/smtpd/auth"
+)
+
+// fakeUserStore 只支持查询和列出用户的凭据存储，unsupported 时两者都不支持
+type fakeUserStore struct {
+	users       []string
+	lists       int
+	unsupported bool
+}
+
+func (s *fakeUserStore) Lookup(username string) (bool, error) {
+	if s.unsupported {
+		return false, auth.ErrUnsupported
+	}
+	return slices.Contains(s.users, username), nil
+}
+
+func (s *fakeUserStore) Verify(username, password string) (bool, error) {
+	return false, nil
+}
+
+func (s *fakeUserStore) List() ([]string, error) {
+	if s.unsupported {
+		return nil, auth.ErrUnsupported
+	}
+	s.lists++
+	return s.users, nil
+}
+
+func TestTableCheck(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "recipients")
+	content := "# 本地收件人\n" +
+		"Alice@Example.com\n" +
+		"bob@bücher.example\n" +
+		"@lists.example.com\n"
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	store := &fakeUserStore{users: []string{"carol@example.net", "admin"}}
+	table, err := NewTable(Options{
+		File:    filename,
+		Store:   store,
+		Domains: []string{"example.org"},
+	})
+	if err != nil {
+		t.Fatalf("NewTable() error = %v", err)
+	}
+
+	tests := []struct {
+		address string
+		want    Status
+	}{
+		{"alice@example.com", Known},
+		{"ALICE@EXAMPLE.COM", Known},
+		{"bob@xn--bcher-kva.example", Known},
+		{"anyone@lists.example.com", Known},
+		{"carol@example.net", Known},
+		{"typo@example.com", Unknown},
+		{"typo@xn--bcher-kva.example", Unknown},
+		{"someone@example.org", Unknown},
+		// 域名来自凭据存储的用户名
+		{"dave@example.net", Unknown},
+		{"someone@remote.example", NotLocal},
+	}
+	for _, tt := range tests {
+		got, err := table.Check(tt.address)
+		if err != nil {
+			t.Fatalf("Check(%q) error = %v", tt.address, err)
+		}
+		if got != tt.want {
+			t.Errorf("Check(%q) = %v, want %v", tt.address, got, tt.want)
+		}
+	}
+
+	// 用户名的域名在缓存期内不重复列出
+	if store.lists != 1 {
+		t.Errorf("List() called %d times, want 1", store.lists)
+	}
+	now := time.Now().Add(2 * userDomainsTTL)
+	table.now = func() time.Time { return now }
+	store.users = append(store.users, "erin@example.info")
+	if got, _ := table.Check("frank@example.info"); got != Unknown {
+		t.Errorf("Check() after TTL = %v, want %v", got, Unknown)
+	}
+}
+
+func TestTableUnsupportedStore(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "recipients")
+	if err := os.WriteFile(filename, []byte("alice@example.com\n"), 0600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	table, err := NewTable(Options{
+		File:  filename,
+		Store: &fakeUserStore{users: []string{"bob@example.com"}, unsupported: true},
+	})
+	if err != nil {
+		t.Fatalf("NewTable() error = %v", err)
+	}
+
+	tests := []struct {
+		address string
+		want    Status
+	}{
+		{"alice@example.com", Known},
+		{"bob@example.com", Unknown},
+		{"someone@remote.example", NotLocal},
+	}
+	for _, tt := range tests {
+		got, err := table.Check(tt.address)
+		if err != nil {
+			t.Fatalf("Check(%q) error = %v", tt.address, err)
+		}
+		if got != tt.want {
+			t.Errorf("Check(%q) = %v, want %v", tt.address, got, tt.want)
+		}
+	}
+}
+
+func TestTableInvalid(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "recipients")
+	if err := os.WriteFile(filename, []byte("alice\n"), 0600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if _, err := NewTable(Options{File: filename}); err == nil {
+		t.Error("NewTable() expected error for address without domain")
+	}
+}
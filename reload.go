@@ -0,0 +1,40 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// reloader 可以在运行时重新加载的组件，失败时应保留原有状态
+type reloader interface {
+	Reload() error
+}
+
+// reloadOnSIGHUP 收到 SIGHUP 信号时依次重新加载各组件
+func reloadOnSIGHUP(reloaders ...reloader) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+
+	go func() {
+		for range ch {
+			slog.Info("收到 SIGHUP，重新加载",
+				"count", len(reloaders),
+				"timestamp", time.Now().Format(time.RFC3339Nano),
+			)
+			for _, r := range reloaders {
+				// 各组件自行记录失败原因
+				r.Reload()
+			}
+		}
+	}()
+}
+
+// notifyShutdown 返回接收 SIGTERM 和 SIGINT 信号的通道
+func notifyShutdown() <-chan os.Signal {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
+	return ch
+}
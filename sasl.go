@@ -0,0 +1,320 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/catroll/smtpd/auth"
+	"github.com/emersion/go-sasl"
+	gosmtp "github.com/emersion/go-smtp"
+)
+
+var (
+	// errAuthLocked 客户端 IP 因认证失败过多被临时锁定
+	errAuthLocked = &gosmtp.SMTPError{
+		Code:         454,
+		EnhancedCode: gosmtp.EnhancedCode{4, 7, 0},
+		Message:      "Too many failed authentication attempts, try again later",
+	}
+	// errAuthTemporary 凭据存储暂时不可用
+	errAuthTemporary = &gosmtp.SMTPError{
+		Code:         454,
+		EnhancedCode: gosmtp.EnhancedCode{4, 7, 0},
+		Message:      "Temporary authentication failure",
+	}
+	// errTooManyAuthFailures 单个连接的认证失败次数过多
+	errTooManyAuthFailures = &gosmtp.SMTPError{
+		Code:         421,
+		EnhancedCode: gosmtp.EnhancedCode{4, 7, 0},
+		Message:      "Too many failed authentication attempts, closing connection",
+	}
+)
+
+// newSASLServer 根据认证机制创建对应的 SASL 服务端
+func (s *Session) newSASLServer(mech string) (sasl.Server, error) {
+	if !slices.Contains(s.AuthMechanisms(), mech) {
+		return nil, gosmtp.ErrAuthUnknownMechanism
+	}
+
+	done := func(username string, ok bool) error {
+		return s.finishAuth(mech, username, ok)
+	}
+	if s.proxiedToDovecot(mech) {
+		return &dovecotServer{
+			Server:  s.backend.authenticator.Store().(*auth.DovecotStore).NewServer(mech, s.clientInfo(mech), done),
+			session: s,
+			mech:    mech,
+		}, nil
+	}
+	switch mech {
+	case sasl.Plain:
+		return sasl.NewPlainServer(func(identity, username, password string) error {
+			return s.authenticate(mech, identity, username, password)
+		}), nil
+	case sasl.Login:
+		return sasl.NewLoginServer(func(username, password string) error {
+			return s.authenticate(mech, "", username, password)
+		}), nil
+	case auth.CRAMMD5:
+		return s.backend.authenticator.NewCRAMMD5Server(s.backend.cfg.SMTP.Hostname, done), nil
+	case auth.SCRAMSHA256, auth.SCRAMSHA256Plus:
+		return s.backend.authenticator.NewSCRAMServer(auth.SCRAMOptions{
+			Plus:           mech == auth.SCRAMSHA256Plus,
+			PlusAdvertised: slices.Contains(s.AuthMechanisms(), auth.SCRAMSHA256Plus),
+			ChannelBinding: s.channelBinding,
+		}, done), nil
+	case auth.OAuthBearer:
+		return s.backend.tokens.NewOAuthBearerServer(done), nil
+	case auth.XOAuth2:
+		return s.backend.tokens.NewXOAuth2Server(done), nil
+	case auth.External:
+		return s.backend.certs.NewExternalServer(s.peerCertificate(), done), nil
+	default:
+		return nil, gosmtp.ErrAuthUnknownMechanism
+	}
+}
+
+// proxiedToDovecot 判断是否将该机制的认证会话转发给 Dovecot：凭据存储为 Dovecot
+// 且其支持该机制；已配置本地令牌校验时 OAuth 机制在本地处理，
+// 需要 TLS 通道绑定或客户端证书的机制总是在本地处理
+func (s *Session) proxiedToDovecot(mech string) bool {
+	if s.backend.authenticator == nil {
+		return false
+	}
+	dovecot, ok := s.backend.authenticator.Store().(*auth.DovecotStore)
+	if !ok || !dovecot.Supports(mech) {
+		return false
+	}
+	switch mech {
+	case auth.SCRAMSHA256Plus, auth.External:
+		return false
+	case auth.OAuthBearer, auth.XOAuth2:
+		return s.backend.tokens == nil
+	default:
+		return true
+	}
+}
+
+// clientInfo 返回交给外部认证服务的客户端信息
+func (s *Session) clientInfo(mech string) auth.ClientInfo {
+	_, isTLS := s.conn.TLSConnectionState()
+	return auth.ClientInfo{
+		SessionID:  s.sessionID,
+		LocalAddr:  s.conn.Conn().LocalAddr().String(),
+		RemoteAddr: s.remoteAddr,
+		Secured:    isTLS,
+		Mechanism:  mech,
+	}
+}
+
+// dovecotServer 转发给 Dovecot 的认证会话，Dovecot 暂时不可用时回复 454
+type dovecotServer struct {
+	sasl.Server
+	session *Session
+	mech    string
+}
+
+func (d *dovecotServer) Next(response []byte) ([]byte, bool, error) {
+	challenge, done, err := d.Server.Next(response)
+	if errors.Is(err, auth.ErrTemporary) {
+		// 不计入认证失败次数
+		slog.Warn("SMTP 认证暂时失败",
+			"session_id", d.session.sessionID,
+			"remote_addr", d.session.remoteAddr,
+			"auth_method", d.mech,
+			"error", err,
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+		return nil, false, errAuthTemporary
+	}
+	return challenge, done, err
+}
+
+// authenticate 校验用户名和密码，成功后将会话标记为已认证
+//
+// identity 为 PLAIN 机制中的授权身份（authzid），为空或与用户名相同时
+// 表示以认证用户本身的身份操作，不允许冒用其他用户的身份。
+func (s *Session) authenticate(mech, identity, username, password string) error {
+	if identity != "" && identity != username {
+		slog.Warn("SMTP 认证失败",
+			"session_id", s.sessionID,
+			"remote_addr", s.remoteAddr,
+			"username", username,
+			"identity", identity,
+			"auth_method", mech,
+			"reason", "授权身份与用户名不一致",
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+		return gosmtp.ErrAuthFailed
+	}
+
+	account, label, err := s.backend.authenticator.AuthenticateClient(username, password, s.clientInfo(mech))
+	if err != nil {
+		// 凭据存储暂时不可用，不计入认证失败次数
+		slog.Warn("SMTP 认证暂时失败",
+			"session_id", s.sessionID,
+			"remote_addr", s.remoteAddr,
+			"username", username,
+			"auth_method", mech,
+			"error", err,
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+		return errAuthTemporary
+	}
+	s.appPassword = label
+	return s.finishAuth(mech, username, account != nil)
+}
+
+// finishAuth 记录认证结果，成功时将会话标记为已认证
+func (s *Session) finishAuth(mech, username string, ok bool) error {
+	guard := s.backend.guard
+	if guard != nil && username != "" {
+		// 用户名被锁定时即使密码正确也拒绝，回复与密码错误相同，不泄露锁定状态
+		if until, locked := guard.UserLocked(username); locked {
+			slog.Warn("用户名已被临时锁定，拒绝认证",
+				"session_id", s.sessionID,
+				"remote_addr", s.remoteAddr,
+				"username", username,
+				"auth_method", mech,
+				"locked_until", until.Format(time.RFC3339),
+				"timestamp", time.Now().Format(time.RFC3339Nano),
+			)
+			return s.authFailed()
+		}
+	}
+
+	var account *auth.Account
+	if ok {
+		account, ok = s.checkAccount(mech, username)
+	}
+	if !ok {
+		s.appPassword = ""
+		slog.Warn("SMTP 认证失败",
+			"session_id", s.sessionID,
+			"remote_addr", s.remoteAddr,
+			"username", username,
+			"auth_method", mech,
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+		if guard != nil {
+			// 指数退避，拖慢密码猜测
+			time.Sleep(guard.Fail(s.clientIP(), username))
+		}
+		return s.authFailed()
+	}
+
+	if guard != nil {
+		guard.Succeed(username)
+	}
+	s.authenticated = true
+	s.username = username
+	s.authMethod = mech
+	s.account = account
+
+	attrs := []any{
+		"session_id", s.sessionID,
+		"remote_addr", s.remoteAddr,
+		"username", username,
+		"auth_method", mech,
+	}
+	if s.appPassword != "" {
+		attrs = append(attrs, "app_password", s.appPassword)
+	}
+	if account != nil && len(account.Tags) > 0 {
+		attrs = append(attrs, "tags", account.Tags)
+	}
+	// 证书认证时记录证书身份，便于追溯
+	if cert := s.peerCertificate(); mech == auth.External && cert != nil {
+		attrs = append(attrs,
+			"tls_client_subject", cert.Subject.String(),
+			"tls_client_fingerprint", auth.CertFingerprint(cert),
+		)
+	}
+	slog.Info("SMTP 认证成功", append(attrs, "timestamp", time.Now().Format(time.RFC3339Nano))...)
+	return nil
+}
+
+// checkAccount 检查通过认证的用户的账户状态和来源地址，返回账户记录；
+// 用户不在凭据存储中（如 OAuth 或证书认证的用户）时返回 nil，不做限制
+func (s *Session) checkAccount(mech, username string) (*auth.Account, bool) {
+	if s.backend.authenticator == nil {
+		return nil, true
+	}
+	account, err := s.backend.authenticator.Account(username)
+	if err != nil {
+		slog.Error("查询账户失败",
+			"session_id", s.sessionID,
+			"username", username,
+			"error", err,
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+		return nil, false
+	}
+	if account == nil {
+		return nil, true
+	}
+
+	reason := ""
+	if err := account.Usable(time.Now()); err != nil {
+		reason = err.Error()
+	} else if addr, err := netip.ParseAddr(s.clientIP()); err != nil || !account.AllowsAddr(addr) {
+		reason = "source address not allowed"
+	}
+	if reason != "" {
+		slog.Warn("账户不允许登录",
+			"session_id", s.sessionID,
+			"remote_addr", s.remoteAddr,
+			"username", username,
+			"auth_method", mech,
+			"reason", reason,
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+		return nil, false
+	}
+	return account, true
+}
+
+// authFailed 统计本连接的认证失败次数，达到上限时回复 421 并断开连接
+func (s *Session) authFailed() error {
+	s.authFailures++
+	limit := s.backend.cfg.SMTP.BruteForce.MaxSessionFailures
+	if s.backend.guard == nil || limit <= 0 || s.authFailures < limit {
+		return gosmtp.ErrAuthFailed
+	}
+
+	slog.Warn("连接认证失败次数过多，断开连接",
+		"session_id", s.sessionID,
+		"remote_addr", s.remoteAddr,
+		"failures", s.authFailures,
+		"timestamp", time.Now().Format(time.RFC3339Nano),
+	)
+	// go-smtp 回复错误后不会关闭连接：将读超时设为当前时间，
+	// 回复发出后读取下一条命令时立即超时，由 go-smtp 关闭连接
+	s.conn.Conn().SetReadDeadline(time.Now())
+	return errTooManyAuthFailures
+}
+
+// channelBinding 返回当前 TLS 连接的通道绑定数据，供 SCRAM-SHA-256-PLUS 使用
+func (s *Session) channelBinding(cbType string) ([]byte, error) {
+	state, ok := s.conn.TLSConnectionState()
+	if !ok {
+		return nil, fmt.Errorf("connection is not using TLS")
+	}
+
+	switch cbType {
+	case auth.ChannelBindingTLSUnique:
+		// TLS 1.3 没有定义 tls-unique
+		if len(state.TLSUnique) == 0 {
+			return nil, fmt.Errorf("tls-unique is not available for this connection")
+		}
+		return state.TLSUnique, nil
+	case auth.ChannelBindingTLSExporter:
+		return state.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+	default:
+		return nil, fmt.Errorf("unsupported channel binding type: %s", cbType)
+	}
+}
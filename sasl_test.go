@@ -0,0 +1,973 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/catroll/smtpd/auth"
+	"github.com/catroll/smtpd/config"
+	"github.com/emersion/go-sasl"
+	gosmtp "github.com/emersion/go-smtp"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// cramMD5Client CRAM-MD5 客户端
+type cramMD5Client struct {
+	username, password string
+}
+
+func (c *cramMD5Client) Start() (string, []byte, error) {
+	return auth.CRAMMD5, nil, nil
+}
+
+func (c *cramMD5Client) Next(challenge []byte) ([]byte, error) {
+	mac := hmac.New(md5.New, []byte(c.password))
+	mac.Write(challenge)
+	return []byte(c.username + " " + hex.EncodeToString(mac.Sum(nil))), nil
+}
+
+// scramClient SCRAM-SHA-256 客户端，cbType 不为空时使用 -PLUS 和通道绑定，
+// gs2Header 可预先设置以模拟不同的客户端声明
+type scramClient struct {
+	username, password string
+	cbType             string
+	cbData             []byte
+
+	gs2Header       string
+	clientFirstBare string
+	serverSignature []byte
+	// finalResponse 确认服务端签名后发送的响应，正常为空
+	finalResponse []byte
+}
+
+func (c *scramClient) Start() (string, []byte, error) {
+	mech := auth.SCRAMSHA256
+	if c.gs2Header == "" {
+		c.gs2Header = "n,,"
+	}
+	if c.cbType != "" {
+		mech = auth.SCRAMSHA256Plus
+		c.gs2Header = "p=" + c.cbType + ",,"
+	}
+	nonce := make([]byte, 12)
+	rand.Read(nonce)
+	c.clientFirstBare = "n=" + c.username + ",r=" + base64.RawStdEncoding.EncodeToString(nonce)
+	return mech, []byte(c.gs2Header + c.clientFirstBare), nil
+}
+
+func (c *scramClient) Next(challenge []byte) ([]byte, error) {
+	if c.serverSignature != nil {
+		if string(challenge) != "v="+base64.StdEncoding.EncodeToString(c.serverSignature) {
+			return nil, fmt.Errorf("invalid server signature: %s", challenge)
+		}
+		if c.finalResponse != nil {
+			return c.finalResponse, nil
+		}
+		return []byte{}, nil
+	}
+
+	var nonce, salt string
+	iterations := 0
+	for _, attr := range strings.Split(string(challenge), ",") {
+		switch {
+		case strings.HasPrefix(attr, "r="):
+			nonce = attr[2:]
+		case strings.HasPrefix(attr, "s="):
+			salt = attr[2:]
+		case strings.HasPrefix(attr, "i="):
+			iterations, _ = strconv.Atoi(attr[2:])
+		}
+	}
+	rawSalt, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	salted, err := pbkdf2.Key(sha256.New, c.password, rawSalt, iterations, sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+	clientKey := hmacSHA256(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+
+	cbind := base64.StdEncoding.EncodeToString(append([]byte(c.gs2Header), c.cbData...))
+	withoutProof := "c=" + cbind + ",r=" + nonce
+	authMessage := c.clientFirstBare + "," + string(challenge) + "," + withoutProof
+
+	signature := hmacSHA256(storedKey[:], authMessage)
+	for i := range clientKey {
+		clientKey[i] ^= signature[i]
+	}
+	c.serverSignature = hmacSHA256(hmacSHA256(salted, "Server Key"), authMessage)
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(clientKey)), nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func mustHash(t *testing.T, scheme auth.Scheme, password string) string {
+	t.Helper()
+	stored, err := auth.Hash(scheme, password)
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+	return stored
+}
+
+func TestChallengeResponseAuth(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.SMTP.AuthMechanisms = []string{"CRAM-MD5", "SCRAM-SHA-256", "SCRAM-SHA-256-PLUS"}
+	credentials := fmt.Sprintf(`{"cram": %q, "scram": %q, "plain": "{PLAIN}password123"}`,
+		mustHash(t, auth.SchemeCRAMMD5, "password123"),
+		mustHash(t, auth.SchemeSCRAMSHA256, "password123"),
+	)
+	addr, _ := startTestServer(t, cfg, credentials)
+
+	tests := []struct {
+		name    string
+		client  sasl.Client
+		wantErr bool
+	}{
+		{
+			name:   "CRAM-MD5 with CRAM-MD5 secret",
+			client: &cramMD5Client{"cram", "password123"},
+		},
+		{
+			name:   "CRAM-MD5 with plaintext password",
+			client: &cramMD5Client{"plain", "password123"},
+		},
+		{
+			name:    "CRAM-MD5 with SCRAM secret",
+			client:  &cramMD5Client{"scram", "password123"},
+			wantErr: true,
+		},
+		{
+			name:    "CRAM-MD5 with wrong password",
+			client:  &cramMD5Client{"cram", "wrong"},
+			wantErr: true,
+		},
+		{
+			name:   "SCRAM-SHA-256 with SCRAM secret",
+			client: &scramClient{username: "scram", password: "password123"},
+		},
+		{
+			name:   "SCRAM-SHA-256 with plaintext password",
+			client: &scramClient{username: "plain", password: "password123"},
+		},
+		{
+			name:    "SCRAM-SHA-256 with wrong password",
+			client:  &scramClient{username: "scram", password: "wrong"},
+			wantErr: true,
+		},
+		{
+			name:    "SCRAM-SHA-256 with unknown user",
+			client:  &scramClient{username: "nobody", password: "password123"},
+			wantErr: true,
+		},
+		{
+			name:    "SCRAM-SHA-256 with malformed client-first",
+			client:  &scramClient{username: "scram", password: "password123", gs2Header: "x,,"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := gosmtp.Dial(addr)
+			if err != nil {
+				t.Fatalf("Failed to dial: %v", err)
+			}
+			defer c.Close()
+
+			if err := c.Hello("localhost"); err != nil {
+				t.Fatalf("Hello failed: %v", err)
+			}
+			if c.SupportsAuth(sasl.Plain) {
+				t.Errorf("Server advertises PLAIN, want only configured mechanisms")
+			}
+			if c.SupportsAuth(auth.SCRAMSHA256Plus) {
+				t.Errorf("Server advertises %s without TLS", auth.SCRAMSHA256Plus)
+			}
+
+			err = c.Auth(tt.client)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Auth() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				var smtpErr *gosmtp.SMTPError
+				if !errors.As(err, &smtpErr) || smtpErr.Code != 535 {
+					t.Errorf("Expected 535 error, got %v", err)
+				}
+			}
+		})
+	}
+
+	// 服务端签名之后客户端没有正确确认时不完成认证
+	c, err := gosmtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer c.Close()
+	if err := c.Auth(&scramClient{username: "scram", password: "password123", finalResponse: []byte("x")}); err == nil {
+		t.Errorf("Auth() with unexpected final response succeeded")
+	}
+	if err := c.Mail("scram@localhost", nil); err == nil {
+		t.Errorf("Mail() succeeded after incomplete SCRAM exchange")
+	}
+
+	// 未公布的机制不可用
+	c, err = gosmtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer c.Close()
+	if err := c.Auth(sasl.NewPlainClient("", "plain", "password123")); err == nil {
+		t.Errorf("Auth(PLAIN) succeeded, want error for unadvertised mechanism")
+	}
+}
+
+func TestChallengeResponseMechanisms(t *testing.T) {
+	tests := []struct {
+		name        string
+		credentials string
+		want        []string
+	}{
+		{
+			name:        "bcrypt only",
+			credentials: fmt.Sprintf(`{"user1": %q}`, mustHash(t, auth.SchemeBcrypt, "password123")),
+		},
+		{
+			name:        "CRAM-MD5 secret",
+			credentials: fmt.Sprintf(`{"user1": %q}`, mustHash(t, auth.SchemeCRAMMD5, "password123")),
+			want:        []string{auth.CRAMMD5},
+		},
+		{
+			name:        "SCRAM secret",
+			credentials: fmt.Sprintf(`{"user1": %q}`, mustHash(t, auth.SchemeSCRAMSHA256, "password123")),
+			want:        []string{auth.SCRAMSHA256},
+		},
+		{
+			name:        "plaintext password",
+			credentials: `{"user1": "{PLAIN}password123"}`,
+			want:        []string{auth.CRAMMD5, auth.SCRAMSHA256},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig()
+			cfg.SMTP.AuthMechanisms = []string{"PLAIN", "CRAM-MD5", "SCRAM-SHA-256"}
+			addr, _ := startTestServer(t, cfg, tt.credentials)
+
+			c, err := gosmtp.Dial(addr)
+			if err != nil {
+				t.Fatalf("Failed to dial: %v", err)
+			}
+			defer c.Close()
+			if err := c.Hello("localhost"); err != nil {
+				t.Fatalf("Hello failed: %v", err)
+			}
+
+			if !c.SupportsAuth(sasl.Plain) {
+				t.Errorf("Server does not advertise PLAIN")
+			}
+			for _, mech := range []string{auth.CRAMMD5, auth.SCRAMSHA256} {
+				if got, want := c.SupportsAuth(mech), slices.Contains(tt.want, mech); got != want {
+					t.Errorf("SupportsAuth(%s) = %v, want %v", mech, got, want)
+				}
+			}
+		})
+	}
+}
+
+// writeTestCert 生成自签名证书并写入 dir
+func writeTestCert(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	certFile = filepath.Join(dir, "server.crt")
+	keyFile = filepath.Join(dir, "server.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	return certFile, keyFile
+}
+
+func TestSCRAMChannelBinding(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.TLS.Enabled = true
+	cfg.TLS.CertFile, cfg.TLS.KeyFile = writeTestCert(t, t.TempDir())
+	cfg.Server.Listeners = []config.Listener{{
+		Name:           "submissions",
+		Port:           4650,
+		ImplicitTLS:    true,
+		AuthMechanisms: []string{"SCRAM-SHA-256", "SCRAM-SHA-256-PLUS"},
+	}}
+	credentials := fmt.Sprintf(`{"scram": %q}`, mustHash(t, auth.SchemeSCRAMSHA256, "password123"))
+	addr, _ := startTestServer(t, cfg, credentials)
+
+	tests := []struct {
+		name    string
+		client  func(state tls.ConnectionState) sasl.Client
+		wantErr bool
+	}{
+		{
+			name: "tls-exporter",
+			client: func(state tls.ConnectionState) sasl.Client {
+				data, err := state.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+				if err != nil {
+					t.Fatalf("Failed to export keying material: %v", err)
+				}
+				return &scramClient{username: "scram", password: "password123", cbType: "tls-exporter", cbData: data}
+			},
+		},
+		{
+			name: "wrong binding data",
+			client: func(state tls.ConnectionState) sasl.Client {
+				return &scramClient{username: "scram", password: "password123", cbType: "tls-exporter", cbData: []byte("forged")}
+			},
+			wantErr: true,
+		},
+		{
+			name: "client supports binding but server advertised it",
+			client: func(state tls.ConnectionState) sasl.Client {
+				return &scramClient{username: "scram", password: "password123", gs2Header: "y,,"}
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := gosmtp.DialTLS(addr, &tls.Config{InsecureSkipVerify: true})
+			if err != nil {
+				t.Fatalf("Failed to dial: %v", err)
+			}
+			defer c.Close()
+
+			if err := c.Hello("localhost"); err != nil {
+				t.Fatalf("Hello failed: %v", err)
+			}
+			if !c.SupportsAuth(auth.SCRAMSHA256Plus) {
+				t.Fatalf("Server does not advertise %s over TLS", auth.SCRAMSHA256Plus)
+			}
+			state, _ := c.TLSConnectionState()
+
+			err = c.Auth(tt.client(state))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Auth() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// xoauth2Client XOAUTH2 客户端，收到错误挑战后发送空响应
+type xoauth2Client struct {
+	username, token string
+	challenge       []byte
+}
+
+func (c *xoauth2Client) Start() (string, []byte, error) {
+	return auth.XOAuth2, []byte("user=" + c.username + "\x01auth=Bearer " + c.token + "\x01\x01"), nil
+}
+
+func (c *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	c.challenge = challenge
+	return []byte{}, nil
+}
+
+// newTestIssuer 生成签名密钥并写入 JWKS 文件，返回签发令牌的函数
+func newTestIssuer(t *testing.T, cfg *config.Config) func(sub string, ttl time.Duration) string {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwks := fmt.Sprintf(`{"keys": [{"kty": "EC", "kid": "k1", "crv": "P-256", "x": %q, "y": %q}]}`,
+		b64(key.X.FillBytes(make([]byte, 32))), b64(key.Y.FillBytes(make([]byte, 32))))
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(jwksFile, []byte(jwks), 0644); err != nil {
+		t.Fatalf("Failed to write JWKS: %v", err)
+	}
+
+	cfg.SMTP.OAuth.JWKS = jwksFile
+	cfg.SMTP.OAuth.Issuer = "https://idp.example.com"
+	cfg.SMTP.OAuth.Audience = "smtpd"
+
+	return func(sub string, ttl time.Duration) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+			"iss": "https://idp.example.com",
+			"aud": "smtpd",
+			"sub": sub,
+			"exp": time.Now().Add(ttl).Unix(),
+		})
+		token.Header["kid"] = "k1"
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatalf("Failed to sign token: %v", err)
+		}
+		return signed
+	}
+}
+
+func TestOAuthAuth(t *testing.T) {
+	cfg := newTestConfig()
+	issue := newTestIssuer(t, cfg)
+	addr, _ := startTestServer(t, cfg, "")
+
+	dial := func(t *testing.T) *gosmtp.Client {
+		c, err := gosmtp.Dial(addr)
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		t.Cleanup(func() { c.Close() })
+		if err := c.Hello("localhost"); err != nil {
+			t.Fatalf("Hello failed: %v", err)
+		}
+		if !c.SupportsAuth(auth.OAuthBearer) || !c.SupportsAuth(auth.XOAuth2) {
+			t.Fatalf("Server does not advertise OAUTHBEARER and XOAUTH2")
+		}
+		if c.SupportsAuth(sasl.Plain) {
+			t.Errorf("Server advertises PLAIN without a credential store")
+		}
+		return c
+	}
+
+	t.Run("OAUTHBEARER", func(t *testing.T) {
+		c := dial(t)
+		err := c.Auth(sasl.NewOAuthBearerClient(&sasl.OAuthBearerOptions{
+			Username: "svc-reports",
+			Token:    issue("svc-reports", time.Minute),
+		}))
+		if err != nil {
+			t.Fatalf("Auth() error = %v", err)
+		}
+		msg := "Subject: test\r\n\r\nhello\r\n"
+		if err := c.SendMail("svc-reports@localhost", []string{"rcpt@localhost"}, strings.NewReader(msg)); err != nil {
+			t.Errorf("SendMail failed: %v", err)
+		}
+	})
+
+	t.Run("OAUTHBEARER expired token", func(t *testing.T) {
+		c := dial(t)
+		err := c.Auth(sasl.NewOAuthBearerClient(&sasl.OAuthBearerOptions{
+			Username: "svc-reports",
+			Token:    issue("svc-reports", -time.Minute),
+		}))
+		var oauthErr *sasl.OAuthBearerError
+		if !errors.As(err, &oauthErr) || oauthErr.Status != "invalid_token" || oauthErr.Schemes != "bearer" {
+			t.Errorf("Auth() error = %v, want RFC 7628 invalid_token challenge", err)
+		}
+	})
+
+	t.Run("OAUTHBEARER foreign authzid", func(t *testing.T) {
+		c := dial(t)
+		err := c.Auth(sasl.NewOAuthBearerClient(&sasl.OAuthBearerOptions{
+			Username: "admin",
+			Token:    issue("svc-reports", time.Minute),
+		}))
+		if err == nil {
+			t.Errorf("Auth() succeeded, want error for mismatched authzid")
+		}
+	})
+
+	t.Run("XOAUTH2", func(t *testing.T) {
+		c := dial(t)
+		if err := c.Auth(&xoauth2Client{username: "svc-reports", token: issue("svc-reports", time.Minute)}); err != nil {
+			t.Fatalf("Auth() error = %v", err)
+		}
+	})
+
+	t.Run("XOAUTH2 bad signature", func(t *testing.T) {
+		c := dial(t)
+		token := issue("svc-reports", time.Minute)
+		client := &xoauth2Client{username: "svc-reports", token: token[:len(token)-4] + "AAAA"}
+		err := c.Auth(client)
+		var smtpErr *gosmtp.SMTPError
+		if !errors.As(err, &smtpErr) || smtpErr.Code != 535 {
+			t.Errorf("Auth() error = %v, want 535", err)
+		}
+		if !strings.Contains(string(client.challenge), `"status":"invalid_token"`) {
+			t.Errorf("Error challenge = %q, want invalid_token status", client.challenge)
+		}
+	})
+}
+
+// testCA 测试用的证书颁发机构
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create CA certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key}
+}
+
+// write 将 CA 证书写入 dir 并返回文件路径
+func (ca *testCA) write(t *testing.T, dir string) string {
+	t.Helper()
+	filename := filepath.Join(dir, "client-ca.crt")
+	if err := os.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0600); err != nil {
+		t.Fatalf("Failed to write CA certificate: %v", err)
+	}
+	return filename
+}
+
+// issue 签发客户端证书
+func (ca *testCA) issue(t *testing.T, commonName string, dnsNames ...string) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("Failed to create client certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestExternalAuth(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+
+	cfg := newTestConfig()
+	cfg.TLS.Enabled = true
+	cfg.TLS.CertFile, cfg.TLS.KeyFile = writeTestCert(t, dir)
+	cfg.TLS.ClientCAFile = ca.write(t, dir)
+	cfg.TLS.ClientCertMap = filepath.Join(dir, "client-certs")
+	mapping := "# 客户端证书映射\n" +
+		"subject:CN=reports svc-reports\n" +
+		"san:backup.internal.example.com svc-backup\n"
+	if err := os.WriteFile(cfg.TLS.ClientCertMap, []byte(mapping), 0600); err != nil {
+		t.Fatalf("Failed to write certificate map: %v", err)
+	}
+	cfg.Server.Listeners = []config.Listener{{Name: "submissions", Port: 4650, ImplicitTLS: true}}
+	addr, dataDir := startTestServer(t, cfg, "")
+
+	tests := []struct {
+		name     string
+		certs    []tls.Certificate
+		identity string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:  "subject",
+			certs: []tls.Certificate{ca.issue(t, "reports")},
+			want:  "svc-reports",
+		},
+		{
+			name:     "SAN with matching authzid",
+			certs:    []tls.Certificate{ca.issue(t, "backup-01", "backup.internal.example.com")},
+			identity: "svc-backup",
+			want:     "svc-backup",
+		},
+		{
+			name:     "foreign authzid",
+			certs:    []tls.Certificate{ca.issue(t, "reports")},
+			identity: "admin",
+			wantErr:  true,
+		},
+		{
+			name:    "unmapped certificate",
+			certs:   []tls.Certificate{ca.issue(t, "unknown")},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := gosmtp.DialTLS(addr, &tls.Config{InsecureSkipVerify: true, Certificates: tt.certs})
+			if err != nil {
+				t.Fatalf("Failed to dial: %v", err)
+			}
+			defer c.Close()
+
+			if err := c.Hello("localhost"); err != nil {
+				t.Fatalf("Hello failed: %v", err)
+			}
+			if !c.SupportsAuth(auth.External) {
+				t.Fatalf("Server does not advertise EXTERNAL with a client certificate")
+			}
+
+			err = c.Auth(sasl.NewExternalClient(tt.identity))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Auth() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			msg := "Subject: test\r\n\r\nhello\r\n"
+			if err := c.SendMail(tt.want+"@localhost", []string{"rcpt@localhost"}, strings.NewReader(msg)); err != nil {
+				t.Fatalf("SendMail failed: %v", err)
+			}
+		})
+	}
+
+	// 邮件元数据中记录证书身份
+	files, err := filepath.Glob(filepath.Join(dataDir, "*.eml"))
+	if err != nil || len(files) != 2 {
+		t.Fatalf("Expected 2 stored messages, got %d (%v)", len(files), err)
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("Failed to read message: %v", err)
+		}
+		for _, want := range []string{`"auth":"EXTERNAL"`, `"tls_client_subject":"CN=`, "with ESMTPSA"} {
+			if !strings.Contains(string(data), want) {
+				t.Errorf("Message %s does not contain %q", filepath.Base(file), want)
+			}
+		}
+	}
+
+	// 没有客户端证书时不公布 EXTERNAL
+	c, err := gosmtp.DialTLS(addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer c.Close()
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatalf("Hello failed: %v", err)
+	}
+	if c.SupportsAuth(auth.External) {
+		t.Errorf("Server advertises EXTERNAL without a client certificate")
+	}
+}
+
+func TestBruteForceProtection(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.SMTP.BruteForce.Enabled = true
+	cfg.SMTP.BruteForce.BaseDelay = 0
+	cfg.SMTP.BruteForce.MaxUserFailures = 2
+	cfg.SMTP.BruteForce.MaxIPFailures = 4
+	cfg.SMTP.BruteForce.MaxSessionFailures = 3
+	cfg.SMTP.BruteForce.StateFile = filepath.Join(t.TempDir(), "brute-force.json")
+	addr, _ := startTestServer(t, cfg, `{"user1": "password123", "user2": "password456"}`)
+
+	dial := func(t *testing.T) *gosmtp.Client {
+		t.Helper()
+		c, err := gosmtp.Dial(addr)
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		if err := c.Hello("localhost"); err != nil {
+			t.Fatalf("Hello failed: %v", err)
+		}
+		return c
+	}
+	wantCode := func(t *testing.T, err error, code int) {
+		t.Helper()
+		var smtpErr *gosmtp.SMTPError
+		if !errors.As(err, &smtpErr) || smtpErr.Code != code {
+			t.Errorf("Expected %d error, got %v", code, err)
+		}
+	}
+
+	// 用户名锁定后正确的密码也被拒绝，第三次失败后断开连接
+	c := dial(t)
+	defer c.Close()
+	wantCode(t, c.Auth(sasl.NewPlainClient("", "user1", "wrong1")), 535)
+	wantCode(t, c.Auth(sasl.NewPlainClient("", "user1", "wrong2")), 535)
+	wantCode(t, c.Auth(sasl.NewPlainClient("", "user1", "password123")), 421)
+	if err := c.Noop(); err == nil {
+		t.Errorf("Connection still open after too many failures")
+	}
+
+	// 其他用户不受影响
+	c = dial(t)
+	defer c.Close()
+	if err := c.Auth(sasl.NewPlainClient("", "user2", "password456")); err != nil {
+		t.Fatalf("Auth() error = %v", err)
+	}
+
+	// IP 达到阈值后在 AUTH 命令处直接拒绝
+	c = dial(t)
+	defer c.Close()
+	wantCode(t, c.Auth(sasl.NewPlainClient("", "nobody", "x")), 535)
+	wantCode(t, c.Auth(sasl.NewPlainClient("", "nobody", "y")), 535)
+	c = dial(t)
+	defer c.Close()
+	wantCode(t, c.Auth(sasl.NewPlainClient("", "user2", "password456")), 454)
+}
+
+// startFakeDovecot 启动只支持 PLAIN 和 CRAM-MD5 的 Dovecot 认证服务，
+// 用户 temp 总是暂时失败；requests 收到每条 AUTH 命令
+func startFakeDovecot(t *testing.T, users map[string]string) (socket string, requests chan string) {
+	t.Helper()
+	socket = filepath.Join(t.TempDir(), "auth-client")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	requests = make(chan string, 100)
+
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		fmt.Fprint(conn, "VERSION\t1\t2\nMECH\tPLAIN\tplaintext\nMECH\tCRAM-MD5\nDONE\n")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			fields := strings.Split(strings.TrimSpace(line), "\t")
+			if fields[0] != "AUTH" {
+				continue
+			}
+			requests <- line
+			id, username, ok := fields[1], "", false
+			if fields[2] == auth.CRAMMD5 {
+				challenge := "<1.2@dovecot>"
+				fmt.Fprintf(conn, "CONT\t%s\t%s\n", id, base64.StdEncoding.EncodeToString([]byte(challenge)))
+				line, _ = r.ReadString('\n')
+				cont := strings.Split(strings.TrimSpace(line), "\t")
+				data, _ := base64.StdEncoding.DecodeString(cont[len(cont)-1])
+				if parts := strings.Fields(string(data)); len(parts) == 2 {
+					mac := hmac.New(md5.New, []byte(users[parts[0]]))
+					mac.Write([]byte(challenge))
+					username, ok = parts[0], hex.EncodeToString(mac.Sum(nil)) == parts[1]
+				}
+			} else {
+				resp, _ := strings.CutPrefix(fields[len(fields)-1], "resp=")
+				data, _ := base64.StdEncoding.DecodeString(resp)
+				if parts := strings.Split(string(data), "\x00"); len(parts) == 3 {
+					username, ok = parts[1], users[parts[1]] == parts[2]
+				}
+			}
+			switch {
+			case username == "temp":
+				fmt.Fprintf(conn, "FAIL\t%s\ttemp\n", id)
+			case ok:
+				fmt.Fprintf(conn, "OK\t%s\tuser=%s\n", id, username)
+			default:
+				fmt.Fprintf(conn, "FAIL\t%s\tuser=%s\n", id, username)
+			}
+		}
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return socket, requests
+}
+
+func TestDovecotAuth(t *testing.T) {
+	socket, requests := startFakeDovecot(t, map[string]string{"alice": "secret", "temp": "secret"})
+	cfg := newTestConfig()
+	cfg.SMTP.AuthStore = "dovecot"
+	cfg.SMTP.Dovecot.Socket = socket
+	cfg.SMTP.AuthMechanisms = []string{"PLAIN", "LOGIN", "CRAM-MD5", "SCRAM-SHA-256"}
+	addr, _ := startTestServer(t, cfg, "")
+
+	c, err := gosmtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer c.Close()
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatalf("Hello failed: %v", err)
+	}
+	// Dovecot 不支持的 SCRAM-SHA-256 不公布；LOGIN 在本地处理，以 PLAIN 校验
+	if _, mechs := c.Extension("AUTH"); mechs != "PLAIN LOGIN CRAM-MD5" {
+		t.Errorf("AUTH mechanisms = %q, want %q", mechs, "PLAIN LOGIN CRAM-MD5")
+	}
+
+	tests := []struct {
+		name     string
+		client   sasl.Client
+		wantCode int
+	}{
+		{name: "plain", client: sasl.NewPlainClient("", "alice", "secret")},
+		{name: "plain wrong password", client: sasl.NewPlainClient("", "alice", "wrong"), wantCode: 535},
+		{name: "login", client: sasl.NewLoginClient("alice", "secret")},
+		{name: "cram-md5", client: &cramMD5Client{"alice", "secret"}},
+		{name: "cram-md5 wrong password", client: &cramMD5Client{"alice", "wrong"}, wantCode: 535},
+		{name: "temporary failure", client: sasl.NewPlainClient("", "temp", "secret"), wantCode: 454},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := gosmtp.Dial(addr)
+			if err != nil {
+				t.Fatalf("Failed to dial: %v", err)
+			}
+			defer c.Close()
+			if err := c.Hello("localhost"); err != nil {
+				t.Fatalf("Hello failed: %v", err)
+			}
+
+			err = c.Auth(tt.client)
+			var smtpErr *gosmtp.SMTPError
+			switch {
+			case tt.wantCode == 0 && err != nil:
+				t.Errorf("Auth() error = %v", err)
+			case tt.wantCode != 0 && (!errors.As(err, &smtpErr) || smtpErr.Code != tt.wantCode):
+				t.Errorf("Expected %d error, got %v", tt.wantCode, err)
+			}
+		})
+	}
+
+	// 转发的请求带有客户端地址
+	if request := <-requests; !strings.Contains(request, "service=smtp") || !strings.Contains(request, "rip=127.0.0.1") {
+		t.Errorf("AUTH request = %q, want service and client address", request)
+	}
+}
+
+func TestHTTPAuth(t *testing.T) {
+	var mu sync.Mutex
+	var mechanisms []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Username, Password, Mechanism string
+			RemoteIP                      string `json:"remote_ip"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		mechanisms = append(mechanisms, body.Mechanism)
+		mu.Unlock()
+
+		verdict := "deny"
+		switch {
+		case body.Username == "temp":
+			verdict = "tempfail"
+		case body.Username == "alice" && body.Password == "secret" && body.RemoteIP == "127.0.0.1":
+			verdict = "allow"
+		}
+		fmt.Fprintf(w, `{"verdict": %q}`, verdict)
+	}))
+	defer srv.Close()
+
+	cfg := newTestConfig()
+	cfg.SMTP.AuthStore = "http"
+	cfg.SMTP.HTTPAuth.URL = srv.URL
+	addr, _ := startTestServer(t, cfg, "")
+
+	tests := []struct {
+		name     string
+		client   sasl.Client
+		wantCode int
+	}{
+		{name: "plain", client: sasl.NewPlainClient("", "alice", "secret")},
+		{name: "login", client: sasl.NewLoginClient("alice", "secret")},
+		{name: "deny", client: sasl.NewPlainClient("", "alice", "wrong"), wantCode: 535},
+		{name: "tempfail", client: sasl.NewPlainClient("", "temp", "secret"), wantCode: 454},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := gosmtp.Dial(addr)
+			if err != nil {
+				t.Fatalf("Failed to dial: %v", err)
+			}
+			defer c.Close()
+			if err := c.Hello("localhost"); err != nil {
+				t.Fatalf("Hello failed: %v", err)
+			}
+
+			err = c.Auth(tt.client)
+			var smtpErr *gosmtp.SMTPError
+			switch {
+			case tt.wantCode == 0 && err != nil:
+				t.Errorf("Auth() error = %v", err)
+			case tt.wantCode != 0 && (!errors.As(err, &smtpErr) || smtpErr.Code != tt.wantCode):
+				t.Errorf("Expected %d error, got %v", tt.wantCode, err)
+			}
+		})
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got := strings.Join(mechanisms, " "); got != "PLAIN LOGIN PLAIN PLAIN" {
+		t.Errorf("Mechanisms sent to callback = %q", got)
+	}
+}
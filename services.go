@@ -0,0 +1,322 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"github.com/catroll/smtpd/access"
+	"github.com/catroll/smtpd/auth"
+	"github.com/catroll/smtpd/config"
+	"github.com/catroll/smtpd/greylist"
+	"github.com/catroll/smtpd/internal/netaddr"
+	"github.com/catroll/smtpd/quota"
+	"github.com/catroll/smtpd/recipient"
+)
+
+// services 在所有监听器之间共享的组件，未配置的为 nil
+type services struct {
+	authenticator *auth.Authenticator
+	tokens        *auth.TokenValidator
+	certs         *auth.CertMap
+	guard         *auth.Guard
+	quota         *quota.Quota
+	greylist      *greylist.List
+	senders       *auth.SenderMap
+	aliases       *recipient.AliasMap
+	recipients    *recipient.Table
+	// access 全局的连接访问控制规则，listenerAccess 为各监听器自己的规则
+	access         *access.List
+	listenerAccess map[string]*access.List
+	// limiter 连接和命令的速率限制
+	limiter *connLimiter
+	// trusted 无需认证即可发信的客户端网段
+	trusted []netip.Prefix
+	// policies 策略委托服务，按配置顺序查询
+	policies []*policyService
+	// milters 内容过滤器，按配置顺序处理邮件
+	milters []*milterService
+
+	// reloaders 收到 SIGHUP 时需要重新加载的组件
+	reloaders []reloader
+}
+
+// newServices 根据配置初始化共享组件
+func newServices(cfg *config.Config) (*services, error) {
+	svc := &services{}
+
+	authenticator, err := newAuthenticator(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("loading credentials: %w", err)
+	}
+	svc.authenticator = authenticator
+	if authenticator != nil {
+		if fs, ok := authenticator.Store().(*auth.FileStore); ok {
+			svc.reloaders = append(svc.reloaders, fs)
+		}
+	}
+
+	tokens, err := newTokenValidator(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("loading jwks: %w", err)
+	}
+	if tokens != nil {
+		svc.tokens = tokens
+		svc.reloaders = append(svc.reloaders, tokens)
+	}
+
+	if cfg.TLS.ClientCertMap != "" {
+		certs, err := auth.NewCertMap(cfg.TLS.ClientCertMap)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate map: %w", err)
+		}
+		svc.certs = certs
+		svc.reloaders = append(svc.reloaders, certs)
+	}
+
+	if cfg.SMTP.SenderLoginMap != "" {
+		senders, err := auth.NewSenderMap(cfg.SMTP.SenderLoginMap)
+		if err != nil {
+			return nil, fmt.Errorf("loading sender login map: %w", err)
+		}
+		svc.senders = senders
+		svc.reloaders = append(svc.reloaders, senders)
+	}
+
+	if cfg.SMTP.VirtualAliasMap != "" {
+		aliases, err := recipient.NewAliasMap(cfg.SMTP.VirtualAliasMap)
+		if err != nil {
+			return nil, fmt.Errorf("loading virtual alias map: %w", err)
+		}
+		svc.aliases = aliases
+		svc.reloaders = append(svc.reloaders, aliases)
+	}
+
+	if lr := cfg.SMTP.LocalRecipients; lr.File != "" || lr.FromUsers {
+		opts := recipient.Options{File: lr.File, Domains: lr.Domains}
+		if lr.FromUsers {
+			if authenticator == nil {
+				return nil, fmt.Errorf("local recipients from users require a credential store")
+			}
+			opts.Store = authenticator.Store()
+		}
+		recipients, err := recipient.NewTable(opts)
+		if err != nil {
+			return nil, fmt.Errorf("loading local recipients: %w", err)
+		}
+		svc.recipients = recipients
+		if lr.File != "" {
+			svc.reloaders = append(svc.reloaders, recipients)
+		}
+	}
+
+	if cfg.Server.AccessList != "" {
+		list, err := access.New(cfg.Server.AccessList)
+		if err != nil {
+			return nil, fmt.Errorf("loading access list: %w", err)
+		}
+		svc.access = list
+		svc.reloaders = append(svc.reloaders, list)
+	}
+	for _, l := range cfg.Listeners() {
+		if l.AccessList == "" {
+			continue
+		}
+		list, err := access.New(l.AccessList)
+		if err != nil {
+			return nil, fmt.Errorf("loading access list for listener %s: %w", l.Name, err)
+		}
+		if svc.listenerAccess == nil {
+			svc.listenerAccess = make(map[string]*access.List)
+		}
+		svc.listenerAccess[l.Name] = list
+		svc.reloaders = append(svc.reloaders, list)
+	}
+
+	limiter, err := newConnLimiter(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("creating rate limiter: %w", err)
+	}
+	svc.limiter = limiter
+
+	for _, network := range cfg.SMTP.TrustedNetworks {
+		prefix, err := netaddr.ParsePrefix(network)
+		if err != nil {
+			return nil, fmt.Errorf("parsing trusted networks: %w", err)
+		}
+		svc.trusted = append(svc.trusted, prefix)
+	}
+
+	policies, err := newPolicyServices(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("creating policy services: %w", err)
+	}
+	svc.policies = policies
+
+	milters, err := newMilterServices(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("creating milters: %w", err)
+	}
+	svc.milters = milters
+
+	if bf := cfg.SMTP.BruteForce; bf.Enabled {
+		guard, err := auth.NewGuard(auth.GuardOptions{
+			Window:          bf.Window,
+			MaxIPFailures:   bf.MaxIPFailures,
+			MaxUserFailures: bf.MaxUserFailures,
+			Lockout:         bf.Lockout,
+			BaseDelay:       bf.BaseDelay,
+			MaxDelay:        bf.MaxDelay,
+			StateFile:       bf.StateFile,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("loading brute force state: %w", err)
+		}
+		svc.guard = guard
+	}
+
+	if q := cfg.SMTP.Quota; q.User != (config.QuotaLimits{}) || q.IP != (config.QuotaLimits{}) {
+		tracker, err := quota.New(quota.Options{
+			User:      quotaLimits(q.User),
+			IP:        quotaLimits(q.IP),
+			StateFile: q.StateFile,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("loading quota state: %w", err)
+		}
+		svc.quota = tracker
+	}
+
+	if gl := cfg.SMTP.Greylist; gl.Enabled {
+		var networks []netip.Prefix
+		for _, network := range gl.WhitelistNetworks {
+			prefix, err := netaddr.ParsePrefix(network)
+			if err != nil {
+				return nil, fmt.Errorf("parsing greylist whitelist: %w", err)
+			}
+			networks = append(networks, prefix)
+		}
+		list, err := greylist.New(greylist.Options{
+			Delay:            gl.Delay,
+			RetryWindow:      gl.RetryWindow,
+			Expire:           gl.Expire,
+			StateFile:        gl.StateFile,
+			Networks:         networks,
+			Senders:          gl.WhitelistSenders,
+			RecipientDomains: gl.WhitelistRecipientDomains,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("loading greylist: %w", err)
+		}
+		svc.greylist = list
+	}
+
+	return svc, nil
+}
+
+// quotaLimits 转换配置中的发送额度
+func quotaLimits(l config.QuotaLimits) quota.Limits {
+	return quota.Limits{
+		MessagesPerHour:  l.MessagesPerHour,
+		MessagesPerDay:   l.MessagesPerDay,
+		RecipientsPerDay: l.RecipientsPerDay,
+		BytesPerDay:      l.BytesPerDay,
+	}
+}
+
+// trustedNetwork 判断客户端地址是否属于受信任的网段
+func (svc *services) trustedNetwork(addr string) bool {
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := ap.Addr().Unmap()
+	for _, prefix := range svc.trusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// newAuthenticator 根据配置创建凭据存储和认证器，未配置凭据来源时返回 nil
+func newAuthenticator(cfg *config.Config) (*auth.Authenticator, error) {
+	opts := auth.Options{
+		AllowPlaintext: cfg.SMTP.AllowPlaintextPasswords,
+	}
+	if cfg.SMTP.PasswordScheme != "" {
+		scheme, err := auth.ParseScheme(cfg.SMTP.PasswordScheme)
+		if err != nil {
+			return nil, err
+		}
+		opts.PasswordScheme = scheme
+	}
+
+	// 未配置认证文件时不提供 SMTP AUTH
+	if !slices.Contains([]string{"ldap", "checkpassword", "dovecot", "http"}, cfg.SMTP.AuthStore) && cfg.SMTP.AuthFile == "" {
+		return nil, nil
+	}
+
+	var store auth.Store
+	var err error
+	switch cfg.SMTP.AuthStore {
+	case "", "json":
+		store, err = auth.NewJSONStore(cfg.SMTP.AuthFile, opts)
+	case "htpasswd":
+		store, err = auth.NewHtpasswdStore(cfg.SMTP.AuthFile, opts)
+	case "passwd-file":
+		store, err = auth.NewPasswdFileStore(cfg.SMTP.AuthFile, opts)
+	case "ldap":
+		store, err = auth.NewLDAPStore(auth.LDAPOptions{
+			URL:           cfg.SMTP.LDAP.URL,
+			UserDN:        cfg.SMTP.LDAP.UserDN,
+			BaseDN:        cfg.SMTP.LDAP.BaseDN,
+			UserAttribute: cfg.SMTP.LDAP.UserAttribute,
+			BindDN:        cfg.SMTP.LDAP.BindDN,
+			BindPassword:  cfg.SMTP.LDAP.BindPassword,
+			Timeout:       cfg.SMTP.LDAP.Timeout,
+		})
+	case "checkpassword":
+		store, err = auth.NewCheckpasswordStore(auth.CheckpasswordOptions{
+			Command:       cfg.SMTP.Checkpassword.Command,
+			Timeout:       cfg.SMTP.Checkpassword.Timeout,
+			MaxConcurrent: cfg.SMTP.Checkpassword.MaxConcurrent,
+		})
+	case "dovecot":
+		store, err = auth.NewDovecotStore(auth.DovecotOptions{
+			Socket:  cfg.SMTP.Dovecot.Socket,
+			Service: cfg.SMTP.Dovecot.Service,
+			Timeout: cfg.SMTP.Dovecot.Timeout,
+		})
+	case "http":
+		store, err = auth.NewHTTPStore(auth.HTTPOptions{
+			URL:              cfg.SMTP.HTTPAuth.URL,
+			Headers:          cfg.SMTP.HTTPAuth.Headers,
+			Timeout:          cfg.SMTP.HTTPAuth.Timeout,
+			CacheTTL:         cfg.SMTP.HTTPAuth.CacheTTL,
+			BreakerThreshold: cfg.SMTP.HTTPAuth.BreakerThreshold,
+			BreakerCooldown:  cfg.SMTP.HTTPAuth.BreakerCooldown,
+		})
+	default:
+		err = fmt.Errorf("unknown auth store: %s", cfg.SMTP.AuthStore)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return auth.New(store), nil
+}
+
+// newTokenValidator 根据配置创建 OAuth 令牌校验器，未配置 JWKS 时返回 nil
+func newTokenValidator(cfg *config.Config) (*auth.TokenValidator, error) {
+	if cfg.SMTP.OAuth.JWKS == "" {
+		return nil, nil
+	}
+	return auth.NewTokenValidator(auth.OAuthOptions{
+		JWKS:          cfg.SMTP.OAuth.JWKS,
+		Issuer:        cfg.SMTP.OAuth.Issuer,
+		Audience:      cfg.SMTP.OAuth.Audience,
+		UsernameClaim: cfg.SMTP.OAuth.UsernameClaim,
+		Leeway:        cfg.SMTP.OAuth.Leeway,
+	})
+}
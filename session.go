@@ -1,13 +1,25 @@
 package main
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
-	"os"
+	"net"
+	"net/mail"
+	"net/netip"
 	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 
+	"github.com/catroll/smtpd/auth"
+	"github.com/catroll/smtpd/greylist"
+	"github.com/catroll/smtpd/quota"
+	"github.com/catroll/smtpd/recipient"
 	"github.com/emersion/go-sasl"
 	gosmtp "github.com/emersion/go-smtp"
 )
@@ -16,91 +28,146 @@ import (
 type Session struct {
 	backend       *Backend
 	conn          *gosmtp.Conn
-	from          string
-	to            []string
+	from          Address
+	to            []Address
 	sessionID     string
 	remoteAddr    string
 	authenticated bool
 	username      string
+	authMethod    string
+	authFailures  int
+	// account 已认证用户在凭据存储中的账户记录，没有时为 nil
+	account *auth.Account
+	// appPassword 登录时匹配的应用专用密码标签，使用账户密码时为空
+	appPassword string
+	// trusted 客户端来自受信任的网段，未认证也可以发信
+	trusted bool
+	// smtputf8 MAIL 命令声明了 SMTPUTF8，地址可以含有非 ASCII 字符
+	smtputf8 bool
+	// rcpts RCPT 命令中的原始收件人，to 为拆分子地址、展开别名后的收件人
+	rcpts []Address
+	// subaddresses 拆分出的子地址标签，形如 user@example.com=tag
+	subaddresses []string
+	// unknownRcpts 推迟到 DATA 阶段拒绝的未知收件人
+	unknownRcpts []Address
+	// mailSize MAIL 命令声明的邮件大小，未声明时为 0
+	mailSize int64
+	// transactions 会话中已开始的邮件事务数，用于策略查询的 instance
+	transactions int
+	// policyHold 策略服务要求暂存邮件的原因，policyHeaders 为要添加到邮件开头的头部
+	policyHold    string
+	policyHeaders []string
+	// milters 会话与各 milter 的连接，milterDiscard 为 milter 要求丢弃当前邮件
+	milters       []*milterSession
+	milterDiscard bool
 }
 
 // NewSession 创建新的会话实例
 func NewSession(backend *Backend, conn *gosmtp.Conn, sessionID, remoteAddr string) *Session {
-	return &Session{
+	s := &Session{
 		backend:    backend,
 		conn:       conn,
 		sessionID:  sessionID,
 		remoteAddr: remoteAddr,
 	}
+	if backend.trustedNetwork(remoteAddr) {
+		s.trusted = true
+		slog.Info("客户端来自受信任网络，无需认证即可发信",
+			"session_id", sessionID,
+			"remote_addr", remoteAddr,
+			"auth", authTrustedNetwork,
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+	}
+	return s
 }
 
-// WithAuth 设置认证信息
-func (s *Session) WithAuth(username string) *Session {
-	s.authenticated = true
-	s.username = username
-	return s
+// authTrustedNetwork 受信任网络的会话在日志和邮件元数据中记录的授权方式
+const authTrustedNetwork = "trusted-network"
+
+// authGrant 返回会话发信的授权方式：认证机制、trusted-network 或空（匿名）
+func (s *Session) authGrant() string {
+	if s.authenticated {
+		return s.authMethod
+	}
+	if s.trusted {
+		return authTrustedNetwork
+	}
+	return ""
 }
 
-// AuthMechanisms 返回支持的认证机制
-func (s *Session) AuthMechanisms() []string {
-	return []string{"PLAIN", "LOGIN"}
+// authorized 判断会话是否可以发信：允许匿名访问、已认证或来自受信任的网段
+func (s *Session) authorized() bool {
+	return s.backend.cfg.SMTP.AllowAnonymous || s.authenticated || s.trusted
 }
 
-// Auth 实现认证机制
-func (s *Session) Auth(mech string, fr sasl.Server) error {
-	switch mech {
-	case "PLAIN", "LOGIN":
-		// 第一次调用 Next，获取用户名
-		username, done, err := fr.Next(nil)
-		if err != nil {
-			return err
-		}
-		if done {
-			return fmt.Errorf("认证未完成就收到了完成信号")
-		}
+// AuthMechanisms 返回当前连接上可用的认证机制
+func (s *Session) AuthMechanisms() []string {
+	authenticator := s.backend.authenticator
+	_, isTLS := s.conn.TLSConnectionState()
 
-		// 第二次调用 Next，获取密码
-		password, done, err := fr.Next(nil)
-		if err != nil {
-			return err
+	var mechanisms []string
+	for _, mech := range s.backend.listener.AuthMechanisms {
+		var ok bool
+		switch mech {
+		case sasl.Plain, sasl.Login:
+			ok = authenticator != nil
+		case auth.CRAMMD5, auth.SCRAMSHA256:
+			// 质询-响应机制需要凭据存储提供可用于该机制的密钥
+			ok = authenticator != nil && authenticator.SupportsMechanism(mech) || s.proxiedToDovecot(mech)
+		case auth.SCRAMSHA256Plus:
+			// -PLUS 还需要 TLS 连接提供通道绑定
+			ok = authenticator != nil && authenticator.SupportsMechanism(mech) && isTLS
+		case auth.OAuthBearer, auth.XOAuth2:
+			ok = s.backend.tokens != nil || s.proxiedToDovecot(mech)
+		case auth.External:
+			ok = s.backend.certs != nil && s.peerCertificate() != nil
 		}
-		if !done {
-			return fmt.Errorf("认证完成但未收到完成信号")
+		if ok {
+			mechanisms = append(mechanisms, mech)
 		}
+	}
+	return mechanisms
+}
 
-		// 确保 username 和 password 正确转换为 string 类型
-		usernameStr := string(username)
-		passwordStr := string(password)
+// peerCertificate 返回已通过验证的 TLS 客户端证书，没有时返回 nil
+func (s *Session) peerCertificate() *x509.Certificate {
+	state, ok := s.conn.TLSConnectionState()
+	if !ok || len(state.VerifiedChains) == 0 {
+		return nil
+	}
+	return state.PeerCertificates[0]
+}
+
+// clientIP 返回客户端 IP 地址
+func (s *Session) clientIP() string {
+	ip, _, err := net.SplitHostPort(s.remoteAddr)
+	if err != nil {
+		return s.remoteAddr
+	}
+	return ip
+}
 
-		if !s.backend.authenticator.Authenticate(usernameStr, passwordStr) {
-			slog.Warn("SMTP 认证失败",
+// Auth 为指定的认证机制创建 SASL 服务端，客户端 IP 被锁定时拒绝认证
+func (s *Session) Auth(mech string) (sasl.Server, error) {
+	if s.backend.guard != nil {
+		if until, locked := s.backend.guard.IPLocked(s.clientIP()); locked {
+			slog.Warn("客户端 IP 已被临时锁定，拒绝认证",
 				"session_id", s.sessionID,
 				"remote_addr", s.remoteAddr,
-				"username", usernameStr,
 				"auth_method", mech,
+				"locked_until", until.Format(time.RFC3339),
 				"timestamp", time.Now().Format(time.RFC3339Nano),
 			)
-			return gosmtp.ErrAuthFailed
+			return nil, errAuthLocked
 		}
-
-		s.authenticated = true
-		s.username = usernameStr
-		slog.Info("SMTP 认证成功",
-			"session_id", s.sessionID,
-			"remote_addr", s.remoteAddr,
-			"username", usernameStr,
-			"auth_method", mech,
-			"timestamp", time.Now().Format(time.RFC3339Nano),
-		)
-		return nil
-	default:
-		return gosmtp.ErrAuthUnsupported
 	}
+	return s.newSASLServer(mech)
 }
 
 // Mail 设置发件人
 func (s *Session) Mail(from string, opts *gosmtp.MailOptions) error {
-	if !s.backend.cfg.SMTP.AllowAnonymous && !s.authenticated {
+	if !s.authorized() {
 		slog.Warn("未认证的发送尝试",
 			"session_id", s.sessionID,
 			"remote_addr", s.remoteAddr,
@@ -110,11 +177,51 @@ func (s *Session) Mail(from string, opts *gosmtp.MailOptions) error {
 		return gosmtp.ErrAuthRequired
 	}
 
-	s.from = from
+	s.smtputf8 = opts != nil && opts.UTF8
+	addr, err := s.parseEnvelope("from", from)
+	if err != nil {
+		return err
+	}
+
+	// 预先声明的邮件大小超出用户的限制时直接拒绝
+	if limit := s.maxMessageSize(); opts != nil && opts.Size > limit {
+		slog.Warn("邮件大小超出用户限制",
+			"session_id", s.sessionID,
+			"remote_addr", s.remoteAddr,
+			"username", s.username,
+			"size", opts.Size,
+			"max_size", limit,
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+		return errMessageTooLarge
+	}
+
+	// 已认证用户只能使用发件人映射中属于自己的地址，空发件人（退信）除外
+	if s.authenticated && s.backend.senders != nil && !addr.IsNull() && !s.backend.senders.Allowed(s.username, addr.String()) {
+		slog.Warn("发件人与登录用户不匹配",
+			"session_id", s.sessionID,
+			"remote_addr", s.remoteAddr,
+			"username", s.username,
+			"from", addr.String(),
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+		return errSenderNotOwned
+	}
+
+	if err := s.milterMail(addr, opts); err != nil {
+		return err
+	}
+
+	s.from = addr
+	s.transactions++
+	if opts != nil {
+		s.mailSize = opts.Size
+	}
 	slog.Info("设置发件人",
 		"session_id", s.sessionID,
 		"remote_addr", s.remoteAddr,
-		"from", from,
+		"from", addr.String(),
+		"utf8", addr.UTF8,
 		"timestamp", time.Now().Format(time.RFC3339Nano),
 	)
 	return nil
@@ -122,7 +229,7 @@ func (s *Session) Mail(from string, opts *gosmtp.MailOptions) error {
 
 // Rcpt 添加收件人
 func (s *Session) Rcpt(to string, opts *gosmtp.RcptOptions) error {
-	if !s.backend.cfg.SMTP.AllowAnonymous && !s.authenticated {
+	if !s.authorized() {
 		slog.Warn("未认证的收件人添加尝试",
 			"session_id", s.sessionID,
 			"remote_addr", s.remoteAddr,
@@ -132,30 +239,186 @@ func (s *Session) Rcpt(to string, opts *gosmtp.RcptOptions) error {
 		return gosmtp.ErrAuthRequired
 	}
 
-	if len(s.to) >= s.backend.cfg.SMTP.MaxRecipients {
+	if limit := s.maxRecipients(); len(s.to) >= limit {
 		slog.Warn("超出最大收件人数量限制",
 			"session_id", s.sessionID,
 			"remote_addr", s.remoteAddr,
-			"max_recipients", s.backend.cfg.SMTP.MaxRecipients,
+			"username", s.username,
+			"max_recipients", limit,
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+		return fmt.Errorf("too many recipients")
+	}
+
+	rcpt, err := s.parseEnvelope("to", to)
+	if err != nil {
+		return err
+	}
+	expanded, tag, err := s.expandRecipient(rcpt)
+	if err != nil {
+		return err
+	}
+	unknown, err := s.checkRecipient(rcpt, expanded)
+	if err != nil {
+		return err
+	}
+	// 灰名单在收件人检查之后，不存在的收件人直接拒绝，不为它们记录三元组
+	if err := s.checkGreylist(rcpt); err != nil {
+		return err
+	}
+	if err := s.checkPolicy(policyStageRcpt, rcpt, s.mailSize); err != nil {
+		return err
+	}
+
+	// 最大收件人数量按展开后的收件人计算，已添加过的收件人不重复计入
+	var added []Address
+	for _, addr := range expanded {
+		if !slices.Contains(s.to, addr) && !slices.Contains(added, addr) {
+			added = append(added, addr)
+		}
+	}
+	if limit := s.maxRecipients(); len(s.to)+len(added) > limit {
+		slog.Warn("展开别名后超出最大收件人数量限制",
+			"session_id", s.sessionID,
+			"remote_addr", s.remoteAddr,
+			"username", s.username,
+			"to", rcpt.String(),
+			"expanded", len(added),
+			"max_recipients", limit,
 			"timestamp", time.Now().Format(time.RFC3339Nano),
 		)
 		return fmt.Errorf("too many recipients")
 	}
+	if err := s.checkQuota(len(s.to) + len(added)); err != nil {
+		return err
+	}
+	if err := s.milterRcpt(rcpt); err != nil {
+		return err
+	}
 
-	s.to = append(s.to, to)
+	s.to = append(s.to, added...)
+	s.rcpts = append(s.rcpts, rcpt)
+	s.unknownRcpts = append(s.unknownRcpts, unknown...)
+	if tag != "" {
+		base, _ := splitSubaddress(rcpt, s.backend.cfg.SMTP.RecipientDelimiter)
+		s.subaddresses = append(s.subaddresses, base.String()+"="+tag)
+	}
 	slog.Info("添加收件人",
 		"session_id", s.sessionID,
 		"remote_addr", s.remoteAddr,
-		"to", to,
+		"to", rcpt.String(),
 		"recipient_count", len(s.to),
 		"timestamp", time.Now().Format(time.RFC3339Nano),
 	)
 	return nil
 }
 
+// errUnknownRecipient 收件人不在本地收件人表中
+var errUnknownRecipient = &gosmtp.SMTPError{
+	Code:         550,
+	EnhancedCode: gosmtp.EnhancedCode{5, 1, 1},
+	Message:      "Recipient address rejected: User unknown",
+}
+
+// checkRecipient 按本地收件人表检查展开后的收件人，未配置时不检查；有未知收件人时回复 550，
+// 启用 delay_reject 时先接受并返回未知的收件人，在 DATA 阶段再拒绝
+func (s *Session) checkRecipient(rcpt Address, expanded []Address) ([]Address, error) {
+	if s.backend.recipients == nil {
+		return nil, nil
+	}
+	var unknown []Address
+	for _, addr := range expanded {
+		status, err := s.backend.recipients.Check(addr.String())
+		if err != nil {
+			slog.Error("查询本地收件人失败",
+				"session_id", s.sessionID,
+				"remote_addr", s.remoteAddr,
+				"to", addr.String(),
+				"error", err,
+				"timestamp", time.Now().Format(time.RFC3339Nano),
+			)
+			return nil, &gosmtp.SMTPError{
+				Code:         451,
+				EnhancedCode: gosmtp.EnhancedCode{4, 3, 0},
+				Message:      "Recipient lookup failed, try again later",
+			}
+		}
+		if status != recipient.Unknown {
+			continue
+		}
+
+		delay := s.backend.cfg.SMTP.LocalRecipients.DelayReject
+		slog.Warn("未知的本地收件人",
+			"session_id", s.sessionID,
+			"remote_addr", s.remoteAddr,
+			"to", rcpt.String(),
+			"unknown", addr.String(),
+			"delay_reject", delay,
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+		if !delay {
+			return nil, errUnknownRecipient
+		}
+		unknown = append(unknown, addr)
+	}
+	return unknown, nil
+}
+
+// expandRecipient 拆分收件人的子地址并展开虚拟别名，返回最终收件人和标签；
+// 未配置别名文件时只拆分子地址。含标签的完整地址本身有别名时优先使用，不拆分
+func (s *Session) expandRecipient(rcpt Address) ([]Address, string, error) {
+	aliases := s.backend.aliases
+	base, tag := splitSubaddress(rcpt, s.backend.cfg.SMTP.RecipientDelimiter)
+	if aliases == nil {
+		return []Address{base}, tag, nil
+	}
+
+	if _, ok := aliases.Lookup(rcpt.String()); ok {
+		base, tag = rcpt, ""
+	}
+	expanded, err := expandAlias(aliases, base)
+	if err != nil {
+		slog.Error("展开收件人别名失败",
+			"session_id", s.sessionID,
+			"remote_addr", s.remoteAddr,
+			"to", rcpt.String(),
+			"error", err,
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+		if errors.Is(err, errAliasLoop) {
+			return nil, "", &gosmtp.SMTPError{
+				Code:         550,
+				EnhancedCode: gosmtp.EnhancedCode{5, 4, 6},
+				Message:      "Alias expansion loop detected",
+			}
+		}
+		return nil, "", &gosmtp.SMTPError{
+			Code:         451,
+			EnhancedCode: gosmtp.EnhancedCode{4, 3, 0},
+			Message:      "Alias expansion failed, try again later",
+		}
+	}
+
+	if len(expanded) != 1 || expanded[0] != rcpt {
+		to := make([]string, len(expanded))
+		for i, addr := range expanded {
+			to[i] = addr.String()
+		}
+		slog.Info("展开收件人别名",
+			"session_id", s.sessionID,
+			"remote_addr", s.remoteAddr,
+			"to", rcpt.String(),
+			"subaddress", tag,
+			"expanded", to,
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+	}
+	return expanded, tag, nil
+}
+
 // Data 处理邮件内容
 func (s *Session) Data(r io.Reader) error {
-	if !s.backend.cfg.SMTP.AllowAnonymous && !s.authenticated {
+	if !s.authorized() {
 		slog.Warn("未认证的数据发送尝试",
 			"session_id", s.sessionID,
 			"remote_addr", s.remoteAddr,
@@ -164,29 +427,103 @@ func (s *Session) Data(r io.Reader) error {
 		return gosmtp.ErrAuthRequired
 	}
 
-	// 生成邮件文件名
-	timestamp := time.Now().Format("20060102150405")
-	filename := fmt.Sprintf("%s-%s.eml", timestamp, s.sessionID)
-	filepath := filepath.Join(s.backend.dataDir, filename)
+	if len(s.unknownRcpts) > 0 {
+		to := make([]string, len(s.unknownRcpts))
+		for i, addr := range s.unknownRcpts {
+			to[i] = addr.String()
+		}
+		slog.Warn("邮件含有未知收件人，在 DATA 阶段拒绝",
+			"session_id", s.sessionID,
+			"remote_addr", s.remoteAddr,
+			"unknown", to,
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+		return errUnknownRecipient
+	}
+	if err := s.checkPolicy(policyStageData, Address{}, s.mailSize); err != nil {
+		return err
+	}
 
-	// 创建邮件文件
-	f, err := os.Create(filepath)
+	// 读取邮件内容，大小已由服务器的 MaxMessageBytes 限制
+	data, err := io.ReadAll(r)
 	if err != nil {
-		slog.Error("创建邮件文件失败",
+		slog.Error("读取邮件内容失败",
 			"session_id", s.sessionID,
 			"remote_addr", s.remoteAddr,
-			"filepath", filepath,
 			"error", err.Error(),
 			"timestamp", time.Now().Format(time.RFC3339Nano),
 		)
 		return err
 	}
-	defer f.Close()
 
-	// 写入邮件内容
-	n, err := io.Copy(f, r)
+	if limit := s.maxMessageSize(); int64(len(data)) > limit {
+		slog.Warn("邮件大小超出用户限制",
+			"session_id", s.sessionID,
+			"remote_addr", s.remoteAddr,
+			"username", s.username,
+			"size", len(data),
+			"max_size", limit,
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+		return errMessageTooLarge
+	}
+
+	if err := s.checkFromHeader(data); err != nil {
+		return err
+	}
+	// 预占发送额度，并发的会话不会同时通过检查；邮件最终没有保存时退还
+	reservation, err := s.reserveQuota(len(s.to), int64(len(data)))
 	if err != nil {
-		slog.Error("写入邮件内容失败",
+		return err
+	}
+	saved := false
+	defer func() {
+		if !saved {
+			reservation.Release()
+		}
+	}()
+	if err := s.checkPolicy(policyStageEOM, Address{}, int64(len(data))); err != nil {
+		return err
+	}
+
+	id, err := GenerateID(s.backend.cfg.Server.InstanceName, s.username)
+	if err != nil {
+		return err
+	}
+	if data, err = s.milterMessage(id, data); err != nil {
+		return err
+	}
+	if s.milterDiscard {
+		slog.Info("milter 要求丢弃邮件",
+			"session_id", s.sessionID,
+			"remote_addr", s.remoteAddr,
+			"from", s.from.String(),
+			"to", s.recipients(),
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+		return nil
+	}
+
+	m := &Mail{
+		ID:         id,
+		ReceivedAt: time.Now(),
+		Username:   s.username,
+		MailFrom:   s.from.String(),
+		RcptTo:     s.recipients(),
+		Data:       io.MultiReader(strings.NewReader(s.policyHeaderBlock()), bytes.NewReader(data)),
+		ClientIP:   s.clientIP(),
+		Size:       int64(len(data)),
+		Extras:     s.metadata(),
+	}
+
+	// 保存邮件，元数据写入邮件头；策略服务要求暂存的邮件保存到 hold 子目录
+	dir := s.backend.dataDir
+	if s.policyHold != "" {
+		dir = filepath.Join(dir, "hold")
+	}
+	filepath := filepath.Join(dir, id+".eml")
+	if err := m.Save(filepath); err != nil {
+		slog.Error("保存邮件失败",
 			"session_id", s.sessionID,
 			"remote_addr", s.remoteAddr,
 			"filepath", filepath,
@@ -196,22 +533,309 @@ func (s *Session) Data(r io.Reader) error {
 		return err
 	}
 
+	saved = true
+
 	slog.Info("邮件保存成功",
 		"session_id", s.sessionID,
 		"remote_addr", s.remoteAddr,
 		"filepath", filepath,
-		"size", n,
-		"from", s.from,
-		"to", s.to,
+		"size", m.Size,
+		"from", s.from.String(),
+		"to", s.recipients(),
+		"username", s.username,
+		"auth_method", s.authGrant(),
 		"timestamp", time.Now().Format(time.RFC3339Nano),
 	)
 	return nil
 }
 
+// maxRecipients 返回当前用户的最大收件人数量，取全局限制和账户限制中较小的一个
+func (s *Session) maxRecipients() int {
+	limit := s.backend.cfg.SMTP.MaxRecipients
+	if s.account != nil && s.account.MaxRecipients > 0 {
+		limit = min(limit, s.account.MaxRecipients)
+	}
+	return limit
+}
+
+// maxMessageSize 返回当前用户的最大邮件大小，取全局限制和账户限制中较小的一个
+func (s *Session) maxMessageSize() int64 {
+	limit := int64(s.backend.cfg.SMTP.MaxSize)
+	if s.account != nil && s.account.MaxMessageSize > 0 {
+		limit = min(limit, s.account.MaxMessageSize)
+	}
+	return limit
+}
+
+// errMessageTooLarge 邮件超出用户的大小限制
+var errMessageTooLarge = &gosmtp.SMTPError{
+	Code:         552,
+	EnhancedCode: gosmtp.EnhancedCode{5, 3, 4},
+	Message:      "Message size exceeds limit for this user",
+}
+
+// errSenderNotOwned 发件人地址不属于登录用户
+var errSenderNotOwned = &gosmtp.SMTPError{
+	Code:         553,
+	EnhancedCode: gosmtp.EnhancedCode{5, 7, 1},
+	Message:      "Sender address rejected: not owned by user",
+}
+
+// parseEnvelope 解析 MAIL FROM（kind 为 from）或 RCPT TO（kind 为 to）中的地址，
+// 语法错误回复 501，未声明 SMTPUTF8 却含有非 ASCII 字符时回复 553
+func (s *Session) parseEnvelope(kind, raw string) (Address, error) {
+	addr, err := ParseAddress(raw)
+	if err == nil && addr.UTF8 && !s.smtputf8 {
+		err = errAddressUTF8
+	}
+	if err == nil {
+		return addr, nil
+	}
+
+	slog.Warn("信封地址无效",
+		"session_id", s.sessionID,
+		"remote_addr", s.remoteAddr,
+		kind, raw,
+		"error", err,
+		"timestamp", time.Now().Format(time.RFC3339Nano),
+	)
+	if errors.Is(err, errAddressUTF8) {
+		return Address{}, &gosmtp.SMTPError{
+			Code:         553,
+			EnhancedCode: gosmtp.EnhancedCode{5, 6, 7},
+			Message:      "Non-ASCII addresses require SMTPUTF8",
+		}
+	}
+	if kind == "to" {
+		return Address{}, &gosmtp.SMTPError{
+			Code:         501,
+			EnhancedCode: gosmtp.EnhancedCode{5, 1, 3},
+			Message:      "Bad recipient address syntax",
+		}
+	}
+	return Address{}, &gosmtp.SMTPError{
+		Code:         501,
+		EnhancedCode: gosmtp.EnhancedCode{5, 1, 7},
+		Message:      "Bad sender address syntax",
+	}
+}
+
+// recipients 返回字符串形式的收件人地址
+func (s *Session) recipients() []string {
+	to := make([]string, len(s.to))
+	for i, addr := range s.to {
+		to[i] = addr.String()
+	}
+	return to
+}
+
+// checkGreylist 对未认证且不来自受信任网络的会话实施灰名单，三元组首次出现或
+// 还未到可以重试的时间时回复 451
+func (s *Session) checkGreylist(to Address) error {
+	if s.backend.greylist == nil || s.authenticated || s.trusted {
+		return nil
+	}
+	addrPort, err := netip.ParseAddrPort(s.remoteAddr)
+	if err != nil {
+		return nil
+	}
+	result, wait := s.backend.greylist.Check(addrPort.Addr(), s.from.String(), to.String())
+	if result != greylist.Deferred {
+		return nil
+	}
+
+	slog.Info("灰名单暂时拒绝收件人",
+		"session_id", s.sessionID,
+		"remote_addr", s.remoteAddr,
+		"from", s.from.String(),
+		"to", to.String(),
+		"retry_after", wait.Round(time.Second).String(),
+		"timestamp", time.Now().Format(time.RFC3339Nano),
+	)
+	return &gosmtp.SMTPError{
+		Code:         451,
+		EnhancedCode: gosmtp.EnhancedCode{4, 7, 1},
+		Message:      fmt.Sprintf("Greylisted, please try again in %d seconds", int(wait.Round(time.Second).Seconds())),
+	}
+}
+
+// quotaUser 返回统计发送额度的用户名，未认证的会话只按 IP 统计
+func (s *Session) quotaUser() string {
+	if !s.authenticated {
+		return ""
+	}
+	return s.username
+}
+
+// checkQuota 检查再接受一封 recipients 个收件人的邮件是否超出发送额度，超出时回复 452
+func (s *Session) checkQuota(recipients int) error {
+	if s.backend.quota == nil {
+		return nil
+	}
+	return s.quotaReply(s.backend.quota.Check(s.quotaUser(), s.clientIP(), recipients, 0))
+}
+
+// reserveQuota 检查并预占一封 recipients 个收件人、size 字节的邮件的发送额度，超出时回复 452；
+// 未启用发送额度时返回 nil，Release 可以直接调用
+func (s *Session) reserveQuota(recipients int, size int64) (*quota.Reservation, error) {
+	if s.backend.quota == nil {
+		return nil, nil
+	}
+	reservation, err := s.backend.quota.Reserve(s.quotaUser(), s.clientIP(), recipients, size)
+	return reservation, s.quotaReply(err)
+}
+
+// quotaReply 记录超出发送额度的日志并转换为 452 回复，err 不是 *quota.Error 时返回 nil
+func (s *Session) quotaReply(err error) error {
+	var quotaErr *quota.Error
+	if !errors.As(err, &quotaErr) {
+		return nil
+	}
+
+	slog.Warn("超出发送额度",
+		"session_id", s.sessionID,
+		"remote_addr", s.remoteAddr,
+		"username", s.username,
+		"scope", quotaErr.Scope,
+		"quota", quotaErr.Kind,
+		"period", quotaErr.Period,
+		"limit", quotaErr.Limit,
+		"timestamp", time.Now().Format(time.RFC3339Nano),
+	)
+	message := "Sending quota exceeded, try again later"
+	switch quotaErr.Kind {
+	case quota.Messages:
+		message = "Message quota exceeded, try again later"
+	case quota.Recipients:
+		message = "Recipient quota exceeded, try again later"
+	}
+	return &gosmtp.SMTPError{
+		Code:         452,
+		EnhancedCode: gosmtp.EnhancedCode{4, 7, 0},
+		Message:      message,
+	}
+}
+
+// checkFromHeader 按发件人映射检查 From: 头中的每个地址，未启用时不检查
+func (s *Session) checkFromHeader(data []byte) error {
+	if !s.backend.cfg.SMTP.CheckFromHeader || !s.authenticated || s.backend.senders == nil {
+		return nil
+	}
+
+	var addrs []*mail.Address
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err == nil {
+		addrs, err = msg.Header.AddressList("From")
+	}
+	if err != nil {
+		slog.Warn("无法解析邮件的 From: 头",
+			"session_id", s.sessionID,
+			"remote_addr", s.remoteAddr,
+			"username", s.username,
+			"error", err,
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+		return &gosmtp.SMTPError{
+			Code:         550,
+			EnhancedCode: gosmtp.EnhancedCode{5, 6, 0},
+			Message:      "Missing or malformed From header",
+		}
+	}
+
+	for _, addr := range addrs {
+		if !s.backend.senders.Allowed(s.username, addr.Address) {
+			slog.Warn("From: 头与登录用户不匹配",
+				"session_id", s.sessionID,
+				"remote_addr", s.remoteAddr,
+				"username", s.username,
+				"header_from", addr.Address,
+				"timestamp", time.Now().Format(time.RFC3339Nano),
+			)
+			return errSenderNotOwned
+		}
+	}
+	return nil
+}
+
+// metadata 返回记录在邮件元数据中的会话信息
+func (s *Session) metadata() map[string]string {
+	extras := map[string]string{
+		"server_name": s.backend.cfg.SMTP.Hostname,
+		"listener":    s.backend.listener.Name,
+		"session_id":  s.sessionID,
+		"helo":        s.conn.Hostname(),
+	}
+
+	// 协议名称后缀，Received 头中拼接为 RFC 3848 的 ESMTPS、ESMTPA、ESMTPSA
+	protocol := ""
+	if state, ok := s.conn.TLSConnectionState(); ok {
+		protocol += "s"
+		extras["tls_conn"] = tls.VersionName(state.Version)
+		extras["tls_cipher"] = tls.CipherSuiteName(state.CipherSuite)
+		extras["tls_bits"] = cipherBits(state.CipherSuite)
+	}
+	if s.authenticated {
+		protocol += "a"
+		extras["auth"] = s.authMethod
+		if s.appPassword != "" {
+			extras["app_password"] = s.appPassword
+		}
+		if s.account != nil && len(s.account.Tags) > 0 {
+			extras["account_tags"] = strings.Join(s.account.Tags, ",")
+		}
+	} else if s.trusted {
+		// 未经过 SMTP AUTH，协议名称不加 A
+		extras["auth"] = authTrustedNetwork
+	}
+	extras["protocol"] = protocol
+
+	// 收件人被改写时记录原始收件人和子地址标签
+	if !slices.Equal(s.rcpts, s.to) {
+		rcpts := make([]string, len(s.rcpts))
+		for i, addr := range s.rcpts {
+			rcpts[i] = addr.String()
+		}
+		extras["original_rcpt"] = strings.Join(rcpts, ",")
+	}
+	if len(s.subaddresses) > 0 {
+		extras["subaddress"] = strings.Join(s.subaddresses, ",")
+	}
+	if s.policyHold != "" {
+		extras["policy_hold"] = s.policyHold
+	}
+
+	if cert := s.peerCertificate(); cert != nil {
+		extras["tls_client_subject"] = cert.Subject.String()
+		extras["tls_client_fingerprint"] = auth.CertFingerprint(cert)
+	}
+	return extras
+}
+
+// cipherBits 返回加密套件的密钥长度
+func cipherBits(suite uint16) string {
+	name := tls.CipherSuiteName(suite)
+	switch {
+	case strings.Contains(name, "AES_128"):
+		return "128"
+	case strings.Contains(name, "AES_256"), strings.Contains(name, "CHACHA20"):
+		return "256"
+	default:
+		return ""
+	}
+}
+
 // Reset 重置会话状态
 func (s *Session) Reset() {
-	s.from = ""
+	s.from = Address{}
 	s.to = nil
+	s.smtputf8 = false
+	s.rcpts = nil
+	s.subaddresses = nil
+	s.unknownRcpts = nil
+	s.mailSize = 0
+	s.policyHold = ""
+	s.policyHeaders = nil
+	s.resetMilters()
 	slog.Info("重置会话状态",
 		"session_id", s.sessionID,
 		"remote_addr", s.remoteAddr,
@@ -221,6 +845,7 @@ func (s *Session) Reset() {
 
 // Logout 处理客户端断开连接
 func (s *Session) Logout() error {
+	s.closeMilters()
 	slog.Info("客户端断开连接",
 		"session_id", s.sessionID,
 		"remote_addr", s.remoteAddr,
@@ -0,0 +1,635 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/catroll/smtpd/config"
+	"github.com/emersion/go-sasl"
+	gosmtp "github.com/emersion/go-smtp"
+)
+
+// startTestServer 在随机端口上启动一个进程内 SMTP 服务器，
+// 使用配置中最后一个监听器的设置；credentials 为空时不使用认证文件
+func startTestServer(t *testing.T, cfg *config.Config, credentials string) (addr, dataDir string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	if credentials != "" {
+		authFile := filepath.Join(dir, "auth.txt")
+		if err := os.WriteFile(authFile, []byte(credentials), 0600); err != nil {
+			t.Fatalf("Failed to write auth file: %v", err)
+		}
+		cfg.SMTP.AuthFile = authFile
+	}
+	svc, err := newServices(cfg)
+	if err != nil {
+		t.Fatalf("Failed to initialize services: %v", err)
+	}
+
+	dataDir = filepath.Join(dir, "maildata")
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		t.Fatalf("Failed to create data dir: %v", err)
+	}
+
+	listeners := cfg.Listeners()
+	listener := listeners[len(listeners)-1]
+	bkd := NewBackend(cfg, listener, dataDir, svc)
+	s, err := newServer(cfg, listener, bkd)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	var implicitTLS *tls.Config
+	if listener.ImplicitTLS {
+		implicitTLS = s.TLSConfig
+	}
+	go s.Serve(bkd.listen(l, implicitTLS))
+	t.Cleanup(func() { s.Close() })
+
+	return l.Addr().String(), dataDir
+}
+
+// newAnonymousConfig 返回允许匿名发信的测试配置
+func newAnonymousConfig() *config.Config {
+	cfg := config.New()
+	cfg.SMTP.AllowAnonymous = true
+	return cfg
+}
+
+// newTestConfig 返回要求认证且允许明文认证的测试配置
+func newTestConfig() *config.Config {
+	cfg := config.New()
+	cfg.SMTP.AllowAnonymous = false
+	cfg.SMTP.AllowInsecureAuth = true
+	cfg.SMTP.AllowPlaintextPasswords = true
+	return cfg
+}
+
+func TestSMTPAuth(t *testing.T) {
+	addr, _ := startTestServer(t, newTestConfig(), `{"user1": "password123"}`)
+
+	tests := []struct {
+		name    string
+		client  sasl.Client
+		wantErr bool
+	}{
+		{
+			name:   "PLAIN",
+			client: sasl.NewPlainClient("", "user1", "password123"),
+		},
+		{
+			name:   "PLAIN with matching authzid",
+			client: sasl.NewPlainClient("user1", "user1", "password123"),
+		},
+		{
+			name:    "PLAIN with foreign authzid",
+			client:  sasl.NewPlainClient("admin", "user1", "password123"),
+			wantErr: true,
+		},
+		{
+			name:    "PLAIN with wrong password",
+			client:  sasl.NewPlainClient("", "user1", "wrong"),
+			wantErr: true,
+		},
+		{
+			name:   "LOGIN",
+			client: sasl.NewLoginClient("user1", "password123"),
+		},
+		{
+			name:    "LOGIN with unknown user",
+			client:  sasl.NewLoginClient("nobody", "password123"),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := gosmtp.Dial(addr)
+			if err != nil {
+				t.Fatalf("Failed to dial: %v", err)
+			}
+			defer c.Close()
+
+			if err := c.Hello("localhost"); err != nil {
+				t.Fatalf("Hello failed: %v", err)
+			}
+			if !c.SupportsAuth(sasl.Plain) || !c.SupportsAuth(sasl.Login) {
+				t.Fatalf("Server does not advertise PLAIN and LOGIN")
+			}
+
+			err = c.Auth(tt.client)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Auth() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				var smtpErr *gosmtp.SMTPError
+				if !errors.As(err, &smtpErr) || smtpErr.Code != 535 {
+					t.Errorf("Expected 535 error, got %v", err)
+				}
+			}
+		})
+	}
+}
+
+// sendTestMail 通过明文连接投递一封邮件，a 为 nil 时不进行认证
+func sendTestMail(addr string, a sasl.Client, from string, to []string, msg string) error {
+	c, err := gosmtp.Dial(addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := c.Hello("localhost"); err != nil {
+		return err
+	}
+	if a != nil {
+		if err := c.Auth(a); err != nil {
+			return err
+		}
+	}
+	if err := c.SendMail(from, to, strings.NewReader(msg)); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func TestSendMailRequiresAuth(t *testing.T) {
+	addr, dataDir := startTestServer(t, newTestConfig(), `{"user1": "password123"}`)
+
+	msg := "Subject: test\r\n\r\nhello\r\n"
+	err := sendTestMail(addr, nil, "user1@localhost", []string{"rcpt@localhost"}, msg)
+	if err == nil {
+		t.Fatalf("Expected unauthenticated send to fail")
+	}
+
+	a := sasl.NewPlainClient("", "user1", "password123")
+	if err := sendTestMail(addr, a, "user1@localhost", []string{"rcpt@localhost"}, msg); err != nil {
+		t.Fatalf("SendMail failed: %v", err)
+	}
+
+	files, err := os.ReadDir(dataDir)
+	if err != nil {
+		t.Fatalf("Failed to read data dir: %v", err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("Expected 1 stored message, got %d", len(files))
+	}
+}
+
+func TestSenderLoginMap(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.SMTP.SenderLoginMap = filepath.Join(t.TempDir(), "senders")
+	cfg.SMTP.CheckFromHeader = true
+	if err := os.WriteFile(cfg.SMTP.SenderLoginMap, []byte("user1 user1@example.com @user1.example.com\n"), 0600); err != nil {
+		t.Fatalf("Failed to write sender map: %v", err)
+	}
+	addr, _ := startTestServer(t, cfg, `{"user1": "password123"}`)
+	a := sasl.NewPlainClient("", "user1", "password123")
+
+	tests := []struct {
+		name     string
+		from     string
+		header   string
+		wantCode int
+	}{
+		{
+			name:   "own address",
+			from:   "user1@example.com",
+			header: "From: User One <user1@example.com>\r\n",
+		},
+		{
+			name:   "own domain",
+			from:   "news@user1.example.com",
+			header: "From: news@user1.example.com\r\n",
+		},
+		{
+			name:   "null sender",
+			from:   "",
+			header: "From: user1@example.com\r\n",
+		},
+		{
+			name:     "foreign envelope sender",
+			from:     "admin@example.com",
+			header:   "From: user1@example.com\r\n",
+			wantCode: 553,
+		},
+		{
+			name:     "foreign From header",
+			from:     "user1@example.com",
+			header:   "From: Admin <admin@example.com>\r\n",
+			wantCode: 553,
+		},
+		{
+			name:     "missing From header",
+			from:     "user1@example.com",
+			wantCode: 550,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := tt.header + "Subject: test\r\n\r\nhello\r\n"
+			err := sendTestMail(addr, a, tt.from, []string{"rcpt@localhost"}, msg)
+			if tt.wantCode == 0 {
+				if err != nil {
+					t.Fatalf("SendMail failed: %v", err)
+				}
+				return
+			}
+			var smtpErr *gosmtp.SMTPError
+			if !errors.As(err, &smtpErr) || smtpErr.Code != tt.wantCode {
+				t.Errorf("Expected %d error, got %v", tt.wantCode, err)
+			}
+		})
+	}
+}
+
+func TestAccountLimits(t *testing.T) {
+	cfg := newTestConfig()
+	addr, dataDir := startTestServer(t, cfg, `{
+		"user1": "{PLAIN}password123",
+		"limited": {"password": "{PLAIN}password123", "max_recipients": 2, "max_message_size": 64, "tags": ["trial"]},
+		"disabled": {"password": "{PLAIN}password123", "enabled": false},
+		"expired": {"password": "{PLAIN}password123", "expires": "2001-01-01"},
+		"remote": {"password": "{PLAIN}password123", "networks": ["192.0.2.0/24"]}
+	}`)
+	login := func(username string) sasl.Client {
+		return sasl.NewPlainClient("", username, "password123")
+	}
+	small := "Subject: test\r\n\r\nhello\r\n"
+	large := "Subject: test\r\n\r\n" + strings.Repeat("x", 100) + "\r\n"
+
+	tests := []struct {
+		name     string
+		username string
+		to       []string
+		msg      string
+		wantCode int
+	}{
+		{"global limits", "user1", []string{"a@localhost", "b@localhost", "c@localhost"}, large, 0},
+		{"within user limits", "limited", []string{"a@localhost", "b@localhost"}, small, 0},
+		{"too many recipients", "limited", []string{"a@localhost", "b@localhost", "c@localhost"}, small, 451},
+		{"message too large", "limited", []string{"a@localhost"}, large, 552},
+		{"disabled account", "disabled", []string{"a@localhost"}, small, 535},
+		{"expired account", "expired", []string{"a@localhost"}, small, 535},
+		{"source address not allowed", "remote", []string{"a@localhost"}, small, 535},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := sendTestMail(addr, login(tt.username), tt.username+"@localhost", tt.to, tt.msg)
+			if tt.wantCode == 0 {
+				if err != nil {
+					t.Fatalf("SendMail failed: %v", err)
+				}
+				return
+			}
+			var smtpErr *gosmtp.SMTPError
+			if !errors.As(err, &smtpErr) || smtpErr.Code != tt.wantCode {
+				t.Errorf("Expected %d error, got %v", tt.wantCode, err)
+			}
+		})
+	}
+
+	// 账户标签写入邮件元数据
+	files, err := filepath.Glob(filepath.Join(dataDir, "*.eml"))
+	if err != nil {
+		t.Fatalf("Failed to list messages: %v", err)
+	}
+	tagged := 0
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("Failed to read message: %v", err)
+		}
+		if strings.Contains(string(data), `"account_tags":"trial"`) {
+			tagged++
+		}
+	}
+	if len(files) != 2 || tagged != 1 {
+		t.Errorf("Expected 2 messages with 1 tagged, got %d and %d", len(files), tagged)
+	}
+}
+
+func TestTrustedNetworks(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.SMTP.TrustedNetworks = []string{"127.0.0.0/8"}
+	addr, dataDir := startTestServer(t, cfg, `{"user1": "password123"}`)
+
+	msg := "Subject: test\r\n\r\nhello\r\n"
+	if err := sendTestMail(addr, nil, "app@localhost", []string{"rcpt@localhost"}, msg); err != nil {
+		t.Fatalf("SendMail from trusted network failed: %v", err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dataDir, "*.eml"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expected 1 stored message, got %d (%v)", len(files), err)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	for _, want := range []string{`"auth":"trusted-network"`, "with ESMTP id"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("Message does not contain %q", want)
+		}
+	}
+
+	// 不在受信任网段内的客户端仍需认证
+	cfg = newTestConfig()
+	cfg.SMTP.TrustedNetworks = []string{"192.0.2.0/24", "2001:db8::/32"}
+	addr, _ = startTestServer(t, cfg, `{"user1": "password123"}`)
+	err = sendTestMail(addr, nil, "app@localhost", []string{"rcpt@localhost"}, msg)
+	var smtpErr *gosmtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 502 {
+		t.Errorf("Expected 502 error, got %v", err)
+	}
+}
+
+func TestSendingQuota(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.SMTP.Quota.User.RecipientsPerDay = 3
+	cfg.SMTP.Quota.IP.BytesPerDay = 100
+	addr, _ := startTestServer(t, cfg, `{"user1": "password123"}`)
+	a := sasl.NewPlainClient("", "user1", "password123")
+
+	small := "Subject: test\r\n\r\nhello\r\n"
+	large := "Subject: test\r\n\r\n" + strings.Repeat("x", 60) + "\r\n"
+	tests := []struct {
+		name     string
+		to       []string
+		msg      string
+		wantCode int
+	}{
+		{name: "within quota", to: []string{"a@localhost", "b@localhost"}, msg: small},
+		{name: "recipients exceeded", to: []string{"c@localhost", "d@localhost"}, msg: small, wantCode: 452},
+		{name: "bytes exceeded", to: []string{"c@localhost"}, msg: large, wantCode: 452},
+		{name: "last recipient", to: []string{"c@localhost"}, msg: small},
+		{name: "recipients used up", to: []string{"d@localhost"}, msg: small, wantCode: 452},
+	}
+	for _, tt := range tests {
+		err := sendTestMail(addr, a, "user1@localhost", tt.to, tt.msg)
+		if tt.wantCode == 0 {
+			if err != nil {
+				t.Fatalf("%s: SendMail failed: %v", tt.name, err)
+			}
+			continue
+		}
+		var smtpErr *gosmtp.SMTPError
+		if !errors.As(err, &smtpErr) || smtpErr.Code != tt.wantCode {
+			t.Errorf("%s: Expected %d error, got %v", tt.name, tt.wantCode, err)
+		}
+	}
+}
+
+func TestGreylisting(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.SMTP.AllowAnonymous = true
+	cfg.SMTP.Greylist.Enabled = true
+	cfg.SMTP.Greylist.Delay = 100 * time.Millisecond
+	cfg.SMTP.Greylist.WhitelistRecipientDomains = []string{"postmaster.example"}
+	addr, _ := startTestServer(t, cfg, `{"user1": "password123"}`)
+	msg := "Subject: test\r\n\r\nhello\r\n"
+
+	err := sendTestMail(addr, nil, "sender@example.org", []string{"rcpt@localhost"}, msg)
+	var smtpErr *gosmtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 451 || smtpErr.EnhancedCode != (gosmtp.EnhancedCode{4, 7, 1}) {
+		t.Fatalf("Expected 451 4.7.1 error on first sight, got %v", err)
+	}
+
+	// 白名单中的收件人域名和已认证的会话不受灰名单限制
+	if err := sendTestMail(addr, nil, "sender@example.org", []string{"abuse@postmaster.example"}, msg); err != nil {
+		t.Errorf("SendMail to whitelisted domain failed: %v", err)
+	}
+	a := sasl.NewPlainClient("", "user1", "password123")
+	if err := sendTestMail(addr, a, "user1@localhost", []string{"other@localhost"}, msg); err != nil {
+		t.Errorf("Authenticated SendMail failed: %v", err)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if err := sendTestMail(addr, nil, "sender@example.org", []string{"rcpt@localhost"}, msg); err != nil {
+		t.Errorf("SendMail after greylist delay failed: %v", err)
+	}
+}
+
+func TestGreylistAfterRecipientCheck(t *testing.T) {
+	recipientsFile := filepath.Join(t.TempDir(), "recipients")
+	if err := os.WriteFile(recipientsFile, []byte("alice@example.com\n"), 0600); err != nil {
+		t.Fatalf("Failed to write recipients file: %v", err)
+	}
+	cfg := newAnonymousConfig()
+	cfg.SMTP.Greylist.Enabled = true
+	cfg.SMTP.LocalRecipients.File = recipientsFile
+	addr, _ := startTestServer(t, cfg, "")
+	msg := "Subject: test\r\n\r\nhello\r\n"
+
+	// 不存在的收件人直接拒绝，而不是先被灰名单暂时拒绝
+	err := sendTestMail(addr, nil, "sender@example.org", []string{"typo@example.com"}, msg)
+	var smtpErr *gosmtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 550 {
+		t.Errorf("Expected 550 error for unknown recipient, got %v", err)
+	}
+	err = sendTestMail(addr, nil, "sender@example.org", []string{"alice@example.com"}, msg)
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 451 {
+		t.Errorf("Expected 451 greylist error for known recipient, got %v", err)
+	}
+}
+
+func TestEnvelopeAddresses(t *testing.T) {
+	addr, dataDir := startTestServer(t, newAnonymousConfig(), "")
+
+	tests := []struct {
+		name     string
+		from     string
+		utf8     bool
+		to       string
+		wantCode int
+	}{
+		{name: "normalised domain", from: "User@Example.COM", to: "rcpt@LOCALHOST"},
+		{name: "null sender", from: "", to: "rcpt@localhost"},
+		{name: "internationalised", from: "用户@例子.测试", utf8: true, to: "收件人@bücher.example"},
+		{name: "bad sender domain", from: "user@exa_mple.com", to: "rcpt@localhost", wantCode: 501},
+		{name: "bad recipient domain", from: "user@example.com", to: "rcpt@-localhost", wantCode: 501},
+		{name: "utf8 without SMTPUTF8", from: "用户@例子.测试", to: "rcpt@localhost", wantCode: 553},
+		{name: "utf8 recipient without SMTPUTF8", from: "user@example.com", to: "收件人@localhost", wantCode: 553},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := gosmtp.Dial(addr)
+			if err != nil {
+				t.Fatalf("Failed to dial: %v", err)
+			}
+			defer c.Close()
+			if err := c.Hello("localhost"); err != nil {
+				t.Fatalf("Hello() error = %v", err)
+			}
+
+			err = c.Mail(tt.from, &gosmtp.MailOptions{UTF8: tt.utf8})
+			if err == nil {
+				err = c.Rcpt(tt.to, nil)
+			}
+			if tt.wantCode == 0 {
+				if err != nil {
+					t.Fatalf("Mail/Rcpt failed: %v", err)
+				}
+				return
+			}
+			var smtpErr *gosmtp.SMTPError
+			if !errors.As(err, &smtpErr) || smtpErr.Code != tt.wantCode {
+				t.Errorf("Expected %d error, got %v", tt.wantCode, err)
+			}
+		})
+	}
+
+	// 保存的元数据使用规范化后的地址
+	msg := "Subject: test\r\n\r\nhello\r\n"
+	if err := sendTestMail(addr, nil, "User@Example.COM", []string{"rcpt@XN--BCHER-KVA.Example"}, msg); err != nil {
+		t.Fatalf("SendMail failed: %v", err)
+	}
+	files, err := filepath.Glob(filepath.Join(dataDir, "*.eml"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expected 1 stored message, got %d (%v)", len(files), err)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	for _, want := range []string{`"mail_from":"User@example.com"`, `"rcpt_to":["rcpt@xn--bcher-kva.example"]`} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("Message does not contain %q", want)
+		}
+	}
+}
+
+func TestVirtualAliases(t *testing.T) {
+	aliasFile := filepath.Join(t.TempDir(), "virtual")
+	content := "user@example.com   alice@example.com\n" +
+		"team@example.com   alice@example.com, bob@example.com, carol@example.com\n" +
+		"loop@example.com   loop@example.org\n" +
+		"loop@example.org   loop@example.com\n"
+	if err := os.WriteFile(aliasFile, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write alias file: %v", err)
+	}
+	cfg := newAnonymousConfig()
+	cfg.SMTP.VirtualAliasMap = aliasFile
+	cfg.SMTP.MaxRecipients = 2
+	addr, dataDir := startTestServer(t, cfg, "")
+
+	// 展开后的收件人数量超出限制，别名循环
+	for _, tt := range []struct {
+		to       string
+		wantCode int
+	}{
+		{to: "team@example.com", wantCode: 451},
+		{to: "loop@example.com", wantCode: 550},
+	} {
+		err := sendTestMail(addr, nil, "sender@example.com", []string{tt.to}, "Subject: test\r\n\r\nhello\r\n")
+		var smtpErr *gosmtp.SMTPError
+		if !errors.As(err, &smtpErr) || smtpErr.Code != tt.wantCode {
+			t.Errorf("RCPT %s: expected %d error, got %v", tt.to, tt.wantCode, err)
+		}
+	}
+
+	// 子地址按 user@example.com 展开，标签记录在元数据中；重复的收件人只保存一次
+	msg := "Subject: test\r\n\r\nhello\r\n"
+	if err := sendTestMail(addr, nil, "sender@example.com", []string{"user+news@example.com", "alice@example.com"}, msg); err != nil {
+		t.Fatalf("SendMail failed: %v", err)
+	}
+	files, err := filepath.Glob(filepath.Join(dataDir, "*.eml"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expected 1 stored message, got %d (%v)", len(files), err)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	for _, want := range []string{
+		`"rcpt_to":["alice@example.com"]`,
+		`"original_rcpt":"user+news@example.com,alice@example.com"`,
+		`"subaddress":"user@example.com=news"`,
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("Message does not contain %q", want)
+		}
+	}
+}
+
+func TestLocalRecipients(t *testing.T) {
+	recipientsFile := filepath.Join(t.TempDir(), "recipients")
+	if err := os.WriteFile(recipientsFile, []byte("alice@example.com\n"), 0600); err != nil {
+		t.Fatalf("Failed to write recipients file: %v", err)
+	}
+	msg := "Subject: test\r\n\r\nhello\r\n"
+
+	t.Run("reject at RCPT", func(t *testing.T) {
+		cfg := newAnonymousConfig()
+		cfg.SMTP.LocalRecipients.File = recipientsFile
+		addr, _ := startTestServer(t, cfg, "")
+
+		if err := sendTestMail(addr, nil, "sender@example.net", []string{"alice@example.com", "someone@remote.example"}, msg); err != nil {
+			t.Fatalf("SendMail failed: %v", err)
+		}
+		c, err := dialHello(t, addr)
+		if err != nil {
+			t.Fatalf("Hello() error = %v", err)
+		}
+		if err := c.Mail("sender@example.net", nil); err != nil {
+			t.Fatalf("Mail() error = %v", err)
+		}
+		// 没有别名文件时同样拆分子地址后检查
+		if err := c.Rcpt("alice+news@example.com", nil); err != nil {
+			t.Errorf("Rcpt() with subaddress error = %v", err)
+		}
+		err = c.Rcpt("typo@example.com", nil)
+		var smtpErr *gosmtp.SMTPError
+		if !errors.As(err, &smtpErr) || smtpErr.Code != 550 || smtpErr.EnhancedCode != (gosmtp.EnhancedCode{5, 1, 1}) {
+			t.Errorf("Expected 550 5.1.1 error, got %v", err)
+		}
+	})
+
+	t.Run("delay until DATA", func(t *testing.T) {
+		cfg := newAnonymousConfig()
+		cfg.SMTP.LocalRecipients.File = recipientsFile
+		cfg.SMTP.LocalRecipients.DelayReject = true
+		addr, dataDir := startTestServer(t, cfg, "")
+
+		c, err := dialHello(t, addr)
+		if err != nil {
+			t.Fatalf("Hello() error = %v", err)
+		}
+		if err := c.Mail("sender@example.net", nil); err != nil {
+			t.Fatalf("Mail() error = %v", err)
+		}
+		for _, to := range []string{"alice@example.com", "typo@example.com"} {
+			if err := c.Rcpt(to, nil); err != nil {
+				t.Fatalf("Rcpt(%s) error = %v", to, err)
+			}
+		}
+		w, err := c.Data()
+		if err != nil {
+			t.Fatalf("Data() error = %v", err)
+		}
+		if _, err := w.Write([]byte(msg)); err != nil {
+			t.Fatalf("Failed to write message: %v", err)
+		}
+		err = w.Close()
+		var smtpErr *gosmtp.SMTPError
+		if !errors.As(err, &smtpErr) || smtpErr.Code != 550 {
+			t.Errorf("Expected 550 error, got %v", err)
+		}
+		if files, _ := filepath.Glob(filepath.Join(dataDir, "*.eml")); len(files) != 0 {
+			t.Errorf("Expected no stored message, got %d", len(files))
+		}
+	})
+}
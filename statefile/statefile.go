@@ -0,0 +1,120 @@
+package statefile
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// File 保存内存状态的 JSON 文件，并记录状态在上次保存之后是否有修改；
+// 本身不加锁，由使用者的锁保护
+type File struct {
+	name  string
+	dirty bool
+}
+
+// New 返回名为 name 的状态文件，name 为空时不持久化
+func New(name string) File {
+	return File{name: name}
+}
+
+// Load 把状态文件的内容解析到 v；未配置状态文件或文件不存在时返回 false
+func (f *File) Load(v any) (bool, error) {
+	if f.name == "" {
+		return false, nil
+	}
+	data, err := os.ReadFile(f.name)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Changed 标记状态已修改，下次 Save 时写入文件
+func (f *File) Changed() {
+	f.dirty = true
+}
+
+// Save 在状态有修改时把 v 写入状态文件，失败时记录日志
+func (f *File) Save(v any) error {
+	if f.name == "" || !f.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := WriteAtomic(f.name, data); err != nil {
+		slog.Error("保存状态文件失败",
+			"file", f.name,
+			"error", err,
+			"timestamp", time.Now().Format(time.RFC3339Nano),
+		)
+		return err
+	}
+	f.dirty = false
+	return nil
+}
+
+// Saver 定期清理过期数据并保存状态的组件
+type Saver interface {
+	Save() error
+}
+
+// Persist 按 interval 调用 s.Save，直到 stop 被关闭，退出前再保存一次
+func Persist(s Saver, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			s.Save()
+			return
+		case <-ticker.C:
+			// 失败时已记录日志
+			s.Save()
+		}
+	}
+}
+
+// WriteAtomic 通过临时文件加重命名的方式写入文件，并保留原文件权限
+func WriteAtomic(filename string, data []byte) error {
+	mode := os.FileMode(0600)
+	if fi, err := os.Stat(filename); err == nil {
+		mode = fi.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
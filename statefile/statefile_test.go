@@ -0,0 +1,91 @@
+package statefile
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "state.json")
+	f := New(name)
+
+	var state map[string]int
+	if loaded, err := f.Load(&state); err != nil || loaded {
+		t.Fatalf("Load() of missing file = %v, %v; want false, nil", loaded, err)
+	}
+
+	// 没有修改时不写文件
+	if err := f.Save(map[string]int{"a": 1}); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Fatalf("Save() without changes wrote the file: %v", err)
+	}
+
+	f.Changed()
+	if err := f.Save(map[string]int{"a": 1}); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	if err := os.Chmod(name, 0640); err != nil {
+		t.Fatalf("Failed to chmod state file: %v", err)
+	}
+	f.Changed()
+	if err := f.Save(map[string]int{"a": 2}); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	if fi, err := os.Stat(name); err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("Save() did not keep the file mode: %v, %v", fi.Mode(), err)
+	}
+
+	reopened := New(name)
+	loaded, err := reopened.Load(&state)
+	if err != nil || !loaded || state["a"] != 2 {
+		t.Errorf("Load() = %v, %v, %v; want a=2", state, loaded, err)
+	}
+
+	// 未配置状态文件时不读写
+	empty := New("")
+	empty.Changed()
+	if loaded, err := empty.Load(&state); err != nil || loaded {
+		t.Errorf("Load() without file = %v, %v", loaded, err)
+	}
+	if err := empty.Save(state); err != nil {
+		t.Errorf("Save() without file error = %v", err)
+	}
+}
+
+// countingSaver 记录 Save 的调用次数
+type countingSaver struct {
+	mu    sync.Mutex
+	saves int
+}
+
+func (s *countingSaver) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.saves++
+	return nil
+}
+
+func TestPersistSavesOnStop(t *testing.T) {
+	s := &countingSaver{}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		Persist(s, time.Hour, stop)
+		close(done)
+	}()
+
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Persist() did not return after stop was closed")
+	}
+	if s.saves != 1 {
+		t.Errorf("Persist() saved %d times on stop, want 1", s.saves)
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/catroll/smtpd/auth"
+	"github.com/catroll/smtpd/config"
+	"golang.org/x/term"
+)
+
+const userUsage = `Usage: smtpd [-config file] user <command> [arguments]
+
+Commands:
+  add <username>       add a user, prompting for the password
+  passwd <username>    change a user's password
+  del <username>       delete a user
+  list                 list users and their status
+  verify <username>    check a password without logging in
+  app-add <username> <label> [expires]
+                       add an app password, optionally expiring at a date
+                       (YYYY-MM-DD) or RFC 3339 time
+  app-revoke <username> <label>
+                       revoke an app password
+
+Passwords are read from the terminal without echo, or one per line from
+standard input when it is not a terminal.
+`
+
+// userCommand smtpd user 子命令，管理 smtp.auth_file 中的用户
+type userCommand struct {
+	cfg    *config.Config
+	out    io.Writer
+	errOut io.Writer
+
+	// readPassword 读取一个密码，confirm 为 true 且在终端上时要求再输入一次
+	readPassword func(prompt string, confirm bool) (string, error)
+}
+
+// runUserCommand 执行 smtpd user 子命令，返回进程退出码
+func runUserCommand(cfg *config.Config, args []string) int {
+	cmd := &userCommand{
+		cfg:          cfg,
+		out:          os.Stdout,
+		errOut:       os.Stderr,
+		readPassword: newPasswordReader(os.Stdin, os.Stderr),
+	}
+	if err := cmd.run(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			fmt.Fprint(cmd.errOut, userUsage)
+			return 2
+		}
+		fmt.Fprintf(cmd.errOut, "smtpd user: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func (c *userCommand) run(args []string) error {
+	if len(args) == 0 {
+		return flag.ErrHelp
+	}
+	name, args := args[0], args[1:]
+	if name == "list" {
+		if len(args) != 0 {
+			return flag.ErrHelp
+		}
+		return c.list()
+	}
+	if len(args) == 0 || args[0] == "" {
+		return flag.ErrHelp
+	}
+	username, args := args[0], args[1:]
+
+	switch name {
+	case "app-add":
+		if len(args) != 1 && len(args) != 2 {
+			return flag.ErrHelp
+		}
+		return c.appAdd(username, args[0], args[1:])
+	case "app-revoke":
+		if len(args) != 1 {
+			return flag.ErrHelp
+		}
+		return c.appRevoke(username, args[0])
+	}
+	if len(args) != 0 {
+		return flag.ErrHelp
+	}
+
+	switch name {
+	case "add":
+		return c.add(username)
+	case "passwd":
+		return c.passwd(username)
+	case "del":
+		return c.del(username)
+	case "verify":
+		return c.verify(username)
+	default:
+		return flag.ErrHelp
+	}
+}
+
+// store 打开配置的认证文件，只支持可写回的文件格式
+func (c *userCommand) store() (*auth.FileStore, error) {
+	if c.cfg.SMTP.AuthFile == "" {
+		return nil, fmt.Errorf("smtp.auth_file is not configured")
+	}
+	authenticator, err := newAuthenticator(c.cfg)
+	if err != nil {
+		return nil, err
+	}
+	fs, ok := authenticator.Store().(*auth.FileStore)
+	if !ok {
+		return nil, fmt.Errorf("auth store %q is not file based", c.cfg.SMTP.AuthStore)
+	}
+	return fs, nil
+}
+
+func (c *userCommand) add(username string) error {
+	fs, err := c.store()
+	if err != nil {
+		return err
+	}
+	if exists, _ := fs.Lookup(username); exists {
+		return fmt.Errorf("%w: %s", auth.ErrUserExists, username)
+	}
+	password, err := c.readPassword("Password: ", true)
+	if err != nil {
+		return err
+	}
+	if err := fs.AddUser(username, password); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "user %s added\n", username)
+	return nil
+}
+
+func (c *userCommand) passwd(username string) error {
+	fs, err := c.store()
+	if err != nil {
+		return err
+	}
+	if exists, _ := fs.Lookup(username); !exists {
+		return fmt.Errorf("%w: %s", auth.ErrUserNotFound, username)
+	}
+	password, err := c.readPassword("New password: ", true)
+	if err != nil {
+		return err
+	}
+	if err := fs.SetPassword(username, password); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "password for %s changed\n", username)
+	return nil
+}
+
+func (c *userCommand) del(username string) error {
+	fs, err := c.store()
+	if err != nil {
+		return err
+	}
+	if err := fs.DeleteUser(username); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "user %s deleted\n", username)
+	return nil
+}
+
+// appAdd 为用户添加应用专用密码，expires 可选，为过期时间
+func (c *userCommand) appAdd(username, label string, expires []string) error {
+	var expiresAt time.Time
+	if len(expires) > 0 {
+		t, err := auth.ParseExpiry(expires[0])
+		if err != nil {
+			return err
+		}
+		expiresAt = t
+	}
+	fs, err := c.store()
+	if err != nil {
+		return err
+	}
+	if exists, _ := fs.Lookup(username); !exists {
+		return fmt.Errorf("%w: %s", auth.ErrUserNotFound, username)
+	}
+	password, err := c.readPassword("App password: ", true)
+	if err != nil {
+		return err
+	}
+	if err := fs.AddAppPassword(username, label, password, expiresAt); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "app password %s added for %s\n", label, username)
+	return nil
+}
+
+func (c *userCommand) appRevoke(username, label string) error {
+	fs, err := c.store()
+	if err != nil {
+		return err
+	}
+	if err := fs.RevokeAppPassword(username, label); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "app password %s revoked for %s\n", label, username)
+	return nil
+}
+
+// list 列出用户，并标出停用、过期、明文存储等状态
+func (c *userCommand) list() error {
+	fs, err := c.store()
+	if err != nil {
+		return err
+	}
+	names, err := fs.List()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, username := range names {
+		account, _, _ := fs.Account(username)
+		var notes []string
+		if account.Disabled {
+			notes = append(notes, "disabled")
+		}
+		if !account.ExpiresAt.IsZero() {
+			if now.Before(account.ExpiresAt) {
+				notes = append(notes, "expires "+account.ExpiresAt.Format(time.RFC3339))
+			} else {
+				notes = append(notes, "expired")
+			}
+		}
+		if account.Password != "" && auth.Identify(account.Password) == auth.SchemePlain {
+			notes = append(notes, "plaintext password")
+		}
+		if n := len(account.AppPasswords); n > 0 {
+			notes = append(notes, fmt.Sprintf("%d app password(s)", n))
+		}
+		if len(notes) == 0 {
+			fmt.Fprintln(c.out, username)
+		} else {
+			fmt.Fprintf(c.out, "%s\t%s\n", username, strings.Join(notes, ", "))
+		}
+	}
+	return nil
+}
+
+// verify 检查密码是否与账户密码或有效的应用专用密码匹配；
+// 不经过 FileStore.Verify，以免升级哈希或记录使用时间而修改文件
+func (c *userCommand) verify(username string) error {
+	fs, err := c.store()
+	if err != nil {
+		return err
+	}
+	account, exists, err := fs.Account(username)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("%w: %s", auth.ErrUserNotFound, username)
+	}
+	password, err := c.readPassword("Password: ", false)
+	if err != nil {
+		return err
+	}
+
+	matched := ""
+	if account.Password != "" {
+		if ok, err := auth.Verify(account.Password, password); err != nil {
+			return err
+		} else if ok {
+			matched = "account password"
+			if auth.Identify(account.Password) == auth.SchemePlain && !c.cfg.SMTP.AllowPlaintextPasswords {
+				fmt.Fprintln(c.errOut, "warning: the password is stored in plaintext and is rejected unless allow_plaintext_passwords is enabled")
+			}
+		}
+	}
+	now := time.Now()
+	for _, p := range account.AppPasswords {
+		if matched != "" {
+			break
+		}
+		if ok, _ := auth.Verify(p.Password, password); ok && p.Active(now) {
+			matched = fmt.Sprintf("app password %q", p.Label)
+		}
+	}
+	if matched == "" {
+		return fmt.Errorf("password does not match")
+	}
+	if err := account.Usable(now); err != nil {
+		return fmt.Errorf("password matches the %s, but %w", matched, err)
+	}
+	fmt.Fprintf(c.out, "password matches the %s\n", matched)
+	return nil
+}
+
+// newPasswordReader 返回从 in 读取密码的函数：in 为终端时在 prompt 上提示并关闭回显，
+// 否则每行读取一个密码，便于脚本调用
+func newPasswordReader(in *os.File, prompt io.Writer) func(string, bool) (string, error) {
+	if !term.IsTerminal(int(in.Fd())) {
+		r := bufio.NewReader(in)
+		return func(string, bool) (string, error) {
+			line, err := r.ReadString('\n')
+			if err != nil && (err != io.EOF || line == "") {
+				return "", fmt.Errorf("reading password: %w", err)
+			}
+			return strings.TrimRight(line, "\r\n"), nil
+		}
+	}
+
+	read := func(text string) (string, error) {
+		fmt.Fprint(prompt, text)
+		password, err := term.ReadPassword(int(in.Fd()))
+		fmt.Fprintln(prompt)
+		if err != nil {
+			return "", fmt.Errorf("reading password: %w", err)
+		}
+		return string(password), nil
+	}
+	return func(text string, confirm bool) (string, error) {
+		password, err := read(text)
+		if err != nil || !confirm {
+			return password, err
+		}
+		again, err := read("Retype " + strings.ToLower(text[:1]) + text[1:])
+		if err != nil {
+			return "", err
+		}
+		if again != password {
+			return "", fmt.Errorf("passwords do not match")
+		}
+		return password, nil
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/catroll/smtpd/auth"
+)
+
+func TestUserCommand(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.SMTP.AllowPlaintextPasswords = false
+	cfg.SMTP.AuthFile = filepath.Join(t.TempDir(), "auth.txt")
+	if err := os.WriteFile(cfg.SMTP.AuthFile, []byte(`{"user1": "{PLAIN}password123"}`), 0600); err != nil {
+		t.Fatalf("Failed to write auth file: %v", err)
+	}
+
+	var out, errOut bytes.Buffer
+	var passwords []string
+	cmd := &userCommand{
+		cfg:    cfg,
+		out:    &out,
+		errOut: &errOut,
+		readPassword: func(string, bool) (string, error) {
+			if len(passwords) == 0 {
+				return "", errors.New("no more passwords")
+			}
+			password := passwords[0]
+			passwords = passwords[1:]
+			return password, nil
+		},
+	}
+	run := func(input []string, args ...string) error {
+		t.Helper()
+		out.Reset()
+		errOut.Reset()
+		passwords = input
+		return cmd.run(args)
+	}
+
+	if err := run([]string{"secret2"}, "add", "user2"); err != nil {
+		t.Fatalf("user add error = %v", err)
+	}
+	if err := run([]string{"x"}, "add", "user2"); !errors.Is(err, auth.ErrUserExists) {
+		t.Errorf("user add existing error = %v", err)
+	}
+	if err := run(nil, "list"); err != nil || out.String() != "user1\tplaintext password\nuser2\n" {
+		t.Errorf("user list = %q, %v", out.String(), err)
+	}
+
+	if err := run([]string{"password123"}, "verify", "user1"); err != nil {
+		t.Errorf("user verify error = %v", err)
+	}
+	if !strings.Contains(errOut.String(), "plaintext") {
+		t.Errorf("user verify did not warn about plaintext password: %q", errOut.String())
+	}
+	if err := run([]string{"newpass"}, "passwd", "user1"); err != nil {
+		t.Fatalf("user passwd error = %v", err)
+	}
+	if err := run([]string{"password123"}, "verify", "user1"); err == nil {
+		t.Errorf("user verify accepted the old password")
+	}
+	if err := run([]string{"newpass"}, "verify", "user1"); err != nil || errOut.Len() != 0 {
+		t.Errorf("user verify new password = %v, stderr %q", err, errOut.String())
+	}
+
+	if err := run([]string{"app-secret"}, "app-add", "user1", "ci", "2099-01-01"); err != nil {
+		t.Fatalf("user app-add error = %v", err)
+	}
+	if err := run([]string{"x"}, "app-add", "user1", "ci"); err == nil {
+		t.Errorf("user app-add accepted a duplicate label")
+	}
+	if err := run([]string{"x"}, "app-add", "user1", "printer", "tomorrow"); err == nil {
+		t.Errorf("user app-add accepted an invalid expiry")
+	}
+	if err := run([]string{"app-secret"}, "verify", "user1"); err != nil || out.String() != "password matches the app password \"ci\"\n" {
+		t.Errorf("user verify app password = %q, %v", out.String(), err)
+	}
+	if err := run(nil, "list"); err != nil || out.String() != "user1\t1 app password(s)\nuser2\n" {
+		t.Errorf("user list = %q, %v", out.String(), err)
+	}
+	if err := run(nil, "app-revoke", "user1", "ci"); err != nil {
+		t.Fatalf("user app-revoke error = %v", err)
+	}
+	if err := run(nil, "app-revoke", "user1", "ci"); !errors.Is(err, auth.ErrAppPasswordNotFound) {
+		t.Errorf("user app-revoke twice error = %v", err)
+	}
+	if err := run([]string{"app-secret"}, "verify", "user1"); err == nil {
+		t.Errorf("user verify accepted a revoked app password")
+	}
+
+	if err := run(nil, "del", "user2"); err != nil {
+		t.Fatalf("user del error = %v", err)
+	}
+	if err := run([]string{"secret2"}, "verify", "user2"); !errors.Is(err, auth.ErrUserNotFound) {
+		t.Errorf("user verify deleted user error = %v", err)
+	}
+	if err := run(nil, "list"); err != nil || out.String() != "user1\n" {
+		t.Errorf("user list = %q, %v", out.String(), err)
+	}
+
+	for _, args := range [][]string{{}, {"add"}, {"remove", "user1"}, {"list", "extra"}, {"del", "user1", "extra"}, {"app-add", "user1"}, {"app-revoke", "user1"}} {
+		if err := run(nil, args...); !errors.Is(err, flag.ErrHelp) {
+			t.Errorf("user %v error = %v, want usage", args, err)
+		}
+	}
+}